@@ -2,38 +2,168 @@ package marionette
 
 import (
 	"bytes"
+	"compress/flate"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
+	"io/ioutil"
+	"sync"
 )
 
 const (
 	// CellHeaderSize is the number of non-payload bytes used by a cell.
 	CellHeaderSize = 25
 
-	// MaxCellLength is the maximum allowed size of a serialized cell.
+	// MaxCellLength is the default maximum size of a serialized cell. Stream
+	// sets can be configured with a different maximum which must be between
+	// MinCellLength & MaxCellLengthLimit. Buffers are sized from the maximum.
 	MaxCellLength = 32768
+
+	// MinCellLength is the smallest configurable maximum cell size.
+	MinCellLength = 256
+
+	// MaxCellLengthLimit is the largest configurable maximum cell size.
+	MaxCellLengthLimit = 16 * 1024 * 1024
+)
+
+var (
+	// ErrInvalidMaxCellLength is returned when a maximum cell size is outside
+	// of the range of MinCellLength to MaxCellLengthLimit.
+	ErrInvalidMaxCellLength = errors.New("marionette: invalid max cell length")
+
+	// ErrDecompressedCellTooLarge is returned when a compressed payload expands
+	// beyond the stream set's maximum cell size.
+	ErrDecompressedCellTooLarge = errors.New("marionette: decompressed cell too large")
 )
 
+// Cell types. Cells other than normal, EOS & open cells are control cells
+// which do not consume a sequence id. Cells with an unknown type are ignored.
 const (
 	// Normal cells carry zero or more bytes in a payload.
 	CellTypeNormal = 0x1
 
 	// EOS (end-of-stream) cells mark the end of streams and carry no payload.
 	CellTypeEOS = 0x2
+
+	// Ack cells acknowledge every cell in a stream before the sequence id.
+	// The payload holds the stream's receive window as a big-endian uint32.
+	CellTypeAck = 0x3
+
+	// RST (reset) cells abort a stream. The payload holds a big-endian uint32
+	// error code which is returned by the peer's reads & writes.
+	CellTypeRST = 0x4
+
+	// Ping cells request a pong from the peer's stream set. Pong cells echo the
+	// ping's payload. Both are sent with a stream id of zero.
+	CellTypePing = 0x5
+	CellTypePong = 0x6
+
+	// Window update cells advertise a larger receive window for a stream. The
+	// payload holds the window as a big-endian uint32.
+	CellTypeWindowUpdate = 0x7
+
+	// Fragment cells carry part of a serialized cell which does not fit in a
+	// single message. The stream id identifies the fragmented cell and the
+	// sequence id is the fragment's byte offset within the serialized cell.
+	CellTypeFragment = 0x8
+
+	// Open cells are sent as the first cell of a stream to request a
+	// destination address from the peer. The payload holds the address as a
+	// "host:port" string. Open cells are sequenced with the stream's data.
+	CellTypeOpen = 0x9
+
+	// Session cells are sent by the client at the start of each connection and
+	// carry the client's session id. Ids which do not fit in a single cell are
+	// split across consecutive cells and the sequence id is the offset of the
+	// payload within the id. Session cells are sent with a stream id of zero.
+	CellTypeSession = 0xA
 )
 
+// isSequencedCellType returns true if cells of type typ consume a sequence id.
+func isSequencedCellType(typ int) bool {
+	return typ <= CellTypeEOS || typ == CellTypeOpen
+}
+
+// SessionIDSize is the size of a session id, in bytes.
+const SessionIDSize = 16
+
+// SessionID is a random identifier generated by a dialer. The listener shares
+// a stream set between connections with the same session id and only resumes
+// a detached session for a matching id.
+type SessionID [SessionIDSize]byte
+
+// NewSessionID returns a session id generated by a cryptographically secure
+// random number generator.
+func NewSessionID() (SessionID, error) {
+	var id SessionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// IsZero returns true if the session id is not set.
+func (id SessionID) IsZero() bool { return id == SessionID{} }
+
+// String returns the session id encoded as hex.
+func (id SessionID) String() string { return hex.EncodeToString(id[:]) }
+
+// CellFlagCompressed is set in the type byte of a serialized cell when the
+// payload is compressed with DEFLATE.
+const CellFlagCompressed = 0x80
+
+const (
+	// AckPayloadSize is the size of an ack cell's payload, in bytes.
+	AckPayloadSize = 4
+
+	// RSTPayloadSize is the size of a reset cell's payload, in bytes.
+	RSTPayloadSize = 4
+
+	// PingPayloadSize is the size of a ping or pong cell's payload, in bytes.
+	PingPayloadSize = 8
+
+	// WindowUpdatePayloadSize is the size of a window update cell's payload, in bytes.
+	WindowUpdatePayloadSize = 4
+)
+
+// Stream reset error codes sent in RST cells.
+const (
+	// The stream was aborted by the application.
+	ResetCodeCancel = 0x1
+
+	// The server could not connect to the stream's destination.
+	ResetCodeRefused = 0x2
+)
+
+// ValidateMaxCellLength returns ErrInvalidMaxCellLength if n cannot be used
+// as the maximum size of a cell.
+func ValidateMaxCellLength(n int) error {
+	if n < MinCellLength || n > MaxCellLengthLimit {
+		return ErrInvalidMaxCellLength
+	}
+	return nil
+}
+
 // Cell represents a single unit of data sent between the client & server.
 //
 // This cell is associated with a specific stream and the encoder/decoders
 // handle ordering based on sequence id.
 type Cell struct {
-	Type       int    // Record type (normal, end-of-stream)
+	Type       int    // Record type (normal, end-of-stream, control)
 	Payload    []byte // Data
 	Length     int    // Size of marshaled data, if specified.
 	StreamID   int    // Associated stream
 	SequenceID int    // Record number within stream
 	UUID       int    // MAR format identifier
 	InstanceID int    // MAR instance identifier
+	Compressed bool   // Payload is compressed when serialized, if smaller
+
+	// Compressed payload, computed once by encodePayload() or read by
+	// UnmarshalBinary(). Nil if compression does not reduce the size.
+	compressed      []byte
+	compressedValid bool
 }
 
 // NewCell returns a new instance of Cell.
@@ -73,37 +203,93 @@ func (c *Cell) Equal(other *Cell) bool {
 
 // Size returns the marshaled size of the cell, in bytes.
 func (c *Cell) Size() int {
-	return CellHeaderSize + len(c.Payload) + c.paddingN()
+	payload, _ := c.encodePayload()
+	return CellHeaderSize + len(payload) + c.paddingN(len(payload))
+}
+
+// DataN returns the number of stream data bytes carried by the cell. Control
+// cells, fragments & open cells carry no stream data.
+func (c *Cell) DataN() int {
+	if c.Type != CellTypeNormal {
+		return 0
+	}
+	return len(c.Payload)
 }
 
 // paddingN returns the length of padding, in bytes, if a length is specified.
-// If no length is provided or the length is smaller than Size() then 0 is returned.
-func (c *Cell) paddingN() int {
-	n := c.Length - len(c.Payload) - CellHeaderSize
+// If no length is provided or the length is smaller than the header & payloadN
+// then 0 is returned.
+func (c *Cell) paddingN(payloadN int) int {
+	n := c.Length - payloadN - CellHeaderSize
 	if n < 0 {
 		return 0
 	}
 	return n
 }
 
+// encodePayload returns the payload as it is serialized. If the cell is marked
+// as compressed and compression reduces the size then the compressed payload
+// is returned along with a true value. The payload is only compressed once so
+// it must not be changed after the cell is sized or serialized.
+func (c *Cell) encodePayload() ([]byte, bool) {
+	if !c.Compressed || (len(c.Payload) == 0 && !c.compressedValid) {
+		return c.Payload, false
+	}
+	if !c.compressedValid {
+		if buf := compress(c.Payload); len(buf) < len(c.Payload) {
+			c.compressed = buf
+		}
+		c.compressedValid = true
+	}
+	if c.compressed != nil {
+		return c.compressed, true
+	}
+	return c.Payload, false
+}
+
+// Decompress decompresses a payload read by UnmarshalBinary. Returns
+// ErrDecompressedCellTooLarge if the payload expands beyond maxCellLength
+// bytes. This is a no-op if the payload is not compressed or has already been
+// decompressed.
+func (c *Cell) Decompress(maxCellLength int) error {
+	if c.Payload != nil || c.compressed == nil {
+		return nil
+	}
+	payload, err := decompress(c.compressed, maxCellLength)
+	if err != nil {
+		return err
+	}
+	c.Payload = payload
+	return nil
+}
+
 // MarshalBinary returns a byte slice with a serialized cell.
 func (c *Cell) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, c.Size()))
-	binary.Write(buf, binary.BigEndian, uint32(c.Size()))
-	binary.Write(buf, binary.BigEndian, uint32(len(c.Payload)))
+	payload, compressed := c.encodePayload()
+	typ := c.Type
+	if compressed {
+		typ |= CellFlagCompressed
+	}
+
+	size := CellHeaderSize + len(payload) + c.paddingN(len(payload))
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	binary.Write(buf, binary.BigEndian, uint32(size))
+	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
 	binary.Write(buf, binary.BigEndian, uint32(c.UUID))
 	binary.Write(buf, binary.BigEndian, uint32(c.InstanceID))
 	binary.Write(buf, binary.BigEndian, uint32(c.StreamID))
 	binary.Write(buf, binary.BigEndian, uint32(c.SequenceID))
-	binary.Write(buf, binary.BigEndian, uint8(c.Type))
-	buf.Write(c.Payload)
-	buf.Write(make([]byte, c.paddingN()))
-	assert(buf.Len() == CellHeaderSize+len(c.Payload)+c.paddingN())
+	binary.Write(buf, binary.BigEndian, uint8(typ))
+	buf.Write(payload)
+	buf.Write(make([]byte, c.paddingN(len(payload))))
+	assert(buf.Len() == size)
 	return buf.Bytes(), nil
 }
 
-// UnmarshalBinary decodes a serialized cell.
-func (c *Cell) UnmarshalBinary(data []byte) (err error) {
+// UnmarshalBinary decodes a serialized cell. Compressed payloads are not
+// expanded until Decompress() is called so that the size can be limited by
+// the receiving stream set. Until then the cell's Payload is nil.
+func (c *Cell) UnmarshalBinary(data []byte) error {
 	br := bytes.NewReader(data)
 
 	// Read cell size.
@@ -150,18 +336,60 @@ func (c *Cell) UnmarshalBinary(data []byte) (err error) {
 	if err := binary.Read(r, binary.BigEndian, &u8); err != nil {
 		return err
 	}
-	c.Type = int(u8)
+	c.Type = int(u8 &^ CellFlagCompressed)
+	c.Compressed = u8&CellFlagCompressed != 0
+	c.compressed, c.compressedValid = nil, false
 
 	// Read payload.
+	var payload []byte
 	if payloadN > 0 {
-		c.Payload = make([]byte, payloadN)
-		if _, err := r.Read(c.Payload); err != nil {
+		payload = make([]byte, payloadN)
+		if _, err := r.Read(payload); err != nil {
 			return err
 		}
-		return err
+	}
+
+	// Keep compressed payloads for Decompress().
+	if c.Compressed && payload != nil {
+		c.Payload, c.compressed, c.compressedValid = nil, payload, true
 	} else {
-		c.Payload = nil
+		c.Payload = payload
 	}
 
 	return nil
 }
+
+// flateWriters is a pool of DEFLATE writers. Writers are expensive to allocate
+// so they are reused between cells.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compress returns b compressed with DEFLATE.
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(b)
+	w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+// decompress returns the DEFLATE compressed data in b. Returns an error if the
+// decompressed data exceeds max bytes.
+func decompress(b []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	} else if len(buf) > max {
+		return nil, ErrDecompressedCellTooLarge
+	}
+	return buf, nil
+}
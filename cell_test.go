@@ -1,6 +1,7 @@
 package marionette_test
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 
@@ -99,3 +100,108 @@ func TestCell_MarshalBinary(t *testing.T) {
 		t.Fatalf("mismatch: %#v", &other)
 	}
 }
+
+func TestCell_MarshalBinary_Compressed(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		cell := &marionette.Cell{
+			Type:       marionette.CellTypeNormal,
+			Payload:    bytes.Repeat([]byte("foo"), 100),
+			Length:     100,
+			StreamID:   3,
+			Compressed: true,
+		}
+
+		buf, err := cell.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var other marionette.Cell
+		if len(buf) != 100 {
+			t.Fatalf("unexpected size: %d", len(buf))
+		} else if buf[24] != marionette.CellTypeNormal|marionette.CellFlagCompressed {
+			t.Fatalf("unexpected type byte: %x", buf[24])
+		} else if err := other.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		} else if other.Payload != nil {
+			t.Fatalf("unexpected payload before decompression: %q", other.Payload)
+		} else if err := other.Decompress(marionette.MaxCellLength); err != nil {
+			t.Fatal(err)
+		} else if !other.Compressed || other.Length != 100 || !cell.Equal(&other) {
+			t.Fatalf("mismatch: %#v", &other)
+		}
+
+		// Ensure the cached compressed payload is serialized again.
+		if buf2, err := cell.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, buf2) {
+			t.Fatal("serialization mismatch")
+		}
+	})
+
+	// Ensure payloads which expand beyond the max cell size are rejected.
+	t.Run("ErrDecompressedCellTooLarge", func(t *testing.T) {
+		cell := &marionette.Cell{
+			Type:       marionette.CellTypeNormal,
+			Payload:    bytes.Repeat([]byte("foo"), 100),
+			StreamID:   3,
+			Compressed: true,
+		}
+
+		var other marionette.Cell
+		if buf, err := cell.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		} else if err := other.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		} else if err := other.Decompress(marionette.MinCellLength); err != marionette.ErrDecompressedCellTooLarge {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure payloads which do not shrink are sent uncompressed.
+	t.Run("Incompressible", func(t *testing.T) {
+		cell := &marionette.Cell{Type: marionette.CellTypeNormal, Payload: []byte("foo"), StreamID: 3, Compressed: true}
+
+		var other marionette.Cell
+		if buf, err := cell.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		} else if len(buf) != 28 {
+			t.Fatalf("unexpected size: %d", len(buf))
+		} else if err := other.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		} else if other.Compressed || string(other.Payload) != "foo" {
+			t.Fatalf("unexpected cell: %#v", &other)
+		}
+	})
+}
+
+func TestNewSessionID(t *testing.T) {
+	if a, err := marionette.NewSessionID(); err != nil {
+		t.Fatal(err)
+	} else if b, err := marionette.NewSessionID(); err != nil {
+		t.Fatal(err)
+	} else if a.IsZero() || a == b {
+		t.Fatalf("unexpected session ids: %s, %s", a, b)
+	}
+}
+
+func TestCell_DataN(t *testing.T) {
+	if n := (&marionette.Cell{Type: marionette.CellTypeNormal, Payload: []byte("foo")}).DataN(); n != 3 {
+		t.Fatalf("unexpected n: %d", n)
+	} else if n := (&marionette.Cell{Type: marionette.CellTypeAck, Payload: make([]byte, marionette.AckPayloadSize)}).DataN(); n != 0 {
+		t.Fatalf("unexpected n: %d", n)
+	}
+}
+
+func TestValidateMaxCellLength(t *testing.T) {
+	for _, n := range []int{marionette.MinCellLength, marionette.MaxCellLength, marionette.MaxCellLengthLimit} {
+		if err := marionette.ValidateMaxCellLength(n); err != nil {
+			t.Fatalf("unexpected error for %d: %s", n, err)
+		}
+	}
+	for _, n := range []int{0, marionette.MinCellLength - 1, marionette.MaxCellLengthLimit + 1} {
+		if err := marionette.ValidateMaxCellLength(n); err != marionette.ErrInvalidMaxCellLength {
+			t.Fatalf("unexpected error for %d: %v", n, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package marionette
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -8,15 +9,37 @@ import (
 	"go.uber.org/zap"
 )
 
-// ClientProxy represents a proxy between incoming connections and a marionette dialer.
+// StreamDialer opens streams to a marionette peer. Implemented by Dialer on
+// the client and by Session on the server.
+type StreamDialer interface {
+	Dial() (net.Conn, error)
+	DialDestination(addr string) (net.Conn, error)
+}
+
+// ClientProxy represents a proxy between incoming connections and a marionette
+// dialer. Servers may also use it with a Session to forward connections to a
+// client, which accepts the streams using a ServerProxy.
 type ClientProxy struct {
 	ln     net.Listener
-	dialer *Dialer
+	dialer StreamDialer
+	conns  proxyConns
 	wg     sync.WaitGroup
+
+	// Destination requested from the server for every connection. If blank,
+	// the server connects streams to its default destination.
+	Destination string
+
+	// If true, incoming connections specify their destination using a SOCKS5
+	// or HTTP CONNECT request, which overrides Destination. The destination
+	// is sent to the server which connects to it directly.
+	Frontend bool
+
+	// Logger used by the proxy. Defaults to Logger.
+	Logger *zap.Logger
 }
 
 // NewClientProxy returns a new instance of ClientProxy.
-func NewClientProxy(ln net.Listener, dialer *Dialer) *ClientProxy {
+func NewClientProxy(ln net.Listener, dialer StreamDialer) *ClientProxy {
 	return &ClientProxy{
 		ln:     ln,
 		dialer: dialer,
@@ -31,26 +54,60 @@ func (p *ClientProxy) Open() error {
 	return nil
 }
 
-// Close stops the listener.
+// Close stops the listener and closes active connections. Their streams are
+// reset.
 func (p *ClientProxy) Close() error {
+	err := p.closeListener()
+	if e := p.conns.close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// closeListener stops accepting incoming connections.
+func (p *ClientProxy) closeListener() error {
 	if p.ln != nil {
 		return p.ln.Close()
 	}
 	return nil
 }
 
+// Shutdown stops the listener and waits for active connections to finish.
+// If ctx is done first then the remaining connections are closed and the
+// context's error is returned.
+func (p *ClientProxy) Shutdown(ctx context.Context) error {
+	err := p.closeListener()
+	if e := p.conns.shutdown(ctx); e != nil {
+		return e
+	}
+	return err
+}
+
+// logger returns the configured logger or the global logger.
+func (p *ClientProxy) logger() *zap.Logger {
+	if p.Logger == nil {
+		return Logger
+	}
+	return p.Logger
+}
+
 // run executes in a separate goroutine and continually processes incoming connections.
 func (p *ClientProxy) run() {
-	Logger.Debug("client proxy: listening")
-	defer Logger.Debug("client proxy: closed")
+	p.logger().Debug("client proxy: listening")
+	defer p.logger().Debug("client proxy: closed")
 
 	for {
 		conn, err := p.ln.Accept()
 		if err != nil {
-			Logger.Debug("client proxy: listener error", zap.Error(err))
+			p.logger().Debug("client proxy: listener error", zap.Error(err))
 			return
 		}
 
+		if !p.conns.add(conn) {
+			conn.Close()
+			continue
+		}
+
 		p.wg.Add(1)
 		go func() { defer p.wg.Done(); p.handleConn(conn) }()
 	}
@@ -58,19 +115,43 @@ func (p *ClientProxy) run() {
 
 // handleConn continually copies between the incoming connection and stream.
 func (p *ClientProxy) handleConn(incomingConn net.Conn) {
+	defer p.conns.remove(incomingConn)
 	defer incomingConn.Close()
 
-	Logger.Debug("client proxy: connection open")
-	defer Logger.Debug("client proxy: connection closed")
+	p.logger().Debug("client proxy: connection open")
+	defer p.logger().Debug("client proxy: connection closed")
+
+	// Read the requested destination, if the front-end is enabled.
+	addr := p.Destination
+	var r io.Reader = incomingConn
+	if p.Frontend {
+		var err error
+		if addr, r, err = acceptFrontendRequest(incomingConn); err != nil {
+			p.logger().Debug("client proxy: invalid front-end request", zap.Error(err))
+			return
+		}
+	}
 
 	// Create a new stream.
-	stream, err := p.dialer.Dial()
+	var stream net.Conn
+	var err error
+	if addr != "" {
+		stream, err = p.dialer.DialDestination(addr)
+	} else {
+		stream, err = p.dialer.Dial()
+	}
 	if err != nil {
-		Logger.Debug("client proxy: cannot connect create new stream", zap.Error(err))
+		p.logger().Debug("client proxy: cannot connect create new stream", zap.Error(err))
 		return
 	}
 	defer stream.Close()
 
+	if !p.conns.track(stream) {
+		closeProxyConn(stream)
+		return
+	}
+	defer p.conns.untrack(stream)
+
 	// Copy between incoming connection and stream until an error occurs.
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -81,8 +162,111 @@ func (p *ClientProxy) handleConn(incomingConn net.Conn) {
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(stream, incomingConn)
+		io.Copy(stream, r)
 		stream.Close()
 	}()
 	wg.Wait()
 }
+
+// proxyConns tracks a proxy's active connections so they can be drained.
+type proxyConns struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	outbound map[net.Conn]struct{} // connections opened by handlers
+	closing  bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// add tracks conn. Returns false if the proxy is shutting down.
+func (a *proxyConns) add(conn net.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closing {
+		return false
+	}
+	if a.conns == nil {
+		a.conns = make(map[net.Conn]struct{})
+	}
+	a.conns[conn] = struct{}{}
+	a.wg.Add(1)
+	return true
+}
+
+// remove stops tracking conn once its handler has finished.
+func (a *proxyConns) remove(conn net.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.conns[conn]; ok {
+		delete(a.conns, conn)
+		a.wg.Done()
+	}
+}
+
+// track tracks a connection opened by a handler so that it is closed along
+// with the active connections. Returns false if the proxy has been closed.
+func (a *proxyConns) track(conn net.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	if a.outbound == nil {
+		a.outbound = make(map[net.Conn]struct{})
+	}
+	a.outbound[conn] = struct{}{}
+	return true
+}
+
+// untrack stops tracking a connection opened by a handler.
+func (a *proxyConns) untrack(conn net.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.outbound, conn)
+}
+
+// close stops new connections from being added and closes active connections.
+func (a *proxyConns) close() (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closing, a.closed = true, true
+	for conn := range a.conns {
+		if e := closeProxyConn(conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	for conn := range a.outbound {
+		if e := closeProxyConn(conn); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// closeProxyConn closes conn in both directions. Streams are reset since
+// closing a stream only closes its write side.
+func closeProxyConn(conn net.Conn) error {
+	if stream, ok := conn.(*Stream); ok {
+		return stream.Reset(ResetCodeCancel)
+	}
+	return conn.Close()
+}
+
+// shutdown stops new connections from being added and waits for active
+// connections to be removed. Closes active connections if ctx is done first.
+func (a *proxyConns) shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	a.closing = true
+	a.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() { a.wg.Wait(); close(done) }()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		a.close()
+		return ctx.Err()
+	}
+}
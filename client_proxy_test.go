@@ -0,0 +1,437 @@
+package marionette_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/redjack/marionette"
+)
+
+func TestClientProxy_Frontend(t *testing.T) {
+	t.Run("SOCKS5", func(t *testing.T) {
+		echo := MustOpenEchoServer(t)
+		defer echo.Close()
+
+		addr, closeFn := MustOpenFrontendProxies(t, true)
+		defer closeFn()
+
+		d := &marionette.SOCKS5Dialer{Addr: addr, Forward: &net.Dialer{}}
+		MustDialEcho(t, d, echo.Addr().String())
+	})
+
+	t.Run("HTTPConnect", func(t *testing.T) {
+		echo := MustOpenEchoServer(t)
+		defer echo.Close()
+
+		addr, closeFn := MustOpenFrontendProxies(t, true)
+		defer closeFn()
+
+		d := &marionette.HTTPConnectDialer{Addr: addr, Forward: &net.Dialer{}}
+		MustDialEcho(t, d, echo.Addr().String())
+	})
+
+	// Ensure the connection is closed if the server refuses the destination.
+	t.Run("Refused", func(t *testing.T) {
+		echo := MustOpenEchoServer(t)
+		defer echo.Close()
+
+		addr, closeFn := MustOpenFrontendProxies(t, false)
+		defer closeFn()
+
+		d := &marionette.SOCKS5Dialer{Addr: addr, Forward: &net.Dialer{}}
+		conn, err := d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Read(make([]byte, 5)); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestClientProxy_Destination(t *testing.T) {
+	echo := MustOpenEchoServer(t)
+	defer echo.Close()
+
+	addr, closeFn := MustOpenProxies(t, func(p *marionette.ServerProxy) {
+		p.AllowedDestinations = []string{echo.Addr().String()}
+	}, func(p *marionette.ClientProxy) {
+		p.Destination = echo.Addr().String()
+	})
+	defer closeFn()
+
+	MustDialEcho(t, &net.Dialer{}, addr)
+}
+
+// Ensure the stream is reset if the destination cannot be reached in time.
+func TestServerProxy_DialTimeout(t *testing.T) {
+	echo := MustOpenEchoServer(t)
+	defer echo.Close()
+
+	addr, closeFn := MustOpenProxies(t, func(p *marionette.ServerProxy) {
+		p.Addr = echo.Addr().String()
+		p.DialTimeout = time.Nanosecond
+	}, func(p *marionette.ClientProxy) {})
+	defer closeFn()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := conn.Read(make([]byte, 5)); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServerProxy_AllowedDestinations(t *testing.T) {
+	echo := MustOpenEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	for _, tt := range []struct {
+		pattern string
+		allowed bool
+	}{
+		{pattern: "127.0.0.1:" + port, allowed: true},
+		{pattern: "127.0.0.1:*", allowed: true},
+		{pattern: "127.0.0.0/8:" + port, allowed: true},
+		{pattern: "*:" + port, allowed: true},
+		{pattern: "127.0.0.1:1", allowed: false},
+		{pattern: "10.0.0.0/8:*", allowed: false},
+		{pattern: "localhost:*", allowed: false},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			addr, closeFn := MustOpenProxies(t, func(p *marionette.ServerProxy) {
+				p.AllowedDestinations = []string{tt.pattern}
+			}, func(p *marionette.ClientProxy) {
+				p.Destination = echo.Addr().String()
+			})
+			defer closeFn()
+
+			if tt.allowed {
+				MustDialEcho(t, &net.Dialer{}, addr)
+				return
+			}
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			} else if _, err := conn.Read(make([]byte, 5)); err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("ErrInvalidPattern", func(t *testing.T) {
+		for _, pattern := range []string{"foo", ":80", "127.0.0.1:0", "127.0.0.1:http", "10.0.0.0/33:80"} {
+			p := marionette.NewServerProxy(nil)
+			p.AllowedDestinations = []string{pattern}
+			if err := p.Open(); err == nil {
+				t.Fatalf("expected error for %q", pattern)
+			}
+		}
+	})
+}
+
+func TestValidateDestinationPattern(t *testing.T) {
+	for _, pattern := range []string{"10.0.0.5:22", "example.com:443", "192.168.0.0/16:*", "*:*"} {
+		if err := marionette.ValidateDestinationPattern(pattern); err != nil {
+			t.Fatalf("unexpected error for %q: %s", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"foo", ":80", "127.0.0.1:0", "10.0.0.0/33:80"} {
+		if err := marionette.ValidateDestinationPattern(pattern); err == nil {
+			t.Fatalf("expected error for %q", pattern)
+		}
+	}
+}
+
+// Ensure a server can forward connections through a client's session to a
+// destination allowed by the client.
+func TestClientProxy_RemoteForward(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		allowed bool
+	}{
+		{name: "OK", allowed: true},
+		{name: "Refused", allowed: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := MustOpenEchoServer(t)
+			defer echo.Close()
+
+			ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+			defer ln.Close()
+			defer d.Close()
+			MustEcho(t, ln, d, []byte("foo"))
+
+			// Connect streams opened by the server on the client.
+			reverseProxy := marionette.NewServerProxy(d)
+			if tt.allowed {
+				reverseProxy.AllowedDestinations = []string{echo.Addr().String()}
+			}
+			if err := reverseProxy.Open(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Forward connections on the server to the echo server via the client.
+			tcpln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := marionette.NewClientProxy(tcpln, ln.Sessions()[0])
+			proxy.Destination = echo.Addr().String()
+			if err := proxy.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+
+			if tt.allowed {
+				MustDialEcho(t, &net.Dialer{}, tcpln.Addr().String())
+				return
+			}
+
+			conn, err := net.Dial("tcp", tcpln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			} else if _, err := conn.Read(make([]byte, 5)); err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Ensure proxies stop accepting connections but let active ones finish.
+func TestProxy_Shutdown(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		clientProxy, serverProxy, closeFn := MustOpenEchoProxies(t)
+		defer closeFn()
+
+		conn, err := net.Dial("tcp", clientProxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustWriteString(t, conn, "foo")
+		MustReadString(t, conn, "foo")
+
+		errs := make(chan error, 2)
+		go func() { errs <- clientProxy.Shutdown(context.Background()) }()
+		go func() { errs <- serverProxy.Shutdown(context.Background()) }()
+
+		// Ensure new connections are refused once the listener closes.
+		for {
+			other, err := net.Dial("tcp", clientProxy.Addr().String())
+			if err != nil {
+				break
+			}
+			other.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Ensure the active connection continues until it is closed.
+		MustWriteString(t, conn, "bar")
+		MustReadString(t, conn, "bar")
+		conn.Close()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for shutdown")
+			}
+		}
+	})
+
+	// Ensure active connections are closed once the context is done.
+	t.Run("Timeout", func(t *testing.T) {
+		clientProxy, _, closeFn := MustOpenEchoProxies(t)
+		defer closeFn()
+
+		conn, err := net.Dial("tcp", clientProxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustWriteString(t, conn, "foo")
+		MustReadString(t, conn, "foo")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := clientProxy.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure closing the client proxy tears down in-flight connections.
+	t.Run("Close", func(t *testing.T) {
+		clientProxy, _, closeFn := MustOpenEchoProxies(t)
+		defer closeFn()
+
+		conn, err := net.Dial("tcp", clientProxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustWriteString(t, conn, "foo")
+		MustReadString(t, conn, "foo")
+
+		if err := clientProxy.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the server proxy resets its streams once the context is done.
+	t.Run("ServerTimeout", func(t *testing.T) {
+		clientProxy, serverProxy, closeFn := MustOpenEchoProxies(t)
+		defer closeFn()
+
+		conn, err := net.Dial("tcp", clientProxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustWriteString(t, conn, "foo")
+		MustReadString(t, conn, "foo")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := serverProxy.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenFrontendProxies opens client & server proxies with the client
+// proxy's front-end enabled. If allowDestinations is false then the server
+// proxy uses a fixed address. Returns the client proxy's address & a function
+// to close everything.
+func MustOpenFrontendProxies(tb testing.TB, allowDestinations bool) (string, func()) {
+	tb.Helper()
+	return MustOpenProxies(tb, func(p *marionette.ServerProxy) {
+		if allowDestinations {
+			p.Socks5Server, _ = socks5.New(&socks5.Config{})
+		} else {
+			p.Addr = "127.0.0.1:1"
+		}
+	}, func(p *marionette.ClientProxy) {
+		p.Frontend = true
+	})
+}
+
+// MustOpenProxies opens a marionette listener & dialer connected by server &
+// client proxies. The proxies are configured by serverFn & clientFn before
+// they are opened. Returns the client proxy's address & a function to close
+// everything.
+func MustOpenProxies(tb testing.TB, serverFn func(*marionette.ServerProxy), clientFn func(*marionette.ClientProxy)) (string, func()) {
+	tb.Helper()
+
+	ln, d := MustOpenPool(tb, "http_simple_blocking", 1, 1)
+
+	serverProxy := marionette.NewServerProxy(ln)
+	serverFn(serverProxy)
+	if err := serverProxy.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	tcpln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	clientProxy := marionette.NewClientProxy(tcpln, d)
+	clientFn(clientProxy)
+	if err := clientProxy.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return tcpln.Addr().String(), func() {
+		clientProxy.Close()
+		d.Close()
+		ln.Close()
+	}
+}
+
+// ShutdownClientProxy is a ClientProxy with the address it listens on.
+type ShutdownClientProxy struct {
+	*marionette.ClientProxy
+	ln net.Listener
+}
+
+// Addr returns the client proxy's listening address.
+func (p *ShutdownClientProxy) Addr() net.Addr { return p.ln.Addr() }
+
+// MustOpenEchoProxies opens client & server proxies connected to an echo
+// server. Returns both proxies & a function to close everything.
+func MustOpenEchoProxies(tb testing.TB) (*ShutdownClientProxy, *marionette.ServerProxy, func()) {
+	tb.Helper()
+
+	echo := MustOpenEchoServer(tb)
+	ln, d := MustOpenPool(tb, "http_simple_blocking", 1, 1)
+
+	serverProxy := marionette.NewServerProxy(ln)
+	serverProxy.Addr = echo.Addr().String()
+	if err := serverProxy.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	tcpln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	clientProxy := marionette.NewClientProxy(tcpln, d)
+	if err := clientProxy.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return &ShutdownClientProxy{ClientProxy: clientProxy, ln: tcpln}, serverProxy, func() {
+		clientProxy.Close()
+		serverProxy.Close()
+		d.Close()
+		ln.Close()
+		echo.Close()
+	}
+}
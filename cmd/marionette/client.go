@@ -1,16 +1,12 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"net"
-	"os"
-	"os/signal"
+	"strings"
 
 	"github.com/redjack/marionette"
-	"github.com/redjack/marionette/fte"
-	"github.com/redjack/marionette/mar"
 	_ "github.com/redjack/marionette/plugins"
 	"go.uber.org/zap"
 )
@@ -24,80 +20,175 @@ func NewClientCommand() *ClientCommand {
 func (cmd *ClientCommand) Run(args []string) error {
 	// Parse arguments.
 	fs := NewFlagSet("marionette-client", flag.ContinueOnError)
+	fs.Party = marionette.PartyClient
+	var forwards stringSliceFlag
+	fs.Var(&forwards, "L", "Local forward as local:port=remotehost:remoteport; may be repeated")
+	var allowed stringSliceFlag
+	fs.Var(&allowed, "allow", "Destination the server may request for remote forwards as host:port; may be repeated")
 	var (
-		bind     = fs.String("bind", "127.0.0.1:8079", "Bind address")
-		serverIP = fs.String("server", "127.0.0.1", "Server IP address")
-		format   = fs.String("format", "", "Format name and version")
-		verbose  = fs.Bool("v", false, "Debug logging enabled")
+		bind            = fs.String("bind", "127.0.0.1:8079", "Bind address")
+		serverIP        = fs.String("server", "127.0.0.1", "Server IP address")
+		format          = fs.String("format", "", "Format name and version")
+		minConns        = fs.Int("min-conns", 1, "Minimum number of server connections")
+		maxConns        = fs.Int("max-conns", 1, "Maximum number of server connections")
+		maxCellLength   = fs.Int("max-cell-length", marionette.MaxCellLength, "Maximum cell size, in bytes; must match server")
+		compress        = fs.Bool("compress", false, "Compress data sent to server")
+		upstreamProxy   = fs.String("upstream-proxy", "", "Proxy URL for server connections (socks5:// or http://)")
+		frontend        = fs.Bool("frontend", false, "Accept SOCKS5 & HTTP CONNECT requests on bind address")
+		shutdownTimeout = fs.Duration("shutdown-timeout", DefaultShutdownTimeout, "Time open streams are given to finish on SIGINT or SIGTERM")
+		retransmitTO    = fs.Duration("retransmit-timeout", 0, "Time before unacknowledged cells are resent; must match server; defaults to enabled for UDP formats only")
+		keepaliveInt    = fs.Duration("keepalive-interval", 0, "Idle time before pinging the server; disabled if zero")
+		keepaliveTO     = fs.Duration("keepalive-timeout", 0, "Idle time before closing a server connection; disabled if zero")
+		verbose         = fs.Bool("v", false, "Debug logging enabled")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
+	// Only listen on the bind address if specified or if there are no forwards.
+	var bindSet bool
+	fs.Visit(func(f *flag.Flag) { bindSet = bindSet || f.Name == "bind" })
+
 	// Validate arguments.
-	if *format == "" {
-		return errors.New("format required")
+	if err := marionette.ValidateMaxCellLength(*maxCellLength); err != nil {
+		return err
 	}
 
-	// Read MAR file.
-	data, err := mar.ReadFormat(*format)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("MAR document not found: %s", *format)
-	} else if err != nil {
-		return err
+	// Parse local forwards.
+	localAddrs, remoteAddrs := make([]string, len(forwards)), make([]string, len(forwards))
+	for i, s := range forwards {
+		var err error
+		if localAddrs[i], remoteAddrs[i], err = parseForward(s); err != nil {
+			return err
+		}
 	}
 
-	// Parse document.
-	doc, err := mar.Parse(marionette.PartyClient, data)
+	// Read & parse MAR file.
+	doc, err := readDocument(marionette.PartyClient, *format)
 	if err != nil {
 		return err
 	}
 
 	// Set logger if debug is on.
-	fte.Verbose = *verbose
+	var logger *zap.Logger
 	if *verbose {
 		config := zap.NewDevelopmentConfig()
 		config.DisableStacktrace = true
-		marionette.Logger, _ = config.Build()
+		logger, _ = config.Build()
 	} else {
 		config := zap.NewProductionConfig()
 		config.DisableStacktrace = true
-		marionette.Logger, _ = config.Build()
+		logger, _ = config.Build()
+	}
+
+	// Build library settings, including keys from the config file.
+	config, err := fs.Config.MarionetteConfig(logger, fs.SleepFactor)
+	if err != nil {
+		return err
 	}
 
 	streamSet := marionette.NewStreamSet()
 	streamSet.TracePath = fs.TracePath
+	streamSet.MaxCellLength = *maxCellLength
+	streamSet.Compress = *compress
 
 	// Create dialer to remote server.
 	dialer := marionette.NewDialer(doc, *serverIP, streamSet)
+	dialer.MinConns, dialer.MaxConns = *minConns, *maxConns
+	dialer.KeepaliveInterval, dialer.KeepaliveTimeout = *keepaliveInt, *keepaliveTO
+	if *retransmitTO > 0 {
+		dialer.RetransmitTimeout = *retransmitTO
+	}
+	dialer.Config = config
+	if *upstreamProxy != "" {
+		if dialer.Dialer, err = marionette.NewUpstreamProxyDialer(*upstreamProxy, nil); err != nil {
+			return err
+		}
+	}
 	if err := dialer.Open(); err != nil {
 		return err
 	}
 
-	// Start listener.
-	ln, err := net.Listen("tcp", *bind)
-	if err != nil {
+	// Connect streams opened by the server's remote forwards. Destinations
+	// which are not allowed are refused.
+	reverseProxy := marionette.NewServerProxy(dialer)
+	reverseProxy.Logger = logger
+	reverseProxy.AllowedDestinations = allowed
+	if err := reverseProxy.Open(); err != nil {
 		return err
 	}
 
-	// Start proxy.
-	proxy := marionette.NewClientProxy(ln, dialer)
-	if err := proxy.Open(); err != nil {
-		return err
+	// Start listener & proxy. Proxies are shut down before the dialer so their
+	// streams can finish.
+	var proxies []shutdowner
+	if len(forwards) == 0 || bindSet {
+		ln, err := net.Listen("tcp", *bind)
+		if err != nil {
+			return err
+		}
+
+		proxy := marionette.NewClientProxy(ln, dialer)
+		proxy.Frontend = *frontend
+		proxy.Logger = logger
+		if err := proxy.Open(); err != nil {
+			return err
+		}
+		proxies = append(proxies, proxy)
+		fmt.Printf("listening on %s, connected to %s\n", *bind, *serverIP)
 	}
 
-	fmt.Printf("listening on %s, connected to %s\n", *bind, *serverIP)
+	// Start a listener & proxy for each local forward.
+	for i := range forwards {
+		ln, err := net.Listen("tcp", localAddrs[i])
+		if err != nil {
+			return err
+		}
+
+		proxy := marionette.NewClientProxy(ln, dialer)
+		proxy.Destination = remoteAddrs[i]
+		proxy.Logger = logger
+		if err := proxy.Open(); err != nil {
+			return err
+		}
+		proxies = append(proxies, proxy)
+		fmt.Printf("listening on %s, forwarding to %s via %s\n", localAddrs[i], remoteAddrs[i], *serverIP)
+	}
 
-	// Wait for signal.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	fmt.Fprintln(os.Stderr, "received interrupt, shutting down...")
+	// Reload the format & settings used by new connections on SIGHUP.
+	stopReload := notifyReload(logger, func() error {
+		format, config, err := fs.Reload(logger)
+		if err != nil {
+			return err
+		}
+		doc, err := readDocument(marionette.PartyClient, format)
+		if err != nil {
+			return err
+		}
+		return dialer.Reload(doc, config)
+	})
+	defer stopReload()
+
+	// Wait for signal, then drain open streams.
+	ctx, cancel := waitSignal(*shutdownTimeout)
+	defer cancel()
 
 	// Dump open streams.
 	if *verbose {
 		dumpStreams(streamSet.Streams())
 	}
 
-	return nil
+	return shutdown(ctx, append(proxies, reverseProxy, dialer)...)
+}
+
+// parseForward parses a "local:port=remotehost:remoteport" forward.
+func parseForward(s string) (localAddr, remoteAddr string, err error) {
+	a := strings.SplitN(s, "=", 2)
+	if len(a) != 2 {
+		return "", "", fmt.Errorf("invalid forward, expected local:port=remotehost:remoteport: %s", s)
+	} else if _, _, err := net.SplitHostPort(a[0]); err != nil {
+		return "", "", fmt.Errorf("invalid forward local address: %s", s)
+	} else if host, _, err := net.SplitHostPort(a[1]); err != nil || host == "" {
+		return "", "", fmt.Errorf("invalid forward remote address: %s", s)
+	}
+	return a[0], a[1], nil
 }
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/armon/go-socks5"
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+	"go.uber.org/zap"
+)
+
+// FileConfig represents the settings read from a TOML file passed to -config.
+//
+// Top-level settings apply to all commands. The [client] & [server] sections
+// apply to the client & server commands and their PT equivalents. Zero values
+// are treated as unset so the flag defaults are used. Flags which are
+// specified on the command line override the file.
+type FileConfig struct {
+	Format            string   `toml:"format"`
+	MaxCellLength     int      `toml:"max_cell_length"`
+	Compress          bool     `toml:"compress"`
+	RetransmitTimeout Duration `toml:"retransmit_timeout"`
+	SleepFactor       float64  `toml:"sleep_factor"`
+	TracePath         string   `toml:"trace_path"`
+	Debug             string   `toml:"debug"`
+	Metrics           string   `toml:"metrics"`
+	ShutdownTimeout   Duration `toml:"shutdown_timeout"`
+
+	Keys   KeysConfig   `toml:"keys"`
+	Log    LogConfig    `toml:"log"`
+	Client ClientConfig `toml:"client"`
+	Server ServerConfig `toml:"server"`
+}
+
+// KeysConfig represents the hex-encoded AES & HMAC keys used to encrypt
+// covertext. Keys can only be set in the config file so they do not appear in
+// the process list. The client & server must use the same keys.
+type KeysConfig struct {
+	EncryptionKey string `toml:"encryption_key"`
+	MACKey        string `toml:"mac_key"`
+}
+
+// LogConfig represents logging settings.
+type LogConfig struct {
+	Verbose bool   `toml:"verbose"`
+	File    string `toml:"file"`
+}
+
+// ClientConfig represents settings for the client commands.
+type ClientConfig struct {
+	Bind              string   `toml:"bind"`
+	Server            string   `toml:"server"`
+	MinConns          int      `toml:"min_conns"`
+	MaxConns          int      `toml:"max_conns"`
+	UpstreamProxy     string   `toml:"upstream_proxy"`
+	Frontend          bool     `toml:"frontend"`
+	Forwards          []string `toml:"forwards"`
+	Allow             []string `toml:"allow"`
+	KeepaliveInterval Duration `toml:"keepalive_interval"`
+	KeepaliveTimeout  Duration `toml:"keepalive_timeout"`
+}
+
+// ServerConfig represents settings for the server commands.
+type ServerConfig struct {
+	Bind              string       `toml:"bind"`
+	Proxy             string       `toml:"proxy"`
+	Socks5            Socks5Config `toml:"socks5"`
+	Allow             []string     `toml:"allow"`
+	RemoteForwards    []string     `toml:"remote_forwards"`
+	SessionTimeout    Duration     `toml:"session_timeout"`
+	KeepaliveInterval Duration     `toml:"keepalive_interval"`
+	KeepaliveTimeout  Duration     `toml:"keepalive_timeout"`
+}
+
+// Socks5Config represents settings for the server's SOCKS5 proxy. If a
+// username is set then SOCKS5 clients must authenticate with it.
+type Socks5Config struct {
+	Enabled  bool   `toml:"enabled"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// Duration is a time.Duration which is read from a string such as "30s".
+type Duration time.Duration
+
+// UnmarshalText parses a duration string. Implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String returns the duration as a string.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// ReadFileConfig reads & validates the config file at path.
+func ReadFileConfig(path string) (*FileConfig, error) {
+	var c FileConfig
+	md, err := toml.DecodeFile(path, &c)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("config file not found: %s", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+
+	// Reject unknown keys so typos are not silently ignored.
+	if keys := md.Undecoded(); len(keys) > 0 {
+		a := make([]string, len(keys))
+		for i := range keys {
+			a[i] = keys[i].String()
+		}
+		return nil, fmt.Errorf("config: %s: unknown keys: %s", path, strings.Join(a, ", "))
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// Validate returns an error if any setting is invalid. The error names the
+// key which is invalid.
+func (c *FileConfig) Validate() error {
+	if c.Format != "" {
+		for _, party := range []string{marionette.PartyClient, marionette.PartyServer} {
+			data, err := mar.ReadFormat(c.Format)
+			if os.IsNotExist(err) {
+				return fmt.Errorf("format: not found: %s", c.Format)
+			} else if err != nil {
+				return fmt.Errorf("format: %s", err)
+			} else if _, err := mar.Parse(party, data); err != nil {
+				return fmt.Errorf("format: %s", err)
+			}
+		}
+	}
+	if c.MaxCellLength != 0 {
+		if err := marionette.ValidateMaxCellLength(c.MaxCellLength); err != nil {
+			return fmt.Errorf("max_cell_length: %s", err)
+		}
+	}
+	if c.SleepFactor < 0 {
+		return errors.New("sleep_factor: must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout: must not be negative")
+	}
+	if c.RetransmitTimeout < 0 {
+		return errors.New("retransmit_timeout: must not be negative")
+	}
+	if c.Metrics != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics); err != nil {
+			return fmt.Errorf("metrics: %s", err)
+		}
+	}
+	if _, _, err := c.Keys.Decode(); err != nil {
+		return err
+	}
+
+	// Validate client settings.
+	if c.Client.Bind != "" {
+		if _, _, err := net.SplitHostPort(c.Client.Bind); err != nil {
+			return fmt.Errorf("client.bind: %s", err)
+		}
+	}
+	if c.Client.MinConns < 0 {
+		return errors.New("client.min_conns: must not be negative")
+	} else if c.Client.MaxConns < 0 {
+		return errors.New("client.max_conns: must not be negative")
+	} else if c.Client.MaxConns != 0 && c.Client.MaxConns < c.Client.MinConns {
+		return errors.New("client.max_conns: must not be less than client.min_conns")
+	}
+	if c.Client.UpstreamProxy != "" {
+		if _, err := marionette.NewUpstreamProxyDialer(c.Client.UpstreamProxy, nil); err != nil {
+			return fmt.Errorf("client.upstream_proxy: %s", err)
+		}
+	}
+	for i, s := range c.Client.Forwards {
+		if _, _, err := parseForward(s); err != nil {
+			return fmt.Errorf("client.forwards[%d]: %s", i, err)
+		}
+	}
+	for i, s := range c.Client.Allow {
+		if err := marionette.ValidateDestinationPattern(s); err != nil {
+			return fmt.Errorf("client.allow[%d]: %s", i, err)
+		}
+	}
+	if err := validateKeepalive("client", c.Client.KeepaliveInterval, c.Client.KeepaliveTimeout); err != nil {
+		return err
+	}
+
+	// Validate server settings.
+	if c.Server.Proxy != "" {
+		if _, _, err := net.SplitHostPort(c.Server.Proxy); err != nil {
+			return fmt.Errorf("server.proxy: %s", err)
+		}
+	}
+	if c.Server.Socks5.Password != "" && c.Server.Socks5.Username == "" {
+		return errors.New("server.socks5.username: required when a password is set")
+	}
+	for i, s := range c.Server.Allow {
+		if err := marionette.ValidateDestinationPattern(s); err != nil {
+			return fmt.Errorf("server.allow[%d]: %s", i, err)
+		}
+	}
+	for i, s := range c.Server.RemoteForwards {
+		if _, _, err := parseForward(s); err != nil {
+			return fmt.Errorf("server.remote_forwards[%d]: %s", i, err)
+		}
+	}
+	if c.Server.SessionTimeout < 0 {
+		return errors.New("server.session_timeout: must not be negative")
+	}
+	if err := validateKeepalive("server", c.Server.KeepaliveInterval, c.Server.KeepaliveTimeout); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateKeepalive returns an error if the keepalive settings in section are invalid.
+func validateKeepalive(section string, interval, timeout Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("%s.keepalive_interval: must not be negative", section)
+	} else if timeout < 0 {
+		return fmt.Errorf("%s.keepalive_timeout: must not be negative", section)
+	} else if timeout != 0 && timeout <= interval {
+		return fmt.Errorf("%s.keepalive_timeout: must be greater than %s.keepalive_interval", section, section)
+	}
+	return nil
+}
+
+// Decode returns the decoded keys. Returns nil keys if unset.
+func (c *KeysConfig) Decode() (encKey, macKey []byte, err error) {
+	if c.EncryptionKey != "" {
+		if encKey, err = hex.DecodeString(c.EncryptionKey); err != nil {
+			return nil, nil, fmt.Errorf("keys.encryption_key: invalid hex: %s", err)
+		} else if _, err := aes.NewCipher(encKey); err != nil {
+			return nil, nil, fmt.Errorf("keys.encryption_key: must be 16, 24, or 32 bytes: got %d", len(encKey))
+		}
+	}
+	if c.MACKey != "" {
+		if macKey, err = hex.DecodeString(c.MACKey); err != nil {
+			return nil, nil, fmt.Errorf("keys.mac_key: invalid hex: %s", err)
+		}
+	}
+	return encKey, macKey, nil
+}
+
+// Credentials returns the credentials required by the server's SOCKS5
+// proxy. Returns nil if authentication is disabled.
+func (c *Socks5Config) Credentials() socks5.CredentialStore {
+	if c.Username == "" {
+		return nil
+	}
+	return socks5.StaticCredentials{c.Username: c.Password}
+}
+
+// flagValues returns the file's settings for party, keyed by flag name.
+func (c *FileConfig) flagValues(party string) map[string][]string {
+	m := make(map[string][]string)
+	setString := func(name, v string) {
+		if v != "" {
+			m[name] = []string{v}
+		}
+	}
+	setInt := func(name string, v int) {
+		if v != 0 {
+			m[name] = []string{strconv.Itoa(v)}
+		}
+	}
+	setBool := func(name string, v bool) {
+		if v {
+			m[name] = []string{"true"}
+		}
+	}
+	setDuration := func(name string, v Duration) {
+		if v != 0 {
+			m[name] = []string{v.String()}
+		}
+	}
+
+	setString("format", c.Format)
+	setInt("max-cell-length", c.MaxCellLength)
+	setBool("compress", c.Compress)
+	setDuration("retransmit-timeout", c.RetransmitTimeout)
+	if c.SleepFactor != 0 {
+		m["sleep-factor"] = []string{strconv.FormatFloat(c.SleepFactor, 'g', -1, 64)}
+	}
+	setString("trace-path", c.TracePath)
+	setString("debug", c.Debug)
+	setString("metrics", c.Metrics)
+	setDuration("shutdown-timeout", c.ShutdownTimeout)
+	setBool("v", c.Log.Verbose)
+	setString("log-file", c.Log.File)
+
+	switch party {
+	case marionette.PartyClient:
+		setString("bind", c.Client.Bind)
+		setString("server", c.Client.Server)
+		setInt("min-conns", c.Client.MinConns)
+		setInt("max-conns", c.Client.MaxConns)
+		setString("upstream-proxy", c.Client.UpstreamProxy)
+		setBool("frontend", c.Client.Frontend)
+		setDuration("keepalive-interval", c.Client.KeepaliveInterval)
+		setDuration("keepalive-timeout", c.Client.KeepaliveTimeout)
+		if len(c.Client.Forwards) > 0 {
+			m["L"] = c.Client.Forwards
+		}
+		if len(c.Client.Allow) > 0 {
+			m["allow"] = c.Client.Allow
+		}
+
+	case marionette.PartyServer:
+		setString("bind", c.Server.Bind)
+		setString("proxy", c.Server.Proxy)
+		setBool("socks5", c.Server.Socks5.Enabled)
+		setDuration("session-timeout", c.Server.SessionTimeout)
+		setDuration("keepalive-interval", c.Server.KeepaliveInterval)
+		setDuration("keepalive-timeout", c.Server.KeepaliveTimeout)
+		if len(c.Server.Allow) > 0 {
+			m["allow"] = c.Server.Allow
+		}
+		if len(c.Server.RemoteForwards) > 0 {
+			m["R"] = c.Server.RemoteForwards
+		}
+	}
+	return m
+}
+
+// apply sets flags in fs which were not specified on the command line to
+// their values from the file. Settings without a matching flag are ignored.
+func (c *FileConfig) apply(fs *flag.FlagSet, party string) error {
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+
+	values := c.flagValues(party)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if visited[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		for _, v := range values[name] {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("config: cannot apply %q to -%s: %s", v, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reloadableFlags are the flags whose settings are applied to new connections
+// when the configuration is reloaded. Other settings require a restart.
+var reloadableFlags = map[string]bool{"format": true, "sleep-factor": true}
+
+// Reload re-reads the config file, if any, and returns the format & library
+// settings for new connections. Flags specified on the command line keep
+// precedence. Changes to settings which require a restart are logged.
+func (fs *FlagSet) Reload(logger *zap.Logger) (format string, config *marionette.Config, err error) {
+	format, sleepFactor := fs.Lookup("format").Value.String(), fs.SleepFactor
+
+	var fileConfig *FileConfig
+	if fs.ConfigPath != "" {
+		if fileConfig, err = ReadFileConfig(fs.ConfigPath); err != nil {
+			return "", nil, err
+		}
+
+		prev, next := fs.Config.flagValues(fs.Party), fileConfig.flagValues(fs.Party)
+		if !fs.cmdline["format"] {
+			format = fs.fileValue(next, "format")
+		}
+		if !fs.cmdline["sleep-factor"] {
+			if sleepFactor, err = strconv.ParseFloat(fs.fileValue(next, "sleep-factor"), 64); err != nil {
+				return "", nil, fmt.Errorf("config: sleep_factor: %s", err)
+			}
+		}
+		fs.warnRestartRequired(logger, prev, next)
+	}
+
+	if config, err = fileConfig.MarionetteConfig(logger, sleepFactor); err != nil {
+		return "", nil, err
+	}
+
+	// Compare the next reload against the settings just read.
+	fs.Config = fileConfig
+	return format, config, nil
+}
+
+// fileValue returns the value of the named flag from the file's settings or
+// the flag's default if unset.
+func (fs *FlagSet) fileValue(values map[string][]string, name string) string {
+	if v := values[name]; len(v) > 0 {
+		return v[0]
+	}
+	return fs.Lookup(name).DefValue
+}
+
+// warnRestartRequired logs settings which changed between the file's previous
+// & next values but cannot be applied without a restart.
+func (fs *FlagSet) warnRestartRequired(logger *zap.Logger, prev, next map[string][]string) {
+	names := make(map[string]struct{})
+	for name := range prev {
+		names[name] = struct{}{}
+	}
+	for name := range next {
+		names[name] = struct{}{}
+	}
+
+	a := make([]string, 0, len(names))
+	for name := range names {
+		if !reloadableFlags[name] && !fs.cmdline[name] && fs.Lookup(name) != nil && !reflect.DeepEqual(prev[name], next[name]) {
+			a = append(a, name)
+		}
+	}
+	sort.Strings(a)
+
+	for _, name := range a {
+		logger.Warn("config setting changed, restart required to apply", zap.String("flag", name))
+	}
+}
+
+// MarionetteConfig returns the library settings for the command. The logger
+// is used by the dialer or listener & its FSMs, streams & plugins. A zero
+// sleep factor disables sleeps rather than using the library default.
+func (c *FileConfig) MarionetteConfig(logger *zap.Logger, sleepFactor float64) (*marionette.Config, error) {
+	if sleepFactor == 0 {
+		sleepFactor = -1
+	}
+	config := &marionette.Config{Logger: logger, SleepFactor: sleepFactor}
+	if c == nil {
+		return config, nil
+	}
+
+	var err error
+	if config.EncryptionKey, config.MACKey, err = c.Keys.Decode(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ConfigCommand represents the "config" command.
+type ConfigCommand struct{}
+
+// NewConfigCommand returns a new instance of ConfigCommand.
+func NewConfigCommand() *ConfigCommand {
+	return &ConfigCommand{}
+}
+
+// Run executes the "config" subcommand specified by args.
+func (cmd *ConfigCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "check":
+		return cmd.runCheck(args[1:])
+	default:
+		return ErrUsage
+	}
+}
+
+// runCheck reads & validates one or more config files.
+func (cmd *ConfigCommand) runCheck(args []string) error {
+	fs := flag.NewFlagSet("marionette-config-check", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, "usage: marionette config check PATH...") }
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	for _, path := range fs.Args() {
+		if _, err := ReadFileConfig(path); err != nil {
+			return err
+		}
+		fmt.Printf("%s: OK\n", path)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	_ "expvar"
 	"flag"
@@ -8,16 +9,25 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"sort"
+	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"github.com/redjack/marionette/plugins/model"
+	"go.uber.org/zap"
 )
 
 var ErrUsage = errors.New("usage")
 
+// DefaultShutdownTimeout is the default amount of time open streams are given
+// to finish after an interrupt or terminate signal.
+const DefaultShutdownTimeout = 30 * time.Second
+
 func main() {
 	if err := run(os.Args[1:]); err == ErrUsage {
 		fmt.Fprintln(os.Stderr, Usage())
@@ -38,6 +48,8 @@ func run(args []string) error {
 	switch args[0] {
 	case "client":
 		return NewClientCommand().Run(args[1:])
+	case "config":
+		return NewConfigCommand().Run(args[1:])
 	case "formats":
 		return NewFormatsCommand().Run(args[1:])
 	case "pt-client":
@@ -51,6 +63,10 @@ func run(args []string) error {
 	}
 }
 
+func init() {
+	http.Handle("/metrics", marionette.DefaultMetrics)
+}
+
 func Usage() string {
 	return `
 Marionette is a programmable client-server proxy that enables the user to
@@ -63,6 +79,7 @@ Usage:
 The commands are:
 
 	client    runs the client proxy
+	config    check a configuration file
 	formats   show a list of available formats
 	pt-client runs the client proxy as a PT
 	pt-server runs the server proxy as a PT
@@ -72,15 +89,31 @@ The commands are:
 
 type FlagSet struct {
 	*flag.FlagSet
-	Debug     string
-	TracePath string
+	Debug      string
+	Metrics    string
+	TracePath  string
+	ConfigPath string
+
+	// Multiplier applied to model.sleep() durations.
+	SleepFactor float64
+
+	// Party whose section of the config file is applied by Parse().
+	Party string
+
+	// Settings read from the config file, if specified.
+	Config *FileConfig
+
+	// Flags specified on the command line.
+	cmdline map[string]bool
 }
 
 func NewFlagSet(name string, errorHandling flag.ErrorHandling) *FlagSet {
 	fs := &FlagSet{FlagSet: flag.NewFlagSet(name, errorHandling)}
-	fs.Float64Var(&model.SleepFactor, "sleep-factor", model.SleepFactor, "model.sleep() multipler")
+	fs.Float64Var(&fs.SleepFactor, "sleep-factor", model.SleepFactor, "model.sleep() multipler")
 	fs.StringVar(&fs.Debug, "debug", "", "debug http bind address")
+	fs.StringVar(&fs.Metrics, "metrics", "", "metrics http bind address; served at /metrics")
 	fs.StringVar(&fs.TracePath, "trace-path", "", "stream trace directory path")
+	fs.StringVar(&fs.ConfigPath, "config", "", "TOML config file; flags override its settings")
 	return fs
 }
 
@@ -89,12 +122,44 @@ func (fs *FlagSet) Parse(arguments []string) error {
 		return err
 	}
 
+	fs.cmdline = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { fs.cmdline[f.Name] = true })
+
+	// Apply settings from the config file to flags not set on the command line.
+	if fs.ConfigPath != "" {
+		config, err := ReadFileConfig(fs.ConfigPath)
+		if err != nil {
+			return err
+		} else if err := config.apply(fs.FlagSet, fs.Party); err != nil {
+			return err
+		}
+		fs.Config = config
+	}
+
 	// Run pprof-server in the background if requested.
 	if fs.Debug != "" {
 		fmt.Fprintf(os.Stderr, "debug http server listening on %s\n", fs.Debug)
 		go func() { http.ListenAndServe(fs.Debug, nil) }()
 	}
 
+	// Serve metrics separately so they can be exposed without pprof.
+	if fs.Metrics != "" && fs.Metrics != fs.Debug {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", marionette.DefaultMetrics)
+		fmt.Fprintf(os.Stderr, "metrics http server listening on %s\n", fs.Metrics)
+		go func() { http.ListenAndServe(fs.Metrics, mux) }()
+	}
+
+	return nil
+}
+
+// stringSliceFlag is a flag which can be specified multiple times.
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
 	return nil
 }
 
@@ -110,3 +175,96 @@ func dumpStreams(streams []*marionette.Stream) {
 	w.Flush()
 	os.Stderr.Write([]byte("\n"))
 }
+
+// shutdowner is implemented by proxies, listeners & dialers which can drain
+// their open connections.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// waitSignal waits for an interrupt or terminate signal. The returned context
+// is canceled once timeout elapses or a second signal is received.
+func waitSignal(timeout time.Duration) (context.Context, context.CancelFunc) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	fmt.Fprintf(os.Stderr, "received signal, shutting down (timeout %s)...\n", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case <-c:
+			fmt.Fprintln(os.Stderr, "received second signal, closing immediately")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// notifyReload calls fn each time a hangup signal is received until stop is
+// called. Errors are logged to logger & the previous configuration is kept.
+func notifyReload(logger *zap.Logger, fn func() error) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				fmt.Fprintln(os.Stderr, "received SIGHUP, reloading configuration")
+				if err := fn(); err != nil {
+					logger.Error("reload failed, keeping previous configuration", zap.Error(err))
+					continue
+				}
+				logger.Info("configuration reloaded")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// readDocument reads & parses the MAR document for format & party.
+func readDocument(party, format string) (*mar.Document, error) {
+	if format == "" {
+		return nil, errors.New("format required")
+	}
+
+	data, err := mar.ReadFormat(format)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("MAR document not found: %s", format)
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc, err := mar.Parse(party, data)
+	if err != nil {
+		return nil, err
+	}
+	doc.Format = format
+	return doc, nil
+}
+
+// shutdown drains each item in order. Items which cannot drain before ctx is
+// done have their open connections closed.
+func shutdown(ctx context.Context, a ...shutdowner) error {
+	var err error
+	for _, v := range a {
+		if e := v.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		fmt.Fprintln(os.Stderr, "shutdown incomplete, open connections closed")
+		return nil
+	}
+	return err
+}
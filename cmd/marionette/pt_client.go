@@ -28,6 +28,7 @@ func NewPTClientCommand() *PTClientCommand {
 
 func (cmd *PTClientCommand) Run(args []string) error {
 	fs := NewFlagSet("marionette-pt-client", flag.ContinueOnError)
+	fs.Party = marionette.PartyClient
 	var (
 		format  = fs.String("format", "", "Format name and version")
 		logFile = fs.String("log-file", "", "Path to log file.")
@@ -46,21 +47,8 @@ func (cmd *PTClientCommand) Run(args []string) error {
 		defer file.Close()
 	}
 
-	// Validate arguments.
-	if *format == "" {
-		return errors.New("format required")
-	}
-
-	// Read MAR file.
-	data, err := mar.ReadFormat(*format)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("MAR document not found: %s", *format)
-	} else if err != nil {
-		return err
-	}
-
-	// Parse document.
-	doc, err := mar.Parse(marionette.PartyClient, data)
+	// Read & parse MAR file.
+	doc, err := readDocument(marionette.PartyClient, *format)
 	if err != nil {
 		return err
 	}
@@ -68,7 +56,13 @@ func (cmd *PTClientCommand) Run(args []string) error {
 	// We always use the production logger when running as a PT.
 	config := zap.NewProductionConfig()
 	config.DisableStacktrace = true
-	marionette.Logger, _ = config.Build()
+	logger, _ := config.Build()
+
+	// Build library settings, including keys from the config file.
+	mconfig, err := fs.Config.MarionetteConfig(logger, fs.SleepFactor)
+	if err != nil {
+		return err
+	}
 
 	clientInfo, err := pt.ClientSetup(nil)
 	if err != nil {
@@ -90,7 +84,7 @@ func (cmd *PTClientCommand) Run(args []string) error {
 		}
 
 		cmd.wg.Add(1)
-		go func() { defer cmd.wg.Done(); cmd.acceptLoop(listener, doc) }()
+		go func() { defer cmd.wg.Done(); cmd.acceptLoop(listener, doc, mconfig) }()
 
 		pt.Cmethod(methodName, listener.Version(), listener.Addr())
 		listeners = append(listeners, listener)
@@ -109,7 +103,7 @@ func (cmd *PTClientCommand) Run(args []string) error {
 	return nil
 }
 
-func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Document) {
+func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Document, config *marionette.Config) {
 	defer listener.Close()
 
 	for {
@@ -122,11 +116,11 @@ func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Docu
 		}
 
 		cmd.wg.Add(1)
-		go func() { defer cmd.wg.Done(); cmd.handleConn(connection, doc) }()
+		go func() { defer cmd.wg.Done(); cmd.handleConn(connection, doc, config) }()
 	}
 }
 
-func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Document) {
+func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Document, config *marionette.Config) {
 	host, _, err := net.SplitHostPort(connection.Req.Target)
 	if err != nil {
 		log.Printf("Invalid connection request target: %s", connection.Req.Target)
@@ -143,6 +137,7 @@ func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Docume
 
 	// Create dialer to remote server.
 	dialer := marionette.NewDialer(doc, host, streamSet)
+	dialer.Config = config
 	if err := dialer.Open(); err != nil {
 		log.Printf("Unable to create dialer: %s", err)
 		connection.Reject()
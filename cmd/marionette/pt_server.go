@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,7 +12,6 @@ import (
 
 	pt "git.torproject.org/pluggable-transports/goptlib.git"
 	"github.com/redjack/marionette"
-	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
@@ -27,6 +25,7 @@ func NewPTServerCommand() *PTServerCommand {
 
 func (cmd *PTServerCommand) Run(args []string) error {
 	fs := NewFlagSet("marionette-ptserver", flag.ContinueOnError)
+	fs.Party = marionette.PartyServer
 	var (
 		format  = fs.String("format", "", "Format name and version")
 		logFile = fs.String("log-file", "", "Path to log file.")
@@ -35,10 +34,6 @@ func (cmd *PTServerCommand) Run(args []string) error {
 		return err
 	}
 
-	if *format == "" {
-		return errors.New("format required")
-	}
-
 	if *logFile != "" {
 		file, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 
@@ -50,16 +45,8 @@ func (cmd *PTServerCommand) Run(args []string) error {
 		defer file.Close()
 	}
 
-	// Read MAR file.
-	data, err := mar.ReadFormat(*format)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("MAR document not found: %s", *format)
-	} else if err != nil {
-		return err
-	}
-
-	// Parse document.
-	doc, err := mar.Parse(marionette.PartyServer, data)
+	// Read & parse MAR file.
+	doc, err := readDocument(marionette.PartyServer, *format)
 	if err != nil {
 		return err
 	}
@@ -67,7 +54,13 @@ func (cmd *PTServerCommand) Run(args []string) error {
 	// We always use the production logger when running as a PT.
 	config := zap.NewProductionConfig()
 	config.DisableStacktrace = true
-	marionette.Logger, _ = config.Build()
+	logger, _ := config.Build()
+
+	// Build library settings, including keys from the config file.
+	mconfig, err := fs.Config.MarionetteConfig(logger, fs.SleepFactor)
+	if err != nil {
+		return err
+	}
 
 	// Setup the PT.
 	serverInfo, err := pt.ServerSetup(nil)
@@ -106,6 +99,7 @@ func (cmd *PTServerCommand) Run(args []string) error {
 			pt.SmethodError(bindAddr.MethodName, err.Error())
 			break
 		}
+		listener.Config = mconfig
 
 		cmd.wg.Add(1)
 		go func() { defer cmd.wg.Done(); cmd.acceptLoop(listener, &serverInfo) }()
@@ -7,13 +7,10 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/signal"
+	"net"
 
 	"github.com/armon/go-socks5"
 	"github.com/redjack/marionette"
-	"github.com/redjack/marionette/fte"
-	"github.com/redjack/marionette/mar"
 	_ "github.com/redjack/marionette/plugins"
 	"go.uber.org/zap"
 )
@@ -27,48 +24,67 @@ func NewServerCommand() *ServerCommand {
 func (cmd *ServerCommand) Run(args []string) error {
 	// Parse arguments.
 	fs := NewFlagSet("marionette-server", flag.ContinueOnError)
+	fs.Party = marionette.PartyServer
+	var allowed stringSliceFlag
+	fs.Var(&allowed, "allow", "Destination clients may request as host:port; may be repeated")
+	var remoteForwards stringSliceFlag
+	fs.Var(&remoteForwards, "R", "Remote forward as local:port=clienthost:clientport via the newest client; may be repeated")
 	var (
-		bind      = fs.String("bind", "", "Bind address")
-		useSocks5 = fs.Bool("socks5", false, "Enable socks5 proxying")
-		proxyAddr = fs.String("proxy", "", "Proxy IP and port")
-		format    = fs.String("format", "", "Format name and version")
-		verbose   = fs.Bool("v", false, "Debug logging enabled")
+		bind            = fs.String("bind", "", "Bind address")
+		useSocks5       = fs.Bool("socks5", false, "Enable socks5 proxying")
+		proxyAddr       = fs.String("proxy", "", "Proxy IP and port")
+		format          = fs.String("format", "", "Format name and version")
+		maxCellLength   = fs.Int("max-cell-length", marionette.MaxCellLength, "Maximum cell size, in bytes; must match client")
+		compress        = fs.Bool("compress", false, "Compress data sent to clients")
+		verbose         = fs.Bool("v", false, "Debug logging enabled")
+		shutdownTimeout = fs.Duration("shutdown-timeout", DefaultShutdownTimeout, "Time open streams are given to finish on SIGINT or SIGTERM")
+		sessionTimeout  = fs.Duration("session-timeout", marionette.DefaultSessionTimeout, "Time a disconnected client's streams are kept for it to reconnect; requires retransmission")
+		retransmitTO    = fs.Duration("retransmit-timeout", 0, "Time before unacknowledged cells are resent; must match client; defaults to enabled for UDP formats only")
+		keepaliveInt    = fs.Duration("keepalive-interval", 0, "Idle time before pinging a client; disabled if zero")
+		keepaliveTO     = fs.Duration("keepalive-timeout", 0, "Idle time before closing a client connection; disabled if zero")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
 	// Validate arguments.
-	if *format == "" {
-		return errors.New("format required")
-	} else if !*useSocks5 && *proxyAddr == "" {
+	if !*useSocks5 && *proxyAddr == "" && len(allowed) == 0 && len(remoteForwards) == 0 {
 		return errors.New("proxy address required")
+	} else if err := marionette.ValidateMaxCellLength(*maxCellLength); err != nil {
+		return err
 	}
 
-	// Read MAR file.
-	data, err := mar.ReadFormat(*format)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("MAR document not found: %s", *format)
-	} else if err != nil {
-		return err
+	// Parse remote forwards.
+	localAddrs, clientAddrs := make([]string, len(remoteForwards)), make([]string, len(remoteForwards))
+	for i, s := range remoteForwards {
+		var err error
+		if localAddrs[i], clientAddrs[i], err = parseForward(s); err != nil {
+			return err
+		}
 	}
 
-	// Parse document.
-	doc, err := mar.Parse(marionette.PartyServer, data)
+	// Read & parse MAR file.
+	doc, err := readDocument(marionette.PartyServer, *format)
 	if err != nil {
 		return err
 	}
 
 	// Set logger if verbose.
-	fte.Verbose = *verbose
+	var logger *zap.Logger
 	if *verbose {
 		config := zap.NewDevelopmentConfig()
 		config.DisableStacktrace = true
-		marionette.Logger, _ = config.Build()
+		logger, _ = config.Build()
 	} else {
 		config := zap.NewProductionConfig()
 		config.DisableStacktrace = true
-		marionette.Logger, _ = config.Build()
+		logger, _ = config.Build()
+	}
+
+	// Build library settings, including keys from the config file.
+	config, err := fs.Config.MarionetteConfig(logger, fs.SleepFactor)
+	if err != nil {
+		return err
 	}
 
 	// Start listener.
@@ -77,18 +93,30 @@ func (cmd *ServerCommand) Run(args []string) error {
 		return err
 	}
 	ln.TracePath = fs.TracePath
+	ln.MaxCellLength = *maxCellLength
+	ln.Compress = *compress
+	ln.SessionTimeout = *sessionTimeout
+	if *retransmitTO > 0 {
+		ln.RetransmitTimeout = *retransmitTO
+	}
+	ln.KeepaliveInterval, ln.KeepaliveTimeout = *keepaliveInt, *keepaliveTO
+	ln.Config = config
 
 	// Start proxy.
 	proxy := marionette.NewServerProxy(ln)
+	proxy.Logger = logger
 	if *useSocks5 {
-		if proxy.Socks5Server, err = socks5.New(&socks5.Config{
-			Logger: log.New(&socks5LogWriter{}, "", 0),
-		}); err != nil {
+		socks5Config := &socks5.Config{Logger: log.New(&socks5LogWriter{logger: logger}, "", 0)}
+		if fs.Config != nil {
+			socks5Config.Credentials = fs.Config.Server.Socks5.Credentials()
+		}
+		if proxy.Socks5Server, err = socks5.New(socks5Config); err != nil {
 			return err
 		}
 	} else {
 		proxy.Addr = *proxyAddr
 	}
+	proxy.AllowedDestinations = allowed
 	if err := proxy.Open(); err != nil {
 		return err
 	}
@@ -96,27 +124,80 @@ func (cmd *ServerCommand) Run(args []string) error {
 	// Notify user that proxy is ready.
 	if proxy.Socks5Server != nil {
 		fmt.Printf("listening on %s, proxying via socks5\n", ln.Addr().String())
-	} else {
+	} else if *proxyAddr != "" {
 		fmt.Printf("listening on %s, proxying to %s\n", ln.Addr().String(), *proxyAddr)
+	} else if len(allowed) > 0 {
+		fmt.Printf("listening on %s, proxying to allowed destinations\n", ln.Addr().String())
+	} else {
+		fmt.Printf("listening on %s\n", ln.Addr().String())
+	}
+
+	// Start a listener & proxy for each remote forward. Connections are
+	// forwarded through the most recently connected client.
+	var forwardProxies []shutdowner
+	for i := range remoteForwards {
+		fln, err := net.Listen("tcp", localAddrs[i])
+		if err != nil {
+			return err
+		}
+
+		proxy := marionette.NewClientProxy(fln, &newestSessionDialer{ln: ln})
+		proxy.Destination = clientAddrs[i]
+		proxy.Logger = logger
+		if err := proxy.Open(); err != nil {
+			return err
+		}
+		forwardProxies = append(forwardProxies, proxy)
+		fmt.Printf("listening on %s, forwarding to %s via client\n", localAddrs[i], clientAddrs[i])
 	}
 
-	// Wait for signal.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	fmt.Fprintln(os.Stderr, "received interrupt, shutting down...")
+	// Reload the format & settings used by new connections on SIGHUP.
+	stopReload := notifyReload(logger, func() error {
+		format, config, err := fs.Reload(logger)
+		if err != nil {
+			return err
+		}
+		doc, err := readDocument(marionette.PartyServer, format)
+		if err != nil {
+			return err
+		}
+		return ln.Reload(doc, config)
+	})
+	defer stopReload()
 
-	return nil
+	// Wait for signal, then drain open streams. Proxies are shut down before
+	// the listener so their streams can finish.
+	ctx, cancel := waitSignal(*shutdownTimeout)
+	defer cancel()
+
+	return shutdown(ctx, append(forwardProxies, proxy, ln)...)
+}
+
+// newestSessionDialer opens streams on the listener's most recently created
+// client session.
+type newestSessionDialer struct {
+	ln *marionette.Listener
+}
+
+func (d *newestSessionDialer) Dial() (net.Conn, error) { return d.DialDestination("") }
+
+func (d *newestSessionDialer) DialDestination(addr string) (net.Conn, error) {
+	sessions := d.ln.Sessions()
+	if len(sessions) == 0 {
+		return nil, errors.New("no client connected")
+	}
+	return sessions[len(sessions)-1].DialDestination(addr)
 }
 
 // socks5LogWriter converts errors to use zap. Also drops some expected errors.
 type socks5LogWriter struct {
-	w io.Writer
+	w      io.Writer
+	logger *zap.Logger
 }
 
 func (w *socks5LogWriter) Write(p []byte) (n int, err error) {
 	p = bytes.TrimPrefix(p, []byte("[ERR] socks: Failed to handle request: "))
-	logger := marionette.Logger.With(zap.String("service", "socks5"))
+	logger := w.logger.With(zap.String("service", "socks5"))
 
 	switch {
 	case bytes.Contains(p, []byte("connection reset by peer")),
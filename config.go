@@ -0,0 +1,84 @@
+package marionette
+
+import (
+	"math/rand"
+
+	"github.com/redjack/marionette/fte"
+	"go.uber.org/zap"
+)
+
+// Config represents settings shared by a dialer or listener with its FSMs,
+// streams & plugins. Zero values use the package defaults.
+type Config struct {
+	// Logger used by FSMs, stream sets & plugins. Defaults to Logger.
+	Logger *zap.Logger
+
+	// Multiplier applied to model.sleep() durations. Defaults to
+	// model.SleepFactor. A negative value disables sleeps.
+	SleepFactor float64
+
+	// AES & HMAC keys used to encrypt covertext. Both parties must use the
+	// same keys. Default to fte.K1 & fte.K2.
+	EncryptionKey []byte
+	MACKey        []byte
+
+	// Returns a new PRNG used by plugins for probabilistic decisions.
+	// Defaults to Rand.
+	Rand func() *rand.Rand
+
+	// Port used by channel.bind() when the server binds a new channel. A zero
+	// value uses the MARIONETTE_CHANNEL_BIND_PORT environment variable or a
+	// random port.
+	ChannelBindPort int
+
+	// Registry used to look up plugins referenced by action blocks.
+	// Defaults to DefaultPluginRegistry.
+	Plugins *PluginRegistry
+
+	// Metrics recorded by FSMs, streams & plugins. Defaults to DefaultMetrics.
+	Metrics *Metrics
+}
+
+// logger returns the configured logger or the global logger.
+func (c *Config) logger() *zap.Logger {
+	if c == nil || c.Logger == nil {
+		return Logger
+	}
+	return c.Logger
+}
+
+// Keys returns the encryption & MAC keys, or their defaults if unset.
+func (c *Config) Keys() (encKey, macKey []byte) {
+	encKey, macKey = fte.K1, fte.K2
+	if c != nil && c.EncryptionKey != nil {
+		encKey = c.EncryptionKey
+	}
+	if c != nil && c.MACKey != nil {
+		macKey = c.MACKey
+	}
+	return encKey, macKey
+}
+
+// NewRand returns a new PRNG from the configured source or from Rand.
+func (c *Config) NewRand() *rand.Rand {
+	if c == nil || c.Rand == nil {
+		return Rand()
+	}
+	return c.Rand()
+}
+
+// metrics returns the configured metrics or the default metrics.
+func (c *Config) metrics() *Metrics {
+	if c == nil || c.Metrics == nil {
+		return DefaultMetrics
+	}
+	return c.Metrics
+}
+
+// plugins returns the configured plugin registry or the default registry.
+func (c *Config) plugins() *PluginRegistry {
+	if c == nil || c.Plugins == nil {
+		return DefaultPluginRegistry
+	}
+	return c.Plugins
+}
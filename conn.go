@@ -1,10 +1,18 @@
 package marionette
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrReadTimeout is returned when a blocking read on a packet-based
+	// connection does not receive a message within PacketReadTimeout.
+	ErrReadTimeout = errors.New("marionette: read timeout")
 )
 
 // BufferedConn wraps a net.Conn and continually reads from it into a buffer.
@@ -12,13 +20,22 @@ import (
 // The buffer is inspectable and seekable by the caller. This provides buffering
 // until a complete cell can be decoded from the connection. The buffer is sized
 // based on the max cell size and does not support cells that exceed that size.
+//
+// Connections over packet-based transports preserve message boundaries. Peek
+// only returns data from the first message in the buffer and blocking reads
+// time out after PacketReadTimeout.
 type BufferedConn struct {
 	net.Conn
 
 	// Current buffer & last error, protected for concurrent use.
-	mu  sync.RWMutex
-	buf []byte
-	err error
+	mu     sync.RWMutex
+	buf    []byte
+	err    error
+	readAt time.Time // last time data was appended
+
+	// Lengths of each message in buf, if packet-based.
+	packet bool
+	sizes  []int
 
 	// Close management.
 	closing chan struct{}
@@ -35,6 +52,7 @@ func NewBufferedConn(conn net.Conn, bufferSize int) *BufferedConn {
 		Conn:    conn,
 		buf:     make([]byte, 0, bufferSize*2),
 		closing: make(chan struct{}, 0),
+		readAt:  time.Now(),
 
 		seekNotify:  make(chan struct{}, 1),
 		writeNotify: make(chan struct{}, 1),
@@ -43,6 +61,31 @@ func NewBufferedConn(conn net.Conn, bufferSize int) *BufferedConn {
 	return c
 }
 
+// NewBufferedPacketConn returns a new BufferedConn wrapping a packet-based
+// conn, such as UDP. Each read from conn must return a single message.
+func NewBufferedPacketConn(conn net.Conn, bufferSize int) *BufferedConn {
+	if bufferSize*2 < MaxPacketSize {
+		bufferSize = (MaxPacketSize + 1) / 2
+	}
+
+	c := &BufferedConn{
+		Conn:    conn,
+		buf:     make([]byte, 0, bufferSize*2),
+		closing: make(chan struct{}, 0),
+		readAt:  time.Now(),
+		packet:  true,
+
+		seekNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+	go c.monitor()
+	return c
+}
+
+// Packet returns true if the connection preserves message boundaries.
+// Messages which cannot be parsed will never be completed by later reads.
+func (conn *BufferedConn) Packet() bool { return conn.packet }
+
 // Close closes the connection.
 func (conn *BufferedConn) Close() error {
 	conn.once.Do(func() { close(conn.closing) })
@@ -55,6 +98,18 @@ func (conn *BufferedConn) Append(b []byte) {
 	defer conn.mu.Unlock()
 	copy(conn.buf[len(conn.buf):len(conn.buf)+len(b)], b)
 	conn.buf = conn.buf[:len(conn.buf)+len(b)]
+	conn.readAt = time.Now()
+	if conn.packet {
+		conn.sizes = append(conn.sizes, len(b))
+	}
+}
+
+// LastRead returns the last time data was read from the connection. Returns
+// the time the connection was created if no data has been read.
+func (conn *BufferedConn) LastRead() time.Time {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.readAt
 }
 
 // Read is unavailable for BufferedConn.
@@ -64,11 +119,27 @@ func (conn *BufferedConn) Read(p []byte) (int, error) {
 
 // Peek returns the first n bytes of the read buffer.
 // If n is -1 then returns any available data after attempting a read.
+//
+// For packet-based connections, only the first message is returned. If the
+// message is shorter than n then the entire message is returned.
 func (conn *BufferedConn) Peek(n int, blocking bool) ([]byte, error) {
+	var timeout <-chan time.Time
+	if conn.packet && blocking {
+		timer := time.NewTimer(PacketReadTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	for {
 		// Read buffer & error from monitor under read lock.
 		conn.mu.RLock()
 		buf, err := conn.buf, conn.err
+		if conn.packet && len(conn.sizes) > 0 {
+			buf = buf[:conn.sizes[0]]
+			if n > len(buf) {
+				n = len(buf)
+			}
+		}
 		conn.mu.RUnlock()
 
 		// Return any data that exists in the buffer.
@@ -95,7 +166,11 @@ func (conn *BufferedConn) Peek(n int, blocking bool) ([]byte, error) {
 		}
 
 		// Wait for a new write or error from the monitor.
-		<-conn.writeNotify
+		select {
+		case <-conn.writeNotify:
+		case <-timeout:
+			return nil, ErrReadTimeout
+		}
 	}
 }
 
@@ -112,6 +187,16 @@ func (conn *BufferedConn) Seek(offset int64, whence int) (int64, error) {
 	conn.buf = conn.buf[:len(b)]
 	copy(conn.buf, b)
 
+	// Remove fully consumed messages.
+	for n := int(offset); n > 0 && len(conn.sizes) > 0; {
+		if n < conn.sizes[0] {
+			conn.sizes[0] -= n
+			break
+		}
+		n -= conn.sizes[0]
+		conn.sizes = conn.sizes[1:]
+	}
+
 	conn.notifySeek()
 
 	return 0, nil
@@ -145,6 +230,15 @@ func (conn *BufferedConn) monitor() {
 			}
 		}
 
+		// Read the entire next message, if packet-based, so it is not truncated.
+		// Wait until the buffer has room for the message before appending.
+		if conn.packet {
+			if !conn.readPacket(buf) {
+				return
+			}
+			continue
+		}
+
 		// Attempt to read next bytes from connection.
 		n, err := conn.Conn.Read(buf[:capacity])
 
@@ -165,6 +259,37 @@ func (conn *BufferedConn) monitor() {
 	}
 }
 
+// readPacket reads a single message into buf and appends it to the buffer.
+// Returns false if the connection is closed or a non-temporary error occurs.
+func (conn *BufferedConn) readPacket(buf []byte) bool {
+	n, err := conn.Conn.Read(buf)
+	for n > 0 {
+		conn.mu.RLock()
+		capacity := cap(conn.buf) - len(conn.buf)
+		conn.mu.RUnlock()
+		if capacity >= n {
+			conn.Append(buf[:n])
+			conn.notifyWrite()
+			break
+		}
+
+		select {
+		case <-conn.closing:
+			return false
+		case <-conn.seekNotify:
+		}
+	}
+
+	if err != nil && !isTemporaryError(err) {
+		conn.mu.Lock()
+		conn.err = err
+		conn.mu.Unlock()
+		conn.notifyWrite()
+		return false
+	}
+	return true
+}
+
 // notifySeek performs a non-blocking send to the seekNotify channel.
 func (conn *BufferedConn) notifySeek() {
 	select {
@@ -67,3 +67,75 @@ func TestBufferedConn(t *testing.T) {
 		t.Fatalf("incorrect bytes read: got=%d, exp=%d", len(b), len(data))
 	}
 }
+
+func TestBufferedPacketConn(t *testing.T) {
+	// Open a pair of UDP sockets.
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send several datagrams from the connected socket.
+	for _, msg := range []string{"foo", "barbaz", "bat"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read datagrams from the listening socket through a buffered connection.
+	bufConn := marionette.NewBufferedPacketConn(&packetReader{PacketConn: ln}, marionette.MaxCellLength)
+	defer bufConn.Close()
+
+	// Only the first message should be returned.
+	if buf, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "foo" {
+		t.Fatalf("unexpected message: %q", buf)
+	} else if _, err := bufConn.Seek(int64(len(buf)), io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peeking past the end of a message returns the message.
+	if buf, err := bufConn.Peek(10, true); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "barbaz" {
+		t.Fatalf("unexpected message: %q", buf)
+	}
+
+	// Partially consuming a message leaves the remainder.
+	if _, err := bufConn.Seek(3, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	} else if buf, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "baz" {
+		t.Fatalf("unexpected message: %q", buf)
+	} else if _, err := bufConn.Seek(3, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "bat" {
+		t.Fatalf("unexpected message: %q", buf)
+	}
+}
+
+// packetReader adapts a net.PacketConn to net.Conn for reading.
+type packetReader struct {
+	net.PacketConn
+}
+
+func (r *packetReader) Read(b []byte) (int, error) {
+	n, _, err := r.ReadFrom(b)
+	return n, err
+}
+
+func (r *packetReader) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (r *packetReader) RemoteAddr() net.Addr        { return nil }
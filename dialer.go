@@ -3,59 +3,356 @@ package marionette
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+const (
+	// DialerScaleInterval is the frequency that the dialer checks for
+	// buffered writes when deciding to open additional connections.
+	DialerScaleInterval = 1 * time.Second
+
+	// DialerAcceptBacklog is the number of streams opened by the server which
+	// are queued until returned by Dialer.Accept(). Additional streams are reset.
+	DialerAcceptBacklog = 16
+)
+
 var (
 	// ErrDialerClosed is returned when trying to operate on a closed dialer.
 	ErrDialerClosed = errors.New("marionette: dialer closed")
+
+	// errPoolFull is returned by openConn() when the pool is at its limit.
+	errPoolFull = errors.New("marionette: connection pool full")
+)
+
+// DialerState represents the connectivity of a dialer.
+type DialerState string
+
+// Dialer states reported to Dialer.OnStateChange.
+const (
+	// At least one connection to the server is open.
+	DialerStateConnected = DialerState("connected")
+
+	// All connections have failed and the dialer is redialing the server.
+	// Streams remain open and writes are buffered until reconnected.
+	DialerStateReconnecting = DialerState("reconnecting")
+
+	// The dialer has been closed or has exhausted its retry policy.
+	DialerStateClosed = DialerState("closed")
 )
 
+// RetryPolicy specifies how a dialer redials after a connection fails.
+type RetryPolicy struct {
+	// Delay before the first attempt & the maximum delay between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Factor the delay is multiplied by after each failed attempt.
+	Multiplier float64
+
+	// Fraction of the delay, between 0 and 1, which is randomly subtracted
+	// so that clients do not redial in lockstep.
+	Jitter float64
+
+	// Maximum number of consecutive failed attempts before the dialer is
+	// closed. If zero, the dialer retries indefinitely.
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy is the retry policy used by new dialers.
+var DefaultRetryPolicy = RetryPolicy{
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// Backoff returns the delay before the given attempt, starting from zero.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.MinBackoff)
+	for i := 0; i < attempt && d < float64(p.MaxBackoff); i++ {
+		d *= p.Multiplier
+	}
+	if max := float64(p.MaxBackoff); d > max {
+		d = max
+	}
+	return time.Duration(d - d*p.Jitter*rand.Float64())
+}
+
 // Dialer represents a client-side dialer that communicates over the marionette protocol.
+//
+// The dialer maintains a pool of connections, each executing its own FSM, which
+// all send & receive cells for the same stream set. Cells carry a random
+// session id so the server can associate the connections with each other.
 type Dialer struct {
-	mu        sync.RWMutex
-	addr      string        // Server hostport to connect to
-	doc       *mar.Document // Parsed MAR document
-	fsm       FSM           // Associated FSM
-	streamSet *StreamSet    // Associated StreamSet
+	mu         sync.RWMutex
+	addr       string           // Server hostport to connect to
+	doc        *mar.Document    // MAR document executed by new connections
+	fsms       map[FSM]struct{} // Pooled FSMs
+	streamSet  *StreamSet       // Associated StreamSet
+	state      DialerState      // Last reported state
+	newStreams chan *Stream     // Streams opened by the server
+
+	// Copies of RetryPolicy & OnStateChange made by Open().
+	retryPolicy   *RetryPolicy
+	onStateChange func(state DialerState, err error)
+
+	// Pool management
+	dialing      int  // connections being dialed
+	reconnecting bool // true while the reconnect loop is running
 
 	// Close management
-	ctx    context.Context
-	cancel func()
-	closed bool
-	wg     sync.WaitGroup
+	ctx       context.Context
+	cancel    func()
+	closed    bool
+	wg        sync.WaitGroup
+	drainOnce sync.Once
+	draining  chan struct{} // closed when Shutdown() is called
+
+	configMu sync.RWMutex // protects doc & Config for Reload()
 
-	// Underlying NetDialer used for net connection.
+	// Underlying NetDialer used for net connection. Also used by connections
+	// spawned by the FSM. See NewUpstreamProxyDialer() to connect via a proxy.
 	Dialer NetDialer
+
+	// Minimum & maximum number of concurrent connections. MinConns are opened
+	// by Open(). Additional connections are opened, up to MaxConns, while
+	// stream writes remain buffered across consecutive DialerScaleInterval checks.
+	//
+	// Pooling requires the client to be the first sender. Otherwise, a single
+	// connection is used.
+	MinConns int
+	MaxConns int
+
+	// Policy used to redial connections which fail. Streams are kept open
+	// while reconnecting if retransmission is enabled. If nil, the dialer
+	// closes when all connections fail. Copied by Open() so later changes
+	// have no effect.
+	RetryPolicy *RetryPolicy
+
+	// If non-zero, cells are acknowledged by the server and resent after the
+	// timeout so that streams survive dropped messages and reconnects. Must
+	// match the server's value. Defaults to PacketRetransmitTimeout for packet
+	// transports and is disabled for stream transports. Without it, open
+	// streams are reset when the last connection fails.
+	RetransmitTimeout time.Duration
+
+	// If non-zero, pings are sent after KeepaliveInterval without receiving a
+	// cell. Connections which receive no data within KeepaliveTimeout are
+	// closed & redialed. The timeout should be several times the interval.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// Settings shared with the dialer's FSMs, streams & plugins. If nil,
+	// package defaults are used. Must be set before Open(). Use Reload() to
+	// change afterward.
+	Config *Config
+
+	// Callback executed when the dialer's state changes. The error is the
+	// cause of the change, if any. Must not call back into the dialer's
+	// Close() method. Must be set before Open() is called.
+	OnStateChange func(state DialerState, err error)
 }
 
 // NewDialer returns a new instance of Dialer.
 func NewDialer(doc *mar.Document, addr string, streamSet *StreamSet) *Dialer {
 	// Run execution in a separate goroutine.
 	d := &Dialer{
-		addr:      addr,
-		doc:       doc,
-		streamSet: streamSet,
-		Dialer:    &net.Dialer{},
+		addr:       addr,
+		doc:        doc,
+		fsms:       make(map[FSM]struct{}),
+		streamSet:  streamSet,
+		newStreams: make(chan *Stream, DialerAcceptBacklog),
+		draining:   make(chan struct{}),
+		Dialer:     &net.Dialer{},
+		MinConns:   1,
+		MaxConns:   1,
+
+		RetransmitTimeout: defaultRetransmitTimeout(doc.Transport),
 	}
+	streamSet.party = PartyClient
+	streamSet.OnPeerStream = d.onPeerStream
+	policy := DefaultRetryPolicy
+	d.RetryPolicy = &policy
 	d.ctx, d.cancel = context.WithCancel(context.Background())
 	return d
 }
 
-// Open initializes the underlying connection.
+// DialContext connects to a server using the named format or MAR file and
+// returns a single stream. The address is the server host, optionally with a
+// port which overrides the format's port. The connection is aborted if ctx is
+// canceled before it is established. Closing the returned connection closes
+// its underlying connections.
+func DialContext(ctx context.Context, format, addr string, opts ...Option) (net.Conn, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := readDocument(PartyClient, format)
+	if err != nil {
+		return nil, err
+	}
+
+	streamSet := NewStreamSet()
+	streamSet.TracePath = o.tracePath
+
+	d := NewDialer(doc, splitDocumentAddr(doc, addr), streamSet)
+	d.Config = &o.config
+	if o.dialer != nil {
+		d.Dialer = o.dialer
+	}
+	if o.hasRetransmitTimeout {
+		d.RetransmitTimeout = o.retransmitTimeout
+	}
+
+	// Close the dialer if ctx is canceled while connecting.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.close()
+		case <-done:
+		}
+	}()
+	err = d.Open()
+	close(done)
+
+	if ctx.Err() != nil {
+		d.Close()
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+	return &dialerConn{Stream: streamSet.Create(), dialer: d}, nil
+}
+
+// dialerConn is a stream returned by DialContext() which owns its dialer.
+type dialerConn struct {
+	*Stream
+	dialer *Dialer
+	once   sync.Once
+}
+
+// Close closes the stream and then closes the dialer once the end of the
+// stream has been sent or StreamCloseTimeout elapses.
+func (c *dialerConn) Close() error {
+	err := c.Stream.Close()
+	c.once.Do(func() {
+		timer := time.NewTimer(StreamCloseTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.Stream.WriteCloseNotifiedNotify():
+		case <-timer.C:
+		}
+		c.dialer.Close()
+	})
+	return err
+}
+
+// Open initializes the underlying connections.
 func (d *Dialer) Open() error {
-	conn, err := d.Dialer.DialContext(d.ctx, d.doc.Transport, net.JoinHostPort(d.addr, d.doc.Port))
+	if d.MinConns < 1 {
+		d.MinConns = 1
+	}
+	if d.doc.FirstSender() != PartyClient {
+		d.MinConns = 1
+		d.MaxConns = 1
+	}
+	if d.MaxConns < d.MinConns {
+		d.MaxConns = d.MinConns
+	}
+
+	if err := ValidateMaxCellLength(d.streamSet.MaxCellLength); err != nil {
+		return err
+	}
+
+	// Identify the session so the server can share streams between pooled
+	// connections and resume them after reconnecting.
+	if d.streamSet.SessionID.IsZero() {
+		id, err := NewSessionID()
+		if err != nil {
+			return err
+		}
+		d.streamSet.SessionID = id
+	}
+
+	d.streamSet.config = d.Config
+	d.streamSet.RetransmitTimeout = d.RetransmitTimeout
+	d.streamSet.KeepaliveInterval = d.KeepaliveInterval
+
+	// Copy settings read by connection goroutines.
+	d.mu.Lock()
+	if d.RetryPolicy != nil {
+		policy := *d.RetryPolicy
+		d.retryPolicy = &policy
+	}
+	d.onStateChange = d.OnStateChange
+	d.mu.Unlock()
+
+	for i := 0; i < d.MinConns; i++ {
+		if err := d.openConn(d.MinConns); err != nil {
+			d.close()
+			d.wg.Wait()
+			return err
+		}
+	}
+	d.setState(DialerStateConnected, nil)
+
+	// Monitor for backed up writes if the pool can grow.
+	if d.MaxConns > d.MinConns {
+		d.wg.Add(1)
+		go func() { defer d.wg.Done(); d.monitor() }()
+	}
+	return nil
+}
+
+// openConn dials a new connection and executes an FSM over it. Connections
+// being dialed count toward the pool size so the pool never exceeds max.
+// Returns errPoolFull if the pool already has max connections.
+func (d *Dialer) openConn(max int) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrDialerClosed
+	} else if len(d.fsms)+d.dialing >= max {
+		d.mu.Unlock()
+		return errPoolFull
+	}
+	d.dialing++
+	d.mu.Unlock()
+
+	doc, config := d.current()
+	conn, err := d.Dialer.DialContext(d.ctx, doc.Transport, net.JoinHostPort(d.addr, doc.Port))
 	if err != nil {
+		d.mu.Lock()
+		d.dialing--
+		d.mu.Unlock()
 		return err
 	}
-	d.fsm = NewFSM(d.doc, d.addr, PartyClient, conn, d.streamSet)
+	fsm := newFSM(doc, d.addr, PartyClient, conn, d.streamSet, config)
+	fsm.dialer = d.Dialer
+
+	d.mu.Lock()
+	d.dialing--
+	if d.closed {
+		d.mu.Unlock()
+		fsm.Close()
+		return ErrDialerClosed
+	}
+
+	d.fsms[fsm] = struct{}{}
+	d.mu.Unlock()
+
+	fsm.Metrics().Connections.Inc()
 
 	d.wg.Add(1)
-	go func() { defer d.wg.Done(); d.execute() }()
+	go func() { defer d.wg.Done(); d.execute(fsm) }()
 	return nil
 }
 
@@ -69,13 +366,107 @@ func (d *Dialer) Close() error {
 func (d *Dialer) close() (err error) {
 	d.mu.Lock()
 	d.closed = true
-	err = d.fsm.Close()
+	for fsm := range d.fsms {
+		if e := fsm.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
 	d.mu.Unlock()
 
 	d.cancel()
+	d.setState(DialerStateClosed, nil)
 	return err
 }
 
+// Shutdown stops new streams from being opened and waits for open streams to
+// finish before closing the dialer. A stream finishes once both sides have
+// sent their end-of-stream cells. If ctx is done first then the dialer is
+// closed immediately and the context's error is returned.
+func (d *Dialer) Shutdown(ctx context.Context) error {
+	d.drainOnce.Do(func() { close(d.draining) })
+
+	// Refuse streams which were opened by the server but not yet accepted.
+	for done := false; !done; {
+		select {
+		case stream := <-d.newStreams:
+			stream.Reset(ResetCodeRefused)
+		default:
+			done = true
+		}
+	}
+
+	if err := waitDrained(ctx, d.streamSet.activeStreamN); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// isDraining returns true if Shutdown() has been called.
+func (d *Dialer) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns the current state of the dialer.
+func (d *Dialer) State() DialerState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.state
+}
+
+// setState updates the state and executes the callback if the state changed.
+func (d *Dialer) setState(state DialerState, err error) {
+	d.mu.Lock()
+	if d.state == state || d.state == DialerStateClosed {
+		d.mu.Unlock()
+		return
+	}
+	d.state = state
+	fn := d.onStateChange
+	d.mu.Unlock()
+
+	d.logger().Debug("dialer state changed", zap.String("state", string(state)), zap.Error(err))
+	if fn != nil {
+		fn(state, err)
+	}
+}
+
+// logger returns the configured logger.
+func (d *Dialer) logger() *zap.Logger {
+	_, config := d.current()
+	return config.logger()
+}
+
+// Reload replaces the MAR document & settings used by new connections,
+// including reconnects. Connections which are already open continue to
+// execute their current document & settings until they close. The document
+// must use the same transport. Pooled dialers also require the client to be
+// the first sender.
+func (d *Dialer) Reload(doc *mar.Document, config *Config) error {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+
+	if doc.Transport != d.doc.Transport {
+		return fmt.Errorf("marionette: reloaded document must use %s transport", d.doc.Transport)
+	} else if d.MaxConns > 1 && doc.FirstSender() != PartyClient {
+		return errors.New("marionette: reloaded document must be sent first by the client when pooling connections")
+	}
+	d.doc, d.Config = doc, config
+	return nil
+}
+
+// current returns the MAR document & settings used by new connections.
+func (d *Dialer) current() (*mar.Document, *Config) {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.doc, d.Config
+}
+
 // Closed returns true if the dialer has been closed.
 func (d *Dialer) Closed() bool {
 	d.mu.RLock()
@@ -84,26 +475,214 @@ func (d *Dialer) Closed() bool {
 	return closed
 }
 
-// Dial returns a new stream from the dialer.
+// ConnN returns the number of open connections in the pool.
+func (d *Dialer) ConnN() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.fsms)
+}
+
+// Dial returns a new stream from the dialer. Returns ErrDialerClosed once
+// the dialer is closed or shutting down.
 func (d *Dialer) Dial() (net.Conn, error) {
-	if d.Closed() {
+	if d.Closed() || d.isDraining() {
 		return nil, ErrDialerClosed
 	}
 	return d.streamSet.Create(), nil
 }
 
+// DialDestination returns a new stream from the dialer which requests that the
+// server connects it to addr instead of the server's default destination.
+func (d *Dialer) DialDestination(addr string) (net.Conn, error) {
+	if d.Closed() || d.isDraining() {
+		return nil, ErrDialerClosed
+	}
+	return d.streamSet.CreateWithDestination(addr), nil
+}
+
+// Accept waits for the next stream opened by the server. Returns
+// ErrDialerClosed once the dialer is closed or shutting down.
+func (d *Dialer) Accept() (net.Conn, error) {
+	select {
+	case <-d.ctx.Done():
+		return nil, ErrDialerClosed
+	case <-d.draining:
+		return nil, ErrDialerClosed
+	case stream := <-d.newStreams:
+		return stream, nil
+	}
+}
+
+// onPeerStream queues a stream opened by the server for Accept(). The stream
+// is reset if the backlog is full or the dialer is closed or shutting down.
+func (d *Dialer) onPeerStream(stream *Stream) {
+	if d.Closed() || d.isDraining() {
+		stream.Reset(ResetCodeRefused)
+		return
+	}
+
+	select {
+	case d.newStreams <- stream:
+	default:
+		d.logger().Debug("dialer accept backlog full, resetting stream", zap.Int("stream_id", stream.ID()))
+		stream.Reset(ResetCodeRefused)
+	}
+}
+
 // execute continually executes the FSM until the stream and dialer are closed.
-func (d *Dialer) execute() {
-	defer d.close()
+// The FSM is removed from the pool on error and is redialed, if enabled.
+func (d *Dialer) execute(fsm FSM) {
+	// Close the connection if the server stops responding.
+	if d.KeepaliveTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		d.wg.Add(1)
+		go func() { defer d.wg.Done(); monitorKeepalive(fsm, d.KeepaliveTimeout, done) }()
+	}
 
 	for !d.Closed() {
-		if err := d.fsm.Execute(d.ctx); err == ErrStreamClosed {
+		if err := fsm.Execute(d.ctx); err == ErrStreamClosed {
 			continue
+		} else if err == ErrReadTimeout {
+			d.logger().Debug("dialer read timeout, restarting fsm")
 		} else if err != nil {
-			Logger.Debug("dialer error", zap.Error(err))
+			d.logger().Debug("dialer error", zap.Error(err))
+			d.removeFSM(fsm, err)
 			return
 		}
-		d.fsm.Reset()
+		fsm.Reset()
+	}
+	d.removeFSM(fsm, nil)
+}
+
+// removeFSM closes fsm and removes it from the pool. If the dialer is still
+// open then the pool is refilled by the reconnect loop. Without a retry
+// policy, the dialer is closed once no FSMs remain.
+func (d *Dialer) removeFSM(fsm FSM, err error) {
+	fsm.Close()
+	fsm.Metrics().Connections.Dec()
+
+	d.mu.Lock()
+	delete(d.fsms, fsm)
+	n := len(d.fsms)
+	d.mu.Unlock()
+
+	if d.Closed() {
+		return
+	} else if d.retryPolicy == nil {
+		if n == 0 {
+			d.close()
+		}
+		return
+	}
+
+	// Resend unacknowledged cells which may have been lost with the connection.
+	// Without retransmission, the server closes the session once the last
+	// connection fails so open streams are reset.
+	if err != nil && d.streamSet.RetransmitTimeout > 0 {
+		d.streamSet.Retransmit()
+	} else if err != nil && n == 0 {
+		for _, stream := range d.streamSet.Streams() {
+			stream.Reset(ResetCodeCancel)
+		}
+	}
+
+	if n == 0 {
+		d.setState(DialerStateReconnecting, err)
+	}
+
+	// Only one reconnect loop runs at a time, regardless of how many
+	// connections fail at once.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.reconnecting || d.closed {
+		return
+	}
+	d.reconnecting = true
+	d.wg.Add(1)
+	go func() { defer d.wg.Done(); d.reconnect() }()
+}
+
+// reconnect redials the server using the retry policy until the pool has at
+// least MinConns connections. Closes the dialer if the policy is exhausted.
+func (d *Dialer) reconnect() {
+	var err error
+	for attempt := 0; d.retryPolicy.MaxAttempts == 0 || attempt < d.retryPolicy.MaxAttempts; attempt++ {
+		// Exit once the pool is full. The check & flag are updated together
+		// so that a connection failing afterward starts a new loop.
+		d.mu.Lock()
+		if d.closed || len(d.fsms)+d.dialing >= d.MinConns {
+			d.reconnecting = false
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		// Wait for backoff or for the dialer to close.
+		timer := time.NewTimer(d.retryPolicy.Backoff(attempt))
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			d.stopReconnecting()
+			return
+		case <-timer.C:
+		}
+
+		if err = d.openConn(d.MinConns); err == ErrDialerClosed {
+			d.stopReconnecting()
+			return
+		} else if err == errPoolFull {
+			continue
+		} else if err != nil {
+			d.logger().Debug("dialer reconnect failed", zap.Int("attempt", attempt+1), zap.Error(err))
+			continue
+		}
+		d.setState(DialerStateConnected, nil)
+
+		// Restart the backoff for any remaining connections.
+		attempt = -1
+	}
+	d.stopReconnecting()
+
+	// Close the dialer if no connections remain after exhausting the policy.
+	if d.ConnN() == 0 {
+		d.setState(DialerStateClosed, err)
+		d.close()
+	}
+}
+
+// stopReconnecting marks the reconnect loop as finished.
+func (d *Dialer) stopReconnecting() {
+	d.mu.Lock()
+	d.reconnecting = false
+	d.mu.Unlock()
+}
+
+// monitor periodically checks for buffered writes and opens additional
+// connections while writes remain backed up and the pool is below MaxConns.
+func (d *Dialer) monitor() {
+	ticker := time.NewTicker(DialerScaleInterval)
+	defer ticker.Stop()
+
+	var backlogged bool
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		prev := backlogged
+		backlogged = d.streamSet.WriteBufferLen() > 0
+		if !prev || !backlogged || d.ConnN() >= d.MaxConns {
+			continue
+		}
+
+		d.logger().Debug("dialer writes backed up, opening connection", zap.Int("n", d.ConnN()+1))
+		if err := d.openConn(d.MaxConns); err != nil && err != ErrDialerClosed && err != errPoolFull {
+			d.logger().Debug("cannot open pooled connection", zap.Error(err))
+		}
+		backlogged = false
 	}
 }
 
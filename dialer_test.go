@@ -0,0 +1,571 @@
+package marionette_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+func TestDialer_Pool(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 3, 3)
+		defer ln.Close()
+		defer d.Close()
+
+		if n := d.ConnN(); n != 3 {
+			t.Fatalf("unexpected conn count: %d", n)
+		}
+
+		// Send enough data to require many cells spread across connections.
+		data := bytes.Repeat([]byte("0123456789"), 200)
+		MustEcho(t, ln, d, data)
+
+		// All pooled connections share a single session.
+		if sessions := ln.Sessions(); len(sessions) != 1 {
+			t.Fatalf("unexpected session count: %d", len(sessions))
+		} else if sessions[0].ID().IsZero() {
+			t.Fatal("expected session id")
+		}
+	})
+
+	t.Run("ScaleUp", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 2)
+		defer ln.Close()
+		defer d.Close()
+
+		// Buffer writes without reading them from the server.
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Write(make([]byte, 30000)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the pool to grow.
+		for i := 0; d.ConnN() < 2; i++ {
+			if i > 50 {
+				t.Fatalf("unexpected conn count: %d", d.ConnN())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
+
+func TestDialer_Reconnect(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d, dialer, states := MustOpenReconnectingDialer(t, 0)
+		defer ln.Close()
+		defer d.Close()
+
+		// Break the underlying connection.
+		dialer.CloseAll()
+
+		// Wait for the dialer to reconnect.
+		if state := MustReceiveState(t, states); state != marionette.DialerStateReconnecting {
+			t.Fatalf("unexpected state: %s", state)
+		} else if state := MustReceiveState(t, states); state != marionette.DialerStateConnected {
+			t.Fatalf("unexpected state: %s", state)
+		} else if n := d.ConnN(); n != 1 {
+			t.Fatalf("unexpected conn count: %d", n)
+		}
+
+		// Ensure new streams work over the new connection.
+		MustEcho(t, ln, d, []byte("foo"))
+	})
+
+	// Ensure pooled connections failing at once are redialed by a single
+	// reconnect loop which does not exceed MinConns.
+	t.Run("ConcurrentFailures", func(t *testing.T) {
+		ln := MustListenResumable(t)
+		defer ln.Close()
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+		dialer := &RecordingDialer{}
+		d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		d.Dialer = dialer
+		d.MinConns, d.MaxConns = 3, 3
+		d.RetransmitTimeout = marionette.SessionRetransmitTimeout
+		d.RetryPolicy = &marionette.RetryPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		// Changes to the policy after Open() are ignored.
+		d.RetryPolicy.MaxAttempts = 1
+
+		// Break all connections at once.
+		dialer.CloseAll()
+
+		// Wait for the pool to refill and ensure it is never overfilled.
+		for i := 0; dialer.ConnN() < 6 || d.ConnN() < 3; i++ {
+			if i > 50 {
+				t.Fatalf("unexpected conn count: %d", d.ConnN())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := d.ConnN(); n != 3 {
+			t.Fatalf("unexpected conn count: %d", n)
+		} else if n := dialer.ConnN(); n != 6 {
+			t.Fatalf("unexpected dial count: %d", n)
+		}
+
+		MustEcho(t, ln, d, []byte("foo"))
+	})
+
+	t.Run("ErrMaxAttempts", func(t *testing.T) {
+		ln, d, dialer, states := MustOpenReconnectingDialer(t, 2)
+		defer d.Close()
+
+		// Stop the server & break the underlying connection.
+		ln.Close()
+		dialer.CloseAll()
+
+		if state := MustReceiveState(t, states); state != marionette.DialerStateReconnecting {
+			t.Fatalf("unexpected state: %s", state)
+		} else if state := MustReceiveState(t, states); state != marionette.DialerStateClosed {
+			t.Fatalf("unexpected state: %s", state)
+		} else if _, err := d.Dial(); err != marionette.ErrDialerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoRetryPolicy", func(t *testing.T) {
+		doc := MustParseFormat(t, "server", "http_simple_blocking")
+		doc.Port = "0"
+		ln, err := marionette.Listen(doc, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		d.RetryPolicy = nil
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		// Closing the listener closes the server side of the connection.
+		ln.Close()
+
+		for i := 0; !d.Closed(); i++ {
+			if i > 50 {
+				t.Fatal("expected dialer to close")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
+
+func TestDialer_Accept(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		// Establish the client's session.
+		MustEcho(t, ln, d, []byte("foo"))
+
+		sessions := ln.Sessions()
+		if len(sessions) != 1 {
+			t.Fatalf("unexpected session count: %d", len(sessions))
+		}
+
+		// Open a stream from the server & verify data flows both ways.
+		stream, err := sessions[0].OpenStream("")
+		if err != nil {
+			t.Fatal(err)
+		} else if stream.ID()%2 != 0 {
+			t.Fatalf("expected even server stream id: %d", stream.ID())
+		}
+		defer stream.Close()
+		MustWriteString(t, stream, "hello")
+
+		conn, err := d.Accept()
+		if err != nil {
+			t.Fatal(err)
+		} else if id := conn.(*marionette.Stream).ID(); id != stream.ID() {
+			t.Fatalf("unexpected stream id: %d", id)
+		}
+		defer conn.Close()
+		MustReadString(t, conn, "hello")
+		MustWriteString(t, conn, "world")
+		MustReadString(t, stream, "world")
+
+		// Client streams use odd ids so they never collide with the server's.
+		if conn, err := d.Dial(); err != nil {
+			t.Fatal(err)
+		} else if id := conn.(*marionette.Stream).ID(); id%2 != 1 {
+			t.Fatalf("expected odd client stream id: %d", id)
+		}
+	})
+
+	t.Run("ErrSessionClosed", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer d.Close()
+
+		MustEcho(t, ln, d, []byte("foo"))
+		sessions := ln.Sessions()
+		if len(sessions) != 1 {
+			t.Fatalf("unexpected session count: %d", len(sessions))
+		}
+
+		ln.Close()
+		if _, err := sessions[0].OpenStream(""); err != marionette.ErrSessionClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrDialerClosed", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+
+		d.Close()
+		if _, err := d.Accept(); err != marionette.ErrDialerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDialer_Shutdown(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		go func() { errs <- d.Shutdown(context.Background()) }()
+
+		// Ensure new streams cannot be opened once shutdown begins.
+		for {
+			if _, err := d.Accept(); err == marionette.ErrDialerClosed {
+				break
+			}
+		}
+		if _, err := d.Dial(); err != marionette.ErrDialerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Ensure the open stream continues to work until both sides close.
+		MustWriteString(t, conn, "bar")
+		MustReadString(t, serverConn, "bar")
+		conn.Close()
+		serverConn.Close()
+
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			} else if !d.Closed() {
+				t.Fatal("expected dialer to be closed")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for shutdown")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := d.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !d.Closed() {
+			t.Fatal("expected dialer to be closed")
+		}
+	})
+}
+
+func TestDialer_Reload(t *testing.T) {
+	// Ensure reconnects use the new document & settings.
+	t.Run("OK", func(t *testing.T) {
+		ln, d, dialer, states := MustOpenReconnectingDialer(t, 0)
+		defer ln.Close()
+		defer d.Close()
+
+		config := &marionette.Config{EncryptionKey: []byte("0123456789abcdef"), MACKey: []byte("secret")}
+		doc := MustParseFormat(t, "server", "http_simple_blocking:20150702")
+		doc.Port = "0"
+		other, err := marionette.Listen(doc, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		if err := other.Reload(doc, config); err != nil {
+			t.Fatal(err)
+		}
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking:20150702")
+		clientDoc.Port = strconv.Itoa(other.Addr().(*net.TCPAddr).Port)
+		if err := d.Reload(clientDoc, config); err != nil {
+			t.Fatal(err)
+		}
+
+		dialer.CloseAll()
+		if state := MustReceiveState(t, states); state != marionette.DialerStateReconnecting {
+			t.Fatalf("unexpected state: %s", state)
+		} else if state := MustReceiveState(t, states); state != marionette.DialerStateConnected {
+			t.Fatalf("unexpected state: %s", state)
+		}
+		MustEcho(t, other, d, []byte("hello"))
+	})
+
+	t.Run("ErrTransportChanged", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		doc := MustParseFormat(t, "client", "dns_request")
+		if err := d.Reload(doc, nil); err == nil || err.Error() != `marionette: reloaded document must use tcp transport` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDialContext(t *testing.T) {
+	keys := marionette.WithKeys([]byte("0123456789abcdef"), []byte("secret"))
+
+	t.Run("OK", func(t *testing.T) {
+		ln, err := marionette.ListenContext(context.Background(), "http_simple_blocking", "127.0.0.1:0", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.CopyN(conn, conn, 5)
+		}()
+
+		conn, err := marionette.DialContext(context.Background(), "http_simple_blocking", ln.Addr().String(), keys, marionette.WithSleepFactor(0.5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		MustWriteString(t, conn, "hello")
+		MustReadString(t, conn, "hello")
+	})
+
+	// Ensure data cannot be exchanged when the keys differ.
+	t.Run("KeyMismatch", func(t *testing.T) {
+		ln, err := marionette.ListenContext(context.Background(), "http_simple_blocking", "127.0.0.1:0", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		conn, err := marionette.DialContext(context.Background(), "http_simple_blocking", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		MustWriteString(t, conn, "hello")
+		if _, err := conn.Read(make([]byte, 5)); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("ErrInvalidKey", func(t *testing.T) {
+		opt := marionette.WithKeys([]byte("short"), nil)
+		if _, err := marionette.DialContext(context.Background(), "http_simple_blocking", "127.0.0.1", opt); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := marionette.ListenContext(context.Background(), "http_simple_blocking", "127.0.0.1:0", opt); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("ErrFormatNotFound", func(t *testing.T) {
+		if _, err := marionette.DialContext(context.Background(), "no_such_format", "127.0.0.1"); err == nil || err.Error() != `marionette: format not found: no_such_format` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrCanceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := marionette.DialContext(ctx, "http_simple_blocking", "127.0.0.1:1"); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := marionette.RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2, Jitter: 0.5}
+	for _, tt := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 0, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{attempt: 1, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{attempt: 3, min: 400 * time.Millisecond, max: 800 * time.Millisecond},
+		{attempt: 10, min: 500 * time.Millisecond, max: time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := p.Backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("unexpected backoff for attempt %d: %s", tt.attempt, d)
+			}
+		}
+	}
+}
+
+// MustOpenReconnectingDialer opens a listener and a dialer with a short retry
+// policy. Returns the dialer's underlying net dialer & a channel of states.
+func MustOpenReconnectingDialer(tb testing.TB, maxAttempts int) (*marionette.Listener, *marionette.Dialer, *RecordingDialer, chan marionette.DialerState) {
+	tb.Helper()
+
+	ln := MustListenResumable(tb)
+
+	clientDoc := MustParseFormat(tb, "client", "http_simple_blocking")
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	states := make(chan marionette.DialerState, 10)
+	dialer := &RecordingDialer{}
+
+	d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+	d.Dialer = dialer
+	d.RetransmitTimeout = marionette.SessionRetransmitTimeout
+	d.RetryPolicy = &marionette.RetryPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2, MaxAttempts: maxAttempts}
+	d.OnStateChange = func(state marionette.DialerState, err error) { states <- state }
+	if err := d.Open(); err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	} else if state := MustReceiveState(tb, states); state != marionette.DialerStateConnected {
+		tb.Fatalf("unexpected state: %s", state)
+	}
+	return ln, d, dialer, states
+}
+
+// MustReceiveState waits for the next dialer state.
+func MustReceiveState(tb testing.TB, states chan marionette.DialerState) marionette.DialerState {
+	tb.Helper()
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(5 * time.Second):
+		tb.Fatal("timeout waiting for dialer state")
+		return ""
+	}
+}
+
+// RecordingDialer is a net dialer which records all dialed connections.
+type RecordingDialer struct {
+	net.Dialer
+	mu       sync.Mutex
+	conns    []net.Conn
+	networks []string
+}
+
+func (d *RecordingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *RecordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.networks = append(d.networks, network)
+	d.mu.Unlock()
+	return conn, nil
+}
+
+// ConnN returns the number of dialed connections.
+func (d *RecordingDialer) ConnN() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// CloseAll closes all dialed connections.
+func (d *RecordingDialer) CloseAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+}
+
+// MustOpenPool opens a listener on a random port and a dialer connected to it.
+func MustOpenPool(tb testing.TB, format string, minConns, maxConns int) (*marionette.Listener, *marionette.Dialer) {
+	tb.Helper()
+
+	doc := MustParseFormat(tb, "server", format)
+	doc.Port = "0"
+	ln, err := marionette.Listen(doc, "127.0.0.1")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	clientDoc := MustParseFormat(tb, "client", format)
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+	d.MinConns, d.MaxConns = minConns, maxConns
+	if err := d.Open(); err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	}
+	return ln, d
+}
+
+// MustEcho writes data to a new stream, echoes it from the server & verifies it.
+func MustEcho(tb testing.TB, ln *marionette.Listener, d *marionette.Dialer, data []byte) {
+	tb.Helper()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(conn, conn, int64(len(data)))
+	}()
+
+	conn, err := d.Dial()
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := conn.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		tb.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		tb.Fatal("unexpected echo")
+	}
+}
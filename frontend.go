@@ -0,0 +1,134 @@
+package marionette
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// ErrFrontendMethod is returned when a front-end HTTP request does not
+	// use the CONNECT method.
+	ErrFrontendMethod = errors.New("marionette: front-end only supports CONNECT requests")
+)
+
+// acceptFrontendRequest reads a SOCKS5 or HTTP CONNECT request from conn and
+// replies that the connection succeeded. The protocol is detected from the
+// first byte. Returns the requested destination & a reader for any data which
+// follows the request.
+//
+// The reply is sent before the server connects to the destination so that no
+// additional round trip is made over the covert channel. Connection failures
+// are reported by the server resetting the stream.
+func acceptFrontendRequest(conn net.Conn) (addr string, r io.Reader, err error) {
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if b[0] == socks5Version {
+		addr, err = acceptSOCKS5Request(br, conn)
+	} else {
+		addr, err = acceptHTTPConnectRequest(br, conn)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, br, nil
+}
+
+// acceptSOCKS5Request reads a SOCKS5 CONNECT request without authentication.
+func acceptSOCKS5Request(br *bufio.Reader, w io.Writer) (string, error) {
+	// Read greeting & require the "no authentication" method.
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return "", err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	} else if bytes.IndexByte(methods, socks5AuthNone) == -1 {
+		w.Write([]byte{socks5Version, 0xFF})
+		return "", errors.New("marionette: no acceptable socks5 authentication method")
+	} else if _, err := w.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return "", err
+	}
+
+	// Read request header.
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return "", err
+	} else if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(w, 0x07)
+		return "", fmt.Errorf("marionette: unsupported socks5 command: %d", req[1])
+	}
+
+	// Read destination address.
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(w, 0x08)
+		return "", fmt.Errorf("marionette: unsupported socks5 address type: %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	if err := writeSOCKS5Reply(w, 0x00); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// writeSOCKS5Reply writes a reply with the given code and an empty bound address.
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// acceptHTTPConnectRequest reads an HTTP CONNECT request.
+func acceptHTTPConnectRequest(br *bufio.Reader, w io.Writer) (string, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	} else if req.Method != http.MethodConnect {
+		io.WriteString(w, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return "", ErrFrontendMethod
+	} else if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\n\r\n")
+		return "", err
+	}
+
+	if _, err := io.WriteString(w, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return "", err
+	}
+	return req.Host, nil
+}
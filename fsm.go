@@ -2,15 +2,19 @@ package marionette
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/fte"
 	"github.com/redjack/marionette/mar"
@@ -27,6 +31,10 @@ var (
 	// ErrUUIDMismatch is returned when a cell is received from a different UUID.
 	// This can occur when communicating with a peer using a different MAR document.
 	ErrUUIDMismatch = errors.New("uuid mismatch")
+
+	// ErrSessionIDMismatch is returned when a client sends a different session
+	// id than it previously sent on the same connection.
+	ErrSessionIDMismatch = errors.New("session id mismatch")
 )
 
 // FSM represents an interface for the Marionette state machine.
@@ -37,6 +45,7 @@ type FSM interface {
 	UUID() int
 	SetInstanceID(int)
 	InstanceID() int
+	SessionID() SessionID
 
 	// Party & networking.
 	Party() string
@@ -75,6 +84,11 @@ type FSM interface {
 	// Returns the stream set attached to the FSM.
 	StreamSet() *StreamSet
 
+	// Sends & receives cells over the FSM's connection. Session cells are
+	// handled by the FSM and all other cells by the stream set.
+	Enqueue(cell *Cell) error
+	Dequeue(n int) *Cell
+
 	// Sets and retrieves key/values from the FSM.
 	SetVar(key string, value interface{})
 	Var(key string) interface{}
@@ -82,7 +96,13 @@ type FSM interface {
 	// Returns a copy of the FSM with a different format.
 	Clone(doc *mar.Document) FSM
 
+	// Returns the configuration shared with the FSM's dialer or listener.
+	Config() *Config
+
 	Logger() *zap.Logger
+
+	// Returns the metrics recorded by the FSM & its plugins.
+	Metrics() *Metrics
 }
 
 // Ensure implementation implements interface.
@@ -93,6 +113,8 @@ type fsm struct {
 	mu       sync.Mutex
 	doc      *mar.Document // executing document
 	host     string        // bind hostname
+	dialer   NetDialer     // dials spawned client connections, if set
+	config   *Config       // shared configuration
 	party    string        // "client", "server"
 	errored  bool          // entered error transition
 	fteCache *fte.Cache
@@ -119,21 +141,44 @@ type fsm struct {
 
 	// Set by the first sender and used to seed PRNG.
 	instanceID int
+
+	// Client session id. Sent by client FSMs at the start of the connection
+	// and received by server FSMs. The number of bytes sent or received so
+	// far is tracked by sessionN.
+	sessionID  SessionID
+	sessionBuf SessionID
+	sessionN   int
+	received   bool // true once a cell has been received
+
+	// Returns the stream set shared by all connections with a session id.
+	// Set by the listener so pooled client connections share streams.
+	// Returns an error if the session cannot be joined.
+	streamSetFn func(id SessionID) (*StreamSet, error)
 }
 
 // NewFSM returns a new FSM. If party is the first sender then the instance id is set.
-func NewFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet) FSM {
+// A nil config uses the package defaults.
+func NewFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet, config *Config) FSM {
+	return newFSM(doc, host, party, conn, streamSet, config)
+}
+
+func newFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet, config *Config) *fsm {
+	if config == nil {
+		config = &Config{}
+	}
+
 	fsm := &fsm{
 		state:     "start",
 		vars:      make(map[string]interface{}),
 		doc:       doc,
 		host:      host,
 		party:     party,
-		fteCache:  fte.NewCache(),
-		conn:      NewBufferedConn(conn, MaxCellLength),
+		config:    config,
+		fteCache:  fte.NewCacheWithKeys(config.Keys()),
 		streamSet: streamSet,
 		listeners: make(map[int]net.Listener),
 	}
+	fsm.conn = newBufferedConn(doc.Transport, conn, fsm.maxCellLength())
 	fsm.ctx, fsm.cancel = context.WithCancel(context.TODO())
 	fsm.buildTransitions()
 	fsm.initFirstSender()
@@ -153,8 +198,25 @@ func (fsm *fsm) initFirstSender() {
 	if fsm.party != fsm.doc.FirstSender() {
 		return
 	}
-	fsm.instanceID = int(rand.Int31())
-	fsm.rand = rand.New(rand.NewSource(int64(fsm.instanceID)))
+	fsm.seed(newInstanceID())
+}
+
+// newInstanceID returns a random, non-zero 31-bit instance id.
+func newInstanceID() int {
+	var buf [4]byte
+	for {
+		if _, err := crand.Read(buf[:]); err != nil {
+			return int(rand.Int31n(math.MaxInt32-1)) + 1
+		} else if id := int(binary.BigEndian.Uint32(buf[:]) & math.MaxInt32); id != 0 {
+			return id
+		}
+	}
+}
+
+// seed sets the instance ID & seeds the PRNG from it.
+func (fsm *fsm) seed(instanceID int) {
+	fsm.instanceID = instanceID
+	fsm.rand = rand.New(rand.NewSource(int64(instanceID)))
 }
 
 // Close closes the underlying connection & context.
@@ -196,6 +258,32 @@ func (fsm *fsm) InstanceID() int { return fsm.instanceID }
 // SetInstanceID sets the ID for the FSM.
 func (fsm *fsm) SetInstanceID(id int) { fsm.instanceID = id }
 
+// SessionID returns the session id received from the client, if any.
+func (fsm *fsm) SessionID() SessionID { return fsm.sessionID }
+
+// setSessionID sets the session id received from the client. If the FSM has a
+// shared stream set function then the FSM switches to the stream set for the
+// session. Returns ErrSessionIDMismatch if a different session id has already
+// been received.
+func (fsm *fsm) setSessionID(id SessionID) error {
+	if id == fsm.sessionID {
+		return nil
+	} else if !fsm.sessionID.IsZero() {
+		return ErrSessionIDMismatch
+	}
+
+	if fsm.streamSetFn != nil {
+		streamSet, err := fsm.streamSetFn(id)
+		if err != nil {
+			return err
+		}
+		fsm.streamSet.Close()
+		fsm.streamSet, fsm.streamSetFn = streamSet, nil
+	}
+	fsm.sessionID = id
+	return nil
+}
+
 // State returns the current state of the FSM.
 func (fsm *fsm) State() string { return fsm.state }
 
@@ -205,6 +293,70 @@ func (fsm *fsm) Conn() *BufferedConn { return fsm.conn }
 // StreamSet returns the stream set the FSM was initialized with.
 func (fsm *fsm) StreamSet() *StreamSet { return fsm.streamSet }
 
+// Enqueue pushes a received cell onto the FSM's stream set. Session cells are
+// consumed by the FSM instead.
+func (fsm *fsm) Enqueue(cell *Cell) error {
+	fsm.received = true
+	if cell.Type == CellTypeSession {
+		return fsm.enqueueSession(cell)
+	}
+	return fsm.streamSet.Enqueue(cell)
+}
+
+// enqueueSession copies the part of the client's session id carried by cell.
+// Once the whole id is received, the FSM switches to the session's stream set.
+// Parts are sent in order so out of order parts are ignored.
+func (fsm *fsm) enqueueSession(cell *Cell) error {
+	if fsm.party != PartyServer {
+		return nil
+	} else if cell.SequenceID == 0 {
+		fsm.sessionN = 0
+	}
+	if cell.SequenceID != fsm.sessionN || fsm.sessionN+len(cell.Payload) > SessionIDSize {
+		return nil
+	}
+
+	fsm.sessionN += copy(fsm.sessionBuf[fsm.sessionN:], cell.Payload)
+	if fsm.sessionN < SessionIDSize {
+		return nil
+	}
+	return fsm.setSessionID(fsm.sessionBuf)
+}
+
+// Dequeue returns the next cell to send over the FSM's connection. If the
+// stream set has a session id then it is sent before any other cells.
+func (fsm *fsm) Dequeue(n int) *Cell {
+	if cell := fsm.dequeueSession(n); cell != nil {
+		return cell
+	}
+	return fsm.streamSet.Dequeue(n)
+}
+
+// dequeueSession returns a session cell with as much of the unsent session id
+// as fits in n bytes. Packet transports may drop the session cells so the id
+// is resent until a cell is received from the server.
+func (fsm *fsm) dequeueSession(n int) *Cell {
+	id := fsm.streamSet.SessionID
+	if id.IsZero() || (n != 0 && n <= CellHeaderSize) {
+		return nil
+	} else if fsm.sessionN == SessionIDSize {
+		if fsm.received || !isPacketTransport(fsm.doc.Transport) {
+			return nil
+		}
+		fsm.sessionN = 0
+	}
+
+	sz := SessionIDSize - fsm.sessionN
+	if n != 0 && sz > n-CellHeaderSize {
+		sz = n - CellHeaderSize
+	}
+
+	cell := NewCell(0, fsm.sessionN, n, CellTypeSession)
+	cell.Payload = id[fsm.sessionN : fsm.sessionN+sz]
+	fsm.sessionN += sz
+	return cell
+}
+
 // Host returns the hostname the FSM was initialized with.
 func (fsm *fsm) Host() string { return fsm.host }
 
@@ -279,6 +431,7 @@ func (fsm *fsm) Next(ctx context.Context) (err error) {
 	// This only occurs if FSM's party is not the first sender.
 	fsm.stepN += 1
 	fsm.state = nextState
+	fsm.Metrics().Transitions.Inc(fsm.doc.Format, nextState)
 
 	return nil
 }
@@ -377,10 +530,16 @@ func (fsm *fsm) evalActions(actions []*mar.Action) error {
 			}
 		}
 
-		fn := FindPlugin(action.Module, action.Method)
+		fn := fsm.config.plugins().Find(action.Module, action.Method)
 		if fn == nil {
 			return fmt.Errorf("plugin not found: %s", action.Name())
-		} else if err := fn(fsm.ctx, fsm, action.ArgValues()...); err != nil {
+		}
+
+		fsm.Metrics().PluginCalls.Inc(action.Name())
+		if err := fn(fsm.ctx, fsm, action.ArgValues()...); err != nil {
+			if err != ErrRetryTransition && err != ErrReadTimeout {
+				fsm.Metrics().PluginErrors.Inc(action.Name())
+			}
 			return err
 		}
 		return nil
@@ -422,10 +581,13 @@ func (fsm *fsm) DFA(regex string, n int) (DFA, error) {
 
 // Listen opens a listener used by channel.bind(). Listener closed by Close().
 //
-// Port is chosen randomly unless MARIONETTE_CHANNEL_BIND_PORT environment variable is set.
+// Port is chosen randomly unless set by Config.ChannelBindPort or the
+// MARIONETTE_CHANNEL_BIND_PORT environment variable.
 func (fsm *fsm) Listen() (port int, err error) {
 	addr := fsm.host
-	if s := os.Getenv("MARIONETTE_CHANNEL_BIND_PORT"); s != "" {
+	if fsm.config.ChannelBindPort != 0 {
+		addr = net.JoinHostPort(addr, strconv.Itoa(fsm.config.ChannelBindPort))
+	} else if s := os.Getenv("MARIONETTE_CHANNEL_BIND_PORT"); s != "" {
 		addr = net.JoinHostPort(addr, s)
 	}
 
@@ -457,12 +619,17 @@ func (fsm *fsm) ensureConn(ctx context.Context) error {
 
 // ensureClientConn dials a connection to the server. Connection closed on Close().
 func (fsm *fsm) ensureClientConn(ctx context.Context) error {
-	conn, err := net.Dial(fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port())))
+	dialer := fsm.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	conn, err := dialer.DialContext(ctx, fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port())))
 	if err != nil {
 		return err
 	}
 
-	fsm.conn = NewBufferedConn(conn, MaxCellLength)
+	fsm.conn = newBufferedConn(fsm.doc.Transport, conn, fsm.maxCellLength())
 	fsm.closeFuncs = append(fsm.closeFuncs, conn.Close)
 
 	return nil
@@ -473,7 +640,7 @@ func (fsm *fsm) ensureClientConn(ctx context.Context) error {
 func (fsm *fsm) ensureServerConn(ctx context.Context) (err error) {
 	ln := fsm.listeners[fsm.Port()]
 	if ln == nil {
-		if ln, err = net.Listen("tcp", net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port()))); err != nil {
+		if ln, err = listen(fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port()))); err != nil {
 			return err
 		}
 		fsm.listeners[fsm.Port()] = ln
@@ -484,12 +651,50 @@ func (fsm *fsm) ensureServerConn(ctx context.Context) (err error) {
 		return err
 	}
 
-	fsm.conn = NewBufferedConn(conn, MaxCellLength)
+	fsm.conn = newBufferedConn(fsm.doc.Transport, conn, fsm.maxCellLength())
 	fsm.closeFuncs = append(fsm.closeFuncs, conn.Close)
 
 	return nil
 }
 
+// maxCellLength returns the maximum cell size of the FSM's stream set.
+func (fsm *fsm) maxCellLength() int {
+	if fsm.streamSet == nil {
+		return MaxCellLength
+	}
+	return fsm.streamSet.MaxCellLength
+}
+
+// newBufferedConn wraps conn in a BufferedConn based on the transport. The
+// buffer is sized to hold cells up to maxCellLength bytes.
+func newBufferedConn(transport string, conn net.Conn, maxCellLength int) *BufferedConn {
+	if isPacketTransport(transport) {
+		return NewBufferedPacketConn(conn, maxCellLength)
+	}
+	return NewBufferedConn(conn, maxCellLength)
+}
+
+// monitorKeepalive closes fsm if its connection does not receive any data
+// within timeout. Returns once fsm is closed or done is closed.
+func monitorKeepalive(fsm FSM, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(fsm.Conn().LastRead()) > timeout {
+			fsm.Logger().Info("peer unresponsive, closing connection", zap.Duration("timeout", timeout))
+			fsm.Close()
+			return
+		}
+	}
+}
+
 // Clone returns a copy of f. Used when spawning new FSMs.
 func (f *fsm) Clone(doc *mar.Document) FSM {
 	other := &fsm{
@@ -497,7 +702,9 @@ func (f *fsm) Clone(doc *mar.Document) FSM {
 		vars:      make(map[string]interface{}),
 		doc:       doc,
 		host:      f.host,
+		dialer:    f.dialer,
 		party:     f.party,
+		config:    f.config,
 		fteCache:  f.fteCache,
 		streamSet: f.streamSet,
 		listeners: f.listeners,
@@ -514,10 +721,16 @@ func (f *fsm) Clone(doc *mar.Document) FSM {
 	return other
 }
 
+// Config returns the configuration shared with the FSM's dialer or listener.
+func (fsm *fsm) Config() *Config { return fsm.config }
+
+// Metrics returns the metrics recorded by the FSM & its plugins.
+func (fsm *fsm) Metrics() *Metrics { return fsm.config.metrics() }
+
 // Logger returns the logger for this FSM.
 func (fsm *fsm) Logger() *zap.Logger {
 	if fsm.Closed() {
 		return zap.NewNop()
 	}
-	return Logger.With(zap.String("party", fsm.party))
+	return fsm.config.logger().With(zap.String("party", fsm.party))
 }
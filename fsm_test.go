@@ -0,0 +1,184 @@
+package marionette_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestNewFSM_Config(t *testing.T) {
+	t.Run("Plugins", func(t *testing.T) {
+		var args []interface{}
+		plugins := marionette.DefaultPluginRegistry.Clone()
+		plugins.Register("test", "record", func(ctx context.Context, fsm marionette.FSM, a ...interface{}) error {
+			args = a
+			return nil
+		})
+
+		doc := MustParseMAR(t, "client", `
+connection(tcp, 8082):
+  start record NULL   1.0
+  record end   record 1.0
+
+action record:
+  client test.record("foo", 100)
+`)
+		conn, other := net.Pipe()
+		defer other.Close()
+
+		fsm := marionette.NewFSM(doc, "127.0.0.1", "client", conn, marionette.NewStreamSet(), &marionette.Config{Plugins: plugins})
+		defer fsm.Close()
+
+		for i := 0; i < 2; i++ {
+			if err := fsm.Next(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if state := fsm.State(); state != "end" {
+			t.Fatalf("unexpected state: %s", state)
+		} else if !reflect.DeepEqual(args, []interface{}{"foo", 100}) {
+			t.Fatalf("unexpected args: %#v", args)
+		} else if marionette.FindPlugin("test", "record") != nil {
+			t.Fatal("expected plugin to not be in default registry")
+		}
+	})
+
+	t.Run("ErrPluginNotFound", func(t *testing.T) {
+		doc := MustParseMAR(t, "client", `
+connection(tcp, 8082):
+  start record NULL   1.0
+  record end   record 1.0
+
+action record:
+  client test.record("foo", 100)
+`)
+		conn, other := net.Pipe()
+		defer other.Close()
+
+		fsm := marionette.NewFSM(doc, "127.0.0.1", "client", conn, marionette.NewStreamSet(), nil)
+		defer fsm.Close()
+
+		if err := fsm.Next(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := fsm.Next(context.Background()); err == nil || err.Error() != `plugin not found: test.record` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ChannelBindPort", func(t *testing.T) {
+		port := MustFreePort(t)
+		conn, other := net.Pipe()
+		defer other.Close()
+
+		doc := MustParseFormat(t, "server", "http_simple_blocking")
+		fsm := marionette.NewFSM(doc, "127.0.0.1", "server", conn, marionette.NewStreamSet(), &marionette.Config{ChannelBindPort: port})
+		defer fsm.Close()
+
+		if other, err := fsm.Listen(); err != nil {
+			t.Fatal(err)
+		} else if other != port {
+			t.Fatalf("unexpected port: %d", other)
+		}
+	})
+}
+
+// Ensure the client's session id is sent at the start of the connection and
+// received by the server, split across cells if necessary.
+func TestFSM_Session(t *testing.T) {
+	const src = `
+connection(tcp, 8082):
+  start end NULL 1.0
+`
+	id, err := marionette.NewSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	streamSet := marionette.NewStreamSet()
+	streamSet.SessionID = id
+	client := marionette.NewFSM(MustParseMAR(t, "client", src), "127.0.0.1", "client", clientConn, streamSet, nil)
+	server := marionette.NewFSM(MustParseMAR(t, "server", src), "127.0.0.1", "server", serverConn, marionette.NewStreamSet(), nil)
+
+	// Only part of the id fits in a small cell.
+	n := marionette.CellHeaderSize + 10
+	for _, sz := range []int{10, marionette.SessionIDSize - 10} {
+		if cell := client.Dequeue(n); cell == nil || cell.Type != marionette.CellTypeSession || len(cell.Payload) != sz {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if !server.SessionID().IsZero() {
+			t.Fatal("unexpected session id")
+		} else if err := server.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cell := client.Dequeue(n); cell != nil {
+		t.Fatalf("unexpected cell: %#v", cell)
+	} else if server.SessionID() != id {
+		t.Fatalf("unexpected session id: %s", server.SessionID())
+	}
+
+	// A different id cannot be sent over the same connection.
+	other := marionette.NewCell(0, 0, 0, marionette.CellTypeSession)
+	other.Payload = make([]byte, marionette.SessionIDSize)
+	other.Payload[0] = 1
+	if err := server.Enqueue(other); err != marionette.ErrSessionIDMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPluginRegistry(t *testing.T) {
+	fn := func(ctx context.Context, fsm marionette.FSM, args ...interface{}) error { return nil }
+
+	t.Run("Clone", func(t *testing.T) {
+		r := marionette.NewPluginRegistry()
+		r.Register("test", "a", fn)
+
+		other := r.Clone()
+		other.Register("test", "b", fn)
+		if other.Find("test", "a") == nil {
+			t.Fatal("expected cloned plugin")
+		} else if r.Find("test", "b") != nil {
+			t.Fatal("expected original registry to be unchanged")
+		}
+	})
+
+	t.Run("ErrDuplicate", func(t *testing.T) {
+		r := marionette.NewPluginRegistry()
+		r.Register("test", "a", fn)
+
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		r.Register("test", "a", fn)
+	})
+}
+
+// MustParseMAR parses a MAR document for party from a string.
+func MustParseMAR(tb testing.TB, party, s string) *mar.Document {
+	tb.Helper()
+	doc, err := mar.Parse(party, []byte(s))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return doc
+}
+
+// MustFreePort returns an unused TCP port on the loopback interface.
+func MustFreePort(tb testing.TB) int {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -18,12 +18,18 @@ type Cipher struct {
 	dec *Decrypter
 }
 
-// NewCipher returns a new instance of Cipher.
+// NewCipher returns a new instance of Cipher using the default keys.
 func NewCipher(regex string, n int) (_ *Cipher, err error) {
+	return NewCipherWithKeys(regex, n, K1, K2)
+}
+
+// NewCipherWithKeys returns a new instance of Cipher using an AES key & an
+// HMAC key. Both parties must use the same keys.
+func NewCipherWithKeys(regex string, n int, encKey, macKey []byte) (_ *Cipher, err error) {
 	var c Cipher
-	if c.enc, err = NewEncrypter(); err != nil {
+	if c.enc, err = NewEncrypterWithKeys(encKey, macKey); err != nil {
 		return nil, err
-	} else if c.dec, err = NewDecrypter(); err != nil {
+	} else if c.dec, err = NewDecrypterWithKeys(encKey, macKey); err != nil {
 		return nil, err
 	} else if c.dfa, err = NewDFA(regex, n); err != nil {
 		return nil, err
@@ -127,9 +133,15 @@ func (c *Cipher) Decrypt(ciphertext []byte) (plaintext, remainder []byte, err er
 	msg_len_header := make([]byte, 16)
 	c.dec.block.Decrypt(msg_len_header, X[:16])
 	msg_len := binary.BigEndian.Uint64(msg_len_header[8:16])
+	if msg_len > uint64(len(X)-16) {
+		return nil, nil, ErrInvalidMessageLength
+	}
 
 	retval := X[16 : 16+msg_len]
 	retval = append(retval, ciphertext[c.dfa.N():]...)
+	if len(retval) < 16 {
+		return nil, nil, ErrShortCiphertext
+	}
 	ctxt_len := c.dec.CiphertextLen(retval)
 	var remaining_buffer []byte
 	if len(retval) > ctxt_len {
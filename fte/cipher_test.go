@@ -39,3 +39,26 @@ func TestCipher(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Ensure ciphertext from a cipher with different keys returns an error.
+func TestCipher_KeyMismatch(t *testing.T) {
+	cipher, err := fte.NewCipherWithKeys(`^(a|b|c)+$`, 512, []byte("0123456789abcdef"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cipher.Close()
+
+	other, err := fte.NewCipher(`^(a|b|c)+$`, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	for i := 0; i < 10; i++ {
+		if ciphertext, err := cipher.Encrypt([]byte(`test`)); err != nil {
+			t.Fatal(err)
+		} else if _, _, err := other.Decrypt(ciphertext); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
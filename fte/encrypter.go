@@ -35,12 +35,20 @@ const _IV_LENGTH = 7
 type Encrypter struct {
 	block     cipher.Block
 	blockMode cipher.BlockMode
+	macKey    []byte
 
 	IV []byte
 }
 
+// NewEncrypter returns an Encrypter using the default keys, K1 & K2.
 func NewEncrypter() (*Encrypter, error) {
-	blk, err := aes.NewCipher(K1)
+	return NewEncrypterWithKeys(K1, K2)
+}
+
+// NewEncrypterWithKeys returns an Encrypter which encrypts with the AES key
+// encKey and signs with the HMAC key macKey.
+func NewEncrypterWithKeys(encKey, macKey []byte) (*Encrypter, error) {
+	blk, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +56,7 @@ func NewEncrypter() (*Encrypter, error) {
 	return &Encrypter{
 		block:     blk,
 		blockMode: ecb.NewEncrypter(blk),
+		macKey:    macKey,
 	}, nil
 }
 
@@ -85,7 +94,7 @@ func (enc *Encrypter) Encrypt(plaintext []byte) ([]byte, error) {
 	ciphertext := append(W1[:len(W1):len(W1)], W2...)
 
 	// Sign the message & limit size to AES block size.
-	mac := hmac.New(sha512.New, K2)
+	mac := hmac.New(sha512.New, enc.macKey)
 	mac.Write(ciphertext)
 	T := mac.Sum(nil)
 	T = T[:aes.BlockSize]
@@ -96,10 +105,18 @@ func (enc *Encrypter) Encrypt(plaintext []byte) ([]byte, error) {
 type Decrypter struct {
 	block     cipher.Block
 	blockMode cipher.BlockMode
+	macKey    []byte
 }
 
+// NewDecrypter returns a Decrypter using the default keys, K1 & K2.
 func NewDecrypter() (*Decrypter, error) {
-	blk, err := aes.NewCipher(K1)
+	return NewDecrypterWithKeys(K1, K2)
+}
+
+// NewDecrypterWithKeys returns a Decrypter which decrypts with the AES key
+// encKey and verifies with the HMAC key macKey.
+func NewDecrypterWithKeys(encKey, macKey []byte) (*Decrypter, error) {
+	blk, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, err
 	}
@@ -107,6 +124,7 @@ func NewDecrypter() (*Decrypter, error) {
 	return &Decrypter{
 		block:     blk,
 		blockMode: ecb.NewDecrypter(blk),
+		macKey:    macKey,
 	}, nil
 }
 
@@ -138,7 +156,7 @@ func (dec *Decrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 	T_expected := ciphertext[T_start:T_end:T_end]
 
 	// Sign the message & limit size to AES block size.
-	mac := hmac.New(sha512.New, K2)
+	mac := hmac.New(sha512.New, dec.macKey)
 	mac.Write(append(W1, W2...))
 	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], T_expected) {
 		return nil, ErrHMACVerificationFailed
@@ -44,6 +44,53 @@ func TestEncrypter_Quick(t *testing.T) {
 	}
 }
 
+func TestEncrypterWithKeys(t *testing.T) {
+	encKey := []byte("0123456789abcdef")
+	macKey := []byte("fedcba9876543210")
+	plaintext := []byte("hello, world")
+
+	enc, err := fte.NewEncrypterWithKeys(encKey, macKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := enc.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		dec, err := fte.NewDecrypterWithKeys(encKey, macKey)
+		if err != nil {
+			t.Fatal(err)
+		} else if other, err := dec.Decrypt(ciphertext); err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(plaintext, other); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("ErrHMACVerificationFailed", func(t *testing.T) {
+		dec, err := fte.NewDecrypterWithKeys(encKey, []byte("other"))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := dec.Decrypt(ciphertext); err != fte.ErrHMACVerificationFailed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DefaultKeys", func(t *testing.T) {
+		if _, err := MustNewDecrypter().Decrypt(ciphertext); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("ErrInvalidKeySize", func(t *testing.T) {
+		if _, err := fte.NewEncrypterWithKeys([]byte("short"), macKey); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
 func MustNewEncrypter() *fte.Encrypter {
 	enc, err := fte.NewEncrypter()
 	if err != nil {
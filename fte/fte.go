@@ -2,9 +2,6 @@ package fte
 
 import (
 	"crypto/aes"
-	"io"
-	"io/ioutil"
-	"os"
 )
 
 const (
@@ -17,19 +14,27 @@ const (
 	CTXT_EXPANSION     = 1 + IV_LENGTH + MSG_COUNTER_LENGTH + aes.BlockSize
 )
 
-var Verbose bool
-
 // Cache represents a cache of Ciphers & DFAs.
 type Cache struct {
 	ciphers map[cacheKey]*Cipher
 	dfas    map[cacheKey]*DFA
+
+	encKey, macKey []byte // keys used by new ciphers
 }
 
-// NewCache returns a new instance of Cache.
+// NewCache returns a new instance of Cache using the default keys.
 func NewCache() *Cache {
+	return NewCacheWithKeys(K1, K2)
+}
+
+// NewCacheWithKeys returns a new instance of Cache whose ciphers use the AES
+// key encKey & the HMAC key macKey.
+func NewCacheWithKeys(encKey, macKey []byte) *Cache {
 	return &Cache{
 		ciphers: make(map[cacheKey]*Cipher),
 		dfas:    make(map[cacheKey]*DFA),
+		encKey:  encKey,
+		macKey:  macKey,
 	}
 }
 
@@ -57,7 +62,7 @@ func (c *Cache) Close() (err error) {
 func (c *Cache) Cipher(regex string, n int) (_ *Cipher, err error) {
 	cipher := c.ciphers[cacheKey{regex, n}]
 	if cipher == nil {
-		if cipher, err = NewCipher(regex, n); err != nil {
+		if cipher, err = NewCipherWithKeys(regex, n, c.encKey, c.macKey); err != nil {
 			return nil, err
 		}
 		c.ciphers[cacheKey{regex, n}] = cipher
@@ -82,10 +87,3 @@ type cacheKey struct {
 	regex string
 	n     int
 }
-
-func stderr() io.Writer {
-	if Verbose {
-		return os.Stderr
-	}
-	return ioutil.Discard
-}
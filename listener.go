@@ -3,46 +3,136 @@ package marionette
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultSessionTimeout is the default amount of time a listener keeps a
+	// client's streams open after its last connection fails.
+	DefaultSessionTimeout = 1 * time.Minute
+)
+
 var (
 	// ErrListenerClosed is returned when trying to operate on a closed listener.
 	ErrListenerClosed = errors.New("marionette: listener closed")
+
+	// ErrSessionClosed is returned when opening a stream on a closed session.
+	ErrSessionClosed = errors.New("marionette: session closed")
 )
 
 // Listener listens on a port and communicates over the marionette protocol.
 type Listener struct {
 	mu         sync.RWMutex
-	iface      string                // bind hostname
-	ln         net.Listener          // underlying listener
-	conns      map[net.Conn]struct{} // open connections
-	fsms       map[FSM]struct{}      // open FSMs
-	doc        *mar.Document         // executing MAR document
-	newStreams chan *Stream          // channel used to send all new streams
-	err        error                 // last received error
+	iface      string                         // bind hostname
+	ln         net.Listener                   // underlying listener
+	conns      map[net.Conn]struct{}          // open connections
+	fsms       map[FSM]struct{}               // open FSMs
+	streamSets map[SessionID]*sharedStreamSet // stream sets by client session id
+	doc        *mar.Document                  // MAR document executed by new connections
+	newStreams chan *Stream                   // channel used to send all new streams
+	err        error                          // last received error
+
+	configMu sync.RWMutex // protects doc & Config for Reload()
 
 	ctx    context.Context
 	cancel func()
 
 	// Close management
-	once    sync.Once
-	wg      sync.WaitGroup
-	closing chan struct{}
-	closed  bool
+	once       sync.Once
+	wg         sync.WaitGroup
+	closing    chan struct{}
+	closed     bool
+	acceptDone chan struct{} // closed when no more connections are accepted
+	lnOnce     sync.Once
+	lnErr      error // error from closing the underlying listener
+	drainOnce  sync.Once
+	draining   chan struct{} // closed when Shutdown() is called
 
 	// Specifies directory for dumping stream traces. Passed to StreamSet.TracePath.
 	TracePath string
+
+	// Amount of time streams are kept open after a client's last connection
+	// fails so that the client can reconnect & resume its session. Sessions are
+	// identified by the random session id carried in the client's cells. If
+	// zero or if retransmission is disabled, streams are closed as soon as the
+	// last connection closes.
+	SessionTimeout time.Duration
+
+	// If non-zero, cells are acknowledged by the peer and resent after the
+	// timeout. Must match the client's value and be set before connections
+	// are accepted. Defaults to PacketRetransmitTimeout for packet transports
+	// and is disabled for stream transports.
+	RetransmitTimeout time.Duration
+
+	// If non-zero, pings are sent after KeepaliveInterval without receiving a
+	// cell. Connections which receive no data within KeepaliveTimeout are closed.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// If true, cell payloads sent to clients are compressed.
+	Compress bool
+
+	// Maximum size of a cell, in bytes. Must match the client's value and be
+	// set before connections are accepted. Defaults to MaxCellLength.
+	MaxCellLength int
+
+	// Settings shared with the listener's FSMs, streams & plugins. If nil,
+	// package defaults are used. Must be set before connections are accepted.
+	// Use Reload() to change afterward.
+	Config *Config
 }
 
 // Listen returns a new instance of Listener.
 func Listen(doc *mar.Document, iface string) (*Listener, error) {
+	l, err := newListener(doc, iface, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.open()
+	return l, nil
+}
+
+// ListenContext returns a listener for the named format or MAR file. The
+// address is a bind host, optionally with a port which overrides the format's
+// port. The context is only used while opening the listener.
+func ListenContext(ctx context.Context, format, addr string, opts ...Option) (net.Listener, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := readDocument(PartyServer, format)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := newListener(doc, splitDocumentAddr(doc, addr), &o.config)
+	if err != nil {
+		return nil, err
+	}
+	l.TracePath = o.tracePath
+	if o.hasRetransmitTimeout {
+		l.RetransmitTimeout = o.retransmitTimeout
+	}
+	l.open()
+	return l, nil
+}
+
+// newListener returns a new instance of Listener using config. Connections
+// are not accepted until open() is called.
+func newListener(doc *mar.Document, iface string, config *Config) (*Listener, error) {
 	// Parse port from MAR specification.
 	port, err := strconv.Atoi(doc.Port)
 	if err != nil {
@@ -50,10 +140,11 @@ func Listen(doc *mar.Document, iface string) (*Listener, error) {
 	}
 	addr := net.JoinHostPort(iface, strconv.Itoa(port))
 
-	Logger.Debug("listen", zap.String("transport", doc.Transport), zap.String("bind", addr))
+	config.logger().Debug("listen", zap.String("transport", doc.Transport), zap.String("bind", addr))
 
-	// Open the underlying listener.
-	ln, err := net.Listen(doc.Transport, addr)
+	// Open the underlying listener. Packet-based transports accept a
+	// separate connection for each remote peer.
+	ln, err := listen(doc.Transport, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -63,16 +154,25 @@ func Listen(doc *mar.Document, iface string) (*Listener, error) {
 		doc:        doc,
 		conns:      make(map[net.Conn]struct{}),
 		fsms:       make(map[FSM]struct{}),
+		streamSets: make(map[SessionID]*sharedStreamSet),
 		newStreams: make(chan *Stream),
 		closing:    make(chan struct{}),
+		acceptDone: make(chan struct{}),
+		draining:   make(chan struct{}),
+
+		SessionTimeout:    DefaultSessionTimeout,
+		RetransmitTimeout: defaultRetransmitTimeout(doc.Transport),
+		MaxCellLength:     MaxCellLength,
+		Config:            config,
 	}
 	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l, nil
+}
 
-	// Hand off connection handling to separate goroutine.
+// open starts accepting connections in a separate goroutine.
+func (l *Listener) open() {
 	l.wg.Add(1)
 	go func() { defer l.wg.Done(); l.accept() }()
-
-	return l, nil
 }
 
 // Err returns the last error that occurred on the listener.
@@ -87,22 +187,21 @@ func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
 
 // Close stops the listener and waits for the connections to finish.
 func (l *Listener) Close() error {
-	err := l.ln.Close()
+	err := l.closeListener()
 
+	// Closing each FSM also closes its connection.
 	l.mu.Lock()
 	l.closed = true
-	for conn := range l.conns {
-		if e := conn.Close(); e != nil && err == nil {
-			err = e
-		}
-		delete(l.conns, conn)
-	}
 	for fsm := range l.fsms {
 		if e := fsm.Close(); e != nil && err == nil {
 			err = e
 		}
 		delete(l.fsms, fsm)
 	}
+	for conn := range l.conns {
+		delete(l.conns, conn)
+	}
+	l.closeDetachedSessions()
 	l.mu.Unlock()
 
 	l.once.Do(func() {
@@ -114,6 +213,91 @@ func (l *Listener) Close() error {
 	return err
 }
 
+// Shutdown stops accepting new sessions & streams and waits for open streams
+// to finish before closing the listener. A stream finishes once both sides
+// have sent their end-of-stream cells. If ctx is done first then the listener
+// is closed immediately and the context's error is returned.
+//
+// Connections for existing sessions are still accepted while draining since
+// some formats use a connection per message and packet transports share a
+// single socket. Detached sessions may also be resumed.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.drainOnce.Do(func() { close(l.draining) })
+
+	if err := waitDrained(ctx, l.activeStreamN); err != nil {
+		l.Close()
+		return err
+	}
+	return l.Close()
+}
+
+// closeListener closes the underlying listener once.
+func (l *Listener) closeListener() error {
+	l.lnOnce.Do(func() { l.lnErr = l.ln.Close() })
+	return l.lnErr
+}
+
+// closeDetachedSessions closes sessions which are waiting for clients to
+// reconnect. Must be called under lock.
+func (l *Listener) closeDetachedSessions() {
+	for id, ss := range l.streamSets {
+		if ss.timer == nil {
+			continue
+		}
+		ss.timer.Stop()
+		ss.Close()
+		delete(l.streamSets, id)
+	}
+}
+
+// activeStreamN returns the number of unfinished streams across all sessions.
+func (l *Listener) activeStreamN() (n int) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, ss := range l.streamSets {
+		n += ss.activeStreamN()
+	}
+	return n
+}
+
+// isDraining returns true if Shutdown() has been called.
+func (l *Listener) isDraining() bool {
+	select {
+	case <-l.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reload replaces the MAR document & settings used by new connections.
+// Connections which are already open continue to execute their current
+// document & settings until they close. The document must use the same
+// transport & port as the listener.
+func (l *Listener) Reload(doc *mar.Document, config *Config) error {
+	l.configMu.Lock()
+	defer l.configMu.Unlock()
+
+	if doc.Transport != l.doc.Transport || doc.Port != l.doc.Port {
+		return fmt.Errorf("marionette: reloaded document must use %s port %s", l.doc.Transport, l.doc.Port)
+	}
+	l.doc, l.Config = doc, config
+	return nil
+}
+
+// current returns the MAR document & settings used by new connections.
+func (l *Listener) current() (*mar.Document, *Config) {
+	l.configMu.RLock()
+	defer l.configMu.RUnlock()
+	return l.doc, l.Config
+}
+
+// logger returns the configured logger.
+func (l *Listener) logger() *zap.Logger {
+	_, config := l.current()
+	return config.logger()
+}
+
 // Closed returns true if the listener has been closed.
 func (l *Listener) Closed() bool {
 	l.mu.RLock()
@@ -122,26 +306,31 @@ func (l *Listener) Closed() bool {
 	return closed
 }
 
-// Accept waits for a new connection.
+// Accept waits for a new connection. Returns ErrListenerClosed once the
+// listener is closed or shutting down.
 func (l *Listener) Accept() (net.Conn, error) {
 	select {
 	case <-l.closing:
 		return nil, ErrListenerClosed
+	case <-l.draining:
+		return nil, ErrListenerClosed
+	case <-l.acceptDone:
+		return nil, l.Err()
 	case stream := <-l.newStreams:
-		return stream, l.Err()
+		return stream, nil
 	}
 }
 
 // accept continually accepts networks connections and multiplexes to streams.
 func (l *Listener) accept() {
-	defer close(l.newStreams)
+	defer close(l.acceptDone)
 
 	for {
 		// Wait for next connection.
 		conn, err := l.ln.Accept()
 		if err != nil {
 			l.mu.Lock()
-			if l.closed {
+			if l.closed || l.isDraining() {
 				l.err = ErrListenerClosed
 			} else {
 				l.err = err
@@ -150,13 +339,12 @@ func (l *Listener) accept() {
 			return
 		}
 
-		// Generate a new multiplexing set for connection.
-		streamSet := NewStreamSet()
-		streamSet.OnNewStream = l.onNewStream
-		streamSet.TracePath = l.TracePath
-
-		// Create FSM for processing communication.
-		fsm := NewFSM(l.doc, l.iface, PartyServer, conn, streamSet)
+		// Create FSM for processing communication. The FSM switches to a
+		// stream set shared by all connections from the same client once
+		// the client's session id is received.
+		doc, config := l.current()
+		fsm := newFSM(doc, l.iface, PartyServer, conn, l.newStreamSet(), config)
+		fsm.streamSetFn = l.acquireStreamSet
 
 		// Run execution in a separate goroutine.
 		l.wg.Add(1)
@@ -167,32 +355,156 @@ func (l *Listener) accept() {
 // execute continually executes the FSM until connection is closed.
 // This function is run in a separate goroutine for each connection.
 func (l *Listener) execute(fsm FSM, conn net.Conn) {
-	defer fsm.StreamSet().Close()
+	defer conn.Close()
+	defer func() { l.releaseStreamSet(fsm.SessionID(), fsm.StreamSet()) }()
 
 	l.addConn(conn, fsm)
 	defer l.removeConn(conn, fsm)
 
+	// Close the connection if the client stops responding.
+	if l.KeepaliveTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		l.wg.Add(1)
+		go func() { defer l.wg.Done(); monitorKeepalive(fsm, l.KeepaliveTimeout, done) }()
+	}
+
 	for !l.Closed() {
 		if err := fsm.Execute(l.ctx); err == ErrStreamClosed {
-			Logger.Debug("stream closed", zap.String("addr", conn.RemoteAddr().String()))
+			l.logger().Debug("stream closed", zap.String("addr", conn.RemoteAddr().String()))
 			return
 		} else if err == io.EOF {
-			Logger.Debug("client disconnected", zap.String("addr", conn.RemoteAddr().String()))
+			l.logger().Debug("client disconnected", zap.String("addr", conn.RemoteAddr().String()))
 			return
+		} else if err == ErrReadTimeout {
+			l.logger().Debug("read timeout, restarting fsm", zap.String("addr", conn.RemoteAddr().String()))
 		} else if err != nil {
-			Logger.Debug("server fsm execution error", zap.Error(err))
+			l.logger().Debug("server fsm execution error", zap.Error(err))
 			return
 		} else if fsm.Errored() {
-			Logger.Debug("server fsm has error transition, stopping")
+			l.logger().Debug("server fsm has error transition, stopping")
 			return
 		}
 		fsm.Reset()
 	}
 }
 
-// onNewStream is called everytime the FSM's stream set creates a new stream.
+// newStreamSet returns a new stream set using the listener's settings.
+func (l *Listener) newStreamSet() *StreamSet {
+	_, config := l.current()
+	streamSet := NewStreamSet()
+	streamSet.party = PartyServer
+	streamSet.config = config
+	streamSet.OnPeerStream = l.onNewStream
+	streamSet.TracePath = l.TracePath
+	streamSet.RetransmitTimeout = l.RetransmitTimeout
+	streamSet.KeepaliveInterval = l.KeepaliveInterval
+	streamSet.MaxCellLength = l.MaxCellLength
+	streamSet.Compress = l.Compress
+	return streamSet
+}
+
+// acquireStreamSet returns the stream set for a client session id and
+// increments its reference count. Creates the stream set if it doesn't exist.
+//
+// If the stream set is detached then the client's session is resumed and
+// unacknowledged cells are resent over the new connection. Session ids are
+// random so only the client which created the session can resume it.
+//
+// Returns ErrListenerClosed for new sessions once the listener is closed or
+// shutting down.
+func (l *Listener) acquireStreamSet(id SessionID) (*StreamSet, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ss := l.streamSets[id]
+	if ss == nil && (l.closed || l.isDraining()) {
+		return nil, ErrListenerClosed
+	} else if ss == nil {
+		ss = &sharedStreamSet{StreamSet: l.newStreamSet(), createdAt: time.Now()}
+		l.streamSets[id] = ss
+	} else if ss.timer != nil {
+		l.logger().Debug("session resumed", zap.String("session_id", id.String()))
+		ss.timer.Stop()
+		ss.timer = nil
+		ss.Retransmit()
+	}
+	ss.refN++
+	return ss.StreamSet, nil
+}
+
+// releaseStreamSet decrements the reference count of a shared stream set.
+// Once no connections remain, the stream set is detached and closed after
+// SessionTimeout unless the client reconnects. Unshared stream sets are closed.
+func (l *Listener) releaseStreamSet(id SessionID, streamSet *StreamSet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ss := l.streamSets[id]
+	if ss == nil || ss.StreamSet != streamSet {
+		streamSet.Close()
+		return
+	}
+
+	// Resend cells which may have been lost with the connection.
+	ss.refN--
+	if ss.refN > 0 {
+		ss.Retransmit()
+		return
+	}
+
+	// Close immediately if the listener is closed or if resumption is
+	// disabled. Sessions cannot be resumed without retransmission since
+	// cells may have been lost with the connection.
+	if l.closed || l.SessionTimeout <= 0 || ss.RetransmitTimeout <= 0 {
+		delete(l.streamSets, id)
+		streamSet.Close()
+		return
+	}
+
+	l.logger().Debug("session detached", zap.String("session_id", id.String()))
+	ss.timer = time.AfterFunc(l.SessionTimeout, func() { l.expireStreamSet(id, ss) })
+}
+
+// expireStreamSet closes a detached stream set if it has not been resumed.
+func (l *Listener) expireStreamSet(id SessionID, ss *sharedStreamSet) {
+	l.mu.Lock()
+	if l.streamSets[id] != ss || ss.refN > 0 {
+		l.mu.Unlock()
+		return
+	}
+	delete(l.streamSets, id)
+	l.mu.Unlock()
+
+	l.logger().Debug("session expired", zap.String("session_id", id.String()))
+	ss.Close()
+}
+
+// Sessions returns the open client sessions, ordered from oldest to newest.
+// Detached sessions waiting for their client to reconnect are included.
+func (l *Listener) Sessions() []*Session {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	a := make([]*Session, 0, len(l.streamSets))
+	for id, ss := range l.streamSets {
+		a = append(a, &Session{listener: l, id: id, ss: ss})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].ss.createdAt.Before(a[j].ss.createdAt) })
+	return a
+}
+
+// onNewStream is called everytime a client creates a new stream.
+// Streams created after the listener is closed are closed immediately and
+// streams created while it is shutting down are refused.
 func (l *Listener) onNewStream(stream *Stream) {
-	l.newStreams <- stream
+	select {
+	case l.newStreams <- stream:
+	case <-l.closing:
+		stream.Close()
+	case <-l.draining:
+		stream.Reset(ResetCodeRefused)
+	}
 }
 
 // addConn adds a connection & associated FSM to the open set.
@@ -201,6 +513,8 @@ func (l *Listener) addConn(conn net.Conn, fsm FSM) {
 	l.conns[conn] = struct{}{}
 	l.fsms[fsm] = struct{}{}
 	l.mu.Unlock()
+
+	fsm.Metrics().Connections.Inc()
 }
 
 // removeConn removes a connection & associated FSM from the open set.
@@ -209,4 +523,56 @@ func (l *Listener) removeConn(conn net.Conn, fsm FSM) {
 	delete(l.conns, conn)
 	delete(l.fsms, fsm)
 	l.mu.Unlock()
+
+	fsm.Metrics().Connections.Dec()
+}
+
+// sharedStreamSet is a stream set shared by connections from the same client.
+type sharedStreamSet struct {
+	*StreamSet
+	refN      int
+	timer     *time.Timer // expiration timer, if detached
+	createdAt time.Time
+}
+
+// Session represents the streams shared by all connections from a client.
+type Session struct {
+	listener *Listener
+	id       SessionID
+	ss       *sharedStreamSet
+}
+
+// ID returns the session id generated by the client.
+func (s *Session) ID() SessionID { return s.id }
+
+// OpenStream returns a new stream initiated by the server. The client receives
+// the stream from Dialer.Accept(). If addr is not blank then it is sent as the
+// stream's destination so the client can connect it to addr.
+//
+// Streams opened on a detached session are buffered until the client
+// reconnects. Returns ErrSessionClosed if the session has expired or closed,
+// or if the listener is shutting down.
+func (s *Session) OpenStream(addr string) (*Stream, error) {
+	s.listener.mu.RLock()
+	defer s.listener.mu.RUnlock()
+
+	if s.listener.closed || s.listener.isDraining() || s.listener.streamSets[s.id] != s.ss {
+		return nil, ErrSessionClosed
+	} else if addr == "" {
+		return s.ss.Create(), nil
+	}
+	return s.ss.CreateWithDestination(addr), nil
+}
+
+// Dial returns a new stream opened by the server. Implements StreamDialer.
+func (s *Session) Dial() (net.Conn, error) { return s.DialDestination("") }
+
+// DialDestination returns a new stream which requests that the client connects
+// it to addr. Implements StreamDialer.
+func (s *Session) DialDestination(addr string) (net.Conn, error) {
+	stream, err := s.OpenStream(addr)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
 }
@@ -0,0 +1,487 @@
+package marionette_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestListener_UDP(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		testListenerUDP(t, "dns_request", &net.Dialer{})
+	})
+
+	t.Run("FTE", func(t *testing.T) {
+		testListenerUDP(t, "udp_test_format", &net.Dialer{})
+	})
+
+	// Ensure lost messages are recovered by restarting the FSM & resending cells.
+	t.Run("Loss", func(t *testing.T) {
+		testListenerUDP(t, "dns_request", &LossyDialer{Drop: 1})
+	})
+}
+
+func TestListener_SessionResume(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d, dialer, states := MustOpenReconnectingDialer(t, 0)
+		defer ln.Close()
+		defer d.Close()
+
+		// Open a stream & wait for it on the server.
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				accepted <- conn
+			}
+		}()
+
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustWriteString(t, conn, "foo")
+
+		var serverConn net.Conn
+		select {
+		case serverConn = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for stream")
+		}
+		defer serverConn.Close()
+		MustReadString(t, serverConn, "foo")
+
+		// Break the underlying connection & wait for the dialer to reconnect.
+		dialer.CloseAll()
+		if state := MustReceiveState(t, states); state != marionette.DialerStateReconnecting {
+			t.Fatalf("unexpected state: %s", state)
+		} else if state := MustReceiveState(t, states); state != marionette.DialerStateConnected {
+			t.Fatalf("unexpected state: %s", state)
+		}
+
+		// Ensure the same streams are used in both directions after reconnecting.
+		MustWriteString(t, conn, "bar")
+		MustReadString(t, serverConn, "bar")
+		MustWriteString(t, serverConn, "baz")
+		MustReadString(t, conn, "baz")
+	})
+
+	// Ensure a detached session is not resumed by a different client.
+	t.Run("NewSession", func(t *testing.T) {
+		ln := MustListenResumable(t)
+		defer ln.Close()
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		d.RetransmitTimeout = marionette.SessionRetransmitTimeout
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+		MustEcho(t, ln, d, []byte("foo"))
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		other := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		other.RetransmitTimeout = marionette.SessionRetransmitTimeout
+		if err := other.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		MustEcho(t, ln, other, []byte("bar"))
+
+		if sessions := ln.Sessions(); len(sessions) != 2 {
+			t.Fatalf("unexpected session count: %d", len(sessions))
+		} else if sessions[0].ID() == sessions[1].ID() {
+			t.Fatal("expected distinct session ids")
+		}
+	})
+
+	// Ensure streams are closed if the client does not reconnect in time.
+	t.Run("Timeout", func(t *testing.T) {
+		ln := MustListenResumable(t)
+		defer ln.Close()
+		ln.SessionTimeout = 100 * time.Millisecond
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		d := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		d.RetransmitTimeout = marionette.SessionRetransmitTimeout
+		d.RetryPolicy = nil
+		if err := d.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		MustWriteString(t, conn, "foo")
+
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverConn.Close()
+		MustReadString(t, serverConn, "foo")
+
+		// Close the client without closing its streams.
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := serverConn.Read(make([]byte, 1))
+			errs <- err
+		}()
+		select {
+		case err := <-errs:
+			if err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for session to expire")
+		}
+	})
+
+	// Ensure sessions over stream transports are not kept without retransmission.
+	t.Run("NoRetransmit", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		if d.RetransmitTimeout != 0 || ln.RetransmitTimeout != 0 {
+			t.Fatalf("unexpected retransmit timeouts: %s, %s", d.RetransmitTimeout, ln.RetransmitTimeout)
+		}
+		MustEcho(t, ln, d, []byte("foo"))
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the server to close the session.
+		for i := 0; len(ln.Sessions()) != 0; i++ {
+			if i == 100 {
+				t.Fatal("timeout waiting for session to close")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
+
+func testListenerUDP(t *testing.T, format string, dialer marionette.NetDialer) {
+	doc := MustParseFormat(t, "server", format)
+	doc.Port = "0"
+
+	ln, err := marionette.Listen(doc, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Echo the first message back from the server.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 11)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		conn.Write(buf)
+	}()
+
+	// Connect client to the listener's port.
+	clientDoc := MustParseFormat(t, "client", format)
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.UDPAddr).Port)
+
+	streamSet := marionette.NewStreamSet()
+	d := marionette.NewDialer(clientDoc, "127.0.0.1", streamSet)
+	d.Dialer = dialer
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := conn.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello world" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+func TestListener_Shutdown(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		go func() { errs <- ln.Shutdown(context.Background()) }()
+
+		// Ensure new streams are no longer accepted.
+		if _, err := ln.Accept(); err != marionette.ErrListenerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Ensure the open stream continues to work until both sides close.
+		MustWriteString(t, serverConn, "bar")
+		MustReadString(t, conn, "bar")
+		MustWriteString(t, conn, "baz")
+		MustReadString(t, serverConn, "baz")
+		conn.Close()
+		serverConn.Close()
+
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			} else if !ln.Closed() {
+				t.Fatal("expected listener to be closed")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for shutdown")
+		}
+	})
+
+	// Ensure existing sessions can reconnect while draining but new sessions
+	// are refused.
+	t.Run("Reconnect", func(t *testing.T) {
+		ln, d, dialer, states := MustOpenReconnectingDialer(t, 0)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		go func() { errs <- ln.Shutdown(context.Background()) }()
+		if _, err := ln.Accept(); err != marionette.ErrListenerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Break the underlying connection & wait for the dialer to reconnect.
+		dialer.CloseAll()
+		if state := MustReceiveState(t, states); state != marionette.DialerStateReconnecting {
+			t.Fatalf("unexpected state: %s", state)
+		} else if state := MustReceiveState(t, states); state != marionette.DialerStateConnected {
+			t.Fatalf("unexpected state: %s", state)
+		}
+		MustWriteString(t, conn, "bar")
+		MustReadString(t, serverConn, "bar")
+
+		// Ensure a client with a new session is disconnected.
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		otherStates := make(chan marionette.DialerState, 10)
+		other := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		other.RetryPolicy = nil
+		other.OnStateChange = func(state marionette.DialerState, err error) { otherStates <- state }
+		if err := other.Open(); err == nil {
+			defer other.Close()
+			for state := MustReceiveState(t, otherStates); state != marionette.DialerStateClosed; state = MustReceiveState(t, otherStates) {
+			}
+		}
+		if sessions := ln.Sessions(); len(sessions) != 1 {
+			t.Fatalf("unexpected session count: %d", len(sessions))
+		}
+
+		conn.Close()
+		serverConn.Close()
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for shutdown")
+		}
+	})
+
+	// Ensure open streams are closed once the context is done.
+	t.Run("Timeout", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := ln.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !ln.Closed() {
+			t.Fatal("expected listener to be closed")
+		} else if _, err := serverConn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+	})
+}
+
+func TestListener_Reload(t *testing.T) {
+	// Ensure new connections use the new settings while open connections
+	// continue with the previous settings.
+	t.Run("OK", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		conn, serverConn := MustOpenStream(t, ln, d)
+		defer conn.Close()
+		defer serverConn.Close()
+
+		doc := MustParseFormat(t, "server", "http_simple_blocking:20150702")
+		doc.Port = "0"
+		config := &marionette.Config{EncryptionKey: []byte("0123456789abcdef"), MACKey: []byte("secret")}
+		if err := ln.Reload(doc, config); err != nil {
+			t.Fatal(err)
+		}
+
+		MustWriteString(t, conn, "bar")
+		MustReadString(t, serverConn, "bar")
+		MustWriteString(t, serverConn, "baz")
+		MustReadString(t, conn, "baz")
+
+		clientDoc := MustParseFormat(t, "client", "http_simple_blocking:20150702")
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		other := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet())
+		other.Config = config
+		if err := other.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		MustEcho(t, ln, other, []byte("hello"))
+	})
+
+	t.Run("ErrPortChanged", func(t *testing.T) {
+		ln, d := MustOpenPool(t, "http_simple_blocking", 1, 1)
+		defer ln.Close()
+		defer d.Close()
+
+		doc := MustParseFormat(t, "server", "http_simple_blocking")
+		if err := ln.Reload(doc, nil); err == nil || err.Error() != `marionette: reloaded document must use tcp port 0` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustParseFormat parses a built-in format for a party. Panic on error.
+func MustParseFormat(tb testing.TB, party, name string) *mar.Document {
+	tb.Helper()
+	data, err := mar.ReadFormat(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return mar.MustParse(party, data)
+}
+
+// LossyDialer dials connections which drop the Nth write.
+type LossyDialer struct {
+	net.Dialer
+	Drop int
+}
+
+func (d *LossyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *LossyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &lossyConn{Conn: conn, drop: d.Drop}, nil
+}
+
+// lossyConn silently drops the Nth write.
+type lossyConn struct {
+	net.Conn
+	mu     sync.Mutex
+	drop   int
+	writeN int
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writeN++
+	drop := c.writeN == c.drop
+	c.mu.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// MustWriteString writes s to w.
+func MustWriteString(tb testing.TB, w io.Writer, s string) {
+	tb.Helper()
+	if _, err := io.WriteString(w, s); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustReadString reads len(s) bytes from r and verifies they match s.
+func MustReadString(tb testing.TB, r io.Reader, s string) {
+	tb.Helper()
+	buf := make([]byte, len(s))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		tb.Fatal(err)
+	} else if string(buf) != s {
+		tb.Fatalf("unexpected read: %q", buf)
+	}
+}
+
+// MustListenResumable opens an http_simple_blocking listener on a random port
+// with retransmission enabled so that clients can resume their sessions.
+func MustListenResumable(tb testing.TB) *marionette.Listener {
+	tb.Helper()
+	ln, err := marionette.ListenContext(context.Background(), "http_simple_blocking", "127.0.0.1:0", marionette.WithRetransmitTimeout(marionette.SessionRetransmitTimeout))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ln.(*marionette.Listener)
+}
+
+// MustOpenStream opens a stream from d and returns it with the stream
+// accepted by ln.
+func MustOpenStream(tb testing.TB, ln *marionette.Listener, d *marionette.Dialer) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	conn, err := d.Dial()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	MustWriteString(tb, conn, "foo")
+
+	serverConn, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	MustReadString(tb, serverConn, "foo")
+	return conn, serverConn
+}
@@ -17,14 +17,19 @@
 // formats/20150701/https_simple_blocking.mar
 // formats/20150701/nmap/kpdyer.com.mar
 // formats/20150701/smb_simple_nonblocking.mar
+// formats/20150701/smtp_session.mar
 // formats/20150701/ssh_simple_nonblocking.mar
 // formats/20150701/ta/amzn_conn.mar
 // formats/20150701/ta/amzn_sess.mar
+// formats/20150701/tls12_simple_blocking.mar
+// formats/20150701/tls_h2_blocking.mar
+// formats/20150701/tls_simple_blocking.mar
 // formats/20150701/udp_test_format.mar
 // formats/20150701/web_conn.mar
 // formats/20150701/web_conn443.mar
 // formats/20150701/web_sess.mar
 // formats/20150701/web_sess443.mar
+// formats/20150701/websocket_session.mar
 // formats/20150702/http_simple_blocking.mar
 // DO NOT EDIT!
 
@@ -153,7 +158,7 @@ func formats20150701Active_probingSsh_openssh_661Mar() (*asset, error) {
 	return a, nil
 }
 
-var _formats20150701Dns_requestMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x5c\x8f\xc1\xca\x02\x31\x0c\x84\xef\x7d\x8a\xd0\xd3\x16\x7e\x96\x5f\x96\x5e\x7c\x86\xc5\x9b\x67\x29\x6d\x90\x05\x4d\x6b\x93\xea\xeb\x8b\xad\x85\xba\x73\x0b\xdf\xcc\x30\xf1\x91\x08\xbd\x6c\x91\xa6\x12\xd2\x1f\xd8\xc5\x2e\xd6\x1c\x15\x00\x8b\xcb\x02\x55\x25\xb1\x64\x74\x77\x00\x38\x9d\xd7\x15\xba\x0e\xf3\xbf\xfa\xa1\x21\xbe\xe8\x7b\x04\xe2\x4b\xc6\x47\x41\x96\x6e\x1c\x28\x52\xe8\x25\xcd\xc8\x29\x12\x63\x35\x2a\x57\xf7\x8c\x0d\x9f\x3d\xfe\xb6\x21\x09\xc8\x75\x66\xa4\x30\xe9\x01\x6b\xb3\x0b\xb5\xb6\xfa\x05\xe6\x27\xe6\x7d\xaa\x71\x6d\xd4\x3b\x00\x00\xff\xff\xde\x8f\x2e\xbf\xff\x00\x00\x00")
+var _formats20150701Dns_requestMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x5c\x8f\x31\x6b\xc3\x30\x14\x84\x77\xfd\x8a\x43\x59\x12\x08\xa6\x6d\xc8\xd2\xb5\x6b\xe8\xe4\x42\xb6\xa2\x48\x47\x6b\x90\x9f\xdc\xf7\xe4\xa6\x3f\xbf\xc4\x8e\x21\xc9\x6d\x8f\x3b\xbe\x77\x17\x8b\x08\x63\xed\x8a\xac\xc7\x34\x6c\xb1\xdf\xed\x77\xfb\xcd\xab\x03\xac\x06\xad\x98\x34\x0e\x56\x95\xa1\x07\xf0\xfe\x71\x38\x60\xd1\x73\xf3\xe4\xee\xdc\x54\xce\x72\x3d\x92\xd8\xa7\xf2\x67\xa4\xd5\x25\x78\xe3\x52\xd2\x02\x99\x83\x36\x14\x31\x4e\x41\xb7\xc2\x1b\x73\x36\x04\x25\x62\x50\xed\x98\xd0\x09\x4e\xc1\xb8\x7b\x41\x0e\x27\x66\xc3\x28\x89\x8a\xfa\x4d\xf8\xda\xf0\x2f\xf4\x43\x66\x13\x4b\xef\x91\x4a\x1f\x3a\x41\x90\xe4\x56\x50\xd6\x51\x65\x06\xb4\xc7\x16\x41\xec\x4c\x85\x32\x16\x4d\xd6\xb8\x30\x6d\xbf\x96\x98\xda\x5e\xb6\xc7\xdc\x51\x2a\xea\x57\x63\x94\xb4\xf6\x37\xb6\xdf\x3e\x3e\xdc\xc2\xb7\xc7\xd6\x6f\xdc\x3d\x6c\x5e\x74\xa1\x19\xf5\x97\xfa\x48\xb3\xa1\x88\xd1\x6f\xdc\xff\x00\xbf\x96\xd9\xac\x83\x01\x00\x00")
 
 func formats20150701Dns_requestMarBytes() ([]byte, error) {
 	return bindataRead(
@@ -168,7 +173,7 @@ func formats20150701Dns_requestMar() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "formats/20150701/dns_request.mar", size: 255, mode: os.FileMode(493), modTime: time.Unix(1518726541, 0)}
+	info := bindataFileInfo{name: "formats/20150701/dns_request.mar", size: 387, mode: os.FileMode(509), modTime: time.Unix(1792359870, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
@@ -433,6 +438,26 @@ func formats20150701Smb_simple_nonblockingMar() (*asset, error) {
 	return a, nil
 }
 
+var _formats20150701Smtp_sessionMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x95\x3d\x6f\xe3\x38\x10\x86\x7b\xfd\x8a\x81\xd3\xc4\x40\x60\xe4\x72\xf9\x00\xae\x0a\x70\xc0\x55\xc1\x15\x8b\xdd\x5a\xa0\xa5\x89\x45\x44\x22\x6d\x92\x4e\x76\xff\xfd\x82\x32\xbf\x66\x64\xda\xeb\x34\x66\xf8\x3c\xe4\x50\xe2\xeb\xe9\xb4\x52\xd8\x39\xa9\xd5\xad\xeb\xf6\x77\xf0\xf0\xf4\xf0\xb4\xfe\xa7\x01\xb0\x4e\x18\x07\xf9\xb3\x33\x88\x4e\xaa\x5d\x1c\xff\xff\xe3\xed\x2d\x7e\x4f\x9f\xbf\x36\xf7\xcd\x12\xc5\x61\xd4\xf1\xbb\xff\xeb\x75\xcb\x91\xa8\x72\xd4\x8f\x5b\xfd\x11\x87\xd0\xeb\x96\x23\xa5\x5a\xa2\x93\x90\x63\xfb\x6e\xf4\x44\xd5\x12\x89\x2a\x47\xd3\x38\xc0\xbd\x6e\x39\xb2\x50\x03\x6a\xba\xbd\x6b\x5d\x2e\xb0\x54\x03\x12\x55\x8e\x86\x71\xa2\x7a\xdd\x72\x84\xa9\x19\x15\x4e\x44\x82\xaa\x09\x89\xea\x02\x15\x4e\x14\x90\x7f\x4c\x1c\x29\xd5\x12\x9d\xd0\x5a\xb1\x43\xae\x96\x48\x54\x39\x7a\x38\xe2\x11\xfb\x38\x9a\x0b\xe6\x48\x54\x39\x9a\x1e\x67\x18\xf7\xba\xe5\x08\xc0\xfd\xe6\xef\x33\xaa\x70\x46\x01\x90\x5d\xcf\xa9\x2f\xcd\x12\xf5\xe3\xf2\x60\xbd\x6e\x39\x12\x0b\xe6\xa8\x61\xb7\x3d\xa8\x25\x12\x55\x8e\x1a\x76\xdb\xfd\x7b\x65\x48\x56\x29\x6a\xd8\x6d\x9f\x55\x8a\x50\x35\xa3\x86\xdd\xf6\xa4\x66\x24\xab\x14\x2d\xc6\x33\x3c\xab\x14\x39\xa3\xce\xa8\x61\xb7\x9d\xaa\x61\xeb\xa8\x52\x34\x8d\x03\x35\xab\x14\x59\xa8\x01\x35\xec\xb6\x97\x6a\x40\xb2\x4a\x51\xc3\x6e\xfb\xac\x52\x84\xaa\x19\x35\xec\xb6\x27\x35\x23\x59\xa5\xa8\x61\xb7\x7d\x56\x29\x92\x55\x8a\x16\x8f\x33\xab\x14\x89\xc9\xe1\xff\x3f\x1c\x65\xd9\x0c\x6a\xea\x4b\xb3\x44\xfd\xb8\x3c\xd6\x1c\x3a\x8a\xc4\x82\x39\x8a\xaa\x87\x45\x5e\x29\x72\x52\x9b\x1b\xf8\x3e\x20\x74\xa3\x44\xe5\xc0\x1e\xb7\x93\x74\x36\xfe\xe8\x58\x70\x1a\xdc\x80\x60\xd1\x7c\xa2\x81\x2f\xe9\x06\xe8\x70\x1c\x2d\x74\xc2\x18\x89\x3d\x48\xd5\xdc\xc0\x56\x58\x7c\x7e\x04\x54\x9d\xee\xb1\x07\xe1\x9c\xe8\x86\x09\x95\xb3\x9b\x46\xcc\x2d\xb2\xec\x5c\x73\x8f\x3c\x2d\xe8\x76\x1b\x8b\xaa\xbf\x5d\xd9\xc9\xed\x13\xb0\xba\x83\x95\x7f\xde\x1b\xfc\x29\xa6\xfd\x88\x1b\x85\x6e\xb5\x6e\x8a\xa5\x7c\xea\xfc\x32\xa1\x6c\xba\x8c\x9f\xf4\x4b\x18\x1c\xc5\xaf\xb4\x86\x36\xbb\xe5\x1a\xad\xfe\xa8\x56\x33\xcf\x1b\xb4\x7b\xad\x2c\x5e\x2f\x29\x5d\x90\x6a\x5d\x89\xf0\x8b\x89\x51\x76\xf8\x5a\x2d\x2e\xb1\x97\x2a\x2c\x21\xaa\x87\x18\x56\x4b\x09\xf3\xbe\x90\xad\xde\xbe\x56\x0f\x15\xb8\x4b\x45\x64\x84\xaa\x3e\xb6\xd5\xfd\xfd\xe4\x12\xbf\xb4\x4d\x98\xa7\x52\xb8\xa6\xd5\x6d\xc2\x3c\x95\x4e\xd9\xab\x6e\x14\x9c\x80\x79\x95\x24\xc4\xe0\xe1\x88\xd6\xd9\xd8\x21\xfd\x3b\x80\x77\x6d\xc0\xc7\xa6\xd7\x93\x90\x0a\x6e\xbf\xfd\xf7\x2f\x3c\x3c\x3f\x3e\xad\xe1\x6b\x90\xdd\x00\x06\x3f\xd1\x58\xb4\xcd\xcd\x9c\x26\xa3\x47\xb4\x60\x49\xb4\x3a\xa1\xa0\xc7\x51\xfa\x93\xf3\xf4\x9d\xb6\x2e\xa3\xe4\x1b\x65\xf5\xd4\x7e\xd2\xbf\xd9\xea\xe5\x0a\x3d\xb4\xfa\x08\xc2\x3c\x95\x72\xf7\xac\x6e\x5c\xe6\xf7\x4a\xf8\x4e\x8d\xb3\x5a\x41\x8c\xf0\xe5\xc8\xa5\xd6\x5a\xad\x68\x91\xe1\xab\x65\xa5\x4c\x5d\x4f\x9d\x2f\xb0\x13\x46\x8f\x17\xf2\x43\x32\x5a\x2d\xb3\x84\xf8\x02\x21\x5f\xd7\xf2\xf7\x07\xbf\x29\x65\x77\xae\x96\x92\x11\x2e\xc7\x40\x9f\xad\x62\x19\xe8\xd4\x95\xab\x5b\x9d\x8d\x74\xea\xc8\xd5\xad\xc2\x3c\xd7\x72\xac\xcf\x6e\xb6\x8c\x75\x96\x7d\xf3\xac\x6e\xe7\x27\x97\xf8\xa5\x73\x1d\x8e\xd2\xb5\xfa\x63\xb5\x6e\x7e\x0f\x00\xae\x71\xad\x17\x23\x0e\x00\x00")
+
+func formats20150701Smtp_sessionMarBytes() ([]byte, error) {
+	return bindataRead(
+		_formats20150701Smtp_sessionMar,
+		"formats/20150701/smtp_session.mar",
+	)
+}
+
+func formats20150701Smtp_sessionMar() (*asset, error) {
+	bytes, err := formats20150701Smtp_sessionMarBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "formats/20150701/smtp_session.mar", size: 3619, mode: os.FileMode(420), modTime: time.Unix(1792359583, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
 var _formats20150701Ssh_simple_nonblockingMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x8f\xb1\x8e\x82\x40\x10\x86\x7b\x9e\x62\x42\xae\x80\x0b\x47\x80\x8a\x5c\x6b\x63\x41\x6c\x88\x1d\x91\xac\xcb\x28\x04\x9c\x25\xbb\xa3\xc6\xb7\x37\x4b\x84\x80\x9a\xe8\x74\x9b\xef\xff\x66\xff\x91\x8a\x08\x25\x37\x8a\x3c\x96\x7d\x00\x69\x94\x26\xfe\xbf\x03\x60\x58\x68\x86\x61\x6a\x41\x95\xa9\x45\x8b\x00\xb0\xd9\x66\x19\x4c\x13\x87\x91\xb3\xe0\xe7\xde\xb0\x46\x71\xb2\xd0\x20\x55\xe5\xbe\x53\xb2\x6d\xe8\xf8\x88\xce\x78\xa5\xae\x34\x3e\xa4\xcd\x3e\x6d\x9d\xf1\xc5\xd6\x97\xa8\x23\x86\xfe\xcb\xff\xec\x09\xb2\x6b\x90\x18\x0e\x8c\xa1\x65\x9e\xbb\xcb\xf3\x75\xf1\x97\x14\x61\x54\xac\x7e\x7f\xdc\x00\xe2\x24\xf5\x27\x7f\x28\xf1\xc6\x2b\x85\xb9\x91\xfc\x64\x9b\xd1\x36\xa8\x2f\xa8\xbf\xb4\xef\x01\x00\x00\xff\xff\xcd\xcb\x59\x56\x7f\x01\x00\x00")
 
 func formats20150701Ssh_simple_nonblockingMarBytes() ([]byte, error) {
@@ -493,6 +518,66 @@ func formats20150701TaAmzn_sessMar() (*asset, error) {
 	return a, nil
 }
 
+var _formats20150701Tls12_simple_blockingMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x84\x92\xcd\x6e\xdb\x30\x10\x84\xef\x7a\x8a\x81\x0d\x34\x09\x10\xb0\x91\x9b\x43\x90\x5b\xd1\xab\xd1\x43\x7f\xce\xc6\x9a\x5c\x9b\x44\x28\x52\x20\xd7\x71\x1f\xbf\x90\xac\xdf\x4a\x6d\x79\xb2\x57\xdf\xee\xcc\x2c\xa9\x63\x08\xac\xc5\xc5\x70\x2f\xba\x7e\xc4\xcb\xf3\xf3\xa7\x87\xd7\x02\xc8\x42\x49\x30\x39\xda\x3b\x0e\x72\xb0\xec\x7d\x6c\x0b\x5f\x7f\xee\xf7\xfd\xc7\xfe\x94\xea\xa9\x58\x41\x33\xa7\x77\x4e\x93\x82\x89\x87\x05\x74\xeb\x5d\xa0\x1d\x77\x72\xc1\x65\xcb\x06\x30\xf1\xb0\x80\x66\xba\x23\xda\x71\x54\xd7\x07\x43\x42\x53\xdd\x11\x9a\xe9\x8e\x68\xc7\xcd\x7a\x17\xd0\x93\x7a\x59\xeb\xe5\x60\xfa\x8d\xa0\xcf\xbb\xd2\xbb\x1b\x3d\x8f\xe5\x7f\x78\x1e\x6b\x8d\xe7\x62\x8b\xcf\xc7\x63\xe2\x77\x47\xc2\x06\x3f\xf6\xdf\x51\xaa\x1d\x2c\x05\x93\x2d\xbd\x31\x12\xe7\x4b\xe5\xc2\x19\x84\xcc\x39\xbb\x18\x70\x4a\xb1\x02\x41\x9c\x7e\x63\x51\xf8\xc2\xde\x67\x50\xe2\x62\x0b\x4d\x29\x39\x36\x70\x01\x62\xb9\xf3\x75\x97\x71\xbb\xb4\x44\xc1\xc4\x0a\x1f\x86\x49\xce\x80\x82\x69\xd1\x9b\xe3\xbb\x8c\xc0\xd7\x62\x3b\x10\x9d\x48\x41\xed\xf3\x9a\xc4\x68\x27\xbe\x0e\xd9\x21\x67\x95\x39\x98\xfb\x8d\xf8\x3c\x63\x36\x8f\xd8\x5c\xaf\x57\xc5\xbf\xa8\xaa\x3d\x2b\x1d\xab\xa6\x64\x45\xea\x8f\xa5\x2a\x9b\xdf\xa5\xda\x6d\x1e\x8a\x89\x46\xb7\xbe\x41\xe3\xf6\x7f\xae\x31\x65\x56\x87\xfc\xf1\x46\xfe\xe3\xb5\xc7\x1a\x23\x5b\x7c\x63\x1d\x93\x81\xe7\x70\x16\xdb\x2e\x17\xda\xc6\xcc\xdd\xf2\x9b\x85\x19\x3e\xd1\xc5\x0b\x8c\xcb\x92\xdc\xf1\xd2\xec\x47\x2d\x33\xf4\xd7\xfd\xb7\x18\x54\xd7\xde\x69\x6a\xba\xdb\xa7\xb2\x9a\x61\x3a\x64\x2d\xc3\xca\x90\xdf\x03\x00\x44\x7b\x16\x7a\x14\x04\x00\x00")
+
+func formats20150701Tls12_simple_blockingMarBytes() ([]byte, error) {
+	return bindataRead(
+		_formats20150701Tls12_simple_blockingMar,
+		"formats/20150701/tls12_simple_blocking.mar",
+	)
+}
+
+func formats20150701Tls12_simple_blockingMar() (*asset, error) {
+	bytes, err := formats20150701Tls12_simple_blockingMarBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "formats/20150701/tls12_simple_blocking.mar", size: 1044, mode: os.FileMode(420), modTime: time.Unix(1792374814, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _formats20150701Tls_h2_blockingMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x84\x91\xc1\xae\x9b\x30\x10\x45\xf7\x7c\xc5\x88\xb7\x79\x91\xa8\x83\x01\x25\x8d\xbf\xa0\x8b\xa8\xaa\x94\x74\x8d\x2c\x3c\x04\xab\xc6\xa6\xb6\x13\xaa\x7e\x7d\x05\x81\x00\x85\xf6\x79\xc7\x70\xee\x9d\x3b\x33\x85\xd1\x1a\x0b\x2f\x8d\x7e\xf7\x45\x13\xc1\xe7\x2c\x4b\x77\x2c\x00\x70\x9e\x5b\x0f\xb3\x57\x28\x89\xda\xe7\x15\x2a\x65\xfa\xc2\xd7\xef\xe7\xf3\xf8\x73\x7c\x94\xc4\xc1\x06\xea\xd0\x3e\xd0\xce\x0a\xc2\xe4\x2b\xe8\xa9\x5d\xa1\x03\x57\x4a\x2d\x5d\x85\x02\x40\x98\x7c\x05\x2d\xfa\x4e\xe8\xc0\xf1\xa6\xc9\x05\xf7\x7c\xde\x77\x82\x16\x7d\x27\x74\xe0\x16\xda\x15\x14\x93\xd3\x96\x16\xb5\x18\x37\x02\xe3\xbc\x1b\x5a\x3a\x65\x9e\xca\xff\xc9\x3c\xd5\xba\xcc\xc1\x1b\x5c\xcf\x17\xa0\x24\x85\x8a\x6b\xe1\x2a\xfe\x03\x41\xe3\xcd\x78\xc9\xbd\xd4\x37\xf8\x72\xbd\x7e\xdb\x27\x24\xe0\xfd\x7d\x67\x3e\xfd\x1d\xd8\xab\x39\xf8\x1b\x71\xa8\xc5\x7b\xe8\x95\x5b\x30\x61\x04\x61\xdb\xb6\x04\x7f\xf1\xba\x51\x48\x0a\x53\x77\xa5\x2a\x89\x2a\xef\x9b\x3d\x25\x34\xdc\x05\x33\xff\x21\xfb\xcb\xff\xf9\xbd\xf4\x9f\x33\x4b\xf5\x5f\x97\xf9\x20\xe0\x88\x75\x81\x4e\x07\x96\x46\x34\x3d\xb2\x3e\xcf\x1b\x5c\xfa\x1e\x0e\x4a\xfe\x30\x16\xca\xbb\x52\x9f\x9c\xfc\x8d\x02\x2c\x16\xc6\x0a\x07\x6d\x25\x15\x0e\xee\x0e\x3a\x6f\x70\x35\x57\x0a\x2c\xfe\xbc\xa3\xf3\x50\x5a\x5e\xa3\x23\xeb\xd9\xc6\x1b\xfc\x6b\x3c\xde\x34\x4a\x16\xbc\x53\xf5\xf7\xeb\xe2\xd1\x2c\x8e\x59\x16\x65\x94\xa6\x8c\x46\xf4\x90\xc5\x94\xa5\x9b\xb3\xcf\xdd\xb7\x66\xdf\x72\x3f\x64\x2c\x89\xfa\x0d\x24\xa7\x23\xa3\xe1\x2e\xf8\x33\x00\x77\xa0\xbf\x2e\xd5\x03\x00\x00")
+
+func formats20150701Tls_h2_blockingMarBytes() ([]byte, error) {
+	return bindataRead(
+		_formats20150701Tls_h2_blockingMar,
+		"formats/20150701/tls_h2_blocking.mar",
+	)
+}
+
+func formats20150701Tls_h2_blockingMar() (*asset, error) {
+	bytes, err := formats20150701Tls_h2_blockingMarBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "formats/20150701/tls_h2_blocking.mar", size: 981, mode: os.FileMode(420), modTime: time.Unix(1792359216, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _formats20150701Tls_simple_blockingMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x84\x92\x41\x6f\xd4\x30\x10\x85\xef\xf9\x15\x4f\xbb\x12\x6a\xa5\x95\xe9\xd2\x1e\xaa\xde\x10\xd7\x55\x85\xa0\x9c\x57\x83\x3d\x5b\x5b\x75\xc6\x91\x3d\x65\xe1\xdf\xa3\xa4\xc9\x26\x21\x01\x7c\x9c\x7c\x6f\xde\x9b\xc9\xd8\x24\xc2\x56\x43\x92\x2b\xb5\xcd\x0e\xf7\x77\x77\xb7\xd7\x0f\x15\x50\x94\xb2\x62\xf2\x6c\x0c\x2c\x7a\xf4\x1c\x63\xea\x0a\x8f\xdf\x0e\x87\xe1\xe3\xf0\xf6\xe6\xa6\x5a\x41\x0b\xe7\x1f\x9c\x27\x05\x97\x8e\x0b\xe8\x4d\xbb\x40\x7b\xee\x14\x24\x14\xcf\x0e\x70\xe9\xb8\x80\x66\xbe\x23\xda\x73\xd4\x34\x47\x47\x4a\x53\xdf\x11\x9a\xf9\x8e\x68\xcf\xcd\xb4\x0b\xe8\xc6\xdc\xaf\x69\x59\xdc\xb0\x11\x0c\xf3\xae\x68\x3f\x8c\x99\xc7\xf2\x3f\x32\x8f\xb5\x36\x73\xb5\xc5\xd3\xe1\x2b\xf6\xe6\x16\x9e\xc4\x15\x4f\x2f\x6c\xf0\x89\x63\x2c\xa0\xcc\xb0\x94\x73\x60\x87\x20\x50\xcf\x78\x5b\x7e\x26\x71\xa9\xde\xa1\x70\x29\x21\x09\x82\xdb\x81\xc4\x55\x5b\xbc\xf0\x2f\x14\xdf\x0a\x4f\x81\xa3\x2b\x06\x4f\x9e\xfb\x34\x10\xaa\x19\xef\xf0\xf1\xf0\xf9\x11\x4d\x4e\x9a\x6c\xea\x5d\x0a\x8b\x0e\x16\x36\x32\x65\x53\x51\x77\x4f\x93\xdc\x9d\xf5\xc3\x65\x58\xe8\xb3\x29\x2c\xee\x6a\xa3\xb1\xcc\x98\xcd\x0e\x9b\xf3\xf9\x6c\xf8\x27\xd5\x4d\x64\x63\x53\xdd\x96\xbc\x6a\xf3\x7e\x6f\xf6\x9b\xeb\x6a\xd2\xbc\x5f\xd4\xa5\x79\x1f\x75\xd6\x7c\xca\xcc\xd5\x7f\x9c\xc1\x7f\xd2\x0d\x58\xdb\x63\x8b\x2f\x6c\x53\x76\x88\x2c\xcf\xea\xfb\x65\xfb\x54\x58\x70\xca\xa9\xee\xb6\xed\xf8\x44\xaf\x51\xe1\x42\xd1\x1c\xbe\xbf\xb6\xb6\x66\x19\x7e\xf8\xa3\x7f\xcb\x4f\x4d\x13\x83\xa5\x56\xd5\x5d\xc3\xea\x0c\xd3\x26\x6b\x33\xac\x34\xf9\x3d\x00\x01\xd5\x50\xf4\xf7\x03\x00\x00")
+
+func formats20150701Tls_simple_blockingMarBytes() ([]byte, error) {
+	return bindataRead(
+		_formats20150701Tls_simple_blockingMar,
+		"formats/20150701/tls_simple_blocking.mar",
+	)
+}
+
+func formats20150701Tls_simple_blockingMar() (*asset, error) {
+	bytes, err := formats20150701Tls_simple_blockingMarBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "formats/20150701/tls_simple_blocking.mar", size: 1015, mode: os.FileMode(420), modTime: time.Unix(1792359216, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
 var _formats20150701Udp_test_formatMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x74\x90\x4f\xab\x82\x40\x14\xc5\xf7\x7e\x8a\x8b\xbc\x85\x3e\x44\xfc\xb3\x91\xb7\x7d\x4c\x21\x98\x81\x5a\xcb\x42\x9c\x5b\x89\x35\x23\xe3\xb5\xbe\x7e\x34\x89\x69\xe0\x59\x9d\x99\x73\xe6\x07\x67\x2a\x29\x04\x56\x54\x4b\x61\xf5\xbc\x75\x20\xf2\x22\xdf\xfe\x33\x00\x3a\x2a\x15\x81\x56\xdf\x76\xa4\xb0\xbc\x01\x40\xba\x4b\x12\x7d\xe7\xbb\x9e\x31\x4b\xb8\x7c\x88\xe1\x70\x21\x6a\x8f\x67\xa4\xa1\x34\x49\x46\x1b\xbc\x4b\xb2\x81\xef\x52\xf0\xb1\xe1\x22\x29\x04\x14\x1c\x06\xcd\x48\x46\xa9\xc7\x8c\x2f\x5f\x53\xaa\x6b\x8d\x82\xe0\x44\xe8\x76\x28\xb8\x65\x1e\x0a\x96\x17\x71\xba\x86\x55\xb6\xdd\xc0\x7f\x12\xb3\xb4\x70\x7f\x7f\x4c\x07\xfc\x20\xb2\xe7\x0c\xd9\xe8\xdf\x40\x75\x47\xb5\x88\xc8\x59\xb6\x67\xd9\x04\xf1\x0c\x00\x00\xff\xff\x51\x76\x22\x59\x57\x01\x00\x00")
 
 func formats20150701Udp_test_formatMarBytes() ([]byte, error) {
@@ -593,6 +678,26 @@ func formats20150701Web_sess443Mar() (*asset, error) {
 	return a, nil
 }
 
+var _formats20150701Websocket_sessionMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x84\x91\x31\x6f\xc2\x30\x10\x85\xf7\xfc\x8a\x53\x58\x40\x42\x26\x0c\x48\x94\x95\xa5\x03\x42\x1d\xe8\x1c\x1d\xf6\x15\x2c\x12\x3b\xf5\x99\xa6\xfd\xf7\x55\x42\x9d\xba\x38\xa2\x37\x25\xbe\x4f\xef\xf4\xde\x93\xd6\x18\x92\x5e\x5b\x33\xf5\xb2\x99\xc3\xba\x58\x17\xb3\x4d\x06\xc0\x1e\x9d\x87\x78\xae\xcd\xc9\xa1\xa2\xd2\xd1\xfb\x95\xb8\xdb\xed\x5f\x77\xbb\xb0\x8d\x66\x29\x8a\x6c\x0c\xff\x7d\xe1\xc6\x1a\x26\x00\x65\xcb\x14\x4b\x05\x02\x2e\x2b\x4d\xc6\x97\x6f\x0e\x6b\xea\xb8\x3b\x81\x80\x05\x81\x14\x67\x72\x1f\xe4\xee\x04\x52\x2c\x08\xa4\x78\xca\x2a\x5b\xa6\x18\x40\x21\x9e\x56\xa3\x0a\x64\x54\x60\xe0\x1f\x85\x62\x95\x65\x13\x78\x3e\x1c\x5e\x16\x4b\xb1\x0c\x79\xc0\x19\x8d\xe2\x33\x5e\x48\xc0\xde\x82\x42\x8f\xa0\x19\x24\x3a\xa7\x49\xc1\xd5\x78\x5d\x81\x3f\xd3\xc0\x4b\x5b\x37\x15\x79\x62\x91\x61\xdf\xf4\x48\xec\x9b\x21\x2e\xf0\x27\xc1\x64\xd4\x34\x6f\xe9\xc8\x56\x5e\xc8\xdf\xc3\xf9\x1c\xf2\xc5\x6d\xd5\x7d\xb6\x6d\x2b\xe8\x13\xbb\x23\x42\xda\x3a\x9f\x65\xa3\x77\x6e\xed\x6c\x86\x50\x1e\x1f\xba\xd1\x9d\xd6\x04\xb6\x54\x55\x0c\xe8\x68\x30\xa9\x0d\x1c\xb5\x41\xf7\x05\x7d\xb2\x2c\x60\xdb\x17\xf3\xf3\xdb\xb3\x35\xf2\x85\x54\xec\x39\x2e\xef\xb1\xe1\x98\xfc\xeb\x27\x6e\xea\xb1\x97\x98\xcc\x67\xd9\xf7\x00\xed\x40\xf8\xe6\x69\x03\x00\x00")
+
+func formats20150701Websocket_sessionMarBytes() ([]byte, error) {
+	return bindataRead(
+		_formats20150701Websocket_sessionMar,
+		"formats/20150701/websocket_session.mar",
+	)
+}
+
+func formats20150701Websocket_sessionMar() (*asset, error) {
+	bytes, err := formats20150701Websocket_sessionMarBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "formats/20150701/websocket_session.mar", size: 873, mode: os.FileMode(420), modTime: time.Unix(1792359373, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
 var _formats20150702Http_simple_blockingMar = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x54\x8f\x31\x4f\xc3\x30\x10\x85\xf7\xfc\x8a\x53\xc5\x90\x94\x26\xb1\x3b\x85\x6e\xa8\x42\x20\x51\x01\x83\x59\xe0\x0a\xb2\x9c\x03\xaa\xc2\xd9\x72\x0e\x10\xfc\x7a\x14\x13\x4a\x72\x92\x07\xfb\xde\xfb\xde\xb3\xf3\xcc\xe4\x64\xe7\x39\x17\x17\x16\xd0\xa8\x46\x17\xab\x0c\xa0\x13\x1b\x05\xd2\xbc\x87\x4e\x22\xd9\x37\x00\xb8\xba\xdd\x6c\xd2\x9b\xae\x54\x36\xd9\xb4\xfe\x93\x87\xcb\x8b\x48\x78\x7c\x26\x19\x44\xa3\x0d\x71\x0b\xc3\x24\x91\xdf\xff\x92\x32\x9b\x2a\x1c\x9c\x7d\x01\xf7\xba\x23\x16\x78\x12\xaa\x3a\xe2\x36\x9f\x3d\x9c\x9f\x19\x04\xac\xf3\x7b\x5b\x7e\x9f\x96\x77\xaa\x3c\xc1\x0a\xeb\xed\xbc\x80\x0b\x63\x6e\x6a\x8d\x95\xc2\x88\xdc\x9f\xa3\xd9\x02\xf4\xb2\x29\xa6\x64\xbf\x4f\x3f\xa3\xf8\x41\x71\x0c\xfe\xb7\xc3\x52\x29\xb8\xbe\xec\x11\x6b\xcf\x42\x2c\xa5\xf9\x0a\xb4\x42\x18\xa5\x6e\x8f\x8b\xbf\x1c\x5c\xcf\x0f\x51\x3f\x01\x00\x00\xff\xff\x94\xb3\xb6\x1b\x4b\x01\x00\x00")
 
 func formats20150702Http_simple_blockingMarBytes() ([]byte, error) {
@@ -682,14 +787,19 @@ var _bindata = map[string]func() (*asset, error){
 	"formats/20150701/https_simple_blocking.mar": formats20150701Https_simple_blockingMar,
 	"formats/20150701/nmap/kpdyer.com.mar": formats20150701NmapKpdyerComMar,
 	"formats/20150701/smb_simple_nonblocking.mar": formats20150701Smb_simple_nonblockingMar,
+	"formats/20150701/smtp_session.mar": formats20150701Smtp_sessionMar,
 	"formats/20150701/ssh_simple_nonblocking.mar": formats20150701Ssh_simple_nonblockingMar,
 	"formats/20150701/ta/amzn_conn.mar": formats20150701TaAmzn_connMar,
 	"formats/20150701/ta/amzn_sess.mar": formats20150701TaAmzn_sessMar,
+	"formats/20150701/tls12_simple_blocking.mar": formats20150701Tls12_simple_blockingMar,
+	"formats/20150701/tls_h2_blocking.mar": formats20150701Tls_h2_blockingMar,
+	"formats/20150701/tls_simple_blocking.mar": formats20150701Tls_simple_blockingMar,
 	"formats/20150701/udp_test_format.mar": formats20150701Udp_test_formatMar,
 	"formats/20150701/web_conn.mar": formats20150701Web_connMar,
 	"formats/20150701/web_conn443.mar": formats20150701Web_conn443Mar,
 	"formats/20150701/web_sess.mar": formats20150701Web_sessMar,
 	"formats/20150701/web_sess443.mar": formats20150701Web_sess443Mar,
+	"formats/20150701/websocket_session.mar": formats20150701Websocket_sessionMar,
 	"formats/20150702/http_simple_blocking.mar": formats20150702Http_simple_blockingMar,
 }
 
@@ -756,16 +866,21 @@ var _bintree = &bintree{nil, map[string]*bintree{
 				"kpdyer.com.mar": &bintree{formats20150701NmapKpdyerComMar, map[string]*bintree{}},
 			}},
 			"smb_simple_nonblocking.mar": &bintree{formats20150701Smb_simple_nonblockingMar, map[string]*bintree{}},
+			"smtp_session.mar": &bintree{formats20150701Smtp_sessionMar, map[string]*bintree{}},
 			"ssh_simple_nonblocking.mar": &bintree{formats20150701Ssh_simple_nonblockingMar, map[string]*bintree{}},
 			"ta": &bintree{nil, map[string]*bintree{
 				"amzn_conn.mar": &bintree{formats20150701TaAmzn_connMar, map[string]*bintree{}},
 				"amzn_sess.mar": &bintree{formats20150701TaAmzn_sessMar, map[string]*bintree{}},
 			}},
+			"tls12_simple_blocking.mar": &bintree{formats20150701Tls12_simple_blockingMar, map[string]*bintree{}},
+			"tls_h2_blocking.mar": &bintree{formats20150701Tls_h2_blockingMar, map[string]*bintree{}},
+			"tls_simple_blocking.mar": &bintree{formats20150701Tls_simple_blockingMar, map[string]*bintree{}},
 			"udp_test_format.mar": &bintree{formats20150701Udp_test_formatMar, map[string]*bintree{}},
 			"web_conn.mar": &bintree{formats20150701Web_connMar, map[string]*bintree{}},
 			"web_conn443.mar": &bintree{formats20150701Web_conn443Mar, map[string]*bintree{}},
 			"web_sess.mar": &bintree{formats20150701Web_sessMar, map[string]*bintree{}},
 			"web_sess443.mar": &bintree{formats20150701Web_sess443Mar, map[string]*bintree{}},
+			"websocket_session.mar": &bintree{formats20150701Websocket_sessionMar, map[string]*bintree{}},
 		}},
 		"20150702": &bintree{nil, map[string]*bintree{
 			"http_simple_blocking.mar": &bintree{formats20150702Http_simple_blockingMar, map[string]*bintree{}},
@@ -63,11 +63,15 @@ func Formats() []string {
 		"https_simple_blocking:20150701",
 		"nmap/kpdyer.com:20150701",
 		"smb_simple_nonblocking:20150701",
+		"smtp_session:20150701",
 		"ssh_simple_nonblocking:20150701",
 		"ta/amzn_sess:20150701",
+		"tls_h2_blocking:20150701",
+		"tls_simple_blocking:20150701",
 		"udp_test_format:20150701",
 		"web_sess443:20150701",
 		"web_sess:20150701",
+		"websocket_session:20150701",
 	}
 }
 
@@ -22,28 +22,65 @@ func init() {
 	Logger, _ = config.Build()
 }
 
-// Logger is the global marionette logger.
+// Logger is the global marionette logger. Used when a Config does not
+// specify a logger.
 var Logger = zap.NewNop()
 
-// Rand returns a new PRNG seeded from the current time.
-// This function can be overridden by the tests to provide a repeatable PRNG.
+// Rand returns a new PRNG seeded from the current time. Used when a Config
+// does not specify a PRNG. This function can be overridden by the tests to
+// provide a repeatable PRNG.
 var Rand = func() *rand.Rand { return rand.New(rand.NewSource(time.Now().UnixNano())) }
 
 // PluginFunc represents a plugin in the MAR language.
 type PluginFunc func(ctx context.Context, fsm FSM, args ...interface{}) error
 
-// FindPlugin returns a plugin function by module & name.
-func FindPlugin(module, method string) PluginFunc {
-	return plugins[pluginKey{module, method}]
+// PluginRegistry represents a set of plugins by module & method.
+type PluginRegistry struct {
+	plugins map[pluginKey]PluginFunc
+}
+
+// NewPluginRegistry returns a new, empty instance of PluginRegistry.
+func NewPluginRegistry() *PluginRegistry {
+	return &PluginRegistry{plugins: make(map[pluginKey]PluginFunc)}
+}
+
+// Find returns a plugin function by module & name.
+func (r *PluginRegistry) Find(module, method string) PluginFunc {
+	return r.plugins[pluginKey{module, method}]
 }
 
-// RegisterPlugin adds a plugin to the plugin registry.
+// Register adds a plugin to the registry.
 // Panic on duplicate registration.
-func RegisterPlugin(module, method string, fn PluginFunc) {
-	if v := FindPlugin(module, method); v != nil {
+func (r *PluginRegistry) Register(module, method string, fn PluginFunc) {
+	if v := r.Find(module, method); v != nil {
 		panic("plugin already registered")
 	}
-	plugins[pluginKey{module, method}] = fn
+	r.plugins[pluginKey{module, method}] = fn
+}
+
+// Clone returns a copy of the registry. Plugins registered with the copy do
+// not affect the original.
+func (r *PluginRegistry) Clone() *PluginRegistry {
+	other := NewPluginRegistry()
+	for k, fn := range r.plugins {
+		other.plugins[k] = fn
+	}
+	return other
+}
+
+// DefaultPluginRegistry is the registry used when a Config does not specify
+// one. Built-in plugins register themselves on import.
+var DefaultPluginRegistry = NewPluginRegistry()
+
+// FindPlugin returns a plugin function by module & name from the default registry.
+func FindPlugin(module, method string) PluginFunc {
+	return DefaultPluginRegistry.Find(module, method)
+}
+
+// RegisterPlugin adds a plugin to the default plugin registry.
+// Panic on duplicate registration.
+func RegisterPlugin(module, method string, fn PluginFunc) {
+	DefaultPluginRegistry.Register(module, method, fn)
 }
 
 type pluginKey struct {
@@ -51,8 +88,6 @@ type pluginKey struct {
 	method string
 }
 
-var plugins = make(map[pluginKey]PluginFunc)
-
 // Cipher represents the interface to the FTE Cipher.
 type Cipher interface {
 	Capacity() int
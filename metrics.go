@@ -0,0 +1,334 @@
+package marionette
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMetrics collects metrics for dialers, listeners & FSMs which do not
+// specify Config.Metrics.
+var DefaultMetrics = NewMetrics()
+
+var (
+	// DurationBuckets are the histogram buckets, in seconds, used for
+	// message encode & decode latency.
+	DurationBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+	// SleepBuckets are the histogram buckets, in seconds, used for
+	// model.sleep() durations.
+	SleepBuckets = []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics collects counters, gauges & histograms about FSMs, plugins,
+// connections & streams. It implements http.Handler to serve them in the
+// Prometheus text exposition format.
+type Metrics struct {
+	// Number of FSM transitions by format & destination state.
+	Transitions *CounterVec
+
+	// Number of plugin invocations & failures by "module.method". Retried
+	// transitions & read timeouts are not counted as failures.
+	PluginCalls  *CounterVec
+	PluginErrors *CounterVec
+
+	// Bytes of covertext & of stream data carried by the covertext, by
+	// direction ("sent" or "received").
+	CovertextBytes *CounterVec
+	PayloadBytes   *CounterVec
+
+	// Number of messages which could not be decrypted & cells received for a
+	// different MAR document.
+	DecryptFailures *Counter
+	UUIDMismatches  *Counter
+
+	// Number of open connections & streams.
+	Connections *Gauge
+	Streams     *Gauge
+
+	// Time spent in model.sleep() and time taken to encode & decode each
+	// message, by plugin.
+	SleepDuration  *HistogramVec
+	EncodeDuration *HistogramVec
+	DecodeDuration *HistogramVec
+}
+
+// NewMetrics returns a new, empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Transitions:     NewCounterVec("marionette_fsm_transitions_total", "Number of FSM state transitions.", "format", "state"),
+		PluginCalls:     NewCounterVec("marionette_plugin_calls_total", "Number of plugin invocations.", "plugin"),
+		PluginErrors:    NewCounterVec("marionette_plugin_errors_total", "Number of plugin invocations which failed.", "plugin"),
+		CovertextBytes:  NewCounterVec("marionette_covertext_bytes_total", "Bytes of covertext sent & received.", "direction"),
+		PayloadBytes:    NewCounterVec("marionette_payload_bytes_total", "Bytes of stream data carried by covertext.", "direction"),
+		DecryptFailures: NewCounter("marionette_decrypt_failures_total", "Number of messages which could not be decrypted."),
+		UUIDMismatches:  NewCounter("marionette_uuid_mismatches_total", "Number of cells received with a different MAR document UUID."),
+		Connections:     NewGauge("marionette_connections_active", "Number of open connections."),
+		Streams:         NewGauge("marionette_streams_active", "Number of open streams."),
+		SleepDuration:   NewHistogramVec("marionette_model_sleep_seconds", "Time spent in model.sleep().", SleepBuckets),
+		EncodeDuration:  NewHistogramVec("marionette_message_encode_seconds", "Time taken to encode a message.", DurationBuckets, "plugin"),
+		DecodeDuration:  NewHistogramVec("marionette_message_decode_seconds", "Time taken to decode a message.", DurationBuckets, "plugin"),
+	}
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.Transitions.write(&buf)
+	m.PluginCalls.write(&buf)
+	m.PluginErrors.write(&buf)
+	m.CovertextBytes.write(&buf)
+	m.PayloadBytes.write(&buf)
+	m.DecryptFailures.write(&buf)
+	m.UUIDMismatches.write(&buf)
+	m.Connections.write(&buf)
+	m.Streams.write(&buf)
+	m.SleepDuration.write(&buf)
+	m.EncodeDuration.write(&buf)
+	m.DecodeDuration.write(&buf)
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	n      uint64
+}
+
+// NewCounterVec returns a new counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+// Add increments the counter for the label values by n.
+func (c *CounterVec) Add(n int, values ...string) {
+	assert(len(values) == len(c.labels))
+
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	s := c.series[key]
+	if s == nil {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.n += uint64(n)
+	c.mu.Unlock()
+}
+
+// Value returns the counter for the label values.
+func (c *CounterVec) Value(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.series[strings.Join(values, "\xff")]; s != nil {
+		return s.n
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, s.values), s.n)
+	}
+}
+
+// Counter is a single counter without labels. Its value is always written,
+// even if zero.
+type Counter struct {
+	name string
+	help string
+	n    uint64
+}
+
+// NewCounter returns a new counter.
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n int) { atomic.AddUint64(&c.n, uint64(n)) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.n) }
+
+func (c *Counter) write(w *bytes.Buffer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// Gauge is a value which can go up & down.
+type Gauge struct {
+	name string
+	help string
+	n    int64
+}
+
+// NewGauge returns a new gauge.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() { atomic.AddInt64(&g.n, 1) }
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() { atomic.AddInt64(&g.n, -1) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.n) }
+
+func (g *Gauge) write(w *bytes.Buffer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	n      uint64
+}
+
+// NewHistogramVec returns a new histogram with the given upper bucket bounds
+// & label names. Buckets must be sorted in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// Observe adds v to the histogram for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	assert(len(values) == len(h.labels))
+
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.n++
+	h.mu.Unlock()
+}
+
+// Count returns the number of observations for the label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.series[strings.Join(values, "\xff")]; s != nil {
+		return s.n
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+
+		var n uint64
+		for i, le := range h.buckets {
+			n += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(append([]string{}, s.values...), formatFloat(le))), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(append([]string{}, s.values...), "+Inf")), s.n)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.n)
+	}
+}
+
+// writeHeader writes the HELP & TYPE lines for a metric.
+func writeHeader(w *bytes.Buffer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// labelEscaper escapes label values for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns a label set such as `{a="x",b="y"}`. Returns a blank
+// string if there are no labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// formatFloat formats v for the text exposition format.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
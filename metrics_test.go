@@ -0,0 +1,139 @@
+package marionette_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		m := marionette.NewMetrics()
+		m.Transitions.Inc("http_simple_blocking", "upstream")
+		m.Transitions.Inc("http_simple_blocking", "upstream")
+		m.PluginCalls.Add(3, "fte.send")
+		m.DecryptFailures.Inc()
+		m.Connections.Inc()
+		m.Connections.Inc()
+		m.Connections.Dec()
+		m.EncodeDuration.Observe(0.0003, "fte")
+		m.EncodeDuration.Observe(2, "fte")
+
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		s := buf.String()
+
+		for _, line := range []string{
+			"# HELP marionette_fsm_transitions_total Number of FSM state transitions.",
+			"# TYPE marionette_fsm_transitions_total counter",
+			`marionette_fsm_transitions_total{format="http_simple_blocking",state="upstream"} 2`,
+			`marionette_plugin_calls_total{plugin="fte.send"} 3`,
+			"marionette_decrypt_failures_total 1",
+			"# TYPE marionette_uuid_mismatches_total counter",
+			"marionette_uuid_mismatches_total 0",
+			"# TYPE marionette_connections_active gauge",
+			"marionette_connections_active 1",
+			"# TYPE marionette_message_encode_seconds histogram",
+			`marionette_message_encode_seconds_bucket{plugin="fte",le="0.0001"} 0`,
+			`marionette_message_encode_seconds_bucket{plugin="fte",le="0.0005"} 1`,
+			`marionette_message_encode_seconds_bucket{plugin="fte",le="1"} 1`,
+			`marionette_message_encode_seconds_bucket{plugin="fte",le="+Inf"} 2`,
+			`marionette_message_encode_seconds_sum{plugin="fte"} 2.0003`,
+			`marionette_message_encode_seconds_count{plugin="fte"} 2`,
+		} {
+			if !strings.Contains(s, line+"\n") {
+				t.Fatalf("missing line %q:\n%s", line, s)
+			}
+		}
+	})
+
+	t.Run("EscapeLabels", func(t *testing.T) {
+		m := marionette.NewMetrics()
+		m.Transitions.Inc("a\"b\\c\nd", "x")
+
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		} else if s := buf.String(); !strings.Contains(s, `{format="a\"b\\c\nd",state="x"} 1`) {
+			t.Fatalf("unexpected output:\n%s", s)
+		}
+	})
+}
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := marionette.NewMetrics()
+	m.Streams.Inc()
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if typ := w.Header().Get("Content-Type"); !strings.HasPrefix(typ, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", typ)
+	} else if body := w.Body.String(); !strings.Contains(body, "marionette_streams_active 1\n") {
+		t.Fatalf("unexpected body:\n%s", body)
+	}
+}
+
+// Ensure connections, streams & plugins record metrics.
+func TestMetrics_Conn(t *testing.T) {
+	m := marionette.NewMetrics()
+
+	ln, err := marionette.ListenContext(context.Background(), "http_simple_blocking", "127.0.0.1:0", marionette.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(conn, conn, 5)
+	}()
+
+	conn, err := marionette.DialContext(context.Background(), "http_simple_blocking", ln.Addr().String(), marionette.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	MustWriteString(t, conn, "hello")
+	MustReadString(t, conn, "hello")
+
+	if n := m.Transitions.Value("http_simple_blocking", "downstream"); n == 0 {
+		t.Fatal("expected transitions")
+	} else if n := m.PluginCalls.Value("fte.send"); n == 0 {
+		t.Fatal("expected plugin calls")
+	} else if n := m.CovertextBytes.Value("sent"); n == 0 {
+		t.Fatal("expected covertext bytes sent")
+	} else if n := m.PayloadBytes.Value("received"); n < 5 {
+		t.Fatalf("unexpected payload bytes received: %d", n)
+	} else if n := m.EncodeDuration.Count("fte"); n == 0 {
+		t.Fatal("expected encode durations")
+	} else if n := m.DecodeDuration.Count("fte"); n == 0 {
+		t.Fatal("expected decode durations")
+	} else if n := m.Connections.Value(); n != 2 {
+		t.Fatalf("unexpected connections: %d", n)
+	} else if n := m.DecryptFailures.Value(); n != 0 {
+		t.Fatalf("unexpected decrypt failures: %d", n)
+	}
+
+	// Ensure the gauges are decremented once the connections close.
+	conn.Close()
+	ln.Close()
+	for i := 0; m.Connections.Value() != 0 || m.Streams.Value() != 0; i++ {
+		if i > 50 {
+			t.Fatalf("unexpected gauges: connections=%d streams=%d", m.Connections.Value(), m.Streams.Value())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -16,23 +16,29 @@ type FSM struct {
 	UUIDFn          func() int
 	InstanceIDFn    func() int
 	SetInstanceIDFn func(int)
+	SessionIDFn     func() marionette.SessionID
 	HostFn          func() string
 	PartyFn         func() string
 	PortFn          func() int
 	StateFn         func() string
 	DeadFn          func() bool
+	ErroredFn       func() bool
 	NextFn          func(ctx context.Context) error
 	ExecuteFn       func(ctx context.Context) error
 	ResetFn         func()
 	ListenFn        func() (int, error)
 	ConnFn          func() *marionette.BufferedConn
 	StreamSetFn     func() *marionette.StreamSet
+	EnqueueFn       func(cell *marionette.Cell) error
+	DequeueFn       func(n int) *marionette.Cell
 	CipherFn        func(regex string, n int) (marionette.Cipher, error)
 	DFAFn           func(regex string, n int) (marionette.DFA, error)
 	SetVarFn        func(key string, value interface{})
 	VarFn           func(key string) interface{}
 	CloneFn         func(doc *mar.Document) marionette.FSM
+	ConfigFn        func() *marionette.Config
 	LoggerFn        func() *zap.Logger
+	MetricsFn       func() *marionette.Metrics
 
 	BufferedConn *marionette.BufferedConn
 }
@@ -45,7 +51,12 @@ func NewFSM(conn net.Conn, streamSet *marionette.StreamSet) FSM {
 	fsm.StateFn = func() string { return "default" }
 	fsm.ConnFn = func() *marionette.BufferedConn { return fsm.BufferedConn }
 	fsm.StreamSetFn = func() *marionette.StreamSet { return streamSet }
+	fsm.EnqueueFn = func(cell *marionette.Cell) error { return streamSet.Enqueue(cell) }
+	fsm.DequeueFn = func(n int) *marionette.Cell { return streamSet.Dequeue(n) }
+	fsm.ConfigFn = func() *marionette.Config { return &marionette.Config{} }
 	fsm.LoggerFn = func() *zap.Logger { return marionette.Logger }
+	metrics := marionette.NewMetrics()
+	fsm.MetricsFn = func() *marionette.Metrics { return metrics }
 	return fsm
 }
 
@@ -57,8 +68,11 @@ func (m *FSM) Host() string         { return m.HostFn() }
 func (m *FSM) Party() string        { return m.PartyFn() }
 func (m *FSM) Port() int            { return m.PortFn() }
 
+func (m *FSM) SessionID() marionette.SessionID { return m.SessionIDFn() }
+
 func (m *FSM) State() string { return m.StateFn() }
 func (m *FSM) Dead() bool    { return m.DeadFn() }
+func (m *FSM) Errored() bool { return m.ErroredFn() }
 
 func (m *FSM) Next(ctx context.Context) error    { return m.NextFn(ctx) }
 func (m *FSM) Execute(ctx context.Context) error { return m.ExecuteFn(ctx) }
@@ -68,6 +82,9 @@ func (m *FSM) Listen() (int, error)             { return m.ListenFn() }
 func (m *FSM) Conn() *marionette.BufferedConn   { return m.ConnFn() }
 func (m *FSM) StreamSet() *marionette.StreamSet { return m.StreamSetFn() }
 
+func (m *FSM) Enqueue(cell *marionette.Cell) error { return m.EnqueueFn(cell) }
+func (m *FSM) Dequeue(n int) *marionette.Cell      { return m.DequeueFn(n) }
+
 func (m *FSM) SetVar(key string, value interface{}) { m.SetVarFn(key, value) }
 func (m *FSM) Var(key string) interface{}           { return m.VarFn(key) }
 
@@ -81,4 +98,7 @@ func (m *FSM) DFA(regex string, msgLen int) (marionette.DFA, error) {
 
 func (m *FSM) Clone(doc *mar.Document) marionette.FSM { return m.CloneFn(doc) }
 
-func (m *FSM) Logger() *zap.Logger { return m.LoggerFn() }
+func (m *FSM) Config() *marionette.Config { return m.ConfigFn() }
+
+func (m *FSM) Logger() *zap.Logger          { return m.LoggerFn() }
+func (m *FSM) Metrics() *marionette.Metrics { return m.MetricsFn() }
@@ -0,0 +1,118 @@
+package marionette
+
+import (
+	"crypto/aes"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/redjack/marionette/mar"
+	"go.uber.org/zap"
+)
+
+// Option configures a connection opened by DialContext() or a listener opened
+// by ListenContext().
+type Option func(*options)
+
+// options represents the settings applied by a set of Options.
+type options struct {
+	config    Config
+	tracePath string
+	dialer    NetDialer
+
+	retransmitTimeout    time.Duration
+	hasRetransmitTimeout bool
+}
+
+// newOptions returns options with opts applied. Unlike the lower-level API,
+// nothing is logged by default.
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		config: Config{
+			Logger:      zap.NewNop(),
+			SleepFactor: 1,
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.config.EncryptionKey != nil {
+		if _, err := aes.NewCipher(o.config.EncryptionKey); err != nil {
+			return nil, fmt.Errorf("marionette: invalid encryption key: %s", err)
+		}
+	}
+	return o, nil
+}
+
+// WithKeys sets the AES key & HMAC key used to encrypt covertext. The
+// encryption key must be 16, 24, or 32 bytes. Clients & servers must use the
+// same keys.
+func WithKeys(encryptionKey, macKey []byte) Option {
+	return func(o *options) {
+		o.config.EncryptionKey, o.config.MACKey = encryptionKey, macKey
+	}
+}
+
+// WithLogger sets the logger used by connections & plugins.
+func WithLogger(logger *zap.Logger) Option {
+	return func(o *options) { o.config.Logger = logger }
+}
+
+// WithTracePath sets the directory where stream traces are written.
+func WithTracePath(path string) Option {
+	return func(o *options) { o.tracePath = path }
+}
+
+// WithSleepFactor sets the multiplier applied to model.sleep() durations.
+func WithSleepFactor(factor float64) Option {
+	return func(o *options) { o.config.SleepFactor = factor }
+}
+
+// WithMetrics sets the metrics recorded by connections & plugins.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) { o.config.Metrics = m }
+}
+
+// WithRetransmitTimeout sets the amount of time before unacknowledged cells
+// are resent. Zero disables retransmission. Defaults to PacketRetransmitTimeout
+// for packet transports and is disabled for stream transports. Clients &
+// servers must use the same value.
+func WithRetransmitTimeout(d time.Duration) Option {
+	return func(o *options) { o.retransmitTimeout, o.hasRetransmitTimeout = d, true }
+}
+
+// WithDialer sets the dialer used to connect to the server. Ignored by
+// ListenContext().
+func WithDialer(dialer NetDialer) Option {
+	return func(o *options) { o.dialer = dialer }
+}
+
+// readDocument reads & parses a built-in format or a MAR file for party.
+func readDocument(party, format string) (*mar.Document, error) {
+	data, err := mar.ReadFormat(format)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("marionette: format not found: %s", format)
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc, err := mar.Parse(party, data)
+	if err != nil {
+		return nil, err
+	}
+	doc.Format = format
+	return doc, nil
+}
+
+// splitDocumentAddr returns the host from addr. If addr includes a port then
+// it replaces the port specified by the document.
+func splitDocumentAddr(doc *mar.Document, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	doc.Port = port
+	return host
+}
@@ -17,9 +17,8 @@ func init() {
 func Bind(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "channel.bind"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -52,7 +52,9 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	// Retrieve data from the connection.
 	conn := fsm.Conn()
 	ciphertext, err := conn.Peek(-1, blocking)
-	if err != nil && err != io.EOF {
+	if err == marionette.ErrReadTimeout {
+		return err
+	} else if err != nil && err != io.EOF {
 		logger().Error("cannot read from connection", zap.Error(err))
 		return err
 	} else if len(ciphertext) == 0 {
@@ -64,6 +66,7 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	if err != nil {
 		return err
 	}
+	t1 := time.Now()
 	plaintext, remainder, err := cipher.Decrypt(ciphertext)
 	logger().Debug("decrypt",
 		zap.Int("plaintext", len(plaintext)),
@@ -72,6 +75,17 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		zap.Error(err),
 	)
 	if err != nil {
+		fsm.Metrics().DecryptFailures.Inc()
+	}
+	if err != nil && conn.Packet() {
+		// Discard messages on packet-based connections which cannot be
+		// decrypted, such as stray or duplicate datagrams.
+		logger().Debug("discarding undecryptable message", zap.Error(err))
+		if _, err := conn.Seek(int64(len(ciphertext)), io.SeekCurrent); err != nil {
+			return err
+		}
+		return marionette.ErrRetryTransition
+	} else if err != nil {
 		logger().Error("cannot decrypt ciphertext", zap.Error(err))
 		return err
 	}
@@ -82,10 +96,12 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		logger().Error("cannot unmarshal cell", zap.Error(err))
 		return err
 	}
+	fsm.Metrics().DecodeDuration.Observe(time.Since(t1).Seconds(), "fte")
 
 	// Validate that the FSM & cell document UUIDs match.
 	if fsm.UUID() != cell.UUID {
 		logger().Error("uuid mismatch", zap.Int("local", fsm.UUID()), zap.Int("remote", cell.UUID))
+		fsm.Metrics().UUIDMismatches.Inc()
 		return marionette.ErrUUIDMismatch
 	}
 
@@ -100,7 +116,7 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	}
 
 	// Write plaintext to a cell decoder pipe.
-	if err := fsm.StreamSet().Enqueue(&cell); err != nil {
+	if err := fsm.Enqueue(&cell); err != nil {
 		logger().Error("cannot enqueue cell", zap.Error(err))
 		return err
 	}
@@ -110,6 +126,8 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		logger().Error("cannot move buffer forward", zap.Error(err))
 		return err
 	}
+	fsm.Metrics().CovertextBytes.Add(len(ciphertext)-len(remainder), "received")
+	fsm.Metrics().PayloadBytes.Add(cell.DataN(), "received")
 
 	logger().Debug("msg received",
 		zap.Int("plaintext", len(cell.Payload)),
@@ -28,10 +28,9 @@ func SendAsync(ctx context.Context, fsm marionette.FSM, args ...interface{}) err
 func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking bool) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "fte.send"),
 		zap.Bool("blocking", blocking),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -58,7 +57,7 @@ func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	// blocking then send an empty cell. If no cell exists and we are not
 	// blocking then return. The FSM will move on to the next step. This
 	// allows non-blocking send/recv to continually check both sides of a conn.
-	cell := fsm.StreamSet().Dequeue(capacity)
+	cell := fsm.Dequeue(capacity)
 	if cell != nil {
 		// nop
 	} else if cell == nil && blocking {
@@ -72,6 +71,7 @@ func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	cell.UUID, cell.InstanceID = fsm.UUID(), fsm.InstanceID()
 
 	// Encode to binary.
+	t1 := time.Now()
 	plaintext, err := cell.MarshalBinary()
 	if err != nil {
 		return err
@@ -82,11 +82,14 @@ func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	if err != nil {
 		return err
 	}
+	fsm.Metrics().EncodeDuration.Observe(time.Since(t1).Seconds(), "fte")
 
 	// Write to outgoing connection.
 	if _, err := fsm.Conn().Write(ciphertext); err != nil {
 		return err
 	}
+	fsm.Metrics().CovertextBytes.Add(len(ciphertext), "sent")
+	fsm.Metrics().PayloadBytes.Add(cell.DataN(), "sent")
 
 	logger.Debug("msg sent",
 		zap.Int("plaintext", len(cell.Payload)),
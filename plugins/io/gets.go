@@ -19,9 +19,8 @@ func init() {
 func Gets(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "io.gets"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -50,6 +49,7 @@ func Gets(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		logger.Error("cannot move buffer forward", zap.Error(err))
 		return err
 	}
+	fsm.Metrics().CovertextBytes.Add(len(buf), "received")
 
 	logger.Debug("msg received", zap.Int("n", len(buf)), zap.Duration("t", time.Since(t0)))
 	return nil
@@ -16,9 +16,8 @@ func init() {
 func Puts(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "io.puts"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -45,6 +44,8 @@ func Puts(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		}
 	}
 
+	fsm.Metrics().CovertextBytes.Add(n, "sent")
+
 	logger.Debug("msg sent", zap.Int("n", n), zap.Duration("t", time.Since(t0)))
 
 	return nil
@@ -3,7 +3,6 @@ package model
 import (
 	"context"
 	"errors"
-	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,16 +16,15 @@ func init() {
 	marionette.RegisterPlugin("model", "sleep", Sleep)
 }
 
-// SleepFactor is the multiplier the sleep value is multipled by.
-// By default the sleep is not adjusted.
+// SleepFactor is the multiplier the sleep value is multipled by when the
+// FSM's config does not specify one. By default the sleep is not adjusted.
 var SleepFactor = 1.0
 
 func Sleep(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "model.sleep"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -49,7 +47,7 @@ func Sleep(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	}
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 
-	sum, coin := float64(0), rand.Float64()
+	sum, coin := float64(0), fsm.Config().NewRand().Float64()
 	var k float64
 	for _, k = range keys {
 		sum += dist[k]
@@ -58,8 +56,16 @@ func Sleep(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		}
 	}
 
-	duration := time.Duration(k * float64(time.Second) * SleepFactor)
+	factor := SleepFactor
+	if v := fsm.Config().SleepFactor; v < 0 {
+		factor = 0
+	} else if v != 0 {
+		factor = v
+	}
+
+	duration := time.Duration(k * float64(time.Second) * factor)
 	time.Sleep(duration)
+	fsm.Metrics().SleepDuration.Observe(duration.Seconds())
 
 	logger.Debug("sleep complete", zap.Duration("duration", duration), zap.Duration("t", time.Since(t0)))
 
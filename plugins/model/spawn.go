@@ -15,9 +15,8 @@ func init() {
 }
 
 func Spawn(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "model.spawn"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
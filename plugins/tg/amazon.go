@@ -96,6 +96,12 @@ func (h *AmazonMsgLensCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (pl
 	return plaintext, err
 }
 
+// Pattern returns the cipher's regex followed by any bytes. Ciphertext which
+// exceeds the DFA's capacity is appended to the covertext unformatted.
+func (h *AmazonMsgLensCipher) Pattern() string { return `(?:` + h.regex + `)(?s:.*)` }
+
+func (h *AmazonMsgLensCipher) Length() int { return 0 }
+
 // This a weighted list of message lengths.
 var amazonMsgLens []int
 
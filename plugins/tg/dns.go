@@ -1,198 +1,488 @@
 package tg
 
 import (
+	crand "crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/rand"
-	"regexp"
 	"strings"
 
 	"github.com/redjack/marionette"
 )
 
-type SetDNSTransactionIDCipher struct{}
+// DNS message constants.
+const (
+	// dnsHeaderLen is the size of the fixed message header.
+	dnsHeaderLen = 12
 
-func NewSetDNSTransactionIDCipher() *SetDNSTransactionIDCipher {
-	return &SetDNSTransactionIDCipher{}
-}
+	// dnsMaxNameLen is the maximum length of a domain name in text form.
+	dnsMaxNameLen = 253
 
-func (c *SetDNSTransactionIDCipher) Key() string {
-	return "DNS_TRANSACTION_ID"
-}
+	// dnsMaxLabelLen is the maximum length of a single label.
+	dnsMaxLabelLen = 63
 
-func (c *SetDNSTransactionIDCipher) Capacity(fsm marionette.FSM) (int, error) {
-	return 0, nil
-}
+	// dnsMaxMessageLen is the largest message sent over UDP. This is the
+	// EDNS buffer size recommended to avoid IP fragmentation.
+	dnsMaxMessageLen = 1232
 
-func (c *SetDNSTransactionIDCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
-	var id string
-	if v := fsm.Var("dns_transaction_id"); v != nil {
-		id = v.(string)
-	} else {
-		id = string([]rune{rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1)})
-		fsm.SetVar("dns_transaction_id", id)
-	}
-	return []byte(id), nil
-}
+	// dnsMaxStringLen is the maximum length of a TXT character string.
+	dnsMaxStringLen = 255
 
-func (c *SetDNSTransactionIDCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
-	fsm.SetVar("dns_transaction_id", string(ciphertext))
-	return nil, nil
-}
+	// dnsDefaultDomain is the domain that queries are made under if the
+	// "dns_domain" variable is not set.
+	dnsDefaultDomain = "example.com"
+)
 
-type SetDNSDomainCipher struct{}
+// DNS header flags.
+const (
+	dnsFlagQR = 1 << 15 // response
+	dnsFlagRD = 1 << 8  // recursion desired
+	dnsFlagRA = 1 << 7  // recursion available
+)
 
-func NewSetDNSDomainCipher() *SetDNSDomainCipher {
-	return &SetDNSDomainCipher{}
-}
+// DNS record types & classes.
+const (
+	dnsTypeNULL = 10
+	dnsTypeTXT  = 16
+	dnsTypeOPT  = 41
 
-func (c *SetDNSDomainCipher) Key() string {
-	return "DNS_DOMAIN"
+	dnsClassIN = 1
+)
+
+// dnsEncoding encodes cells into labels. Lowercase is used because names are
+// case-insensitive and resolvers may alter the case of queries.
+var dnsEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// DNSQueryCipher generates a DNS query with a cell encoded into the labels of
+// the query name. Names are formed under the "dns_domain" variable and the
+// record type is read from the "dns_record_type" variable ("TXT" or "NULL").
+type DNSQueryCipher struct{}
+
+func NewDNSQueryCipher() *DNSQueryCipher {
+	return &DNSQueryCipher{}
 }
 
-func (c *SetDNSDomainCipher) Capacity(fsm marionette.FSM) (int, error) {
-	return 0, nil
+func (c *DNSQueryCipher) Key() string { return "DNS_QUERY" }
+
+func (c *DNSQueryCipher) Capacity(fsm marionette.FSM) (int, error) {
+	// Determine the maximum number of encoded characters that fit before the
+	// domain. Each label requires an additional byte for its separator.
+	avail := dnsMaxNameLen - len(dnsDomain(fsm))
+	n := avail - (avail+dnsMaxLabelLen)/(dnsMaxLabelLen+1)
+	return (n*5)/8 - tlsNonceLen, nil
 }
 
-func (c *SetDNSDomainCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
-	var domain string
-	if v := fsm.Var("dns_domain"); v != nil {
-		domain = v.(string)
-	} else {
-		available := []rune{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9'}
-		tlds := []string{"com", "net", "org"}
+func (c *DNSQueryCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	typ, err := dnsRecordType(fsm)
+	if err != nil {
+		return nil, err
+	}
 
-		buf := make([]rune, rand.Intn(60)+3+1)
-		buf[0] = rune(len(buf) - 1) // name length
-		for i := 1; i < len(buf); i++ {
-			buf[i] = available[rand.Intn(len(available))]
+	sealed, err := tlsSeal(fsm, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split encoded data into labels & append domain.
+	var labels []string
+	for s := dnsEncoding.EncodeToString(sealed); len(s) > 0; {
+		n := dnsMaxLabelLen
+		if n > len(s) {
+			n = len(s)
 		}
-		buf = append(buf, 3) // tld length
-		buf = append(buf, []rune(tlds[rand.Intn(len(tlds))])...)
+		labels, s = append(labels, s[:n]), s[n:]
+	}
+	name := strings.Join(append(labels, dnsDomain(fsm)), ".")
 
-		domain = string(buf)
-		fsm.SetVar("dns_domain", domain)
+	// Generate a new transaction id for every query.
+	var id [2]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		return nil, err
 	}
-	return []byte(domain), nil
-}
+	fsm.SetVar("dns_transaction_id", int(binary.BigEndian.Uint16(id[:])))
 
-func (c *SetDNSDomainCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
-	fsm.SetVar("dns_domain", string(ciphertext))
-	return nil, nil
+	msg := &dnsMessage{
+		ID:          binary.BigEndian.Uint16(id[:]),
+		Flags:       dnsFlagRD,
+		Questions:   []dnsQuestion{{Name: name, Type: typ, Class: dnsClassIN}},
+		Additionals: []dnsRecord{dnsOPTRecord()},
+	}
+	return msg.MarshalBinary()
 }
 
-type SetDNSIPCipher struct{}
+func (c *DNSQueryCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	var msg dnsMessage
+	if err := msg.UnmarshalBinary(ciphertext); err != nil {
+		return nil, err
+	} else if len(msg.Questions) != 1 {
+		return nil, errors.New("dns: invalid question count")
+	}
+	q := msg.Questions[0]
+	if _, ok := dnsRecordTypeNames[q.Type]; !ok {
+		return nil, fmt.Errorf("dns: unsupported question type: %d", q.Type)
+	}
 
-func NewSetDNSIPCipher() *SetDNSIPCipher {
-	return &SetDNSIPCipher{}
+	// Save question so it can be echoed by the response.
+	fsm.SetVar("dns_transaction_id", int(msg.ID))
+	fsm.SetVar("dns_question", q.Name)
+	fsm.SetVar("dns_record_type", dnsRecordTypeNames[q.Type])
+
+	// Strip domain and decode remaining labels.
+	suffix := "." + dnsDomain(fsm)
+	if !strings.HasSuffix(strings.ToLower(q.Name), suffix) {
+		return nil, fmt.Errorf("dns: unexpected domain: %s", q.Name)
+	}
+	s := strings.ToLower(strings.Replace(strings.TrimSuffix(q.Name, suffix), ".", "", -1))
+
+	sealed, err := dnsEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return tlsOpen(fsm, sealed)
 }
 
-func (c *SetDNSIPCipher) Key() string {
-	return "DNS_IP"
+func (c *DNSQueryCipher) Pattern() string { return `[\x00-\xff]+` }
+
+func (c *DNSQueryCipher) Length() int { return 0 }
+
+// Validate returns true if value is a complete DNS query.
+func (c *DNSQueryCipher) Validate(msg, value string) bool {
+	var m dnsMessage
+	return m.UnmarshalBinary([]byte(value)) == nil && m.Flags&dnsFlagQR == 0
 }
 
-func (c *SetDNSIPCipher) Capacity(fsm marionette.FSM) (int, error) {
-	return 0, nil
+// DNSResponseCipher generates a response to the last received query with a
+// cell encoded into the answer record. TXT records carry base64 encoded data
+// and NULL records carry the data directly.
+type DNSResponseCipher struct{}
+
+func NewDNSResponseCipher() *DNSResponseCipher {
+	return &DNSResponseCipher{}
 }
 
-func (c *SetDNSIPCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
-	var ip string
-	if v := fsm.Var("dns_ip"); v != nil {
-		ip = v.(string)
-	} else {
-		ip = string([]rune{rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1)})
-		fsm.SetVar("dns_ip", ip)
+func (c *DNSResponseCipher) Key() string { return "DNS_RESPONSE" }
+
+func (c *DNSResponseCipher) Capacity(fsm marionette.FSM) (int, error) {
+	msg, err := c.message(fsm, nil)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := msg.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	avail := dnsMaxMessageLen - len(buf)
+
+	switch msg.Answers[0].Type {
+	case dnsTypeTXT:
+		// Find the longest base64 string whose character strings fit.
+		n := avail - (avail+dnsMaxStringLen)/(dnsMaxStringLen+1)
+		return (n/4)*3 - tlsNonceLen, nil
+	default:
+		return avail - tlsNonceLen, nil
 	}
-	return []byte(ip), nil
 }
 
-func (c *SetDNSIPCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
-	fsm.SetVar("dns_ip", string(ciphertext))
-	return nil, nil
-}
+func (c *DNSResponseCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	sealed, err := tlsSeal(fsm, plaintext)
+	if err != nil {
+		return nil, err
+	}
 
-func parseDNSRequest(data string) map[string]string {
-	if !strings.Contains(data, "\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00") {
-		return nil
+	msg, err := c.message(fsm, sealed)
+	if err != nil {
+		return nil, err
 	}
+	return msg.MarshalBinary()
+}
 
-	domain := parseDNSDomain(data, false)
-	if domain == "" {
-		return nil
+// message returns a response message to the received question with data
+// encoded into the answer record.
+func (c *DNSResponseCipher) message(fsm marionette.FSM, data []byte) (*dnsMessage, error) {
+	id, _ := fsm.Var("dns_transaction_id").(int)
+	name, _ := fsm.Var("dns_question").(string)
+	if name == "" {
+		return nil, errors.New("dns: question unavailable")
+	}
+	typ, err := dnsRecordType(fsm)
+	if err != nil {
+		return nil, err
 	}
 
-	return map[string]string{
-		"DNS_TRANSACTION_ID": data[:2],
-		"DNS_DOMAIN":         domain,
+	var rdata []byte
+	switch typ {
+	case dnsTypeTXT:
+		s := base64.StdEncoding.EncodeToString(data)
+		for len(s) > dnsMaxStringLen {
+			rdata = append(append(rdata, dnsMaxStringLen), s[:dnsMaxStringLen]...)
+			s = s[dnsMaxStringLen:]
+		}
+		rdata = append(append(rdata, byte(len(s))), s...)
+	default:
+		rdata = data
 	}
+
+	return &dnsMessage{
+		ID:          uint16(id),
+		Flags:       dnsFlagQR | dnsFlagRD | dnsFlagRA,
+		Questions:   []dnsQuestion{{Name: name, Type: typ, Class: dnsClassIN}},
+		Answers:     []dnsRecord{{Name: name, Type: typ, Class: dnsClassIN, TTL: uint32(30 + rand.Intn(270)), Data: rdata}},
+		Additionals: []dnsRecord{dnsOPTRecord()},
+	}, nil
 }
 
-func parseDNSResponse(data string) map[string]string {
-	if !strings.Contains(data, "\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00") {
-		return nil
+func (c *DNSResponseCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	var msg dnsMessage
+	if err := msg.UnmarshalBinary(ciphertext); err != nil {
+		return nil, err
+	} else if len(msg.Answers) != 1 {
+		return nil, errors.New("dns: invalid answer count")
+	} else if id, ok := fsm.Var("dns_transaction_id").(int); ok && uint16(id) != msg.ID {
+		return nil, errors.New("dns: transaction id mismatch")
 	}
-
-	domain := parseDNSDomain(data, true)
-	if domain == "" {
-		return nil
+	answer := msg.Answers[0]
+
+	switch answer.Type {
+	case dnsTypeTXT:
+		var s []byte
+		for data := answer.Data; len(data) > 0; {
+			n := int(data[0])
+			if len(data) < 1+n {
+				return nil, errors.New("dns: invalid txt record")
+			}
+			s, data = append(s, data[1:1+n]...), data[1+n:]
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(s))
+		if err != nil {
+			return nil, err
+		}
+		return tlsOpen(fsm, sealed)
+	case dnsTypeNULL:
+		return tlsOpen(fsm, answer.Data)
+	default:
+		return nil, fmt.Errorf("dns: unexpected answer type: %d", answer.Type)
 	}
+}
+
+func (c *DNSResponseCipher) Pattern() string { return `[\x00-\xff]+` }
+
+func (c *DNSResponseCipher) Length() int { return 0 }
+
+// Validate returns true if value is a complete DNS response.
+func (c *DNSResponseCipher) Validate(msg, value string) bool {
+	var m dnsMessage
+	return m.UnmarshalBinary([]byte(value)) == nil && m.Flags&dnsFlagQR != 0
+}
 
-	ip := parseDNSIP(data)
-	if ip == "" {
-		return nil
+// dnsDomain returns the domain that queries are made under.
+func dnsDomain(fsm marionette.FSM) string {
+	if domain, _ := fsm.Var("dns_domain").(string); domain != "" {
+		return strings.ToLower(strings.TrimSuffix(domain, "."))
 	}
+	return dnsDefaultDomain
+}
 
-	return map[string]string{
-		"DNS_TRANSACTION_ID": data[:2],
-		"DNS_DOMAIN":         domain,
-		"DNS_IP":             ip,
+// dnsRecordType returns the record type used to carry responses.
+func dnsRecordType(fsm marionette.FSM) (uint16, error) {
+	name, _ := fsm.Var("dns_record_type").(string)
+	if name == "" {
+		return dnsTypeTXT, nil
+	}
+	for typ, s := range dnsRecordTypeNames {
+		if strings.EqualFold(s, name) {
+			return typ, nil
+		}
 	}
+	return 0, fmt.Errorf("dns: unsupported record type: %q", name)
+}
+
+var dnsRecordTypeNames = map[uint16]string{
+	dnsTypeNULL: "NULL",
+	dnsTypeTXT:  "TXT",
+}
+
+// dnsOPTRecord returns an EDNS pseudo-record advertising the UDP buffer size.
+func dnsOPTRecord() dnsRecord {
+	return dnsRecord{Type: dnsTypeOPT, Class: dnsMaxMessageLen}
+}
+
+// dnsMessage represents a DNS message on the wire.
+type dnsMessage struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []dnsQuestion
+	Answers     []dnsRecord
+	Authorities []dnsRecord
+	Additionals []dnsRecord
 }
 
-func parseDNSDomain(data string, isResponse bool) string {
-	delim, splitN := "\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00", 2
-	if isResponse {
-		delim, splitN = "\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00", 3
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// MarshalBinary encodes m into wire format. Record names that match the first
+// question's name are compressed into a pointer.
+func (m *dnsMessage) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, dnsHeaderLen, dnsMaxMessageLen)
+	binary.BigEndian.PutUint16(buf[0:], m.ID)
+	binary.BigEndian.PutUint16(buf[2:], m.Flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = appendDNSName(buf, q.Name); err != nil {
+			return nil, err
+		}
+		buf = appendUint16(appendUint16(buf, q.Type), q.Class)
 	}
 
-	a0 := strings.Split(data, delim)
-	if len(a0) != 2 {
-		return ""
+	for _, records := range [][]dnsRecord{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range records {
+			if len(m.Questions) > 0 && r.Name != "" && r.Name == m.Questions[0].Name {
+				buf = appendUint16(buf, 0xc000|dnsHeaderLen)
+			} else if buf, err = appendDNSName(buf, r.Name); err != nil {
+				return nil, err
+			}
+
+			if len(r.Data) > 0xffff {
+				return nil, errors.New("dns: record data too long")
+			}
+			buf = appendUint16(appendUint16(buf, r.Type), r.Class)
+			buf = append(buf, byte(r.TTL>>24), byte(r.TTL>>16), byte(r.TTL>>8), byte(r.TTL))
+			buf = append(appendUint16(buf, uint16(len(r.Data))), r.Data...)
+		}
 	}
+	return buf, nil
+}
 
-	a1 := strings.Split(a0[1], "\x00\x01\x00\x01")
-	if len(a1) != splitN {
-		return ""
+// UnmarshalBinary decodes a message from data. Returns an error if the message
+// is incomplete or if it contains trailing data.
+func (m *dnsMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < dnsHeaderLen {
+		return errors.New("dns: message too short")
+	}
+	m.ID = binary.BigEndian.Uint16(data[0:])
+	m.Flags = binary.BigEndian.Uint16(data[2:])
+	qdcount := int(binary.BigEndian.Uint16(data[4:]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(data[6:])),
+		int(binary.BigEndian.Uint16(data[8:])),
+		int(binary.BigEndian.Uint16(data[10:])),
 	}
 
-	// Check for valid prepended length
-	// Remove trailing tld prepended length (1), tld (3) and trailing null (1) = 5
-	domain := a1[0]
-	if int(domain[0]) != len(domain[1:len(domain)-5]) {
-		return ""
-	} else if domain[len(domain)-5] != 3 {
-		return ""
+	off := dnsHeaderLen
+	m.Questions = nil
+	for i := 0; i < qdcount; i++ {
+		var q dnsQuestion
+		var err error
+		if q.Name, off, err = readDNSName(data, off); err != nil {
+			return err
+		} else if len(data) < off+4 {
+			return errors.New("dns: question too short")
+		}
+		q.Type, q.Class = binary.BigEndian.Uint16(data[off:]), binary.BigEndian.Uint16(data[off+2:])
+		m.Questions, off = append(m.Questions, q), off+4
 	}
 
-	// Check for valid TLD
-	if !strings.HasSuffix(domain, "com\x00") && !strings.HasSuffix(domain, "net\x00") && !strings.HasSuffix(domain, "org\x00") {
-		return ""
+	sections := make([][]dnsRecord, len(counts))
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			var r dnsRecord
+			var err error
+			if r.Name, off, err = readDNSName(data, off); err != nil {
+				return err
+			} else if len(data) < off+10 {
+				return errors.New("dns: record too short")
+			}
+			r.Type, r.Class = binary.BigEndian.Uint16(data[off:]), binary.BigEndian.Uint16(data[off+2:])
+			r.TTL = binary.BigEndian.Uint32(data[off+4:])
+			n := int(binary.BigEndian.Uint16(data[off+8:]))
+			if off += 10; len(data) < off+n {
+				return errors.New("dns: record data too short")
+			}
+			r.Data, off = data[off:off+n], off+n
+			sections[i] = append(sections[i], r)
+		}
 	}
+	m.Answers, m.Authorities, m.Additionals = sections[0], sections[1], sections[2]
 
-	// Check for valid domain characters
-	if !domainRegex.MatchString(domain[1 : len(domain)-5]) {
-		return ""
+	if off != len(data) {
+		return errors.New("dns: trailing data")
 	}
+	return nil
+}
 
-	return domain
+// appendDNSName appends name to buf as a sequence of length-prefixed labels.
+func appendDNSName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > dnsMaxNameLen {
+		return nil, fmt.Errorf("dns: name too long: %d", len(name))
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > dnsMaxLabelLen {
+				return nil, fmt.Errorf("dns: invalid label length: %d", len(label))
+			}
+			buf = append(append(buf, byte(len(label))), label...)
+		}
+	}
+	return append(buf, 0), nil
 }
 
-func parseDNSIP(data string) string {
-	a := strings.Split(data, "\x00\x01\x00\x01\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x02\x00\x04")
-	if len(a) != 2 {
-		return ""
-	} else if len(a[1]) != 4 {
-		return ""
+// readDNSName reads a name from data at off, following compression pointers.
+// Returns the name and the offset after the name.
+func readDNSName(data []byte, off int) (name string, next int, err error) {
+	var labels []string
+	next = -1
+	for hops := 0; ; hops++ {
+		if off >= len(data) {
+			return "", 0, errors.New("dns: name too short")
+		} else if hops > dnsMaxNameLen {
+			return "", 0, errors.New("dns: too many labels")
+		}
+
+		n := int(data[off])
+		switch {
+		case n == 0:
+			if next == -1 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(data) {
+				return "", 0, errors.New("dns: pointer too short")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) &^ 0xc000)
+		case n > dnsMaxLabelLen:
+			return "", 0, errors.New("dns: invalid label length")
+		default:
+			if off+1+n > len(data) {
+				return "", 0, errors.New("dns: label too short")
+			}
+			labels, off = append(labels, string(data[off+1:off+1+n])), off+1+n
+		}
 	}
-	return a[1]
 }
 
-var domainRegex = regexp.MustCompile(`^[\w\d]+$`)
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
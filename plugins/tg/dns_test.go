@@ -1,33 +1,189 @@
 package tg_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
 	"testing"
 
-	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette"
 	"github.com/redjack/marionette/plugins/tg"
 )
 
-func TestParse_DNSRequest(t *testing.T) {
-	t.Run("OK", func(t *testing.T) {
-		m := tg.Parse("dns_request", "AB\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03foo\x03com\x00\x00\x01\x00\x01")
-		if diff := cmp.Diff(m, map[string]string{
-			"DNS_TRANSACTION_ID": "AB",
-			"DNS_DOMAIN":         "\x03foo\x03com\x00",
-		}); diff != "" {
-			t.Fatal(diff)
+func TestDNS(t *testing.T) {
+	for _, typ := range []string{"TXT", "NULL"} {
+		t.Run(typ, func(t *testing.T) {
+			client := NewTLSFSM(nil, NewDNSStreamSet(t, "foo"))
+			query := MustSendTLS(t, client, "dns_request", "t.example.org", typ)
+
+			// Verify query header, name & question type.
+			if flags := binary.BigEndian.Uint16(query[2:]); flags != 0x0100 {
+				t.Fatalf("unexpected flags: %04x", flags)
+			} else if n := binary.BigEndian.Uint16(query[4:]); n != 1 {
+				t.Fatalf("unexpected question count: %d", n)
+			}
+			labels, off := ReadDNSLabels(t, query, 12)
+			if name := strings.Join(labels, "."); len(name) > 253 || len(name) < 245 {
+				t.Fatalf("unexpected name length: %d", len(name))
+			} else if !strings.HasSuffix(name, ".t.example.org") {
+				t.Fatalf("unexpected name: %s", name)
+			}
+			for _, label := range labels {
+				if len(label) > 63 {
+					t.Fatalf("label too long: %d", len(label))
+				}
+			}
+			if qtype := binary.BigEndian.Uint16(query[off:]); (typ == "TXT" && qtype != 16) || (typ == "NULL" && qtype != 10) {
+				t.Fatalf("unexpected question type: %d", qtype)
+			}
+
+			// Receive query on server & respond.
+			var recvStream *marionette.Stream
+			serverStreamSet := NewDNSStreamSet(t, "bar")
+			serverStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+			server := NewTLSFSM(query, serverStreamSet)
+			if err := tg.Recv(context.Background(), &server, "dns_request", "t.example.org", typ); err != nil {
+				t.Fatal(err)
+			}
+			MustReadDNSStream(t, recvStream, "foo")
+
+			resp := MustSendTLS(t, server, "dns_response")
+			if !bytes.Equal(resp[:2], query[:2]) {
+				t.Fatalf("transaction id mismatch: %x != %x", resp[:2], query[:2])
+			} else if flags := binary.BigEndian.Uint16(resp[2:]); flags != 0x8180 {
+				t.Fatalf("unexpected flags: %04x", flags)
+			} else if n := binary.BigEndian.Uint16(resp[6:]); n != 1 {
+				t.Fatalf("unexpected answer count: %d", n)
+			} else if len(resp) > 1232 || len(resp) < 1200 {
+				t.Fatalf("unexpected response length: %d", len(resp))
+			}
+
+			// Receive response on client.
+			recvStream = nil
+			clientStreamSet := client.StreamSet()
+			clientStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+			client.ConnFn = NewTLSFSM(resp, nil).ConnFn
+			if err := tg.Recv(context.Background(), &client, "dns_response"); err != nil {
+				t.Fatal(err)
+			}
+			MustReadDNSStream(t, recvStream, "bar")
+		})
+	}
+
+	// Resolvers may randomize the case of query names.
+	t.Run("MixedCase", func(t *testing.T) {
+		query := MustSendTLS(t, NewTLSFSM(nil, NewDNSStreamSet(t, "foo")), "dns_request")
+		for i := 12; i < len(query); i++ {
+			if query[i] >= 'a' && query[i] <= 'z' && i%2 == 0 {
+				query[i] -= 'a' - 'A'
+			}
+		}
+
+		var recvStream *marionette.Stream
+		streamSet := marionette.NewStreamSet()
+		streamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+		server := NewTLSFSM(query, streamSet)
+		if err := tg.Recv(context.Background(), &server, "dns_request"); err != nil {
+			t.Fatal(err)
+		}
+		MustReadDNSStream(t, recvStream, "foo")
+	})
+
+	t.Run("ErrDomainMismatch", func(t *testing.T) {
+		query := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "dns_request", "t.example.org")
+		server := NewTLSFSM(query, marionette.NewStreamSet())
+		if err := tg.Recv(context.Background(), &server, "dns_request", "t.example.net"); err == nil || !strings.Contains(err.Error(), "unexpected domain") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrTransactionIDMismatch", func(t *testing.T) {
+		server := NewTLSFSM(nil, marionette.NewStreamSet())
+		server.SetVar("dns_transaction_id", 100)
+		server.SetVar("dns_question", "foo.example.com")
+		resp := MustSendTLS(t, server, "dns_response")
+
+		client := NewTLSFSM(resp, marionette.NewStreamSet())
+		client.SetVar("dns_transaction_id", 200)
+		if err := tg.Recv(context.Background(), &client, "dns_response"); err == nil || err.Error() != `dns: transaction id mismatch` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrUnsupportedRecordType", func(t *testing.T) {
+		fsm := NewTLSFSM(nil, marionette.NewStreamSet())
+		if err := tg.Send(context.Background(), &fsm, "dns_request", "example.com", "MX"); err == nil {
+			t.Fatal("expected error")
 		}
 	})
 }
 
-func TestParse_DNSResponse(t *testing.T) {
+func TestParse_DNSRequest(t *testing.T) {
+	query := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "dns_request")
+
 	t.Run("OK", func(t *testing.T) {
-		m := tg.Parse("dns_response", "AB\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x03foo\x03com\x00\x00\x01\x00\x01\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x02\x00\x04\x0A\x0B\x0C\x0D")
-		if diff := cmp.Diff(m, map[string]string{
-			"DNS_TRANSACTION_ID": "AB",
-			"DNS_DOMAIN":         "\x03foo\x03com\x00",
-			"DNS_IP":             "\x0A\x0B\x0C\x0D",
-		}); diff != "" {
-			t.Fatal(diff)
+		if m := tg.Parse("dns_request", string(query)); m == nil {
+			t.Fatal("expected values")
+		} else if m["DNS_QUERY"] != string(query) {
+			t.Fatalf("unexpected query: %x", m["DNS_QUERY"])
+		}
+	})
+
+	t.Run("ErrIncomplete", func(t *testing.T) {
+		if m := tg.Parse("dns_request", string(query[:len(query)-1])); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrTrailingData", func(t *testing.T) {
+		if m := tg.Parse("dns_request", string(query)+"\x00"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
+
+	t.Run("ErrResponse", func(t *testing.T) {
+		if m := tg.Parse("dns_response", string(query)); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+}
+
+// NewDNSStreamSet returns a stream set with data queued on a new stream.
+func NewDNSStreamSet(tb testing.TB, data string) *marionette.StreamSet {
+	tb.Helper()
+	streamSet := marionette.NewStreamSet()
+	if _, err := streamSet.Create().Write([]byte(data)); err != nil {
+		tb.Fatal(err)
+	}
+	return streamSet
+}
+
+// MustReadDNSStream reads from stream and verifies it matches data.
+func MustReadDNSStream(tb testing.TB, stream *marionette.Stream, data string) {
+	tb.Helper()
+	if stream == nil {
+		tb.Fatal("expected stream")
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		tb.Fatal(err)
+	} else if string(buf) != data {
+		tb.Fatalf("unexpected read: %q", buf)
+	}
+}
+
+// ReadDNSLabels returns the uncompressed labels of the name at off and the
+// offset after the name.
+func ReadDNSLabels(tb testing.TB, buf []byte, off int) ([]string, int) {
+	tb.Helper()
+	var labels []string
+	for buf[off] != 0 {
+		n := int(buf[off])
+		labels, off = append(labels, string(buf[off+1:off+1+n])), off+1+n
+	}
+	return labels, off + 1
 }
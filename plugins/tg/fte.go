@@ -29,7 +29,7 @@ func (c *FTECipher) Key() string {
 
 func (c *FTECipher) Capacity(fsm marionette.FSM) (int, error) {
 	if !c.useCapacity && strings.HasSuffix(c.regex, ".+") {
-		return marionette.MaxCellLength, nil
+		return fsm.StreamSet().MaxCellLength, nil
 	}
 	cipher, err := fsm.Cipher(c.regex, c.msgLen)
 	if err != nil {
@@ -54,3 +54,9 @@ func (c *FTECipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []
 	plaintext, _, err = cipher.Decrypt(ciphertext)
 	return plaintext, err
 }
+
+// Pattern returns the cipher's regex followed by any bytes. Ciphertext which
+// exceeds the DFA's capacity is appended to the covertext unformatted.
+func (c *FTECipher) Pattern() string { return `(?:` + c.regex + `)(?s:.*)` }
+
+func (c *FTECipher) Length() int { return 0 }
@@ -2,7 +2,6 @@ package tg
 
 import (
 	"strconv"
-	"strings"
 
 	"github.com/redjack/marionette"
 )
@@ -32,6 +31,10 @@ func (c *SetFTPPasvXCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plai
 	return nil, nil
 }
 
+func (c *SetFTPPasvXCipher) Pattern() string { return `[0-9]{1,3}` }
+
+func (c *SetFTPPasvXCipher) Length() int { return 0 }
+
 type SetFTPPasvYCipher struct{}
 
 func NewSetFTPPasvYCipher() *SetFTPPasvYCipher {
@@ -59,18 +62,6 @@ func (c *SetFTPPasvYCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plai
 	return nil, nil
 }
 
-func parseFTPEnteringPassive(msg string) map[string]string {
-	if !strings.HasPrefix(msg, "227 Entering Passive Mode (") || !strings.HasSuffix(msg, ").\n") {
-		return nil
-	}
+func (c *SetFTPPasvYCipher) Pattern() string { return `[0-9]{1,3}` }
 
-	a := strings.Split(msg, ",")
-	if len(a) < 6 {
-		return nil
-	}
-
-	return map[string]string{
-		"FTP_PASV_PORT_X": a[4],
-		"FTP_PASV_PORT_Y": strings.TrimSuffix(a[5], ").\n"),
-	}
-}
+func (c *SetFTPPasvYCipher) Length() int { return 0 }
@@ -1,6 +1,7 @@
 package tg_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -8,34 +9,44 @@ import (
 )
 
 func TestParse_HTTPRequest(t *testing.T) {
+	url := strings.Repeat("a", 2048)
+
 	t.Run("OK", func(t *testing.T) {
-		t.Run("WithScheme", func(t *testing.T) {
-			m := tg.Parse("http_request", "GET http://127.0.0.1:8080/foo HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n")
-			if diff := cmp.Diff(m, map[string]string{
-				"URL": "foo",
-			}); diff != "" {
-				t.Fatal(diff)
-			}
-		})
+		m := tg.Parse("http_request_keep_alive", "GET http://127.0.0.1:8080/"+url+" HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n")
+		if diff := cmp.Diff(m, map[string]string{
+			"SERVER_LISTEN_IP": "127.0.0.1",
+			"URL":              url,
+		}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
 
-		t.Run("WithoutScheme", func(t *testing.T) {
-			m := tg.Parse("http_request", "GET /foo HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n")
-			if diff := cmp.Diff(m, map[string]string{
-				"URL": "foo",
-			}); diff != "" {
-				t.Fatal(diff)
-			}
-		})
+	t.Run("ErrWithoutScheme", func(t *testing.T) {
+		if m := tg.Parse("http_request_keep_alive", "GET /"+url+" HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
 	})
 
 	t.Run("ErrInvalidMethod", func(t *testing.T) {
-		if m := tg.Parse("http_request", "POST http://127.0.0.1:8080/foo"); m != nil {
+		if m := tg.Parse("http_request_keep_alive", "POST http://127.0.0.1:8080/"+url+" HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n"); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
 
 	t.Run("ErrMissingBody", func(t *testing.T) {
-		if m := tg.Parse("http_request", "GET http://127.0.0.1:8080/foo"); m != nil {
+		if m := tg.Parse("http_request_keep_alive", "GET http://127.0.0.1:8080/"+url); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrURLLength", func(t *testing.T) {
+		if m := tg.Parse("http_request_keep_alive", "GET http://127.0.0.1:8080/foo HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrURLPattern", func(t *testing.T) {
+		if m := tg.Parse("http_request_keep_alive", "GET http://127.0.0.1:8080/"+url[1:]+"/ HTTP/1.1\r\nUser-Agent: marionette 0.1\r\nConnection: keep-alive\r\n\r\n"); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
@@ -43,10 +54,20 @@ func TestParse_HTTPRequest(t *testing.T) {
 
 func TestParse_HTTPResponse(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
-		t.Run("WithBody", func(t *testing.T) {
-			m := tg.Parse("http_response", "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nConnection: keep-alive\r\n\r\nfoo")
+		t.Run("200", func(t *testing.T) {
+			m := tg.Parse("http_response_keep_alive", "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nConnection: keep-alive\r\n\r\nfoo")
+			if diff := cmp.Diff(m, map[string]string{
+				"CONTENT-LENGTH":     "3",
+				"HTTP-RESPONSE-BODY": "foo",
+			}); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+
+		// Ensure alternative templates are matched.
+		t.Run("NotFound", func(t *testing.T) {
+			m := tg.Parse("http_response_keep_alive", "HTTP/1.1 404 Not Found\r\nContent-Length: 3\r\nConnection: keep-alive\r\n\r\nfoo")
 			if diff := cmp.Diff(m, map[string]string{
-				"COOKIE":             "",
 				"CONTENT-LENGTH":     "3",
 				"HTTP-RESPONSE-BODY": "foo",
 			}); diff != "" {
@@ -54,12 +75,12 @@ func TestParse_HTTPResponse(t *testing.T) {
 			}
 		})
 
-		t.Run("WithoutBody", func(t *testing.T) {
-			m := tg.Parse("http_response", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n")
+		// Ensure binary data past the FTE capacity is accepted.
+		t.Run("BinaryBody", func(t *testing.T) {
+			m := tg.Parse("http_response_keep_alive", "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: keep-alive\r\n\r\nfoo\x00\n\xff")
 			if diff := cmp.Diff(m, map[string]string{
-				"COOKIE":             "",
-				"CONTENT-LENGTH":     "0",
-				"HTTP-RESPONSE-BODY": "",
+				"CONTENT-LENGTH":     "6",
+				"HTTP-RESPONSE-BODY": "foo\x00\n\xff",
 			}); diff != "" {
 				t.Fatal(diff)
 			}
@@ -67,13 +88,19 @@ func TestParse_HTTPResponse(t *testing.T) {
 	})
 
 	t.Run("ErrMissingVersion", func(t *testing.T) {
-		if m := tg.Parse("http_response", "XYZ"); m != nil {
+		if m := tg.Parse("http_response_keep_alive", "XYZ"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrMissingBody", func(t *testing.T) {
+		if m := tg.Parse("http_response_keep_alive", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
 
 	t.Run("ErrContentLengthMismatch", func(t *testing.T) {
-		if m := tg.Parse("http_response", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: keep-alive\r\n\r\nfoo"); m != nil {
+		if m := tg.Parse("http_response_keep_alive", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: keep-alive\r\n\r\nfoo"); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
@@ -33,29 +33,6 @@ func (c *POP3ContentLengthCipher) Decrypt(fsm marionette.FSM, ciphertext []byte)
 	return nil, nil
 }
 
-func parsePOP3(data string) map[string]string {
-	a := strings.Split(data, "\n\n")
-	if len(a) < 2 {
-		return nil
-	}
-
-	body := a[1]
-	if !strings.HasSuffix(body, "\n.\n") {
-		return nil
-	}
-	body = strings.TrimSuffix(body, "\n.\n")
-
-	return map[string]string{
-		"POP3-RESPONSE-BODY": body,
-		"CONTENT-LENGTH":     strconv.Itoa(len(body)),
-	}
-}
+func (c *POP3ContentLengthCipher) Pattern() string { return `[0-9]+` }
 
-func parsePOP3Password(data string) map[string]string {
-	if !strings.HasPrefix(data, "PASS ") || !strings.HasSuffix(data, "\n") {
-		return nil
-	}
-	data = strings.TrimPrefix(data, "PASS ")
-	data = strings.TrimSuffix(data, "\n")
-	return map[string]string{"PASSWORD": data}
-}
+func (c *POP3ContentLengthCipher) Length() int { return 0 }
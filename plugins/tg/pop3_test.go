@@ -1,6 +1,7 @@
 package tg_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -9,10 +10,11 @@ import (
 
 func TestParse_POP3(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
-		m := tg.Parse("pop3_message_response", "+OK 3 octets\nReturn-Path: sender@example.com\nReceived: from client.example.com ([192.0.2.1])\nFrom: sender@example.com\nSubject: Test message\nTo: recipient@example.com\n\nfoo\n.\n")
+		body := strings.Repeat("a", 2048)
+		m := tg.Parse("pop3_message_response", "+OK 2048 octets\nReturn-Path: sender@example.com\nReceived: from client.example.com ([192.0.2.1])\nFrom: sender@example.com\nSubject: Test message\nTo: recipient@example.com\n\n"+body+"\n.\n")
 		if diff := cmp.Diff(m, map[string]string{
-			"POP3-RESPONSE-BODY": "foo",
-			"CONTENT-LENGTH":     "3",
+			"POP3-RESPONSE-BODY": body,
+			"CONTENT-LENGTH":     "2048",
 		}); diff != "" {
 			t.Fatal(diff)
 		}
@@ -32,23 +34,25 @@ func TestParse_POP3(t *testing.T) {
 }
 
 func TestParse_POP3Password(t *testing.T) {
+	password := strings.Repeat("a", 256)
+
 	t.Run("OK", func(t *testing.T) {
-		m := tg.Parse("pop3_password", "PASS foo\n")
+		m := tg.Parse("pop3_password", "PASS "+password+"\n")
 		if diff := cmp.Diff(m, map[string]string{
-			"PASSWORD": "foo",
+			"PASSWORD": password,
 		}); diff != "" {
 			t.Fatal(diff)
 		}
 	})
 
 	t.Run("ErrMissingPrefix", func(t *testing.T) {
-		if m := tg.Parse("pop3_password", "foo\n"); m != nil {
+		if m := tg.Parse("pop3_password", password+"\n"); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
 
 	t.Run("ErrMissingSuffix", func(t *testing.T) {
-		if m := tg.Parse("pop3_password", "PASS foo"); m != nil {
+		if m := tg.Parse("pop3_password", "PASS "+password); m != nil {
 			t.Fatalf("unexpected values: %#v", m)
 		}
 	})
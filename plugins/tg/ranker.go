@@ -71,3 +71,8 @@ func (c *RankerCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext
 	}
 	return plaintext, nil
 }
+
+func (c *RankerCipher) Pattern() string { return c.regex }
+
+// Length returns the fixed length of the unranked output.
+func (c *RankerCipher) Length() int { return c.msgLen }
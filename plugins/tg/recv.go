@@ -17,9 +17,8 @@ func init() {
 func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "tg.recv"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -38,9 +37,19 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		return errors.New("tg.recv: grammar not found")
 	}
 
+	// Assign variables from additional arguments.
+	grammar.SetArgs(fsm, args[1:])
+
+	// Switch to the grammar variant selected by the arguments, if any.
+	grammar, err := grammar.Variant(fsm)
+	if err != nil {
+		logger.Error("cannot select grammar variant", zap.Error(err))
+		return err
+	}
+
 	// Retrieve data from the connection.
 	ciphertext, err := fsm.Conn().Peek(-1, true)
-	if err == io.EOF {
+	if err == io.EOF || err == marionette.ErrReadTimeout {
 		return err
 	} else if err != nil {
 		logger.Error("cannot read from connection", zap.Error(err))
@@ -49,17 +58,27 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	ciphertextN := len(ciphertext)
 
 	// Verify incoming data can be parsed by the grammar.
-	m := Parse(grammar.Name, string(ciphertext))
+	m := grammar.Parse(string(ciphertext))
 	if m == nil {
 		logger.Debug("tg.recv: cannot parse buffer", zap.String("grammar", grammar.Name))
+
+		// Messages on packet-based connections cannot be completed by later
+		// reads so discard the message and wait for the next one.
+		if fsm.Conn().Packet() {
+			if _, err := fsm.Conn().Seek(int64(ciphertextN), io.SeekCurrent); err != nil {
+				return err
+			}
+		}
 		return marionette.ErrRetryTransition
 	}
 
 	// Execute each cipher against the data.
+	t1 := time.Now()
 	var data []byte
 	for _, cipher := range grammar.Ciphers {
 		if buf, err := cipher.Decrypt(fsm, []byte(m[cipher.Key()])); err != nil {
 			logger.Error("cannot decrypt", zap.String("key", cipher.Key()), zap.Error(err))
+			fsm.Metrics().DecryptFailures.Inc()
 			return err
 		} else if len(buf) != 0 {
 			data = append(data, buf...)
@@ -67,7 +86,7 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	}
 
 	// If any handlers matched and returned data then decode data as a cell.
-	var plaintextN int
+	var plaintextN, dataN int
 	if len(data) > 0 {
 		var cell marionette.Cell
 		if err := cell.UnmarshalBinary(data); err != nil {
@@ -75,9 +94,10 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 			return err
 		} else if cell.UUID != fsm.UUID() {
 			logger.Error("uuid mismatch", zap.Int("local", fsm.UUID()), zap.Int("remote", cell.UUID))
+			fsm.Metrics().UUIDMismatches.Inc()
 			return marionette.ErrUUIDMismatch
 		}
-		plaintextN = len(cell.Payload)
+		plaintextN, dataN = len(cell.Payload), cell.DataN()
 
 		if fsm.InstanceID() == 0 {
 			if cell.InstanceID == 0 {
@@ -87,17 +107,21 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 			fsm.SetInstanceID(cell.InstanceID)
 		}
 
-		if err := fsm.StreamSet().Enqueue(&cell); err != nil {
+		if err := fsm.Enqueue(&cell); err != nil {
 			logger.Error("cannot enqueue cell", zap.Error(err))
 			return err
 		}
 	}
 
+	fsm.Metrics().DecodeDuration.Observe(time.Since(t1).Seconds(), "tg")
+
 	// Clear FSM's read buffer on success.
 	if _, err := fsm.Conn().Seek(int64(len(ciphertext)), io.SeekCurrent); err != nil {
 		logger.Error("cannot move buffer forward", zap.Error(err))
 		return err
 	}
+	fsm.Metrics().CovertextBytes.Add(ciphertextN, "received")
+	fsm.Metrics().PayloadBytes.Add(dataN, "received")
 
 	logger.Debug("msg received",
 		zap.String("grammar", name),
@@ -19,9 +19,8 @@ func init() {
 func Send(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	t0 := time.Now()
 
-	logger := marionette.Logger.With(
+	logger := fsm.Logger().With(
 		zap.String("plugin", "tg.send"),
-		zap.String("party", fsm.Party()),
 		zap.String("state", fsm.State()),
 	)
 
@@ -41,34 +40,53 @@ func Send(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		return errors.New("grammar not found")
 	}
 
+	// Assign variables from additional arguments.
+	grammar.SetArgs(fsm, args[1:])
+
+	// Switch to the grammar variant selected by the arguments, if any.
+	grammar, err := grammar.Variant(fsm)
+	if err != nil {
+		logger.Error("cannot select grammar variant", zap.Error(err))
+		return err
+	}
+
 	// Randomly choose template and replace embedded placeholders.
 	ciphertext := grammar.Templates[rand.Intn(len(grammar.Templates))]
 	ciphertext = strings.Replace(ciphertext, "%%SERVER_LISTEN_IP%%", fsm.Host(), -1)
+	t1 := time.Now()
+	var payloadN int
 	for _, cipher := range grammar.Ciphers {
+		var n int
 		var err error
-		if ciphertext, err = encryptTo(fsm, cipher, ciphertext, logger); err != nil {
+		if ciphertext, n, err = encryptTo(fsm, cipher, ciphertext, logger); err != nil {
 			logger.Error("cannot encrypt", zap.String("key", cipher.Key()), zap.Error(err))
 			return fmt.Errorf("cannot encrypt: %q", err)
 		}
+		payloadN += n
 	}
+	fsm.Metrics().EncodeDuration.Observe(time.Since(t1).Seconds(), "tg")
 
 	// Write to outgoing connection.
 	if _, err := fsm.Conn().Write([]byte(ciphertext)); err != nil {
 		logger.Error("cannot write to connection", zap.Error(err))
 		return err
 	}
+	fsm.Metrics().CovertextBytes.Add(len(ciphertext), "sent")
+	fsm.Metrics().PayloadBytes.Add(payloadN, "sent")
 
 	logger.Debug("msg sent", zap.String("grammar", name), zap.Int("ciphertext", len(ciphertext)), zap.Duration("t", time.Since(t0)))
 	return nil
 }
 
-func encryptTo(fsm marionette.FSM, cipher TemplateCipher, template string, logger *zap.Logger) (_ string, err error) {
+// encryptTo encodes a cell into template using cipher. Returns the template
+// and the number of stream data bytes encoded.
+func encryptTo(fsm marionette.FSM, cipher TemplateCipher, template string, logger *zap.Logger) (_ string, payloadN int, err error) {
 	// Encode data from streams if there is capacity in the handler.
 	var data []byte
 	if capacity, err := cipher.Capacity(fsm); err != nil {
-		return "", err
+		return "", 0, err
 	} else if capacity > 0 {
-		cell := fsm.StreamSet().Dequeue(capacity)
+		cell := fsm.Dequeue(capacity)
 		if cell == nil {
 			cell = marionette.NewCell(0, 0, capacity, marionette.CellTypeNormal)
 		}
@@ -76,13 +94,14 @@ func encryptTo(fsm marionette.FSM, cipher TemplateCipher, template string, logge
 		// Assign ids and marshal to bytes.
 		cell.UUID, cell.InstanceID = fsm.UUID(), fsm.InstanceID()
 		if data, err = cell.MarshalBinary(); err != nil {
-			return "", err
+			return "", 0, err
 		}
+		payloadN = cell.DataN()
 	}
 
 	value, err := cipher.Encrypt(fsm, template, data)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	return strings.Replace(template, "%%"+cipher.Key()+"%%", string(value), -1), nil
+	return strings.Replace(template, "%%"+cipher.Key()+"%%", string(value), -1), payloadN, nil
 }
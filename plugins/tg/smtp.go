@@ -0,0 +1,213 @@
+package tg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+// SMTP message constants.
+const (
+	// smtpLineLen is the maximum length of a line of base64 encoded data.
+	smtpLineLen = 76
+
+	// smtpMaxAttachmentLen is the largest attachment payload sent by the cipher.
+	smtpMaxAttachmentLen = 16384
+
+	// Patterns for domains & mailbox addresses used in commands and headers.
+	smtpDomainPattern  = `[A-Za-z0-9.\-]+`
+	smtpMailboxPattern = `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+`
+)
+
+// SMTPVariableCipher writes the value of a variable, such as a domain or
+// mailbox address. The variable name is the lowercase form of the key and
+// defaults to value if unset.
+type SMTPVariableCipher struct {
+	key     string
+	value   string
+	pattern string
+}
+
+// NewSMTPVariableCipher returns a new instance of SMTPVariableCipher which
+// matches values against pattern.
+func NewSMTPVariableCipher(key, value, pattern string) *SMTPVariableCipher {
+	return &SMTPVariableCipher{key: key, value: value, pattern: pattern}
+}
+
+func (c *SMTPVariableCipher) Key() string { return c.key }
+
+func (c *SMTPVariableCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *SMTPVariableCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	if v, _ := fsm.Var(strings.ToLower(c.key)).(string); v != "" {
+		return []byte(v), nil
+	}
+	return []byte(c.value), nil
+}
+
+func (c *SMTPVariableCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *SMTPVariableCipher) Pattern() string { return c.pattern }
+
+func (c *SMTPVariableCipher) Length() int { return 0 }
+
+// SMTPHeaderCipher writes a randomly generated header value, such as the
+// subject or message id. Values carry no data and are ignored by the receiver.
+type SMTPHeaderCipher struct {
+	key     string
+	pattern string
+	fn      func(fsm marionette.FSM) string
+}
+
+// NewSMTPHeaderCipher returns a new instance of SMTPHeaderCipher which
+// generates values using fn and matches values against pattern.
+func NewSMTPHeaderCipher(key, pattern string, fn func(fsm marionette.FSM) string) *SMTPHeaderCipher {
+	return &SMTPHeaderCipher{key: key, pattern: pattern, fn: fn}
+}
+
+func (c *SMTPHeaderCipher) Key() string { return c.key }
+
+func (c *SMTPHeaderCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *SMTPHeaderCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	return []byte(c.fn(fsm)), nil
+}
+
+func (c *SMTPHeaderCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *SMTPHeaderCipher) Pattern() string { return c.pattern }
+
+func (c *SMTPHeaderCipher) Length() int { return 0 }
+
+// SMTPAttachmentCipher embeds a cell into the base64 encoded body of a MIME
+// attachment. Encoded lines are wrapped at 76 characters.
+//
+// Attachment lengths are chosen from a weighted distribution which can be
+// overridden by the "smtp_attachment_lengths" variable. The variable is
+// formatted as a comma-delimited list of "LENGTH:WEIGHT" pairs.
+type SMTPAttachmentCipher struct {
+	lengths []int
+}
+
+// NewSMTPAttachmentCipher returns a new instance of SMTPAttachmentCipher which
+// chooses attachment lengths from lengths, if the variable is not set.
+func NewSMTPAttachmentCipher(lengths []int) *SMTPAttachmentCipher {
+	return &SMTPAttachmentCipher{lengths: lengths}
+}
+
+func (c *SMTPAttachmentCipher) Key() string { return "SMTP_ATTACHMENT" }
+
+func (c *SMTPAttachmentCipher) Capacity(fsm marionette.FSM) (int, error) {
+	lengths := c.lengths
+	if s, _ := fsm.Var("smtp_attachment_lengths").(string); s != "" {
+		var err error
+		if lengths, err = ParseSMTPAttachmentLengths(s); err != nil {
+			return 0, err
+		}
+	}
+	return lengths[rand.Intn(len(lengths))] - tlsNonceLen, nil
+}
+
+func (c *SMTPAttachmentCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	sealed, err := tlsSeal(fsm, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	s := base64.StdEncoding.EncodeToString(sealed)
+	for len(s) > smtpLineLen {
+		ciphertext = append(ciphertext, s[:smtpLineLen]+"\r\n"...)
+		s = s[smtpLineLen:]
+	}
+	return append(ciphertext, s...), nil
+}
+
+func (c *SMTPAttachmentCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.Replace(string(ciphertext), "\r\n", "", -1))
+	if err != nil {
+		return nil, err
+	}
+	return tlsOpen(fsm, sealed)
+}
+
+func (c *SMTPAttachmentCipher) Pattern() string { return `[A-Za-z0-9+/=\r\n]+` }
+
+func (c *SMTPAttachmentCipher) Length() int { return 0 }
+
+// ParseSMTPAttachmentLengths parses a comma-delimited list of "LENGTH:WEIGHT"
+// pairs into a weighted list of attachment lengths. The weight may be omitted.
+func ParseSMTPAttachmentLengths(s string) ([]int, error) {
+	return parseWeightedLengths(s, "smtp", "attachment", tlsNonceLen+marionette.CellHeaderSize+1, smtpMaxAttachmentLen)
+}
+
+// smtpAttachmentLengths is the default weighted list of attachment lengths.
+var smtpAttachmentLengths, _ = ParseSMTPAttachmentLengths("512:1,1024:2,2048:2,4096:3,8192:3,12288:2,16384:2")
+
+var smtpSubjects = []string{
+	"Invoice %d",
+	"Re: Quarterly report",
+	"Fwd: Photos from the weekend",
+	"Meeting notes %d",
+	"Re: Contract draft",
+	"Scanned document %d",
+	"Updated schedule",
+	"Fwd: Receipt #%d",
+}
+
+var smtpFilenames = []string{
+	"IMG_%04d.jpg",
+	"scan_%d.pdf",
+	"report-%d.zip",
+	"invoice_%d.pdf",
+	"notes-%d.docx",
+}
+
+// smtpSubject returns a randomly chosen subject line.
+func smtpSubject(fsm marionette.FSM) string {
+	s := smtpSubjects[rand.Intn(len(smtpSubjects))]
+	if strings.Contains(s, "%d") {
+		return fmt.Sprintf(s, 1000+rand.Intn(9000))
+	}
+	return s
+}
+
+// smtpDate returns the current time in RFC 5322 format.
+func smtpDate(fsm marionette.FSM) string {
+	return time.Now().Format(time.RFC1123Z)
+}
+
+// smtpMessageID returns a unique message id for the sender's domain.
+func smtpMessageID(fsm marionette.FSM) string {
+	domain := "example.com"
+	if sender, _ := fsm.Var("smtp_sender").(string); strings.Contains(sender, "@") {
+		domain = sender[strings.LastIndex(sender, "@")+1:]
+	}
+	return fmt.Sprintf("%d.%d.%x@%s", time.Now().UnixNano()/int64(time.Millisecond), rand.Intn(1000000), rand.Uint32(), domain)
+}
+
+// smtpBoundary returns a random MIME boundary.
+func smtpBoundary(fsm marionette.FSM) string {
+	return fmt.Sprintf("----=_Part_%d_%d.%d", rand.Intn(100000), rand.Int31(), time.Now().Unix())
+}
+
+// smtpFilename returns a randomly chosen attachment filename.
+func smtpFilename(fsm marionette.FSM) string {
+	return fmt.Sprintf(smtpFilenames[rand.Intn(len(smtpFilenames))], rand.Intn(10000))
+}
+
+// smtpQueueID returns a random Postfix-style queue id.
+func smtpQueueID(fsm marionette.FSM) string {
+	return fmt.Sprintf("%X", rand.Uint64()>>20)
+}
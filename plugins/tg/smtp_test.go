@@ -0,0 +1,152 @@
+package tg_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+func TestSMTP_Message(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		streamSet := marionette.NewStreamSet()
+		stream := streamSet.Create()
+		if _, err := stream.Write([]byte(`foo`)); err != nil {
+			t.Fatal(err)
+		}
+
+		fsm := NewTLSFSM(nil, streamSet)
+		fsm.SetVar("smtp_sender", "alice@example.org")
+		fsm.SetVar("smtp_recipient", "bob@example.net")
+		buf := MustSendTLS(t, fsm, "smtp_message", "1024")
+		if !bytes.HasSuffix(buf, []byte("\r\n.\r\n")) {
+			t.Fatalf("expected end of data marker: %q", buf[len(buf)-16:])
+		}
+
+		// Parse headers with the standard library.
+		msg, err := mail.ReadMessage(bytes.NewReader(bytes.TrimSuffix(buf, []byte(".\r\n"))))
+		if err != nil {
+			t.Fatal(err)
+		} else if v := msg.Header.Get("From"); v != "<alice@example.org>" {
+			t.Fatalf("unexpected from: %s", v)
+		} else if v := msg.Header.Get("To"); v != "<bob@example.net>" {
+			t.Fatalf("unexpected to: %s", v)
+		} else if v := msg.Header.Get("Subject"); v == "" {
+			t.Fatal("expected subject")
+		} else if _, err := msg.Header.Date(); err != nil {
+			t.Fatal(err)
+		} else if v := msg.Header.Get("Message-ID"); !strings.HasSuffix(v, "@example.org>") {
+			t.Fatalf("unexpected message id: %s", v)
+		}
+
+		// Parse attachment from multipart body.
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		} else if mediaType != "multipart/mixed" {
+			t.Fatalf("unexpected media type: %s", mediaType)
+		}
+
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		if _, err := mr.NextPart(); err != nil {
+			t.Fatal(err)
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		} else if part.FileName() == "" {
+			t.Fatal("expected attachment filename")
+		}
+		encoded, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(encoded), "\r\n") {
+			if len(line) > 76 {
+				t.Fatalf("line too long: %d", len(line))
+			}
+		}
+		if data, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1)); err != nil {
+			t.Fatal(err)
+		} else if len(data) != 1024 {
+			t.Fatalf("unexpected attachment length: %d", len(data))
+		}
+
+		// Receive the message on the other side and read the cell.
+		var recvStream *marionette.Stream
+		recvStreamSet := marionette.NewStreamSet()
+		recvStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+		other := NewTLSFSM(buf, recvStreamSet)
+		if err := tg.Recv(context.Background(), &other, "smtp_message", "1024"); err != nil {
+			t.Fatal(err)
+		} else if recvStream == nil {
+			t.Fatal("expected stream")
+		}
+
+		data := make([]byte, 3)
+		if _, err := io.ReadFull(recvStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `foo` {
+			t.Fatalf("unexpected read: %q", data)
+		}
+	})
+
+	// Ensure a message is not parsed until the end of data marker is received.
+	t.Run("ErrIncomplete", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "smtp_message")
+		if m := tg.Parse("smtp_message", string(buf[:len(buf)-3])); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+}
+
+func TestSMTP_Commands(t *testing.T) {
+	for _, tt := range []struct {
+		args []interface{}
+		want string
+	}{
+		{args: []interface{}{"smtp_greeting", "mx.example.net"}, want: "220 mx.example.net ESMTP Postfix\r\n"},
+		{args: []interface{}{"smtp_ehlo"}, want: "EHLO localhost\r\n"},
+		{args: []interface{}{"smtp_mail_from", "alice@example.org"}, want: "MAIL FROM:<alice@example.org>\r\n"},
+		{args: []interface{}{"smtp_rcpt_to", "bob@example.net"}, want: "RCPT TO:<bob@example.net>\r\n"},
+		{args: []interface{}{"smtp_data_ok"}, want: "354 End data with <CR><LF>.<CR><LF>\r\n"},
+		{args: []interface{}{"smtp_atrn", "example.org"}, want: "ATRN example.org\r\n"},
+	} {
+		t.Run(tt.args[0].(string), func(t *testing.T) {
+			buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), tt.args...)
+			if string(buf) != tt.want {
+				t.Fatalf("unexpected command: %q", buf)
+			}
+
+			fsm := NewTLSFSM(buf, marionette.NewStreamSet())
+			if err := tg.Recv(context.Background(), &fsm, tt.args...); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("MessageQueued", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "smtp_message_queued")
+		if m := tg.Parse("smtp_message_queued", string(buf)); m == nil {
+			t.Fatalf("cannot parse: %q", buf)
+		} else if m["SMTP_QUEUE_ID"] == "" {
+			t.Fatal("expected queue id")
+		}
+	})
+}
+
+func TestParseSMTPAttachmentLengths(t *testing.T) {
+	if _, err := tg.ParseSMTPAttachmentLengths("20000"); err == nil || err.Error() != `smtp: attachment length out of range: 20000` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package tg
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// templatePlaceholderRegex matches a %%KEY%% placeholder within a template.
+var templatePlaceholderRegex = regexp.MustCompile(`%%([A-Za-z0-9_\-]+)%%`)
+
+// PatternCipher is implemented by ciphers which can describe the text they
+// substitute for their placeholder. Template parsers use these constraints
+// to locate each placeholder value within a received message.
+//
+// Messages are matched byte-wise so patterns should describe bytes (e.g.
+// "\x00-\xff") rather than UTF-8 encoded characters.
+type PatternCipher interface {
+	// Returns a regular expression matching the cipher's output.
+	Pattern() string
+
+	// Returns the exact length of the cipher's output, or zero if variable.
+	Length() int
+}
+
+// ValidatingCipher is implemented by ciphers whose output depends on other
+// parts of the message, such as length fields. Parsed values are rejected
+// if they do not validate against the full message.
+type ValidatingCipher interface {
+	Validate(msg, value string) bool
+}
+
+// templateParser matches messages generated by a single template.
+type templateParser struct {
+	re      *regexp.Regexp
+	keys    []string // placeholder key by capture group
+	groups  []int    // submatch index by capture group
+	lengths map[string]int
+	ciphers []ValidatingCipher
+	vkeys   []string // placeholder key by validating cipher
+}
+
+// newTemplateParser compiles template into a parser. Placeholders are
+// constrained by the associated cipher, if it implements PatternCipher.
+// Placeholders without a constraint match any text.
+func newTemplateParser(template string, ciphers []TemplateCipher) (*templateParser, error) {
+	p := &templateParser{lengths: make(map[string]int)}
+
+	// Index cipher patterns by key.
+	patterns := make(map[string]string)
+	for _, cipher := range ciphers {
+		if c, ok := cipher.(PatternCipher); ok {
+			patterns[cipher.Key()] = c.Pattern()
+			if n := c.Length(); n > 0 {
+				p.lengths[cipher.Key()] = n
+			}
+		}
+		if c, ok := cipher.(ValidatingCipher); ok {
+			p.ciphers, p.vkeys = append(p.ciphers, c), append(p.vkeys, cipher.Key())
+		}
+	}
+
+	// Convert template into a regex with a capture group per placeholder.
+	var buf bytes.Buffer
+	buf.WriteString(`^`)
+	var offset int
+	for _, loc := range templatePlaceholderRegex.FindAllStringSubmatchIndex(template, -1) {
+		key := template[loc[2]:loc[3]]
+		buf.WriteString(regexp.QuoteMeta(latin1(template[offset:loc[0]])))
+
+		pattern, ok := patterns[key]
+		if !ok {
+			pattern = `(?s:.*?)`
+		}
+		fmt.Fprintf(&buf, `(?P<p%d>(?:%s))`, len(p.keys), pattern)
+
+		p.keys = append(p.keys, key)
+		offset = loc[1]
+	}
+	buf.WriteString(regexp.QuoteMeta(latin1(template[offset:])))
+	buf.WriteString(`$`)
+
+	re, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, err
+	}
+	p.re = re
+
+	// Cipher patterns may contain groups so look up indices by name.
+	p.groups = make([]int, len(p.keys))
+	for i, name := range re.SubexpNames() {
+		var n int
+		if _, err := fmt.Sscanf(name, "p%d", &n); err == nil {
+			p.groups[n] = i
+		}
+	}
+
+	return p, nil
+}
+
+// Parse returns placeholder values by key. Returns nil if msg does not match.
+func (p *templateParser) Parse(msg string) map[string]string {
+	a := p.re.FindStringSubmatch(latin1(msg))
+	if a == nil {
+		return nil
+	}
+
+	m := make(map[string]string, len(p.keys))
+	for i, key := range p.keys {
+		value := unlatin1(a[p.groups[i]])
+
+		// Repeated placeholders must have the same value at each location.
+		if prev, ok := m[key]; ok && prev != value {
+			return nil
+		} else if n, ok := p.lengths[key]; ok && len(value) != n {
+			return nil
+		}
+		m[key] = value
+	}
+
+	// Verify values which depend on the rest of the message.
+	for i, c := range p.ciphers {
+		if !c.Validate(msg, m[p.vkeys[i]]) {
+			return nil
+		}
+	}
+
+	return m
+}
+
+// latin1 maps each byte of s to the code point of the same value. This allows
+// regular expressions to match binary data one byte at a time.
+func latin1(s string) string {
+	a := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		a[i] = rune(s[i])
+	}
+	return string(a)
+}
+
+// unlatin1 reverses the mapping applied by latin1.
+func unlatin1(s string) string {
+	a := make([]byte, 0, len(s))
+	for _, r := range s {
+		a = append(a, byte(r))
+	}
+	return string(a)
+}
@@ -1,7 +1,7 @@
 package tg
 
 import (
-	"strings"
+	"fmt"
 
 	"github.com/redjack/marionette"
 )
@@ -10,6 +10,29 @@ type Grammar struct {
 	Name      string
 	Templates []string
 	Ciphers   []TemplateCipher
+
+	// Names of variables assigned from additional arguments to tg.send() &
+	// tg.recv(). These allow formats to configure ciphers.
+	Args []string
+
+	// Alternate grammars by the value of the VariantArg variable, such as a
+	// protocol version. The grammar is used as-is if the variable is unset.
+	VariantArg string
+	Variants   map[string]string
+
+	parsers []*templateParser
+}
+
+// Parse matches data against each of the grammar's templates in order and
+// returns the placeholder values for the first match. Returns nil if data
+// does not match any template.
+func (g *Grammar) Parse(data string) map[string]string {
+	for _, p := range g.parsers {
+		if m := p.Parse(data); m != nil {
+			return m
+		}
+	}
+	return nil
 }
 
 type TemplateCipher interface {
@@ -21,8 +44,17 @@ type TemplateCipher interface {
 
 var grammars = make(map[string]*Grammar)
 
-// RegisterGrammar adds grammar to the registry.
+// RegisterGrammar adds grammar to the registry. Parsers are generated from
+// the grammar's templates and ciphers. Panics if a template cannot be compiled.
 func RegisterGrammar(grammar *Grammar) {
+	grammar.parsers = make([]*templateParser, len(grammar.Templates))
+	for i, template := range grammar.Templates {
+		p, err := newTemplateParser(template, grammar.Ciphers)
+		if err != nil {
+			panic(fmt.Sprintf("tg: cannot compile template for grammar %q: %s", grammar.Name, err))
+		}
+		grammar.parsers[i] = p
+	}
 	grammars[grammar.Name] = grammar
 }
 
@@ -146,44 +178,327 @@ func init() {
 	})
 
 	RegisterGrammar(&Grammar{
-		Name: "dns_request",
+		Name: "tls_client_hello",
 		Templates: []string{
-			"%%DNS_TRANSACTION_ID%%\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00%%DNS_DOMAIN%%\x00\x00\x01\x00\x01",
+			"\x16\x03\x01%%TLS_RECORD_LENGTH%%\x01%%TLS_HANDSHAKE_LENGTH%%\x03\x03%%TLS_CLIENT_RANDOM%%\x20%%TLS_SESSION_ID%%" +
+				"\x00\x1e\x13\x01\x13\x02\x13\x03\xc0\x2b\xc0\x2f\xc0\x2c\xc0\x30\xcc\xa9\xcc\xa8\xc0\x13\xc0\x14\x00\x9c\x00\x9d\x00\x2f\x00\x35" +
+				"\x01\x00%%TLS_EXTENSIONS_LENGTH%%%%TLS_CLIENT_EXTENSIONS%%",
 		},
 		Ciphers: []TemplateCipher{
-			NewSetDNSTransactionIDCipher(),
-			NewSetDNSDomainCipher(),
+			NewTLSSealedCipher("TLS_CLIENT_RANDOM", 0, 2),
+			NewTLSSealedCipher("TLS_SESSION_ID", 1, 2),
+			NewTLSClientExtensionsCipher(),
+			NewTLSLengthCipher("TLS_EXTENSIONS_LENGTH", 2, 0, -1),
+			NewTLSLengthCipher("TLS_HANDSHAKE_LENGTH", 3, 0, -1),
+			NewTLSLengthCipher("TLS_RECORD_LENGTH", 2, 0, 3),
+		},
+		Args: []string{"tls_server_name", "tls_alpn", "tls_version"},
+	})
+
+	// TLS 1.3 ServerHello is followed by a ChangeCipherSpec record, as sent
+	// in middlebox compatibility mode, and a single ApplicationData record
+	// the size of the encrypted handshake messages. The ServerHello has a
+	// fixed size so its lengths are literal.
+	RegisterGrammar(&Grammar{
+		Name: "tls_server_hello",
+		Templates: []string{
+			"\x16\x03\x03\x00\x7a\x02\x00\x00\x76\x03\x03%%TLS_SERVER_RANDOM%%\x20%%TLS_SESSION_ID%%" +
+				"\x13\x01\x00\x00\x2e\x00\x2b\x00\x02\x03\x04\x00\x33\x00\x24\x00\x1d\x00\x20%%TLS_KEY_SHARE%%" +
+				"\x14\x03\x03\x00\x01\x01" +
+				"\x17\x03\x03%%TLS_RECORD_LENGTH%%%%TLS_ENCRYPTED_HANDSHAKE%%",
+		},
+		Ciphers: []TemplateCipher{
+			NewTLSSealedCipher("TLS_SERVER_RANDOM", 0, 2),
+			NewTLSSessionIDCipher(),
+			NewTLSSealedCipher("TLS_KEY_SHARE", 1, 2),
+			NewTLSRandomCipher("TLS_ENCRYPTED_HANDSHAKE", tlsEncryptedHandshakeLengths),
+			NewTLSLengthCipher("TLS_RECORD_LENGTH", 2, 0, 136),
+		},
+		Args:       []string{"tls_version"},
+		VariantArg: "tls_version",
+		Variants:   map[string]string{TLSVersion12: "tls12_server_hello", TLSVersion13: "tls_server_hello"},
+	})
+
+	// TLS 1.2 servers resuming a session from a ticket send an abbreviated
+	// handshake: ServerHello, NewSessionTicket, ChangeCipherSpec & Finished.
+	// The cell is carried in the new ticket.
+	RegisterGrammar(&Grammar{
+		Name: "tls12_server_hello",
+		Templates: []string{
+			"\x16\x03\x03\x00\x59\x02\x00\x00\x55\x03\x03%%TLS_SERVER_RANDOM%%\x20%%TLS_SESSION_ID%%" +
+				"\xc0\x2f\x00\x00\x0d\xff\x01\x00\x01\x00\x00\x17\x00\x00\x00\x23\x00\x00" +
+				"\x16\x03\x03%%TLS_TICKET_RECORD_LENGTH%%\x04%%TLS_TICKET_HANDSHAKE_LENGTH%%\x00\x00\x1c\x20%%TLS_TICKET_LENGTH%%%%TLS_SESSION_TICKET%%" +
+				"\x14\x03\x03\x00\x01\x01" +
+				"\x16\x03\x03\x00\x28%%TLS_FINISHED%%",
+		},
+		Ciphers: []TemplateCipher{
+			NewTLSRandomCipher("TLS_SERVER_RANDOM", []int{tlsFieldLen}),
+			NewTLSSessionIDCipher(),
+			NewTLSSessionTicketCipher(tlsSessionTicketLengths),
+			NewTLSRandomCipher("TLS_FINISHED", []int{tlsFinishedLen}),
+			NewTLSLengthCipher("TLS_TICKET_LENGTH", 2, 6+5+tlsFinishedLen, -1),
+			NewTLSLengthCipher("TLS_TICKET_HANDSHAKE_LENGTH", 3, 6+5+tlsFinishedLen, -1),
+			NewTLSLengthCipher("TLS_TICKET_RECORD_LENGTH", 2, 6+5+tlsFinishedLen, 97),
+		},
+	})
+
+	// The client's first flight after the ServerHello.
+	RegisterGrammar(&Grammar{
+		Name: "tls_client_finished",
+		Templates: []string{
+			"\x14\x03\x03\x00\x01\x01\x17\x03\x03%%TLS_RECORD_LENGTH%%%%TLS_APPLICATION_DATA%%",
+		},
+		Ciphers: []TemplateCipher{
+			NewTLSApplicationDataCipher(tlsRecordLengths),
+			NewTLSLengthCipher("TLS_RECORD_LENGTH", 2, 0, 9),
+		},
+		Args:       []string{"tls_record_lengths"},
+		VariantArg: "tls_version",
+		Variants:   map[string]string{TLSVersion12: "tls12_client_finished", TLSVersion13: "tls_client_finished"},
+	})
+
+	// TLS 1.2 clients complete an abbreviated handshake with their own
+	// ChangeCipherSpec & Finished, followed by application data.
+	RegisterGrammar(&Grammar{
+		Name: "tls12_client_finished",
+		Templates: []string{
+			"\x14\x03\x03\x00\x01\x01\x16\x03\x03\x00\x28%%TLS_FINISHED%%\x17\x03\x03%%TLS_RECORD_LENGTH%%%%TLS_APPLICATION_DATA%%",
+		},
+		Ciphers: []TemplateCipher{
+			NewTLSRandomCipher("TLS_FINISHED", []int{tlsFinishedLen}),
+			NewTLSApplicationDataCipher(tlsRecordLengths),
+			NewTLSLengthCipher("TLS_RECORD_LENGTH", 2, 0, 54),
+		},
+		Args: []string{"tls_record_lengths"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name: "tls_application_data",
+		Templates: []string{
+			"\x17\x03\x03%%TLS_RECORD_LENGTH%%%%TLS_APPLICATION_DATA%%",
+		},
+		Ciphers: []TemplateCipher{
+			NewTLSApplicationDataCipher(tlsRecordLengths),
+			NewTLSLengthCipher("TLS_RECORD_LENGTH", 2, 0, 3),
+		},
+		Args: []string{"tls_record_lengths"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name: "websocket_upgrade_request",
+		Templates: []string{
+			"GET %%WEBSOCKET_PATH%% HTTP/1.1\r\nHost: %%WEBSOCKET_HOST%%\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %%WEBSOCKET_KEY%%\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		},
+		Ciphers: []TemplateCipher{
+			NewWebSocketPathCipher(),
+			NewWebSocketHostCipher(),
+			NewWebSocketKeyCipher(),
+		},
+		Args: []string{"websocket_path", "websocket_host"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name: "websocket_upgrade_response",
+		Templates: []string{
+			"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %%WEBSOCKET_ACCEPT%%\r\n\r\n",
+		},
+		Ciphers: []TemplateCipher{NewWebSocketAcceptCipher()},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "websocket_client_frame",
+		Templates: []string{"%%WEBSOCKET_FRAME%%"},
+		Ciphers:   []TemplateCipher{NewWebSocketFrameCipher(true, websocketClientFrameLengths)},
+		Args:      []string{"websocket_frame_lengths"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "websocket_server_frame",
+		Templates: []string{"%%WEBSOCKET_FRAME%%"},
+		Ciphers:   []TemplateCipher{NewWebSocketFrameCipher(false, websocketFrameLengths)},
+		Args:      []string{"websocket_frame_lengths"},
+	})
+
+	// SMTP grammars are not tied to a party so that roles can be reversed
+	// after an ATRN command (RFC 2645).
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_greeting",
+		Templates: []string{"220 %%SMTP_DOMAIN%% ESMTP Postfix\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPVariableCipher("SMTP_DOMAIN", "mail.example.com", smtpDomainPattern)},
+		Args:      []string{"smtp_domain"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_ehlo",
+		Templates: []string{"EHLO %%SMTP_DOMAIN%%\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPVariableCipher("SMTP_DOMAIN", "localhost", smtpDomainPattern)},
+		Args:      []string{"smtp_domain"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name: "smtp_ehlo_response",
+		Templates: []string{
+			"250-%%SMTP_DOMAIN%%\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250-ETRN\r\n250-ATRN\r\n250-ENHANCEDSTATUSCODES\r\n250-8BITMIME\r\n250 DSN\r\n",
 		},
+		Ciphers: []TemplateCipher{NewSMTPVariableCipher("SMTP_DOMAIN", "mail.example.com", smtpDomainPattern)},
+		Args:    []string{"smtp_domain"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_mail_from",
+		Templates: []string{"MAIL FROM:<%%SMTP_SENDER%%>\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPVariableCipher("SMTP_SENDER", "postmaster@example.com", smtpMailboxPattern)},
+		Args:      []string{"smtp_sender"},
 	})
 
 	RegisterGrammar(&Grammar{
-		Name: "dns_response",
+		Name:      "smtp_mail_from_ok",
+		Templates: []string{"250 2.1.0 Ok\r\n"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_rcpt_to",
+		Templates: []string{"RCPT TO:<%%SMTP_RECIPIENT%%>\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPVariableCipher("SMTP_RECIPIENT", "postmaster@example.com", smtpMailboxPattern)},
+		Args:      []string{"smtp_recipient"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_rcpt_to_ok",
+		Templates: []string{"250 2.1.5 Ok\r\n"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_data",
+		Templates: []string{"DATA\r\n"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_data_ok",
+		Templates: []string{"354 End data with <CR><LF>.<CR><LF>\r\n"},
+	})
+
+	// Envelope addresses are reused from the MAIL FROM & RCPT TO commands.
+	RegisterGrammar(&Grammar{
+		Name: "smtp_message",
 		Templates: []string{
-			"%%DNS_TRANSACTION_ID%%\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00%%DNS_DOMAIN%%\x00\x01\x00\x01\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x02\x00\x04%%DNS_IP%%",
+			"From: <%%SMTP_SENDER%%>\r\n" +
+				"To: <%%SMTP_RECIPIENT%%>\r\n" +
+				"Subject: %%SMTP_SUBJECT%%\r\n" +
+				"Date: %%SMTP_DATE%%\r\n" +
+				"Message-ID: <%%SMTP_MESSAGE_ID%%>\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/mixed; boundary=\"%%SMTP_BOUNDARY%%\"\r\n" +
+				"\r\n" +
+				"--%%SMTP_BOUNDARY%%\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"Please see the attached file.\r\n" +
+				"\r\n" +
+				"--%%SMTP_BOUNDARY%%\r\n" +
+				"Content-Type: application/octet-stream; name=\"%%SMTP_FILENAME%%\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"Content-Disposition: attachment; filename=\"%%SMTP_FILENAME%%\"\r\n" +
+				"\r\n" +
+				"%%SMTP_ATTACHMENT%%\r\n" +
+				"--%%SMTP_BOUNDARY%%--\r\n" +
+				".\r\n",
 		},
 		Ciphers: []TemplateCipher{
-			NewSetDNSTransactionIDCipher(),
-			NewSetDNSDomainCipher(),
-			NewSetDNSIPCipher(),
+			NewSMTPVariableCipher("SMTP_SENDER", "postmaster@example.com", smtpMailboxPattern),
+			NewSMTPVariableCipher("SMTP_RECIPIENT", "postmaster@example.com", smtpMailboxPattern),
+			NewSMTPHeaderCipher("SMTP_SUBJECT", `[\x20-\x7e]+`, smtpSubject),
+			NewSMTPHeaderCipher("SMTP_DATE", `[A-Z][a-z]{2}, [0-9]{2} [A-Z][a-z]{2} [0-9]{4} [0-9]{2}:[0-9]{2}:[0-9]{2} [+\-][0-9]{4}`, smtpDate),
+			NewSMTPHeaderCipher("SMTP_MESSAGE_ID", `[A-Za-z0-9.\-]+@[A-Za-z0-9.\-]+`, smtpMessageID),
+			NewSMTPHeaderCipher("SMTP_BOUNDARY", `[A-Za-z0-9'()+_,\-./:=?]{1,70}`, smtpBoundary),
+			NewSMTPHeaderCipher("SMTP_FILENAME", `[A-Za-z0-9_.\-]+`, smtpFilename),
+			NewSMTPAttachmentCipher(smtpAttachmentLengths),
 		},
+		Args: []string{"smtp_attachment_lengths"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_message_queued",
+		Templates: []string{"250 2.0.0 Ok: queued as %%SMTP_QUEUE_ID%%\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPHeaderCipher("SMTP_QUEUE_ID", `[0-9A-F]+`, smtpQueueID)},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_atrn",
+		Templates: []string{"ATRN %%SMTP_DOMAIN%%\r\n"},
+		Ciphers:   []TemplateCipher{NewSMTPVariableCipher("SMTP_DOMAIN", "example.com", smtpDomainPattern)},
+		Args:      []string{"smtp_domain"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_atrn_ok",
+		Templates: []string{"250 OK now reversing the connection\r\n"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_quit",
+		Templates: []string{"QUIT\r\n"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "smtp_quit_ok",
+		Templates: []string{"221 2.0.0 Bye\r\n"},
+	})
+
+	// DNS messages are generated by the ciphers so that names & records are
+	// encoded correctly. Queries carry cells in the query name and responses
+	// carry cells in the answer record.
+	RegisterGrammar(&Grammar{
+		Name:      "dns_request",
+		Templates: []string{"%%DNS_QUERY%%"},
+		Ciphers:   []TemplateCipher{NewDNSQueryCipher()},
+		Args:      []string{"dns_domain", "dns_record_type"},
+	})
+
+	RegisterGrammar(&Grammar{
+		Name:      "dns_response",
+		Templates: []string{"%%DNS_RESPONSE%%"},
+		Ciphers:   []TemplateCipher{NewDNSResponseCipher()},
 	})
 }
 
+// SetArgs assigns the grammar's variables from args on fsm.
+func (g *Grammar) SetArgs(fsm marionette.FSM, args []interface{}) {
+	for i, arg := range args {
+		if i >= len(g.Args) {
+			break
+		}
+		fsm.SetVar(g.Args[i], arg)
+	}
+}
+
+// Variant returns the grammar selected by the VariantArg variable on fsm.
+// Returns g if the grammar has no variants or the variable is unset.
+func (g *Grammar) Variant(fsm marionette.FSM) (*Grammar, error) {
+	if g.VariantArg == "" {
+		return g, nil
+	}
+
+	v, _ := fsm.Var(g.VariantArg).(string)
+	if v == "" {
+		return g, nil
+	}
+
+	name, ok := g.Variants[v]
+	if !ok {
+		return nil, fmt.Errorf("tg: invalid %s for grammar %q: %q", g.VariantArg, g.Name, v)
+	} else if grammars[name] == nil {
+		return nil, fmt.Errorf("tg: grammar variant not found: %q", name)
+	}
+	return grammars[name], nil
+}
+
+// Parse parses data using the named grammar. Returns nil if the grammar does
+// not exist or if data does not match any of the grammar's templates.
 func Parse(name, data string) map[string]string {
-	if strings.HasPrefix(name, "http_response") || name == "http_amazon_response" {
-		return parseHTTPResponse(data)
-	} else if strings.HasPrefix(name, "http_request") || name == "http_amazon_request" {
-		return parseHTTPRequest(data)
-	} else if strings.HasPrefix(name, "pop3_message_response") {
-		return parsePOP3(data)
-	} else if strings.HasPrefix(name, "pop3_password") {
-		return parsePOP3Password(data)
-	} else if strings.HasPrefix(name, "ftp_entering_passive") {
-		return parseFTPEnteringPassive(data)
-	} else if strings.HasPrefix(name, "dns_request") {
-		return parseDNSRequest(data)
-	} else if strings.HasPrefix(name, "dns_response") {
-		return parseDNSResponse(data)
+	grammar := grammars[name]
+	if grammar == nil {
+		return nil
 	}
-	return nil
+	return grammar.Parse(data)
 }
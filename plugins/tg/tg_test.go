@@ -0,0 +1,45 @@
+package tg_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+func TestParse(t *testing.T) {
+	tg.RegisterGrammar(&tg.Grammar{
+		Name: "test_parse",
+		Templates: []string{
+			"A %%FTP_PASV_PORT_X%% %%Y%% %%FTP_PASV_PORT_X%%\n",
+			"B %%Y%%\n",
+		},
+		Ciphers: []tg.TemplateCipher{tg.NewSetFTPPasvXCipher()},
+	})
+
+	t.Run("OK", func(t *testing.T) {
+		m := tg.Parse("test_parse", "A 1 2 1\n")
+		if diff := cmp.Diff(m, map[string]string{"FTP_PASV_PORT_X": "1", "Y": "2"}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("AlternativeTemplate", func(t *testing.T) {
+		m := tg.Parse("test_parse", "B foo bar\n")
+		if diff := cmp.Diff(m, map[string]string{"Y": "foo bar"}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("ErrRepeatedKeyMismatch", func(t *testing.T) {
+		if m := tg.Parse("test_parse", "A 1 2 3\n"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrGrammarNotFound", func(t *testing.T) {
+		if m := tg.Parse("no_such_grammar", "A 1 2 1\n"); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+}
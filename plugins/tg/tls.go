@@ -0,0 +1,488 @@
+package tg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/redjack/marionette"
+)
+
+// Values of the "tls_version" variable.
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// TLS record framing constants.
+const (
+	// tlsFieldLen is the size of the random, session id & key share fields.
+	tlsFieldLen = 32
+
+	// tlsNonceLen is the size of the nonce prepended to sealed data.
+	tlsNonceLen = 8
+
+	// tlsMaxRecordLen is the largest allowed TLS 1.3 ciphertext record.
+	tlsMaxRecordLen = 16384 + 256
+)
+
+// TLSSealedCipher embeds a cell into one of several 32-byte fields of a TLS
+// handshake message, such as the random, session id, or key share fields.
+//
+// The cell is masked so that it appears random and is then split across the
+// fields. The first part carries the capacity for the entire cell and all
+// parts must be listed in order within a grammar.
+type TLSSealedCipher struct {
+	key   string
+	part  int
+	parts int
+}
+
+// NewTLSSealedCipher returns a new instance of TLSSealedCipher for one of parts fields.
+func NewTLSSealedCipher(key string, part, parts int) *TLSSealedCipher {
+	return &TLSSealedCipher{key: key, part: part, parts: parts}
+}
+
+func (c *TLSSealedCipher) Key() string { return c.key }
+
+func (c *TLSSealedCipher) Capacity(fsm marionette.FSM) (int, error) {
+	if c.part != 0 {
+		return 0, nil
+	}
+	return (c.parts * tlsFieldLen) - tlsNonceLen, nil
+}
+
+func (c *TLSSealedCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	// The first part seals the cell and stores it for the remaining parts.
+	if c.part == 0 {
+		sealed, err := tlsSeal(fsm, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		fsm.SetVar("tls_sealed", sealed)
+	}
+
+	sealed, _ := fsm.Var("tls_sealed").([]byte)
+	if len(sealed) != c.parts*tlsFieldLen {
+		return nil, errors.New("tls: sealed data unavailable")
+	}
+	ciphertext = sealed[c.part*tlsFieldLen : (c.part+1)*tlsFieldLen]
+	fsm.SetVar(strings.ToLower(c.key), string(ciphertext))
+	return ciphertext, nil
+}
+
+func (c *TLSSealedCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	fsm.SetVar(strings.ToLower(c.key), string(ciphertext))
+
+	// Accumulate parts until the last part is received.
+	var sealed []byte
+	if c.part != 0 {
+		sealed, _ = fsm.Var("tls_sealed").([]byte)
+	}
+	sealed = append(sealed[:len(sealed):len(sealed)], ciphertext...)
+	fsm.SetVar("tls_sealed", sealed)
+
+	if c.part < c.parts-1 {
+		return nil, nil
+	} else if len(sealed) != c.parts*tlsFieldLen {
+		return nil, errors.New("tls: incomplete sealed data")
+	}
+	return tlsOpen(fsm, sealed)
+}
+
+func (c *TLSSealedCipher) Pattern() string { return fmt.Sprintf(`[\x00-\xff]{%d}`, tlsFieldLen) }
+
+func (c *TLSSealedCipher) Length() int { return tlsFieldLen }
+
+// TLSSessionIDCipher echoes the session id received from the client. This
+// is required of TLS 1.3 servers in middlebox compatibility mode.
+type TLSSessionIDCipher struct{}
+
+func NewTLSSessionIDCipher() *TLSSessionIDCipher {
+	return &TLSSessionIDCipher{}
+}
+
+func (c *TLSSessionIDCipher) Key() string { return "TLS_SESSION_ID" }
+
+func (c *TLSSessionIDCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *TLSSessionIDCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	if v, ok := fsm.Var("tls_session_id").(string); ok {
+		return []byte(v), nil
+	}
+
+	ciphertext = make([]byte, tlsFieldLen)
+	if _, err := crand.Read(ciphertext); err != nil {
+		return nil, err
+	}
+	fsm.SetVar("tls_session_id", string(ciphertext))
+	return ciphertext, nil
+}
+
+func (c *TLSSessionIDCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	fsm.SetVar("tls_session_id", string(ciphertext))
+	return nil, nil
+}
+
+func (c *TLSSessionIDCipher) Pattern() string { return fmt.Sprintf(`[\x00-\xff]{%d}`, tlsFieldLen) }
+
+func (c *TLSSessionIDCipher) Length() int { return tlsFieldLen }
+
+// TLSLengthCipher writes a big-endian length field covering the rest of the
+// message after the field, excluding trailer bytes. Length ciphers must be
+// listed after any ciphers for placeholders that they cover.
+type TLSLengthCipher struct {
+	key     string
+	width   int
+	trailer int
+	offset  int
+}
+
+// NewTLSLengthCipher returns a length cipher of width bytes. Lengths which
+// occur at a fixed offset from the start of the message, such as the first
+// record length, can specify it to validate that the message is complete.
+// Use an offset of -1 to disable validation.
+func NewTLSLengthCipher(key string, width, trailer, offset int) *TLSLengthCipher {
+	return &TLSLengthCipher{key: key, width: width, trailer: trailer, offset: offset}
+}
+
+func (c *TLSLengthCipher) Key() string { return c.key }
+
+func (c *TLSLengthCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *TLSLengthCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	placeholder := "%%" + c.key + "%%"
+	i := strings.Index(template, placeholder)
+	if i == -1 {
+		return nil, fmt.Errorf("tls: placeholder not found: %s", c.key)
+	}
+	return tlsEncodeLength(len(template)-i-len(placeholder)-c.trailer, c.width), nil
+}
+
+func (c *TLSLengthCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *TLSLengthCipher) Pattern() string { return fmt.Sprintf(`[\x00-\xff]{%d}`, c.width) }
+
+func (c *TLSLengthCipher) Length() int { return c.width }
+
+// Validate returns true if value matches the length of msg after the field.
+func (c *TLSLengthCipher) Validate(msg, value string) bool {
+	if c.offset < 0 {
+		return true
+	}
+	return string(tlsEncodeLength(len(msg)-c.offset-c.width-c.trailer, c.width)) == value
+}
+
+// TLSClientExtensionsCipher generates the extensions block of a ClientHello.
+//
+// The server name & ALPN protocols are read from the "tls_server_name" and
+// "tls_alpn" variables, respectively. ALPN protocols are comma-delimited.
+// If the "tls_version" variable is "1.2" then only TLS 1.2 is offered and a
+// session ticket is included for resumption.
+type TLSClientExtensionsCipher struct{}
+
+func NewTLSClientExtensionsCipher() *TLSClientExtensionsCipher {
+	return &TLSClientExtensionsCipher{}
+}
+
+func (c *TLSClientExtensionsCipher) Key() string { return "TLS_CLIENT_EXTENSIONS" }
+
+func (c *TLSClientExtensionsCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *TLSClientExtensionsCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	var buf []byte
+
+	// TLS 1.2 clients resume a session using a previously issued ticket.
+	versions, ticket := []byte{3, 4, 3, 3}, []byte(nil)
+	if v, _ := fsm.Var("tls_version").(string); v == TLSVersion12 {
+		versions, ticket = []byte{3, 3}, make([]byte, tlsSessionTicketLengths[rand.Intn(len(tlsSessionTicketLengths))])
+		if _, err := crand.Read(ticket); err != nil {
+			return nil, err
+		}
+	}
+
+	// server_name
+	if name, _ := fsm.Var("tls_server_name").(string); name != "" {
+		entry := append([]byte{0x00}, tlsVector([]byte(name), 2)...)
+		buf = append(buf, tlsExtension(0x0000, tlsVector(entry, 2))...)
+	}
+
+	buf = append(buf, tlsExtension(0x0017, nil)...)                                  // extended_master_secret
+	buf = append(buf, tlsExtension(0xff01, []byte{0x00})...)                         // renegotiation_info
+	buf = append(buf, tlsExtension(0x000a, tlsVector(tlsSupportedGroups, 2))...)     // supported_groups
+	buf = append(buf, tlsExtension(0x000b, tlsVector([]byte{0x00}, 1))...)           // ec_point_formats
+	buf = append(buf, tlsExtension(0x0023, ticket)...)                               // session_ticket
+	buf = append(buf, tlsExtension(0x000d, tlsVector(tlsSignatureAlgorithms, 2))...) // signature_algorithms
+	buf = append(buf, tlsExtension(0x002b, tlsVector(versions, 1))...)               // supported_versions
+	buf = append(buf, tlsExtension(0x002d, tlsVector([]byte{0x01}, 1))...)           // psk_key_exchange_modes
+
+	// application_layer_protocol_negotiation
+	if s, _ := fsm.Var("tls_alpn").(string); s != "" {
+		var protos []byte
+		for _, proto := range strings.Split(s, ",") {
+			protos = append(protos, tlsVector([]byte(proto), 1)...)
+		}
+		buf = append(buf, tlsExtension(0x0010, tlsVector(protos, 2))...)
+	}
+
+	// key_share, using a random x25519 public key.
+	share := make([]byte, tlsFieldLen)
+	if _, err := crand.Read(share); err != nil {
+		return nil, err
+	}
+	entry := append([]byte{0x00, 0x1d}, tlsVector(share, 2)...)
+	buf = append(buf, tlsExtension(0x0033, tlsVector(entry, 2))...)
+
+	return buf, nil
+}
+
+func (c *TLSClientExtensionsCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+// TLSApplicationDataCipher embeds a cell into the body of an ApplicationData
+// record. Record lengths are chosen from a weighted distribution which can be
+// overridden by the "tls_record_lengths" variable. The variable is formatted
+// as a comma-delimited list of "LENGTH:WEIGHT" pairs.
+type TLSApplicationDataCipher struct {
+	lengths []int
+}
+
+// NewTLSApplicationDataCipher returns a new instance of TLSApplicationDataCipher
+// which chooses record lengths from lengths, if the variable is not set.
+func NewTLSApplicationDataCipher(lengths []int) *TLSApplicationDataCipher {
+	return &TLSApplicationDataCipher{lengths: lengths}
+}
+
+func (c *TLSApplicationDataCipher) Key() string { return "TLS_APPLICATION_DATA" }
+
+func (c *TLSApplicationDataCipher) Capacity(fsm marionette.FSM) (int, error) {
+	lengths := c.lengths
+	if s, _ := fsm.Var("tls_record_lengths").(string); s != "" {
+		var err error
+		if lengths, err = ParseTLSRecordLengths(s); err != nil {
+			return 0, err
+		}
+	}
+	return lengths[rand.Intn(len(lengths))] - tlsNonceLen, nil
+}
+
+func (c *TLSApplicationDataCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	return tlsSeal(fsm, plaintext)
+}
+
+func (c *TLSApplicationDataCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return tlsOpen(fsm, ciphertext)
+}
+
+// TLSSessionTicketCipher embeds a cell into the ticket of a TLS 1.2
+// NewSessionTicket message. Ticket lengths are chosen from lengths.
+type TLSSessionTicketCipher struct {
+	lengths []int
+}
+
+// NewTLSSessionTicketCipher returns a new instance of TLSSessionTicketCipher.
+func NewTLSSessionTicketCipher(lengths []int) *TLSSessionTicketCipher {
+	return &TLSSessionTicketCipher{lengths: lengths}
+}
+
+func (c *TLSSessionTicketCipher) Key() string { return "TLS_SESSION_TICKET" }
+
+func (c *TLSSessionTicketCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return c.lengths[rand.Intn(len(c.lengths))] - tlsNonceLen, nil
+}
+
+func (c *TLSSessionTicketCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	return tlsSeal(fsm, plaintext)
+}
+
+func (c *TLSSessionTicketCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return tlsOpen(fsm, ciphertext)
+}
+
+// TLSRandomCipher fills a placeholder with random bytes which carry no data,
+// such as a Finished message or an encrypted handshake record. Lengths are
+// chosen from a weighted list.
+type TLSRandomCipher struct {
+	key     string
+	lengths []int
+}
+
+// NewTLSRandomCipher returns a new instance of TLSRandomCipher.
+func NewTLSRandomCipher(key string, lengths []int) *TLSRandomCipher {
+	return &TLSRandomCipher{key: key, lengths: lengths}
+}
+
+func (c *TLSRandomCipher) Key() string { return c.key }
+
+func (c *TLSRandomCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *TLSRandomCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	ciphertext = make([]byte, c.lengths[rand.Intn(len(c.lengths))])
+	if _, err := crand.Read(ciphertext); err != nil {
+		return nil, err
+	}
+	return ciphertext, nil
+}
+
+func (c *TLSRandomCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *TLSRandomCipher) Pattern() string {
+	if n := c.Length(); n > 0 {
+		return fmt.Sprintf(`[\x00-\xff]{%d}`, n)
+	}
+	return `[\x00-\xff]+`
+}
+
+// Length returns the output length if the cipher has a single length.
+func (c *TLSRandomCipher) Length() int {
+	for _, n := range c.lengths {
+		if n != c.lengths[0] {
+			return 0
+		}
+	}
+	return c.lengths[0]
+}
+
+// ParseTLSRecordLengths parses a comma-delimited list of "LENGTH:WEIGHT"
+// pairs into a weighted list of record lengths. The weight may be omitted.
+func ParseTLSRecordLengths(s string) ([]int, error) {
+	return parseWeightedLengths(s, "tls", "record", tlsNonceLen+marionette.CellHeaderSize+1, tlsMaxRecordLen)
+}
+
+// parseWeightedLengths parses a comma-delimited list of "LENGTH:WEIGHT" pairs.
+// Each length is repeated by its weight. Lengths must be between min & max.
+// The pkg & noun describe the lengths within error messages.
+func parseWeightedLengths(s, pkg, noun string, min, max int) ([]int, error) {
+	var lengths []int
+	for _, item := range strings.Split(s, ",") {
+		a := strings.SplitN(strings.TrimSpace(item), ":", 2)
+
+		n, err := strconv.Atoi(a[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s length: %q", pkg, noun, a[0])
+		} else if n < min || n > max {
+			return nil, fmt.Errorf("%s: %s length out of range: %d", pkg, noun, n)
+		}
+
+		weight := 1
+		if len(a) == 2 {
+			if weight, err = strconv.Atoi(a[1]); err != nil || weight < 1 {
+				return nil, fmt.Errorf("%s: invalid %s length weight: %q", pkg, noun, a[1])
+			}
+		}
+
+		for i := 0; i < weight; i++ {
+			lengths = append(lengths, n)
+		}
+	}
+	return lengths, nil
+}
+
+// tlsSeal prepends a random nonce to plaintext and masks it with a keystream.
+func tlsSeal(fsm marionette.FSM, plaintext []byte) ([]byte, error) {
+	buf := make([]byte, tlsNonceLen+len(plaintext))
+	if _, err := crand.Read(buf[:tlsNonceLen]); err != nil {
+		return nil, err
+	}
+
+	stream, err := tlsStream(fsm, buf[:tlsNonceLen])
+	if err != nil {
+		return nil, err
+	}
+	stream.XORKeyStream(buf[tlsNonceLen:], plaintext)
+	return buf, nil
+}
+
+// tlsOpen removes the nonce from data and unmasks the remaining bytes.
+func tlsOpen(fsm marionette.FSM, data []byte) ([]byte, error) {
+	if len(data) < tlsNonceLen {
+		return nil, errors.New("tls: short sealed data")
+	}
+
+	stream, err := tlsStream(fsm, data[:tlsNonceLen])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(data)-tlsNonceLen)
+	stream.XORKeyStream(plaintext, data[tlsNonceLen:])
+	return plaintext, nil
+}
+
+// tlsStream returns an AES-CTR keystream for the given nonce using the FSM's
+// encryption key.
+func tlsStream(fsm marionette.FSM, nonce []byte) (cipher.Stream, error) {
+	key, _ := fsm.Config().Keys()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	return cipher.NewCTR(block, iv), nil
+}
+
+// tlsEncodeLength returns n as a big-endian integer of width bytes.
+func tlsEncodeLength(n, width int) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(n))
+	return buf[4-width:]
+}
+
+// tlsVector returns data prefixed by its length in width bytes.
+func tlsVector(data []byte, width int) []byte {
+	return append(tlsEncodeLength(len(data), width), data...)
+}
+
+// tlsExtension returns an encoded extension of the given type.
+func tlsExtension(typ uint16, data []byte) []byte {
+	return append([]byte{byte(typ >> 8), byte(typ)}, tlsVector(data, 2)...)
+}
+
+// x25519, secp256r1, secp384r1
+var tlsSupportedGroups = []byte{0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}
+
+// ecdsa_secp256r1_sha256, rsa_pss_rsae_sha256, rsa_pkcs1_sha256,
+// ecdsa_secp384r1_sha384, rsa_pss_rsae_sha384, rsa_pkcs1_sha384,
+// rsa_pss_rsae_sha512, rsa_pkcs1_sha512
+var tlsSignatureAlgorithms = []byte{
+	0x04, 0x03, 0x08, 0x04, 0x04, 0x01,
+	0x05, 0x03, 0x08, 0x05, 0x05, 0x01,
+	0x08, 0x06, 0x06, 0x01,
+}
+
+// tlsRecordLengths is the default weighted list of ApplicationData record
+// lengths. It approximates a browser session: small control frames, MTU-sized
+// records from servers which avoid fragmentation, and full-sized records.
+var tlsRecordLengths, _ = ParseTLSRecordLengths("64:3,96:4,137:2,297:2,542:1,1024:1,1400:6,4113:1,8209:1,16401:4")
+
+// tlsEncryptedHandshakeLengths is the weighted list of lengths for the TLS 1.3
+// record carrying the server's EncryptedExtensions, Certificate,
+// CertificateVerify & Finished messages. Most certificate chains are 2-5KB.
+var tlsEncryptedHandshakeLengths, _ = parseWeightedLengths("1500:1,2600:3,3400:3,4300:2,5200:1", "tls", "handshake", 1, tlsMaxRecordLen)
+
+// tlsSessionTicketLengths is the weighted list of TLS 1.2 session ticket
+// lengths, as issued by common server implementations.
+var tlsSessionTicketLengths, _ = parseWeightedLengths("160:1,176:2,192:4,208:2,240:1", "tls", "ticket", tlsNonceLen+marionette.CellHeaderSize+1, 0xffff)
+
+// tlsFinishedLen is the size of an encrypted TLS 1.2 Finished record body
+// using an AES-GCM cipher suite: an explicit nonce, the message & a tag.
+const tlsFinishedLen = 8 + 16 + 16
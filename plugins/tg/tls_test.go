@@ -0,0 +1,466 @@
+package tg_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mock"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+// tlsVersion13 is the TLS 1.3 version number. The standard library only
+// defines tls.VersionTLS13 since Go 1.12.
+const tlsVersion13 = 0x0304
+
+func TestTLS_ClientHello(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		streamSet := marionette.NewStreamSet()
+		stream := streamSet.Create()
+		if _, err := stream.Write([]byte(`foo`)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := MustSendTLS(t, NewTLSFSM(nil, streamSet), "tls_client_hello", "www.example.com", "h2,http/1.1")
+		if len(buf) < 5 || !bytes.Equal(buf[:3], []byte{0x16, 0x03, 0x01}) {
+			t.Fatalf("unexpected record header: %x", buf)
+		} else if n := int(buf[3])<<8 | int(buf[4]); n != len(buf)-5 {
+			t.Fatalf("unexpected record length: %d", n)
+		}
+
+		// Parse the handshake with the standard library's TLS server.
+		hello, err := ParseTLSClientHello(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if hello.ServerName != "www.example.com" {
+			t.Fatalf("unexpected server name: %q", hello.ServerName)
+		} else if diff := cmp.Diff(hello.SupportedProtos, []string{"h2", "http/1.1"}); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// Older standard libraries do not parse the supported_versions extension.
+		if SupportsTLS13() {
+			if diff := cmp.Diff(hello.SupportedVersions, []uint16{tlsVersion13, tls.VersionTLS12}); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+
+		// Receive the message on the other side and read the cell.
+		var recvStream *marionette.Stream
+		recvStreamSet := marionette.NewStreamSet()
+		recvStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+		fsm := NewTLSFSM(buf, recvStreamSet)
+		if err := tg.Recv(context.Background(), &fsm, "tls_client_hello", "www.example.com", "h2,http/1.1"); err != nil {
+			t.Fatal(err)
+		} else if recvStream == nil {
+			t.Fatal("expected stream")
+		} else if sessionID := fsm.Var("tls_session_id").(string); sessionID != string(buf[44:76]) {
+			t.Fatalf("unexpected session id: %x", sessionID)
+		}
+
+		data := make([]byte, 3)
+		if _, err := io.ReadFull(recvStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `foo` {
+			t.Fatalf("unexpected read: %q", data)
+		}
+	})
+
+	t.Run("NoServerName", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "tls_client_hello")
+		if hello, err := ParseTLSClientHello(buf); err != nil {
+			t.Fatal(err)
+		} else if hello.ServerName != "" {
+			t.Fatalf("unexpected server name: %q", hello.ServerName)
+		} else if len(hello.SupportedProtos) != 0 {
+			t.Fatalf("unexpected protocols: %q", hello.SupportedProtos)
+		}
+	})
+}
+
+func TestTLS_ServerHello(t *testing.T) {
+	if !SupportsTLS13() {
+		t.Skip("standard library does not support TLS 1.3")
+	}
+
+	// Begin a handshake using the standard library's TLS client.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tls.Client(clientConn, &tls.Config{
+			ServerName:         "www.example.com",
+			InsecureSkipVerify: true,
+			MinVersion:         tlsVersion13,
+		}).Handshake()
+	}()
+
+	// Read ClientHello record and extract session id.
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(serverConn, body); err != nil {
+		t.Fatal(err)
+	}
+	sessionID := body[39 : 39+int(body[38])]
+
+	// Reply with a ServerHello, ChangeCipherSpec & encrypted handshake record.
+	streamSet := marionette.NewStreamSet()
+	fsm := NewTLSFSM(nil, streamSet)
+	fsm.SetVar("tls_session_id", string(sessionID))
+	serverHello := MustSendTLS(t, fsm, "tls_server_hello")
+	if records, err := ParseTLSRecords(serverHello); err != nil {
+		t.Fatal(err)
+	} else if diff := cmp.Diff(TLSRecordTypes(records), []byte{0x16, 0x14, 0x17}); diff != "" {
+		t.Fatal(diff)
+	} else if n := len(records[2].Body); n < 1500 || n > 5200 {
+		t.Fatalf("unexpected encrypted handshake length: %d", n)
+	}
+
+	go io.Copy(ioutil.Discard, serverConn)
+	if _, err := serverConn.Write(serverHello); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client accepts the ServerHello & ChangeCipherSpec and only fails
+	// when it cannot decrypt the handshake data in the application data record.
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "bad record MAC") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTLS12_Handshake(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		clientStreamSet := marionette.NewStreamSet()
+		clientStream := clientStreamSet.Create()
+		if _, err := clientStream.Write([]byte(`foo`)); err != nil {
+			t.Fatal(err)
+		}
+		clientFSM := NewTLSFSM(nil, clientStreamSet)
+
+		// Only TLS 1.2 is offered by the client.
+		clientHello := MustSendTLS(t, clientFSM, "tls_client_hello", "www.example.com", "", "1.2")
+		if hello, err := ParseTLSClientHello(clientHello); err != nil {
+			t.Fatal(err)
+		} else if SupportsTLS13() {
+			if diff := cmp.Diff(hello.SupportedVersions, []uint16{tls.VersionTLS12}); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+
+		// Server receives the ClientHello and resumes the session.
+		var serverStream *marionette.Stream
+		serverStreamSet := marionette.NewStreamSet()
+		serverStreamSet.OnNewStream = func(s *marionette.Stream) { serverStream = s }
+		serverFSM := NewTLSFSM(clientHello, serverStreamSet)
+		if err := tg.Recv(context.Background(), &serverFSM, "tls_client_hello", "www.example.com", "", "1.2"); err != nil {
+			t.Fatal(err)
+		} else if serverStream == nil {
+			t.Fatal("expected stream")
+		}
+
+		data := make([]byte, 3)
+		if _, err := io.ReadFull(serverStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `foo` {
+			t.Fatalf("unexpected read: %q", data)
+		} else if _, err := serverStream.Write([]byte(`bar`)); err != nil {
+			t.Fatal(err)
+		}
+		serverHello := MustSendTLS(t, serverFSM, "tls_server_hello", "1.2")
+
+		// Verify the abbreviated handshake flight.
+		records, err := ParseTLSRecords(serverHello)
+		if err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(TLSRecordTypes(records), []byte{0x16, 0x16, 0x14, 0x16}); diff != "" {
+			t.Fatal(diff)
+		}
+		for _, record := range records {
+			if record.Version != tls.VersionTLS12 {
+				t.Fatalf("unexpected record version: %x", record.Version)
+			}
+		}
+
+		sh := records[0].Body
+		if sh[0] != 0x02 || int(sh[1])<<16|int(sh[2])<<8|int(sh[3]) != len(sh)-4 {
+			t.Fatalf("unexpected server hello header: %x", sh[:4])
+		} else if !bytes.Equal(sh[4:6], []byte{0x03, 0x03}) {
+			t.Fatalf("unexpected server version: %x", sh[4:6])
+		} else if !bytes.Equal(sh[39:71], clientHello[44:76]) {
+			t.Fatalf("session id not echoed: %x", sh[39:71])
+		} else if !bytes.Equal(sh[71:74], []byte{0xc0, 0x2f, 0x00}) {
+			t.Fatalf("unexpected cipher suite & compression: %x", sh[71:74])
+		}
+
+		nst := records[1].Body
+		if nst[0] != 0x04 || int(nst[1])<<16|int(nst[2])<<8|int(nst[3]) != len(nst)-4 {
+			t.Fatalf("unexpected new session ticket header: %x", nst[:4])
+		} else if n := int(nst[8])<<8 | int(nst[9]); n != len(nst)-10 {
+			t.Fatalf("unexpected ticket length: %d", n)
+		} else if len(records[3].Body) != 40 {
+			t.Fatalf("unexpected finished length: %d", len(records[3].Body))
+		}
+
+		// Client receives the cell from the session ticket.
+		clientFSM = NewTLSFSMVars(serverHello, clientStreamSet, clientFSM)
+		if err := tg.Recv(context.Background(), &clientFSM, "tls_server_hello", "1.2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(clientStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `bar` {
+			t.Fatalf("unexpected read: %q", data)
+		}
+
+		// Client completes the handshake with application data.
+		if _, err := clientStream.Write([]byte(`baz`)); err != nil {
+			t.Fatal(err)
+		}
+		clientFinished := MustSendTLS(t, clientFSM, "tls_client_finished")
+		if records, err := ParseTLSRecords(clientFinished); err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(TLSRecordTypes(records), []byte{0x14, 0x16, 0x17}); diff != "" {
+			t.Fatal(diff)
+		} else if len(records[1].Body) != 40 {
+			t.Fatalf("unexpected finished length: %d", len(records[1].Body))
+		}
+
+		serverFSM = NewTLSFSMVars(clientFinished, serverStreamSet, serverFSM)
+		if err := tg.Recv(context.Background(), &serverFSM, "tls_client_finished"); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(serverStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `baz` {
+			t.Fatalf("unexpected read: %q", data)
+		}
+	})
+
+	// Ensure a flight missing its Finished record is not parsed.
+	t.Run("ErrIncomplete", func(t *testing.T) {
+		fsm := NewTLSFSM(nil, marionette.NewStreamSet())
+		buf := MustSendTLS(t, fsm, "tls_server_hello", "1.2")
+		if m := tg.Parse("tls12_server_hello", string(buf[:len(buf)-45])); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrInvalidVersion", func(t *testing.T) {
+		fsm := NewTLSFSM(nil, marionette.NewStreamSet())
+		if err := tg.Send(context.Background(), &fsm, "tls_server_hello", "1.1"); err == nil || err.Error() != `tg: invalid tls_version for grammar "tls_server_hello": "1.1"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestTLS_ApplicationData(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		streamSet := marionette.NewStreamSet()
+		stream := streamSet.Create()
+		if _, err := stream.Write([]byte(`foo`)); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := MustSendTLS(t, NewTLSFSM(nil, streamSet), "tls_application_data", "96")
+		if !bytes.Equal(buf[:5], []byte{0x17, 0x03, 0x03, 0x00, 96}) {
+			t.Fatalf("unexpected record header: %x", buf[:5])
+		} else if len(buf) != 5+96 {
+			t.Fatalf("unexpected length: %d", len(buf))
+		}
+
+		var recvStream *marionette.Stream
+		recvStreamSet := marionette.NewStreamSet()
+		recvStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+		fsm := NewTLSFSM(buf, recvStreamSet)
+		if err := tg.Recv(context.Background(), &fsm, "tls_application_data"); err != nil {
+			t.Fatal(err)
+		} else if recvStream == nil {
+			t.Fatal("expected stream")
+		}
+
+		data := make([]byte, 3)
+		if _, err := io.ReadFull(recvStream, data); err != nil {
+			t.Fatal(err)
+		} else if string(data) != `foo` {
+			t.Fatalf("unexpected read: %q", data)
+		}
+	})
+
+	// Ensure a partially received record is not parsed.
+	t.Run("ErrIncomplete", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "tls_application_data", "96")
+		if m := tg.Parse("tls_application_data", string(buf[:len(buf)-1])); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	t.Run("ErrInvalidRecordLengths", func(t *testing.T) {
+		fsm := NewTLSFSM(nil, marionette.NewStreamSet())
+		if err := tg.Send(context.Background(), &fsm, "tls_application_data", "foo"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestParseTLSRecordLengths(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		if lengths, err := tg.ParseTLSRecordLengths("100:2, 200"); err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(lengths, []int{100, 100, 200}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("ErrOutOfRange", func(t *testing.T) {
+		if _, err := tg.ParseTLSRecordLengths("20000"); err == nil || err.Error() != `tls: record length out of range: 20000` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrInvalidWeight", func(t *testing.T) {
+		if _, err := tg.ParseTLSRecordLengths("100:x"); err == nil || err.Error() != `tls: invalid record length weight: "x"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// NewTLSFSM returns a mock FSM which stores variables and reads from buf.
+func NewTLSFSM(buf []byte, streamSet *marionette.StreamSet) mock.FSM {
+	conn := mock.DefaultConn()
+	conn.ReadFn = func(p []byte) (int, error) {
+		if len(buf) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, buf)
+		buf = buf[n:]
+		return n, nil
+	}
+
+	vars := make(map[string]interface{})
+	fsm := mock.NewFSM(&conn, streamSet)
+	fsm.PartyFn = func() string { return marionette.PartyClient }
+	fsm.HostFn = func() string { return "127.0.0.1" }
+	fsm.UUIDFn = func() int { return 100 }
+	fsm.InstanceIDFn = func() int { return 200 }
+	fsm.VarFn = func(key string) interface{} { return vars[key] }
+	fsm.SetVarFn = func(key string, value interface{}) { vars[key] = value }
+	return fsm
+}
+
+// NewTLSFSMVars returns a mock FSM which reads from buf and shares the
+// variables of other, such as a later message on the same connection.
+func NewTLSFSMVars(buf []byte, streamSet *marionette.StreamSet, other mock.FSM) mock.FSM {
+	fsm := NewTLSFSM(buf, streamSet)
+	fsm.VarFn, fsm.SetVarFn = other.VarFn, other.SetVarFn
+	return fsm
+}
+
+// MustSendTLS executes tg.send() for a grammar and returns the written bytes.
+func MustSendTLS(tb testing.TB, fsm mock.FSM, args ...interface{}) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	conn := mock.DefaultConn()
+	conn.WriteFn = buf.Write
+	bufConn := marionette.NewBufferedConn(&conn, marionette.MaxCellLength)
+	fsm.ConnFn = func() *marionette.BufferedConn { return bufConn }
+
+	if err := tg.Send(context.Background(), &fsm, args...); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ParseTLSClientHello parses buf using a standard library TLS server.
+func ParseTLSClientHello(buf []byte) (*tls.ClientHelloInfo, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		clientConn.Write(buf)
+		io.Copy(ioutil.Discard, clientConn)
+	}()
+
+	errMarker := errors.New("marker")
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(serverConn, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errMarker
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// TLSRecord is a single record within a TLS message.
+type TLSRecord struct {
+	Type    byte
+	Version uint16
+	Body    []byte
+}
+
+// ParseTLSRecords splits buf into records. Returns an error if buf does not
+// end on a record boundary.
+func ParseTLSRecords(buf []byte) ([]TLSRecord, error) {
+	var records []TLSRecord
+	for len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, errors.New("short record header")
+		}
+		n := int(buf[3])<<8 | int(buf[4])
+		if len(buf) < 5+n {
+			return nil, errors.New("short record body")
+		}
+		records = append(records, TLSRecord{Type: buf[0], Version: uint16(buf[1])<<8 | uint16(buf[2]), Body: buf[5 : 5+n]})
+		buf = buf[5+n:]
+	}
+	return records, nil
+}
+
+// TLSRecordTypes returns the content type of each record.
+func TLSRecordTypes(records []TLSRecord) []byte {
+	a := make([]byte, len(records))
+	for i := range records {
+		a[i] = records[i].Type
+	}
+	return a
+}
+
+// SupportsTLS13 returns true if the standard library's TLS client offers TLS 1.3.
+func SupportsTLS13() bool {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+
+	var supported bool
+	tls.Server(serverConn, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, v := range info.SupportedVersions {
+				supported = supported || v == tlsVersion13
+			}
+			return nil, errors.New("marker")
+		},
+	}).Handshake()
+	return supported
+}
@@ -0,0 +1,311 @@
+package tg
+
+import (
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+
+	"github.com/redjack/marionette"
+)
+
+// WebSocket framing constants.
+const (
+	// websocketGUID is appended to the client key to compute the accept key.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// websocketMaxFrameLen is the largest frame payload sent by the cipher.
+	websocketMaxFrameLen = 16384
+
+	// websocketOpBinary is the header byte of an unfragmented binary frame.
+	websocketOpBinary = 0x82
+
+	// websocketMaskBit is set in the length byte of masked frames.
+	websocketMaskBit = 0x80
+)
+
+// WebSocketPathCipher writes the request path of the upgrade request. The
+// path is read from the "websocket_path" variable and defaults to "/".
+type WebSocketPathCipher struct{}
+
+func NewWebSocketPathCipher() *WebSocketPathCipher {
+	return &WebSocketPathCipher{}
+}
+
+func (c *WebSocketPathCipher) Key() string { return "WEBSOCKET_PATH" }
+
+func (c *WebSocketPathCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *WebSocketPathCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	if path, _ := fsm.Var("websocket_path").(string); path != "" {
+		return []byte(path), nil
+	}
+	return []byte("/"), nil
+}
+
+func (c *WebSocketPathCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *WebSocketPathCipher) Pattern() string { return `/[\x21-\x7e]*` }
+
+func (c *WebSocketPathCipher) Length() int { return 0 }
+
+// WebSocketHostCipher writes the Host header of the upgrade request. The
+// host is read from the "websocket_host" variable and defaults to the
+// server's address.
+type WebSocketHostCipher struct{}
+
+func NewWebSocketHostCipher() *WebSocketHostCipher {
+	return &WebSocketHostCipher{}
+}
+
+func (c *WebSocketHostCipher) Key() string { return "WEBSOCKET_HOST" }
+
+func (c *WebSocketHostCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *WebSocketHostCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	if host, _ := fsm.Var("websocket_host").(string); host != "" {
+		return []byte(host), nil
+	}
+	return []byte(fsm.Host()), nil
+}
+
+func (c *WebSocketHostCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	return nil, nil
+}
+
+func (c *WebSocketHostCipher) Pattern() string { return `[\x21-\x7e]+` }
+
+func (c *WebSocketHostCipher) Length() int { return 0 }
+
+// WebSocketKeyCipher generates the random Sec-WebSocket-Key header of the
+// upgrade request. The key is stored in the "websocket_key" variable on both
+// parties so the accept key can be computed & verified.
+type WebSocketKeyCipher struct{}
+
+func NewWebSocketKeyCipher() *WebSocketKeyCipher {
+	return &WebSocketKeyCipher{}
+}
+
+func (c *WebSocketKeyCipher) Key() string { return "WEBSOCKET_KEY" }
+
+func (c *WebSocketKeyCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *WebSocketKeyCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(buf)
+	fsm.SetVar("websocket_key", key)
+	return []byte(key), nil
+}
+
+func (c *WebSocketKeyCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	fsm.SetVar("websocket_key", string(ciphertext))
+	return nil, nil
+}
+
+func (c *WebSocketKeyCipher) Pattern() string { return `[A-Za-z0-9+/]{22}==` }
+
+func (c *WebSocketKeyCipher) Length() int { return 24 }
+
+// WebSocketAcceptCipher writes the Sec-WebSocket-Accept header of the upgrade
+// response. The client rejects responses which do not match its key.
+type WebSocketAcceptCipher struct{}
+
+func NewWebSocketAcceptCipher() *WebSocketAcceptCipher {
+	return &WebSocketAcceptCipher{}
+}
+
+func (c *WebSocketAcceptCipher) Key() string { return "WEBSOCKET_ACCEPT" }
+
+func (c *WebSocketAcceptCipher) Capacity(fsm marionette.FSM) (int, error) {
+	return 0, nil
+}
+
+func (c *WebSocketAcceptCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	key, _ := fsm.Var("websocket_key").(string)
+	if key == "" {
+		return nil, errors.New("websocket: key unavailable")
+	}
+	return []byte(WebSocketAcceptKey(key)), nil
+}
+
+func (c *WebSocketAcceptCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	key, _ := fsm.Var("websocket_key").(string)
+	if key == "" {
+		return nil, errors.New("websocket: key unavailable")
+	} else if string(ciphertext) != WebSocketAcceptKey(key) {
+		return nil, errors.New("websocket: accept key mismatch")
+	}
+	return nil, nil
+}
+
+func (c *WebSocketAcceptCipher) Pattern() string { return `[A-Za-z0-9+/]{27}=` }
+
+func (c *WebSocketAcceptCipher) Length() int { return 28 }
+
+// WebSocketAcceptKey returns the Sec-WebSocket-Accept value for key.
+func WebSocketAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WebSocketFrameCipher embeds a cell into a binary WebSocket frame. Frames
+// sent by the client are masked, as required by RFC 6455.
+//
+// Payload lengths are chosen from a weighted distribution which can be
+// overridden by the "websocket_frame_lengths" variable. The variable is
+// formatted as a comma-delimited list of "LENGTH:WEIGHT" pairs.
+type WebSocketFrameCipher struct {
+	masked  bool
+	lengths []int
+}
+
+// NewWebSocketFrameCipher returns a new instance of WebSocketFrameCipher which
+// chooses payload lengths from lengths, if the variable is not set.
+func NewWebSocketFrameCipher(masked bool, lengths []int) *WebSocketFrameCipher {
+	return &WebSocketFrameCipher{masked: masked, lengths: lengths}
+}
+
+func (c *WebSocketFrameCipher) Key() string { return "WEBSOCKET_FRAME" }
+
+func (c *WebSocketFrameCipher) Capacity(fsm marionette.FSM) (int, error) {
+	lengths := c.lengths
+	if s, _ := fsm.Var("websocket_frame_lengths").(string); s != "" {
+		var err error
+		if lengths, err = ParseWebSocketFrameLengths(s); err != nil {
+			return 0, err
+		}
+	}
+	return lengths[rand.Intn(len(lengths))] - tlsNonceLen, nil
+}
+
+func (c *WebSocketFrameCipher) Encrypt(fsm marionette.FSM, template string, plaintext []byte) (ciphertext []byte, err error) {
+	payload, err := tlsSeal(fsm, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode header with the smallest length encoding.
+	var lenByte byte
+	if c.masked {
+		lenByte = websocketMaskBit
+	}
+	ciphertext = []byte{websocketOpBinary}
+	switch n := len(payload); {
+	case n < 126:
+		ciphertext = append(ciphertext, lenByte|byte(n))
+	case n <= 0xffff:
+		ciphertext = append(ciphertext, lenByte|126, byte(n>>8), byte(n))
+	default:
+		ciphertext = append(ciphertext, lenByte|127)
+		ciphertext = append(ciphertext, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(ciphertext[len(ciphertext)-8:], uint64(n))
+	}
+
+	if !c.masked {
+		return append(ciphertext, payload...), nil
+	}
+
+	// Mask payload with a random masking key.
+	mask := make([]byte, 4)
+	if _, err := crand.Read(mask); err != nil {
+		return nil, err
+	}
+	ciphertext = append(ciphertext, mask...)
+	for i, b := range payload {
+		ciphertext = append(ciphertext, b^mask[i%4])
+	}
+	return ciphertext, nil
+}
+
+func (c *WebSocketFrameCipher) Decrypt(fsm marionette.FSM, ciphertext []byte) (plaintext []byte, err error) {
+	hdrLen, payloadLen, ok := websocketFrameLen(ciphertext, c.masked)
+	if !ok || len(ciphertext) != hdrLen+payloadLen {
+		return nil, errors.New("websocket: invalid frame")
+	}
+
+	payload := make([]byte, payloadLen)
+	copy(payload, ciphertext[hdrLen:])
+	if c.masked {
+		mask := ciphertext[hdrLen-4 : hdrLen]
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return tlsOpen(fsm, payload)
+}
+
+func (c *WebSocketFrameCipher) Pattern() string {
+	if c.masked {
+		return `\x82[\x80-\xff][\x00-\xff]*`
+	}
+	return `\x82[\x00-\x7f][\x00-\xff]*`
+}
+
+func (c *WebSocketFrameCipher) Length() int { return 0 }
+
+// Validate returns true if value contains exactly one complete frame.
+func (c *WebSocketFrameCipher) Validate(msg, value string) bool {
+	hdrLen, payloadLen, ok := websocketFrameLen([]byte(value), c.masked)
+	return ok && len(value) == hdrLen+payloadLen
+}
+
+// ParseWebSocketFrameLengths parses a comma-delimited list of "LENGTH:WEIGHT"
+// pairs into a weighted list of frame payload lengths. The weight may be omitted.
+func ParseWebSocketFrameLengths(s string) ([]int, error) {
+	return parseWeightedLengths(s, "websocket", "frame", tlsNonceLen+marionette.CellHeaderSize+1, websocketMaxFrameLen)
+}
+
+// websocketFrameLen returns the header & payload length of the frame at the
+// beginning of buf. Returns false if the header is incomplete or invalid.
+func websocketFrameLen(buf []byte, masked bool) (hdrLen, payloadLen int, ok bool) {
+	if len(buf) < 2 || buf[0] != websocketOpBinary || (buf[1]&websocketMaskBit != 0) != masked {
+		return 0, 0, false
+	}
+
+	hdrLen = 2
+	switch n := int(buf[1] &^ websocketMaskBit); n {
+	case 126:
+		if len(buf) < 4 {
+			return 0, 0, false
+		}
+		hdrLen, payloadLen = 4, int(binary.BigEndian.Uint16(buf[2:4]))
+	case 127:
+		if len(buf) < 10 {
+			return 0, 0, false
+		}
+		n := binary.BigEndian.Uint64(buf[2:10])
+		if n > marionette.MaxCellLengthLimit {
+			return 0, 0, false
+		}
+		hdrLen, payloadLen = 10, int(n)
+	default:
+		payloadLen = n
+	}
+
+	if masked {
+		hdrLen += 4
+	}
+	return hdrLen, payloadLen, true
+}
+
+// websocketFrameLengths is the default weighted list of frame payload lengths.
+// Most frames are small messages that fit within the 7-bit length, with
+// occasional larger frames for bulk transfer.
+var websocketFrameLengths, _ = ParseWebSocketFrameLengths("48:3,64:4,96:3,125:4,256:2,512:2,1024:2,1400:2,4096:1,16384:1")
+
+// websocketClientFrameLengths is the default list for client frames, which
+// are typically smaller than server frames.
+var websocketClientFrameLengths, _ = ParseWebSocketFrameLengths("48:4,64:4,96:3,125:3,256:2,512:1,1024:1")
@@ -0,0 +1,152 @@
+package tg_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+func TestWebSocket_Upgrade(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client := NewTLSFSM(nil, marionette.NewStreamSet())
+		buf := MustSendTLS(t, client, "websocket_upgrade_request", "/chat", "www.example.com")
+
+		// Parse request with the standard library.
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			t.Fatal(err)
+		} else if req.URL.Path != "/chat" {
+			t.Fatalf("unexpected path: %s", req.URL.Path)
+		} else if req.Host != "www.example.com" {
+			t.Fatalf("unexpected host: %s", req.Host)
+		} else if v := req.Header.Get("Upgrade"); v != "websocket" {
+			t.Fatalf("unexpected upgrade: %s", v)
+		}
+		key := req.Header.Get("Sec-WebSocket-Key")
+
+		// Receive request on server & respond.
+		server := NewTLSFSM(buf, marionette.NewStreamSet())
+		if err := tg.Recv(context.Background(), &server, "websocket_upgrade_request", "/chat", "www.example.com"); err != nil {
+			t.Fatal(err)
+		} else if v := server.Var("websocket_key"); v != key {
+			t.Fatalf("unexpected key: %v", v)
+		}
+
+		buf = MustSendTLS(t, server, "websocket_upgrade_response")
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+		if err != nil {
+			t.Fatal(err)
+		} else if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		} else if v := resp.Header.Get("Sec-WebSocket-Accept"); v != tg.WebSocketAcceptKey(key) {
+			t.Fatalf("unexpected accept key: %s", v)
+		}
+
+		// Verify response on client.
+		client.ConnFn = NewTLSFSM(buf, nil).ConnFn
+		if err := tg.Recv(context.Background(), &client, "websocket_upgrade_response"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("DefaultPath", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "websocket_upgrade_request")
+		if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf))); err != nil {
+			t.Fatal(err)
+		} else if req.URL.Path != "/" {
+			t.Fatalf("unexpected path: %s", req.URL.Path)
+		} else if req.Host != "127.0.0.1" {
+			t.Fatalf("unexpected host: %s", req.Host)
+		}
+	})
+
+	t.Run("ErrAcceptKeyMismatch", func(t *testing.T) {
+		server := NewTLSFSM(nil, marionette.NewStreamSet())
+		server.SetVar("websocket_key", "dGhlIHNhbXBsZSBub25jZQ==")
+		buf := MustSendTLS(t, server, "websocket_upgrade_response")
+
+		client := NewTLSFSM(buf, marionette.NewStreamSet())
+		client.SetVar("websocket_key", "AAAAAAAAAAAAAAAAAAAAAA==")
+		if err := tg.Recv(context.Background(), &client, "websocket_upgrade_response"); err == nil || err.Error() != `websocket: accept key mismatch` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestWebSocket_Frame(t *testing.T) {
+	for _, tt := range []struct {
+		grammar string
+		lengths string
+		header  []byte
+	}{
+		{grammar: "websocket_client_frame", lengths: "96", header: []byte{0x82, 0x80 | 96}},
+		{grammar: "websocket_server_frame", lengths: "125", header: []byte{0x82, 125}},
+		{grammar: "websocket_server_frame", lengths: "1400", header: []byte{0x82, 126, 0x05, 0x78}},
+	} {
+		t.Run(tt.grammar+"/"+tt.lengths, func(t *testing.T) {
+			streamSet := marionette.NewStreamSet()
+			stream := streamSet.Create()
+			if _, err := stream.Write([]byte(`foo`)); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := MustSendTLS(t, NewTLSFSM(nil, streamSet), tt.grammar, tt.lengths)
+			if !bytes.HasPrefix(buf, tt.header) {
+				t.Fatalf("unexpected frame header: %x", buf[:4])
+			}
+
+			var recvStream *marionette.Stream
+			recvStreamSet := marionette.NewStreamSet()
+			recvStreamSet.OnNewStream = func(s *marionette.Stream) { recvStream = s }
+
+			fsm := NewTLSFSM(buf, recvStreamSet)
+			if err := tg.Recv(context.Background(), &fsm, tt.grammar, tt.lengths); err != nil {
+				t.Fatal(err)
+			} else if recvStream == nil {
+				t.Fatal("expected stream")
+			}
+
+			data := make([]byte, 3)
+			if _, err := io.ReadFull(recvStream, data); err != nil {
+				t.Fatal(err)
+			} else if string(data) != `foo` {
+				t.Fatalf("unexpected read: %q", data)
+			}
+		})
+	}
+
+	// Ensure a partially received frame is not parsed.
+	t.Run("ErrIncomplete", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "websocket_server_frame", "1400")
+		if m := tg.Parse("websocket_server_frame", string(buf[:len(buf)-1])); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+
+	// Ensure unmasked frames are not accepted from the client.
+	t.Run("ErrUnmasked", func(t *testing.T) {
+		buf := MustSendTLS(t, NewTLSFSM(nil, marionette.NewStreamSet()), "websocket_server_frame", "96")
+		if m := tg.Parse("websocket_client_frame", string(buf)); m != nil {
+			t.Fatalf("unexpected values: %#v", m)
+		}
+	})
+}
+
+func TestWebSocketAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	if v := tg.WebSocketAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); v != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key: %s", v)
+	}
+}
+
+func TestParseWebSocketFrameLengths(t *testing.T) {
+	if _, err := tg.ParseWebSocketFrameLengths("20000"); err == nil || err.Error() != `websocket: frame length out of range: 20000` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package marionette
+
+import (
+	"math/rand"
+)
+
+// Scheduler chooses which stream in a stream set sends the next cell.
+//
+// Schedulers are called while the stream set is locked and may keep state
+// for each stream id so a scheduler must not be shared between stream sets.
+type Scheduler interface {
+	// Next returns the stream to dequeue the next cell from. Streams are
+	// non-empty, have pending writes, and are listed in creation order.
+	Next(streams []*Stream) *Stream
+
+	// Dequeued is called after a cell has been dequeued from stream.
+	Dequeued(stream *Stream, cell *Cell)
+}
+
+// RandomScheduler chooses a random stream for each cell. This is the default.
+type RandomScheduler struct{}
+
+// NewRandomScheduler returns a new instance of RandomScheduler.
+func NewRandomScheduler() *RandomScheduler {
+	return &RandomScheduler{}
+}
+
+// Next returns a random stream.
+func (s *RandomScheduler) Next(streams []*Stream) *Stream {
+	return streams[rand.Intn(len(streams))]
+}
+
+// Dequeued is a no-op.
+func (s *RandomScheduler) Dequeued(stream *Stream, cell *Cell) {}
+
+// DRRScheduler implements deficit round-robin scheduling. Each stream's turn
+// adds Quantum bytes multiplied by the stream's weight to its deficit and the
+// stream sends cells until its deficit is exhausted. Streams receive bandwidth
+// in proportion to their weights regardless of their cell sizes.
+type DRRScheduler struct {
+	deficits map[int]int // deficit by stream id
+	cur      int         // stream id currently being served
+	pos      int         // position in round
+
+	// Number of bytes added to a stream's deficit per weight on each turn.
+	// Defaults to MaxCellLength if zero.
+	Quantum int
+}
+
+// NewDRRScheduler returns a new instance of DRRScheduler.
+func NewDRRScheduler() *DRRScheduler {
+	return &DRRScheduler{Quantum: MaxCellLength}
+}
+
+// Next returns the current stream if it has a remaining deficit. Otherwise
+// moves to the next stream in the round.
+func (s *DRRScheduler) Next(streams []*Stream) *Stream {
+	if s.deficits == nil {
+		s.deficits = make(map[int]int)
+	}
+
+	// Streams without pending writes lose their deficit.
+	for id := range s.deficits {
+		if !containsStreamID(streams, id) {
+			delete(s.deficits, id)
+		}
+	}
+
+	// Continue serving the current stream until its deficit is used.
+	if s.deficits[s.cur] > 0 {
+		for _, stream := range streams {
+			if stream.ID() == s.cur {
+				return stream
+			}
+		}
+	}
+
+	quantum := s.Quantum
+	if quantum <= 0 {
+		quantum = MaxCellLength
+	}
+
+	// Visit streams in order, adding to each deficit, until one can send.
+	for {
+		s.pos = (s.pos + 1) % len(streams)
+		stream := streams[s.pos]
+		s.deficits[stream.ID()] += quantum * stream.Weight()
+		if s.deficits[stream.ID()] > 0 {
+			s.cur = stream.ID()
+			return stream
+		}
+	}
+}
+
+// Dequeued deducts the cell size from the stream's deficit.
+func (s *DRRScheduler) Dequeued(stream *Stream, cell *Cell) {
+	if _, ok := s.deficits[stream.ID()]; ok {
+		s.deficits[stream.ID()] -= CellHeaderSize + len(cell.Payload)
+	}
+}
+
+// PriorityScheduler implements strict priority scheduling. Cells are only sent
+// from the streams with the highest priority. Streams with equal priority are
+// chosen randomly.
+type PriorityScheduler struct{}
+
+// NewPriorityScheduler returns a new instance of PriorityScheduler.
+func NewPriorityScheduler() *PriorityScheduler {
+	return &PriorityScheduler{}
+}
+
+// Next returns a random stream with the highest priority.
+func (s *PriorityScheduler) Next(streams []*Stream) *Stream {
+	var candidates []*Stream
+	for _, stream := range streams {
+		if len(candidates) == 0 || stream.Priority() > candidates[0].Priority() {
+			candidates = append(candidates[:0], stream)
+		} else if stream.Priority() == candidates[0].Priority() {
+			candidates = append(candidates, stream)
+		}
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Dequeued is a no-op.
+func (s *PriorityScheduler) Dequeued(stream *Stream, cell *Cell) {}
+
+// containsStreamID returns true if streams contains a stream with the given id.
+func containsStreamID(streams []*Stream, id int) bool {
+	for _, stream := range streams {
+		if stream.ID() == id {
+			return true
+		}
+	}
+	return false
+}
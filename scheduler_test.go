@@ -0,0 +1,71 @@
+package marionette_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/redjack/marionette"
+)
+
+func TestDRRScheduler(t *testing.T) {
+	t.Run("Weighted", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		ss.Scheduler = &marionette.DRRScheduler{Quantum: 1000}
+		defer ss.Close()
+
+		bulk, interactive := ss.Create(), ss.Create()
+		interactive.SetWeight(3)
+
+		// Keep both streams backlogged & count bytes sent from each.
+		sent := MustDequeueBacklogged(t, ss, []*marionette.Stream{bulk, interactive}, 400)
+		if ratio := float64(sent[interactive.ID()]) / float64(sent[bulk.ID()]); ratio < 2.5 || ratio > 3.5 {
+			t.Fatalf("unexpected ratio: %.2f (%v)", ratio, sent)
+		}
+	})
+}
+
+func TestPriorityScheduler(t *testing.T) {
+	ss := marionette.NewStreamSet()
+	ss.Scheduler = marionette.NewPriorityScheduler()
+	defer ss.Close()
+
+	low, high := ss.Create(), ss.Create()
+	high.SetPriority(1)
+	if _, err := low.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if _, err := high.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Higher priority stream is always sent first.
+	if cell := ss.Dequeue(0); cell == nil || string(cell.Payload) != "bar" {
+		t.Fatalf("unexpected cell: %#v", cell)
+	} else if cell := ss.Dequeue(0); cell == nil || string(cell.Payload) != "foo" {
+		t.Fatalf("unexpected cell: %#v", cell)
+	}
+}
+
+// MustDequeueBacklogged dequeues n cells while keeping all streams' write
+// buffers non-empty. Returns the number of payload bytes sent by stream id.
+func MustDequeueBacklogged(tb testing.TB, ss *marionette.StreamSet, streams []*marionette.Stream, n int) map[int]int {
+	tb.Helper()
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	sent := make(map[int]int)
+	for i := 0; i < n; i++ {
+		for _, stream := range streams {
+			if stream.WriteBufferLen() == 0 {
+				if _, err := stream.Write(data); err != nil {
+					tb.Fatal(err)
+				}
+			}
+		}
+
+		cell := ss.Dequeue(100)
+		if cell == nil {
+			tb.Fatal("expected cell")
+		}
+		sent[cell.StreamID] += len(cell.Payload)
+	}
+	return sent
+}
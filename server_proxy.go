@@ -1,81 +1,189 @@
 package marionette
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/armon/go-socks5"
 	"go.uber.org/zap"
 )
 
-// ServerProxy represents a proxy between a marionette listener and another server.
+// DefaultProxyDialTimeout is the default time allowed for a server proxy to
+// connect to a stream's destination.
+const DefaultProxyDialTimeout = 10 * time.Second
+
+// StreamAccepter accepts streams opened by a marionette peer. Implemented by
+// Listener on the server and by Dialer on the client.
+type StreamAccepter interface {
+	Accept() (net.Conn, error)
+}
+
+// ServerProxy represents a proxy between a marionette listener and another
+// server. Clients may also use it with a Dialer to connect streams opened by
+// the server.
 type ServerProxy struct {
-	ln *Listener
-	wg sync.WaitGroup
+	ln        StreamAccepter
+	allowlist []destinationPattern
+	conns     proxyConns
+	wg        sync.WaitGroup
 
 	// Host and port to proxy requests to.
 	// Ignored if a socks5 server is enabled.
 	Addr string
 
 	// Server used for proxying requests.
+	// Ignored for streams which request a destination.
 	Socks5Server *socks5.Server
+
+	// Destinations which streams may request. Patterns are "host:port" where
+	// the host is a hostname, an IP address, a CIDR range, or "*", and the
+	// port is a number or "*". CIDR ranges only match IP address destinations.
+	//
+	// If empty, any destination is allowed when a socks5 server is enabled.
+	// Otherwise, streams which request a destination are refused.
+	AllowedDestinations []string
+
+	// Time allowed to connect to a destination before the stream is reset.
+	// Defaults to DefaultProxyDialTimeout.
+	DialTimeout time.Duration
+
+	// Logger used by the proxy. Defaults to Logger.
+	Logger *zap.Logger
 }
 
 // NewServerProxy returns a new instance of ServerProxy.
-func NewServerProxy(ln *Listener) *ServerProxy {
+func NewServerProxy(ln StreamAccepter) *ServerProxy {
 	return &ServerProxy{ln: ln}
 }
 
 func (p *ServerProxy) Open() error {
+	for _, s := range p.AllowedDestinations {
+		pattern, err := parseDestinationPattern(s)
+		if err != nil {
+			return err
+		}
+		p.allowlist = append(p.allowlist, pattern)
+	}
+
 	p.wg.Add(1)
 	go func() { defer p.wg.Done(); p.run() }()
 
 	return nil
 }
 
+// Close closes active connections. Streams accepted afterward are refused.
+// The accepter is not closed.
 func (p *ServerProxy) Close() error {
-	return nil
+	return p.conns.close()
+}
+
+// Shutdown refuses new streams and waits for active connections to finish.
+// If ctx is done first then the remaining connections are closed and the
+// context's error is returned. The accepter is not closed.
+func (p *ServerProxy) Shutdown(ctx context.Context) error {
+	return p.conns.shutdown(ctx)
+}
+
+// logger returns the configured logger or the global logger.
+func (p *ServerProxy) logger() *zap.Logger {
+	if p.Logger == nil {
+		return Logger
+	}
+	return p.Logger
 }
 
 func (p *ServerProxy) run() {
-	Logger.Debug("server proxy: listening")
-	defer Logger.Debug("server proxy: closed")
+	p.logger().Debug("server proxy: listening")
+	defer p.logger().Debug("server proxy: closed")
 
 	for {
 		conn, err := p.ln.Accept()
 		if err != nil {
-			Logger.Debug("server proxy: listener error", zap.Error(err))
+			p.logger().Debug("server proxy: listener error", zap.Error(err))
 			return
 		}
 
+		if !p.conns.add(conn) {
+			if stream, ok := conn.(*Stream); ok {
+				stream.Reset(ResetCodeRefused)
+			} else {
+				conn.Close()
+			}
+			continue
+		}
+
 		p.wg.Add(1)
 		go func() { defer p.wg.Done(); p.handleConn(conn) }()
 	}
 }
 
 func (p *ServerProxy) handleConn(conn net.Conn) {
+	defer p.conns.remove(conn)
 	defer conn.Close()
 
-	Logger.Debug("server proxy: connection open")
-	defer Logger.Debug("server proxy: connection closed")
+	p.logger().Debug("server proxy: connection open")
+	defer p.logger().Debug("server proxy: connection closed")
+
+	// Wait for the stream's first cell to determine its destination.
+	var addr string
+	if stream, ok := conn.(*Stream); ok {
+		if addr, ok = waitStreamDestination(stream); !ok {
+			return
+		}
+	}
+
+	// Connect streams which request a destination directly.
+	if addr != "" {
+		if !p.allowed(addr) {
+			p.logger().Debug("server proxy: destination not allowed", zap.String("address", addr))
+			conn.(*Stream).Reset(ResetCodeRefused)
+			return
+		}
+		p.proxy(conn, addr)
+		return
+	}
 
 	// If the proxy address is "socks5" then hand off to socks5 server.
 	if p.Socks5Server != nil {
 		if err := p.Socks5Server.ServeConn(conn); err != nil {
-			Logger.Debug("server proxy: socks5 error", zap.Error(err))
+			p.logger().Debug("server proxy: socks5 error", zap.Error(err))
 		}
 		return
 	}
 
+	p.proxy(conn, p.Addr)
+}
+
+// proxy connects to addr and copies between it and conn until an error occurs.
+// Streams are reset if the connection cannot be made within DialTimeout.
+func (p *ServerProxy) proxy(conn net.Conn, addr string) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyDialTimeout
+	}
+
 	// Connect to remote server.
-	proxyConn, err := net.Dial("tcp", p.Addr)
+	proxyConn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
-		Logger.Debug("server proxy: cannot connect to remote server", zap.String("address", p.Addr))
+		p.logger().Debug("server proxy: cannot connect to remote server", zap.String("address", addr), zap.Error(err))
+		if stream, ok := conn.(*Stream); ok {
+			stream.Reset(ResetCodeRefused)
+		}
 		return
 	}
 	defer proxyConn.Close()
 
+	if !p.conns.track(proxyConn) {
+		return
+	}
+	defer p.conns.untrack(proxyConn)
+
 	// Copy between connection and proxy until an error occurs.
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -90,3 +198,99 @@ func (p *ServerProxy) handleConn(conn net.Conn) {
 	}()
 	wg.Wait()
 }
+
+// allowed returns true if streams may request a connection to addr.
+func (p *ServerProxy) allowed(addr string) bool {
+	if len(p.allowlist) == 0 {
+		return p.Socks5Server != nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range p.allowlist {
+		if pattern.match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationPattern matches destination addresses requested by streams.
+type destinationPattern struct {
+	host  string     // hostname or IP address, "*" matches any host
+	ipnet *net.IPNet // CIDR range, if specified
+	port  string     // port number, "*" matches any port
+}
+
+// ValidateDestinationPattern returns an error if s cannot be used as one of
+// ServerProxy.AllowedDestinations.
+func ValidateDestinationPattern(s string) error {
+	_, err := parseDestinationPattern(s)
+	return err
+}
+
+// parseDestinationPattern parses a "host:port" destination pattern.
+func parseDestinationPattern(s string) (destinationPattern, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return destinationPattern{}, fmt.Errorf("marionette: invalid destination pattern: %q", s)
+	}
+
+	var pattern destinationPattern
+	if strings.Contains(host, "/") {
+		if _, pattern.ipnet, err = net.ParseCIDR(host); err != nil {
+			return destinationPattern{}, fmt.Errorf("marionette: invalid destination pattern: %q", s)
+		}
+	} else {
+		pattern.host = host
+	}
+
+	pattern.port = port
+	if port != "*" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return destinationPattern{}, fmt.Errorf("marionette: invalid destination pattern: %q", s)
+		}
+		pattern.port = strconv.Itoa(n)
+	}
+
+	return pattern, nil
+}
+
+// match returns true if host & port match the pattern.
+func (p *destinationPattern) match(host, port string) bool {
+	if p.port != "*" && p.port != port {
+		return false
+	}
+
+	switch {
+	case p.ipnet != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && p.ipnet.Contains(ip)
+	case p.host == "*":
+		return true
+	}
+
+	// Compare IP addresses by value so equivalent forms match.
+	if ip, other := net.ParseIP(p.host), net.ParseIP(host); ip != nil || other != nil {
+		return ip != nil && other != nil && ip.Equal(other)
+	}
+	return strings.EqualFold(strings.TrimSuffix(p.host, "."), strings.TrimSuffix(host, "."))
+}
+
+// waitStreamDestination waits for the first cell of stream and returns its
+// requested destination. Returns false if the stream closes before opening.
+func waitStreamDestination(stream *Stream) (string, bool) {
+	select {
+	case <-stream.OpenNotify():
+	case <-stream.ReadCloseNotify():
+		select {
+		case <-stream.OpenNotify():
+		default:
+			return "", false
+		}
+	}
+	return stream.Destination(), true
+}
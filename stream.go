@@ -1,6 +1,7 @@
 package marionette
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,6 +21,21 @@ var (
 
 	// ErrWriteTooLarge is returned when a Write() is larger than the buffer.
 	ErrWriteTooLarge = errors.New("marionette: write too large")
+
+	// ErrTimeout is returned when a stream read or write exceeds its deadline.
+	// Implements the net.Error interface.
+	ErrTimeout error = &timeoutError{}
+)
+
+const (
+	// maxCompressionRatio limits the amount of data tried in a compressed cell.
+	maxCompressionRatio = 8
+
+	// StreamWindowSize is the number of unread bytes a stream accepts from its
+	// peer. The peer stops sending once the window is exhausted until the
+	// reader consumes data and a larger window is advertised. Streams in a set
+	// with a larger maximum cell size use a proportionally larger window.
+	StreamWindowSize = 4 * MaxCellLength
 )
 
 // Ensure type implements interface.
@@ -29,10 +45,11 @@ var _ net.Conn = &Stream{}
 // Data is injected into the stream using cells which provide ordering and payload data.
 // Implements the net.Conn interface.
 type Stream struct {
-	mu   sync.RWMutex
-	id   int
-	rseq int
-	wseq int
+	mu     sync.RWMutex
+	id     int
+	rseq   int
+	wseq   int
+	config *Config // shared configuration, if any
 
 	// Read-side close management.
 	ronce       sync.Once
@@ -60,6 +77,41 @@ type Stream struct {
 
 	modTime time.Time // last change to read or write
 
+	// Read & write deadlines. Zero if reads & writes do not time out.
+	rdeadline, wdeadline time.Time
+
+	// Cells sent but not yet acknowledged by the peer & whether the peer
+	// needs an acknowledgement. Only used if retransmitTimeout is non-zero.
+	retransmitTimeout time.Duration
+	unacked           []*unackedCell
+	ackPending        bool
+
+	maxCellLength int  // largest cell dequeued, sizes buffers & window
+	compress      bool // compress cell payloads
+
+	// Flow control byte counts. These wrap at 2^32 to match the ack payload.
+	rn            uint32 // bytes read by the caller
+	rwindow       uint32 // receive limit last advertised to the peer
+	wn            uint32 // payload bytes sent to the peer
+	wwindow       uint32 // receive limit advertised by the peer
+	windowPending bool   // true if a larger window should be advertised
+
+	// Reset state. resetErr is set once the stream is reset by either party.
+	resetErr   *StreamResetError
+	rstPending bool // true if an RST cell needs to be sent
+
+	// Destination address requested when the stream was opened, if any.
+	// openPending is set until the open cell is sent to the peer. openNotify
+	// is closed once the first cell from the peer has been processed.
+	destination string
+	openPending bool
+	opened      bool
+	openNotify  chan struct{}
+
+	// Scheduling parameters used by the stream set's scheduler.
+	priority int
+	weight   int
+
 	onWrite func() // callback when a new write buffer changes
 
 	// Stream verbosely logs to trace writer when set.
@@ -76,15 +128,69 @@ func NewStream(id int) *Stream {
 		writeClosing: make(chan struct{}),
 		rnotify:      make(chan struct{}),
 		wnotify:      make(chan struct{}),
+		openNotify:   make(chan struct{}),
 		modTime:      time.Now(),
+		rwindow:      StreamWindowSize,
+		wwindow:      StreamWindowSize,
+		weight:       1,
+
+		maxCellLength: MaxCellLength,
 
 		writeCloseNotifiedNotify: make(chan struct{}),
 	}
 }
 
+// setMaxCellLength sizes the stream's buffers & window for cells of up to n
+// bytes. Must be called before the stream is used.
+func (s *Stream) setMaxCellLength(n int) {
+	s.maxCellLength = n
+	s.rbuf, s.wbuf = make([]byte, 0, n), make([]byte, 0, n)
+	s.rwindow, s.wwindow = s.windowSize(), s.windowSize()
+}
+
+// windowSize returns the size of the stream's receive window.
+func (s *Stream) windowSize() uint32 {
+	return uint32(4 * s.maxCellLength)
+}
+
 // ID returns the stream id.
 func (s *Stream) ID() int { return s.id }
 
+// Priority returns the scheduling priority of the stream. Defaults to zero.
+func (s *Stream) Priority() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.priority
+}
+
+// SetPriority sets the scheduling priority. Streams with a higher priority are
+// sent first when the stream set uses a PriorityScheduler.
+func (s *Stream) SetPriority(priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.priority = priority
+}
+
+// Weight returns the scheduling weight of the stream. Defaults to one.
+func (s *Stream) Weight() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.weight
+}
+
+// SetWeight sets the scheduling weight. Streams receive bandwidth in proportion
+// to their weight when the stream set uses a DRRScheduler. Weights less than
+// one are set to one.
+func (s *Stream) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weight = weight
+}
+
 // ModTime returns the last time a cell was added or removed from the stream.
 func (s *Stream) ModTime() time.Time {
 	s.mu.RLock()
@@ -116,7 +222,13 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 	for {
 		// Attempt to read from the buffer. Exit if bytes read or error.
 		s.mu.Lock()
-		if n, err = s.read(b); n != 0 || err != nil {
+		if s.resetErr != nil {
+			s.mu.Unlock()
+			return 0, s.resetErr
+		} else if deadlineExceeded(s.rdeadline) {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		} else if n, err = s.read(b); n != 0 || err != nil {
 			s.mu.Unlock()
 			return n, err
 		} else if n == 0 && len(s.rqueue) == 0 && s.readClosed {
@@ -124,16 +236,19 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 			s.mu.Unlock()
 			return 0, io.EOF
 		}
-		notify := s.rnotify
+		notify, deadline := s.rnotify, s.rdeadline
 
 		s.processReadQueue()
 		s.mu.Unlock()
 
-		// Wait for notification of new read buffer bytes.
+		// Wait for notification of new read buffer bytes or the deadline.
+		timer := newDeadlineTimer(deadline)
 		select {
 		case <-s.readClosing:
 		case <-notify:
+		case <-timer.C():
 		}
+		timer.Stop()
 	}
 }
 
@@ -154,9 +269,78 @@ func (s *Stream) read(b []byte) (n int, err error) {
 	copy(s.rbuf, s.rbuf[n:])
 	s.rbuf = s.rbuf[:len(s.rbuf)-n]
 
+	// Advertise a larger window once half of the window has been read.
+	s.rn += uint32(n)
+	if !s.windowPending && s.receiveLimit()-s.rwindow >= s.windowSize()/2 {
+		s.windowPending = true
+		s.notifyWrite()
+	}
+
 	return n, nil
 }
 
+// receiveLimit returns the stream offset up to which bytes can be received.
+func (s *Stream) receiveLimit() uint32 {
+	return s.rn + s.windowSize()
+}
+
+// SendWindow returns the number of bytes the peer is currently able to receive.
+func (s *Stream) SendWindow() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sendWindow()
+}
+
+func (s *Stream) sendWindow() int {
+	if n := int32(s.wwindow - s.wn); n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// SendPending returns true if the stream has buffered data within the peer's
+// window or has an end-of-stream to send.
+//
+// If retransmitting and the window has been exhausted for longer than the
+// retransmit timeout then an empty cell is sent to probe the peer. Its ack
+// carries the current window in case an earlier window update was lost.
+func (s *Stream) SendPending() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.writeCloseNotified || s.resetErr != nil {
+		return false
+	} else if s.openPending {
+		return true
+	} else if len(s.wbuf) > 0 {
+		return s.sendWindow() > 0 || (s.retransmitTimeout > 0 && time.Since(s.modTime) >= s.retransmitTimeout)
+	}
+	return s.writeClosed
+}
+
+// Destination returns the address requested when the stream was opened. For
+// streams created by the peer, the address is available after OpenNotify()
+// is closed. Returns a blank string if no destination was requested.
+func (s *Stream) Destination() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.destination
+}
+
+// OpenNotify returns a channel that closes once the first cell from the peer
+// has been processed.
+func (s *Stream) OpenNotify() <-chan struct{} { return s.openNotify }
+
+// setDestination requests addr from the peer when the stream is opened.
+// Must be called before any data is written.
+func (s *Stream) setDestination(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destination = addr
+	s.openPending = true
+	s.notifyWrite()
+}
+
 // ReadBufferLen returns the number of bytes in the read buffer.
 func (s *Stream) ReadBufferLen() int {
 	s.mu.RLock()
@@ -175,22 +359,31 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 		// Attempt to write to write buffer.
 		// If no room available then wait for write buffer to change and try again.
 		s.mu.Lock()
-		if s.writeClosed {
+		if s.resetErr != nil {
+			s.mu.Unlock()
+			return 0, s.resetErr
+		} else if s.writeClosed {
 			s.mu.Unlock()
 			return 0, ErrStreamClosed
+		} else if deadlineExceeded(s.wdeadline) {
+			s.mu.Unlock()
+			return 0, ErrTimeout
 		} else if n, err = s.write(b); n != 0 || err != nil {
 			s.notifyWrite()
 			s.mu.Unlock()
 			return n, err
 		}
-		notify := s.wnotify
+		notify, deadline := s.wnotify, s.wdeadline
 		s.mu.Unlock()
 
-		// Wait for a change in the write buffer.
+		// Wait for a change in the write buffer or the deadline.
+		timer := newDeadlineTimer(deadline)
 		select {
 		case <-s.writeClosing:
 		case <-notify:
+		case <-timer.C():
 		}
+		timer.Stop()
 	}
 }
 
@@ -244,6 +437,23 @@ func (s *Stream) Enqueue(cell *Cell) error {
 		fmt.Fprintf(s.TraceWriter, "[Enqueue] seq=%d rseq=%d", cell.SequenceID, s.rseq)
 	}
 
+	// Control cells do not use a sequence id & are handled immediately.
+	if !isSequencedCellType(cell.Type) {
+		s.enqueueControl(cell)
+		return nil
+	}
+
+	// Ignore data received after the stream has been reset.
+	if s.resetErr != nil {
+		return nil
+	}
+
+	// Acknowledge every cell, including duplicates, as the peer will
+	// continue to resend until it receives an acknowledgement.
+	if s.retransmitTimeout > 0 {
+		s.ackPending = true
+	}
+
 	// If sequence is a duplicate then ignore it.
 	if cell.SequenceID < s.rseq {
 		s.logger().Info("duplicate cell sequence",
@@ -263,6 +473,44 @@ func (s *Stream) Enqueue(cell *Cell) error {
 	return nil
 }
 
+// enqueueControl applies a control cell to the stream. Unknown types are ignored.
+func (s *Stream) enqueueControl(cell *Cell) {
+	switch cell.Type {
+	case CellTypeAck:
+		s.ack(cell.SequenceID)
+		s.updateWindow(cell.Payload)
+
+	case CellTypeWindowUpdate:
+		s.updateWindow(cell.Payload)
+
+	case CellTypeRST:
+		var code int
+		if len(cell.Payload) >= RSTPayloadSize {
+			code = int(binary.BigEndian.Uint32(cell.Payload))
+		}
+		if s.TraceWriter != nil {
+			fmt.Fprintf(s.TraceWriter, "[rst:recv] code=%d", code)
+		}
+		s.reset(&StreamResetError{Code: code, Remote: true})
+		s.notifyWriteClosed() // peer does not expect an EOS
+
+	default:
+		s.logger().Debug("unknown cell type", zap.Int("type", cell.Type))
+	}
+}
+
+// updateWindow extends the send window if the peer has advertised more space.
+// Windows from reordered cells are ignored.
+func (s *Stream) updateWindow(payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	if window := binary.BigEndian.Uint32(payload); int32(window-s.wwindow) > 0 {
+		s.wwindow = window
+		s.notifyWrite()
+	}
+}
+
 // processReadQueue deserializes cells in the read queue and writes the bytes to
 // the read buffer. Queue processing stops when the next cell does not match the
 // next expected sequence or if there is not enough room left in the read buffer.
@@ -273,20 +521,33 @@ func (s *Stream) processReadQueue() {
 		cell := s.rqueue[0]
 		if cell.SequenceID != s.rseq {
 			break // out-of-order
-		} else if len(cell.Payload) > cap(s.rbuf)-len(s.rbuf) {
+		} else if cell.Type != CellTypeOpen && len(cell.Payload) > cap(s.rbuf)-len(s.rbuf) {
 			break // not enough space on buffer
 		}
 
-		// Extend buffer and copy cell payload.
-		s.rbuf = s.rbuf[:len(s.rbuf)+len(cell.Payload)]
-		copy(s.rbuf[len(s.rbuf)-len(cell.Payload):], cell.Payload)
-		notify = true
+		// Record the requested destination of the first cell. Otherwise,
+		// extend buffer and copy cell payload.
+		if cell.Type == CellTypeOpen {
+			if !s.opened {
+				s.destination = string(cell.Payload)
+			}
+		} else {
+			s.rbuf = s.rbuf[:len(s.rbuf)+len(cell.Payload)]
+			copy(s.rbuf[len(s.rbuf)-len(cell.Payload):], cell.Payload)
+			notify = true
+		}
 
 		// Shift cell off queue and increment sequence.
 		s.rqueue[0] = nil
 		s.rqueue = s.rqueue[1:]
 		s.rseq++
 
+		// Notify that the stream's destination is available.
+		if !s.opened {
+			s.opened = true
+			close(s.openNotify)
+		}
+
 		// If this is the end of the stream then close out reads.
 		if cell.Type == CellTypeEOS {
 			if s.TraceWriter != nil {
@@ -313,16 +574,32 @@ func (s *Stream) Dequeue(n int) *Cell {
 		fmt.Fprintf(s.TraceWriter, "[Dequeue] n=%d", n)
 	}
 
-	// Exit immediately if stream has already notified that its writes are closed.
-	if s.writeCloseNotified {
+	// Resend an unacknowledged cell, if one has timed out.
+	if cell := s.dequeueRetransmit(n); cell != nil {
+		return cell
+	}
+
+	// Exit immediately if stream has already notified that its writes are
+	// closed or if the stream has been reset.
+	if s.writeCloseNotified || s.resetErr != nil {
 		return nil
 	}
 
+	// Request the destination from the peer before sending any data.
+	if s.openPending {
+		return s.dequeueOpen(n)
+	}
+
 	// Determine the amount of data to read.
+	unbounded := n == 0
 	if n == 0 {
-		n = len(s.wbuf) + CellHeaderSize
-	} else if n > MaxCellLength {
-		n = MaxCellLength
+		n = len(s.wbuf)
+		if w := s.sendWindow(); n > w {
+			n = w
+		}
+		n += CellHeaderSize
+	} else if n > s.maxCellLength {
+		n = s.maxCellLength
 	}
 
 	// Determine next sequence.
@@ -335,37 +612,276 @@ func (s *Stream) Dequeue(n int) *Cell {
 		if s.TraceWriter != nil {
 			fmt.Fprintf(s.TraceWriter, "[eos:send] seq=%d", sequenceID)
 		}
-		s.writeCloseNotified = true
-		close(s.writeCloseNotifiedNotify)
-		return NewCell(s.id, sequenceID, n, CellTypeEOS)
+		s.notifyWriteClosed()
+		return s.track(NewCell(s.id, sequenceID, n, CellTypeEOS))
 	}
 
 	// Build cell.
 	cell := NewCell(s.id, sequenceID, n, CellTypeNormal)
 
-	// Determine payload size.
+	// Determine payload size. Limit to the peer's receive window.
 	payloadN := n - CellHeaderSize
 	if payloadN > len(s.wbuf) {
 		payloadN = len(s.wbuf)
 	}
+	if w := s.sendWindow(); payloadN > w {
+		payloadN = w
+	}
+
+	// If compressing, fit as much of the buffer as possible in the cell.
+	// Unbounded cells are not padded to their uncompressed size.
+	var compressed []byte
+	if s.compress && payloadN > 0 {
+		cell.Compressed = true
+		payloadN, compressed = s.compressiblePayloadN(payloadN)
+		if unbounded {
+			cell.Length = 0
+		}
+	}
 
 	// Copy buffer to payload
 	if payloadN > 0 {
 		cell.Payload = make([]byte, payloadN)
 		copy(cell.Payload, s.wbuf[:payloadN])
 
+		// Compress the payload now, reusing the result from sizing it, so
+		// that the cell is not compressed again when sized or serialized.
+		if compressed != nil {
+			cell.compressed, cell.compressedValid = compressed, true
+		} else if cell.Compressed {
+			cell.encodePayload()
+		}
+
 		// Remove payload bytes from buffer.
 		remaining := len(s.wbuf) - payloadN
 		copy(s.wbuf[:remaining], s.wbuf[payloadN:len(s.wbuf)])
 		s.wbuf = s.wbuf[:remaining]
+		s.wn += uint32(payloadN)
 
 		// Send notification that write buffer has changed.
 		s.notifyWrite()
 	}
 
+	return s.track(cell)
+}
+
+// dequeueOpen returns an open cell containing the stream's destination.
+// The cell is unpadded if it does not fit in n bytes.
+func (s *Stream) dequeueOpen(n int) *Cell {
+	if n > s.maxCellLength {
+		n = s.maxCellLength
+	}
+
+	if s.TraceWriter != nil {
+		fmt.Fprintf(s.TraceWriter, "[open:send] seq=%d destination=%s", s.wseq, s.destination)
+	}
+
+	cell := NewCell(s.id, s.wseq, n, CellTypeOpen)
+	cell.Payload = []byte(s.destination)
+	if n == 0 || cell.Size() > n {
+		cell.Length = 0
+	}
+
+	s.wseq++
+	s.openPending = false
+	s.modTime = time.Now()
+	return s.track(cell)
+}
+
+// compressiblePayloadN returns the number of bytes from the write buffer which
+// fit in size bytes once compressed. The number of bytes is limited by the
+// peer's window, the max cell size, and a maximum compression ratio. If more
+// than size bytes fit then their compressed form is also returned.
+func (s *Stream) compressiblePayloadN(size int) (int, []byte) {
+	max := len(s.wbuf)
+	if w := s.sendWindow(); max > w {
+		max = w
+	}
+	if max > s.maxCellLength-CellHeaderSize {
+		max = s.maxCellLength - CellHeaderSize
+	}
+	if max > size*maxCompressionRatio {
+		max = size * maxCompressionRatio
+	}
+
+	// Shrink the prefix in proportion to its compressed size until it fits.
+	// Uncompressed payloads are sent when compression does not reduce the
+	// size so size bytes always fit. Incompressible data stops after one try.
+	for i := 0; i < 4 && max > size; i++ {
+		buf := compress(s.wbuf[:max])
+		if len(buf) <= size {
+			return max, buf
+		}
+		max = (max * size / len(buf)) * 15 / 16
+	}
+	return size, nil
+}
+
+// track adds cell to the retransmit queue, if retransmission is enabled.
+func (s *Stream) track(cell *Cell) *Cell {
+	if s.retransmitTimeout > 0 {
+		s.unacked = append(s.unacked, &unackedCell{cell: cell, sentAt: time.Now()})
+	}
+	return cell
+}
+
+// dequeueRetransmit returns a copy of the oldest timed out cell padded to n
+// bytes. Cells which do not fit in n bytes are returned unpadded so that they
+// can be fragmented by the stream set. Returns nil if no cells need to be resent.
+func (s *Stream) dequeueRetransmit(n int) *Cell {
+	if n > s.maxCellLength {
+		n = s.maxCellLength
+	}
+
+	now := time.Now()
+	for _, u := range s.unacked {
+		if now.Sub(u.sentAt) < s.retransmitTimeout {
+			continue
+		}
+
+		if s.TraceWriter != nil {
+			fmt.Fprintf(s.TraceWriter, "[retransmit] seq=%d", u.cell.SequenceID)
+		}
+		u.sentAt = now
+
+		other := *u.cell
+		other.Length = n
+		if n != 0 && CellHeaderSize+len(u.cell.Payload) > n {
+			other.Length = 0
+		}
+		return &other
+	}
+	return nil
+}
+
+// ack removes all cells before sequenceID from the retransmit queue.
+func (s *Stream) ack(sequenceID int) {
+	if s.TraceWriter != nil {
+		fmt.Fprintf(s.TraceWriter, "[ack:recv] seq=%d", sequenceID)
+	}
+
+	var i int
+	for i < len(s.unacked) && s.unacked[i].cell.SequenceID < sequenceID {
+		s.unacked[i] = nil
+		i++
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// Retransmit marks all unacknowledged cells to be resent on the next dequeue.
+// Used when the connection a cell was sent over may have lost it.
+func (s *Stream) Retransmit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.unacked {
+		u.sentAt = time.Time{}
+	}
+}
+
+// RetransmitPending returns true if an unacknowledged cell has timed out.
+func (s *Stream) RetransmitPending() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.unacked {
+		if time.Since(u.sentAt) >= s.retransmitTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// ControlPending returns true if a reset, an acknowledgement, or a larger
+// receive window needs to be sent to the peer.
+func (s *Stream) ControlPending() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rstPending || s.ackPending || s.windowPending
+}
+
+// DequeueControl returns the next pending control cell. A pending reset is sent
+// first. Otherwise, an ack is sent for all cells received in sequence along
+// with the current receive window or, if no ack is pending, a window update.
+// Returns nil if no control cell is pending.
+func (s *Stream) DequeueControl(n int) *Cell {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cell *Cell
+	switch {
+	case s.rstPending:
+		if s.TraceWriter != nil {
+			fmt.Fprintf(s.TraceWriter, "[rst:send] code=%d", s.resetErr.Code)
+		}
+		s.rstPending = false
+		s.notifyWriteClosed()
+		cell = NewCell(s.id, 0, n, CellTypeRST)
+		cell.Payload = make([]byte, RSTPayloadSize)
+		binary.BigEndian.PutUint32(cell.Payload, uint32(s.resetErr.Code))
+
+	case s.ackPending, s.windowPending:
+		typ := CellTypeAck
+		if !s.ackPending {
+			typ = CellTypeWindowUpdate
+		}
+		s.ackPending, s.windowPending = false, false
+		s.rwindow = s.receiveLimit()
+
+		if s.TraceWriter != nil {
+			fmt.Fprintf(s.TraceWriter, "[ack:send] type=%d seq=%d window=%d", typ, s.rseq, s.rwindow)
+		}
+		cell = NewCell(s.id, s.rseq, n, typ)
+		cell.Payload = make([]byte, AckPayloadSize)
+		binary.BigEndian.PutUint32(cell.Payload, s.rwindow)
+
+	default:
+		return nil
+	}
+
+	if n == 0 || n > s.maxCellLength {
+		cell.Length = CellHeaderSize + len(cell.Payload)
+	}
 	return cell
 }
 
+// Reset aborts the stream. Buffered data is discarded and an RST cell with
+// code is sent to the peer. Reads & writes on both sides of the stream return
+// a *StreamResetError. Resetting a stream more than once has no effect.
+func (s *Stream) Reset(code int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.resetErr != nil {
+		return nil
+	}
+	s.reset(&StreamResetError{Code: code})
+	s.rstPending = true
+	s.notifyWrite()
+	return nil
+}
+
+// reset discards all buffered data and closes both sides of the stream.
+func (s *Stream) reset(err *StreamResetError) {
+	if s.resetErr != nil {
+		return
+	}
+	s.resetErr = err
+
+	s.rbuf, s.wbuf = s.rbuf[:0], s.wbuf[:0]
+	s.rqueue, s.unacked = nil, nil
+	s.ackPending, s.windowPending = false, false
+
+	s.closeRead()
+	s.closeWrite()
+	s.notifyRead()
+}
+
+// ResetErr returns the error the stream was reset with, if any.
+func (s *Stream) ResetErr() *StreamResetError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.resetErr
+}
+
 // Close marks the stream as closed for writes. The server will close the read side.
 func (s *Stream) Close() error {
 	return s.CloseWrite()
@@ -434,11 +950,20 @@ func (s *Stream) WriteCloseNotified() bool {
 
 func (s *Stream) WriteCloseNotifiedNotify() <-chan struct{} { return s.writeCloseNotifiedNotify }
 
+// notifyWriteClosed marks the peer as notified of the end of the stream.
+func (s *Stream) notifyWriteClosed() {
+	if !s.writeCloseNotified {
+		s.writeCloseNotified = true
+		close(s.writeCloseNotifiedNotify)
+	}
+}
+
 // ReadWriteCloseNotified returns true if the stream is closed for read and write and has been notified.
+// If retransmitting, all sent cells must also be acknowledged.
 func (s *Stream) ReadWriteCloseNotified() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readClosed && s.writeCloseNotified
+	return s.readClosed && s.writeCloseNotified && len(s.unacked) == 0
 }
 
 // LocalAddr returns the local address. Implements net.Conn.
@@ -447,17 +972,95 @@ func (c *Stream) LocalAddr() net.Addr { return c.localAddr }
 // RemoteAddr returns the remote address. Implements net.Conn.
 func (c *Stream) RemoteAddr() net.Addr { return c.remoteAddr }
 
-// SetDeadline is a no-op. Implements net.Conn.
-func (c *Stream) SetDeadline(t time.Time) error { return nil }
+// SetDeadline sets the read & write deadlines. Implements net.Conn.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
 
-// SetReadDeadline is a no-op. Implements net.Conn.
-func (c *Stream) SetReadDeadline(t time.Time) error { return nil }
+// SetReadDeadline sets the time after which blocked & future reads return
+// ErrTimeout. A zero value disables the deadline. Implements net.Conn.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rdeadline = t
+	s.notifyRead() // wake blocked reads
+	return nil
+}
 
-// SetWriteDeadline is a no-op. Implements net.Conn.
-func (c *Stream) SetWriteDeadline(t time.Time) error { return nil }
+// SetWriteDeadline sets the time after which blocked & future writes return
+// ErrTimeout. A zero value disables the deadline. Implements net.Conn.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wdeadline = t
+	s.notifyWrite() // wake blocked writes
+	return nil
+}
 
 func (s *Stream) logger() *zap.Logger {
-	return Logger.With(zap.Int("stream_id", s.id))
+	return s.config.logger().With(zap.Int("stream_id", s.id))
+}
+
+// deadlineExceeded returns true if t is set and has passed.
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// deadlineTimer wraps a timer which fires at a deadline.
+// A nil timer is returned for a zero deadline and never fires.
+type deadlineTimer struct {
+	timer *time.Timer
+}
+
+func newDeadlineTimer(t time.Time) *deadlineTimer {
+	if t.IsZero() {
+		return nil
+	}
+	return &deadlineTimer{timer: time.NewTimer(time.Until(t))}
+}
+
+// C returns the timer's channel. Returns nil if there is no deadline.
+func (t *deadlineTimer) C() <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Stop stops the underlying timer, if any.
+func (t *deadlineTimer) Stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// StreamResetError is returned by reads & writes on a stream that has been reset.
+type StreamResetError struct {
+	Code   int  // error code sent in the RST cell
+	Remote bool // true if reset by the peer
+}
+
+// Error returns the error message.
+func (e *StreamResetError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("marionette: stream reset by peer: code=%d", e.Code)
+	}
+	return fmt.Sprintf("marionette: stream reset: code=%d", e.Code)
+}
+
+// timeoutError is returned when a deadline is exceeded. Implements net.Error.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "marionette: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// unackedCell is a sent cell awaiting acknowledgement from the peer.
+type unackedCell struct {
+	cell   *Cell
+	sentAt time.Time
 }
 
 // streamExpVar is a wrapper for stream to generate expvar data.
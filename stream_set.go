@@ -1,9 +1,12 @@
 package marionette
 
 import (
+	"context"
+	"encoding/binary"
 	"expvar"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -18,8 +21,35 @@ const (
 	// StreamCloseTimeout is the amount of time before an idle read-closed or
 	// write-closed stream is reaped by a monitoring goroutine.
 	StreamCloseTimeout = 5 * time.Second
+
+	// StreamRemovedTTL is the amount of time a removed stream id is remembered
+	// so that late retransmissions do not recreate the stream.
+	StreamRemovedTTL = 1 * time.Minute
+
+	// SessionRetransmitTimeout is the recommended retransmit timeout for
+	// stream-based transports when retransmission is enabled. Cells are also
+	// resent immediately when a connection fails.
+	SessionRetransmitTimeout = 30 * time.Second
+
+	// MaxPendingFragments is the number of partially received fragmented cells
+	// kept by a stream set. The oldest is discarded when the limit is exceeded.
+	MaxPendingFragments = 16
+
+	// ShutdownPollInterval is how often Shutdown() checks for open streams.
+	ShutdownPollInterval = 100 * time.Millisecond
 )
 
+// defaultRetransmitTimeout returns the default retransmit timeout for streams
+// sent over transport. Stream-based transports deliver every message so
+// retransmission is disabled unless both parties enable it, which is required
+// to resume sessions over stream-based transports.
+func defaultRetransmitTimeout(transport string) time.Duration {
+	if isPacketTransport(transport) {
+		return PacketRetransmitTimeout
+	}
+	return 0
+}
+
 // evStreams is a global expvar variable for tracking open streams.
 var evStreams = expvar.NewInt("streams")
 
@@ -30,6 +60,24 @@ type StreamSet struct {
 	streamIDs []int           // cached list of all stream ids
 	wnotify   chan struct{}   // notification of write changes
 
+	removed map[int]time.Time // recently removed stream ids, if retransmitting
+	party   string            // party creating local streams, for id allocation
+	config  *Config           // shared configuration, if set by dialer or listener
+	lastAck bool              // true if last dequeued cell was an ack
+
+	// Keepalive state.
+	lastRecv time.Time     // last time a cell was received
+	lastPing time.Time     // last time a ping was sent
+	pong     []byte        // payload of ping awaiting a pong, if any
+	rtt      time.Duration // round trip time of last pong
+
+	// Fragmentation state.
+	frag      []byte                  // unsent bytes of a fragmented cell
+	fragID    int                     // id of the fragmented cell
+	fragOff   int                     // offset of frag in the fragmented cell
+	nextFrag  int                     // last fragmented cell id used
+	fragments map[int]*fragmentBuffer // received fragments by id
+
 	// Close management
 	closing chan struct{}
 	once    sync.Once
@@ -38,16 +86,55 @@ type StreamSet struct {
 	// Callback executed when a new stream is created.
 	OnNewStream func(*Stream)
 
+	// Callback executed when a stream is created by a cell from the peer.
+	// Unlike OnNewStream, this is not executed for locally created streams.
+	OnPeerStream func(*Stream)
+
 	// Directory for storing stream traces.
 	TracePath string
+
+	// If non-zero, a ping is sent when no cells have been received within the
+	// interval so that the peer's liveness can be checked.
+	KeepaliveInterval time.Duration
+
+	// If true, cell payloads are compressed with DEFLATE when it reduces their
+	// size. Compressed cells are accepted regardless of this setting. Must be
+	// set before streams are created.
+	Compress bool
+
+	// Maximum size of a cell, in bytes. Stream buffers & windows are sized from
+	// this value. Both parties must use the same value. Defaults to
+	// MaxCellLength. Must be set before streams are created.
+	MaxCellLength int
+
+	// Chooses the stream to send each cell from. Defaults to a RandomScheduler.
+	// Must be set before cells are dequeued.
+	Scheduler Scheduler
+
+	// If non-zero, cells are kept until acknowledged by the peer and are resent
+	// after the timeout. This allows streams to survive dropped messages and
+	// failed connections. Must be set before streams are created.
+	RetransmitTimeout time.Duration
+
+	// If set, FSMs using the stream set send the session id at the start of
+	// each connection so the peer can associate the connections with each
+	// other. Set by the dialer. Must be set before connections are opened.
+	SessionID SessionID
 }
 
 // NewStreamSet returns a new instance of StreamSet.
 func NewStreamSet() *StreamSet {
 	ss := &StreamSet{
 		streams: make(map[int]*Stream),
+		removed: make(map[int]time.Time),
 		closing: make(chan struct{}),
 		wnotify: make(chan struct{}),
+
+		lastRecv:  time.Now(),
+		fragments: make(map[int]*fragmentBuffer),
+
+		MaxCellLength: MaxCellLength,
+		Scheduler:     NewRandomScheduler(),
 	}
 	return ss
 }
@@ -126,27 +213,70 @@ func (ss *StreamSet) Streams() []*Stream {
 	return streams
 }
 
-// Create returns a new stream with a random stream id.
+// activeStreamN returns the number of streams which have not finished. A
+// stream is finished once both sides have sent & acknowledged end-of-stream,
+// which may be before it is removed from the set.
+func (ss *StreamSet) activeStreamN() (n int) {
+	for _, stream := range ss.Streams() {
+		if !stream.ReadWriteCloseNotified() {
+			n++
+		}
+	}
+	return n
+}
+
+// waitDrained polls until streamN returns zero or ctx is done.
+func waitDrained(ctx context.Context, streamN func() int) error {
+	ticker := time.NewTicker(ShutdownPollInterval)
+	defer ticker.Stop()
+
+	for streamN() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Create returns a new stream with a random, unused stream id.
 func (ss *StreamSet) Create() *Stream {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 	return ss.create(0)
 }
 
+// CreateWithDestination returns a new stream which requests that the peer
+// connects it to addr. The destination is sent before any of the stream's data.
+func (ss *StreamSet) CreateWithDestination(addr string) *Stream {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	stream := ss.create(0)
+	stream.setDestination(addr)
+	return stream
+}
+
 func (ss *StreamSet) create(id int) *Stream {
 	if id == 0 {
-		id = int(rand.Int31() + 1)
+		id = ss.newStreamID()
 	}
 
 	stream := NewStream(id)
+	stream.config = ss.config
+	stream.retransmitTimeout = ss.RetransmitTimeout
+	stream.compress = ss.Compress
+	if ss.MaxCellLength != MaxCellLength {
+		stream.setMaxCellLength(ss.MaxCellLength)
+	}
 
 	// Create a per-stream log if trace path is specified.
 	if ss.TracePath != "" {
 		path := filepath.Join(ss.TracePath, strconv.Itoa(id))
 		if err := os.MkdirAll(ss.TracePath, 0777); err != nil {
-			Logger.Warn("cannot create trace directory", zap.Error(err))
+			ss.config.logger().Warn("cannot create trace directory", zap.Error(err))
 		} else if w, err := os.Create(path); err != nil {
-			Logger.Warn("cannot create trace file", zap.Error(err))
+			ss.config.logger().Warn("cannot create trace file", zap.Error(err))
 		} else {
 			fmt.Fprintf(w, "# STREAM %d\n\n", id)
 			stream.TraceWriter = &timestampWriter{Writer: w}
@@ -160,6 +290,7 @@ func (ss *StreamSet) create(id int) *Stream {
 
 	// Add to global counter.
 	evStreams.Add(1)
+	stream.config.metrics().Streams.Inc()
 
 	// Monitor each stream closing in a separate goroutine.
 	ss.wg.Add(1)
@@ -177,12 +308,33 @@ func (ss *StreamSet) create(id int) *Stream {
 	return stream
 }
 
+// newStreamID returns a random stream id which is not in use and has not been
+// recently removed. Servers allocate even ids & clients allocate odd ids so
+// that streams created by both parties never collide. Must be called under lock.
+func (ss *StreamSet) newStreamID() int {
+	for {
+		id := int(rand.Int31n(math.MaxInt32/2)) * 2
+		if ss.party != PartyServer {
+			id++
+		}
+		if id == 0 {
+			continue
+		} else if _, ok := ss.streams[id]; ok {
+			continue
+		} else if _, ok := ss.removed[id]; ok {
+			continue
+		}
+		return id
+	}
+}
+
 // remove removes stream from the set and decrements open stream count.
 // This must be called under lock.
 func (ss *StreamSet) remove(stream *Stream) {
 	streamID := stream.ID()
 
 	evStreams.Add(-1)
+	stream.config.metrics().Streams.Dec()
 
 	if stream.TraceWriter != nil {
 		stream.TraceWriter.Write([]byte("[remove]"))
@@ -192,6 +344,17 @@ func (ss *StreamSet) remove(stream *Stream) {
 	}
 	delete(ss.streams, streamID)
 
+	// Remember removed ids so retransmitted cells are not treated as new streams.
+	if ss.RetransmitTimeout > 0 {
+		now := time.Now()
+		for id, t := range ss.removed {
+			if now.Sub(t) > StreamRemovedTTL {
+				delete(ss.removed, id)
+			}
+		}
+		ss.removed[streamID] = now
+	}
+
 	for i, id := range ss.streamIDs {
 		if id == streamID {
 			ss.streamIDs = append(ss.streamIDs[:i], ss.streamIDs[i+1:]...)
@@ -205,41 +368,289 @@ func (ss *StreamSet) Enqueue(cell *Cell) error {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
+	ss.lastRecv = time.Now()
+	return ss.enqueue(cell)
+}
+
+// enqueue pushes a received cell onto its stream. Must be called under lock.
+func (ss *StreamSet) enqueue(cell *Cell) error {
+	// Expand compressed payloads up to the maximum cell size.
+	if err := cell.Decompress(ss.MaxCellLength); err != nil {
+		return err
+	}
+
+	// Respond to pings, record round trip times from pongs, and reassemble
+	// fragmented cells.
+	switch cell.Type {
+	case CellTypePing:
+		ss.pong = cell.Payload
+		return nil
+	case CellTypePong:
+		if len(cell.Payload) >= PingPayloadSize {
+			sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(cell.Payload)))
+			if rtt := time.Since(sentAt); rtt >= 0 {
+				ss.rtt = rtt
+			}
+		}
+		return nil
+	case CellTypeFragment:
+		other, err := ss.enqueueFragment(cell)
+		if err != nil || other == nil {
+			return err
+		}
+		return ss.enqueue(other)
+	}
+
 	// Ignore empty cells.
 	if cell.StreamID == 0 {
 		return nil
 	}
 
-	// Create or find stream and enqueue cell.
+	// Create or find stream and enqueue cell. Control cells for unknown
+	// streams & late cells for removed streams are ignored.
 	stream := ss.streams[cell.StreamID]
 	if stream == nil {
+		if _, ok := ss.removed[cell.StreamID]; ok || !isSequencedCellType(cell.Type) {
+			return nil
+		}
 		stream = ss.create(cell.StreamID)
+		if ss.OnPeerStream != nil {
+			ss.OnPeerStream(stream)
+		}
 	}
 	return stream.Enqueue(cell)
 }
 
-// Dequeue returns a cell containing data for a random stream's write buffer.
+// Dequeue returns a cell containing data from a stream's write buffer. The
+// stream is chosen by the scheduler. Streams whose peer has no remaining
+// receive window are skipped.
+//
+// Cells which do not fit in n bytes, such as control cells or cells being
+// resent, are split into fragment cells which are sent by subsequent calls.
 func (ss *StreamSet) Dequeue(n int) *Cell {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	// Choose a random stream with data.
-	var stream *Stream
-	for _, i := range rand.Perm(len(ss.streamIDs)) {
-		s := ss.streams[ss.streamIDs[i]]
-		if s.WriteBufferLen() > 0 || s.WriteClosed() {
-			stream = s
-			break
+	// Finish sending a fragmented cell before any other cell.
+	if len(ss.frag) > 0 {
+		return ss.dequeueFragment(n)
+	}
+
+	// Respond to pings & send keepalives before stream data.
+	if cell := ss.dequeueKeepalive(n); cell != nil {
+		return ss.fit(cell, n)
+	}
+
+	// Find streams with data to send.
+	var streams []*Stream
+	for _, id := range ss.streamIDs {
+		if s := ss.streams[id]; s.SendPending() || s.RetransmitPending() {
+			streams = append(streams, s)
 		}
 	}
 
+	// Alternate control cells, such as acks, with data so that neither
+	// direction stalls.
+	if (len(streams) == 0 || !ss.lastAck) && (n == 0 || n > CellHeaderSize) {
+		for _, i := range rand.Perm(len(ss.streamIDs)) {
+			if s := ss.streams[ss.streamIDs[i]]; s.ControlPending() {
+				ss.lastAck = true
+				return ss.fit(s.DequeueControl(n), n)
+			}
+		}
+	}
+	ss.lastAck = false
+
 	// If there is no stream with data then send an empty
-	if stream == nil {
+	if len(streams) == 0 {
+		return nil
+	}
+
+	// Generate cell from the scheduled stream.
+	stream := ss.Scheduler.Next(streams)
+	cell := stream.Dequeue(n)
+	if cell != nil {
+		ss.Scheduler.Dequeued(stream, cell)
+	}
+	return ss.fit(cell, n)
+}
+
+// fit returns cell if it fits in n bytes. Otherwise, the cell is split into
+// fragments and the first fragment is returned. Must be called under lock.
+func (ss *StreamSet) fit(cell *Cell, n int) *Cell {
+	if cell == nil || n == 0 || cell.Size() <= n {
+		return cell
+	}
+
+	// Marshaling only fails on a nil cell.
+	data, _ := cell.MarshalBinary()
+	ss.nextFrag = ss.nextFrag%math.MaxInt32 + 1
+	ss.frag, ss.fragID, ss.fragOff = data, ss.nextFrag, 0
+
+	ss.config.logger().Debug("fragmenting cell", zap.Int("stream_id", cell.StreamID), zap.Int("size", len(data)), zap.Int("n", n))
+	return ss.dequeueFragment(n)
+}
+
+// dequeueFragment returns the next fragment of the cell being fragmented.
+// Returns nil if n is too small for a fragment. Must be called under lock.
+func (ss *StreamSet) dequeueFragment(n int) *Cell {
+	if n != 0 && n <= CellHeaderSize {
+		return nil
+	} else if n > ss.MaxCellLength {
+		n = ss.MaxCellLength
+	}
+
+	// Fill the remaining space with as much of the cell as possible.
+	sz := len(ss.frag)
+	if n != 0 && sz > n-CellHeaderSize {
+		sz = n - CellHeaderSize
+	}
+
+	cell := NewCell(ss.fragID, ss.fragOff, n, CellTypeFragment)
+	cell.Payload = ss.frag[:sz]
+	ss.frag, ss.fragOff = ss.frag[sz:], ss.fragOff+sz
+	if len(ss.frag) == 0 {
+		ss.frag = nil
+	}
+	return cell
+}
+
+// enqueueFragment adds a received fragment to its reassembly buffer. Returns
+// the original cell once all of its fragments have been received. Must be
+// called under lock.
+func (ss *StreamSet) enqueueFragment(cell *Cell) (*Cell, error) {
+	// Fragments must lie within the largest allowed cell.
+	if cell.SequenceID < 0 || cell.SequenceID+len(cell.Payload) > ss.MaxCellLength {
+		delete(ss.fragments, cell.StreamID)
+		return nil, fmt.Errorf("marionette: fragment out of range: offset=%d size=%d", cell.SequenceID, len(cell.Payload))
+	}
+
+	fb := ss.fragments[cell.StreamID]
+	if fb == nil {
+		// Discard the oldest partial cell, which may never be completed if a
+		// fragment was lost, once the limit is reached.
+		if len(ss.fragments) >= MaxPendingFragments {
+			ss.discardOldestFragment()
+		}
+		fb = &fragmentBuffer{pending: make(map[int][]byte)}
+		ss.fragments[cell.StreamID] = fb
+	}
+	fb.modTime = time.Now()
+
+	// Fragments may arrive out of order over pooled connections so append
+	// all fragments which are contiguous with the reassembled data.
+	// Overlapping fragments could otherwise buffer far more than one cell.
+	if cell.SequenceID >= len(fb.buf) {
+		fb.pendingN += len(cell.Payload) - len(fb.pending[cell.SequenceID])
+		fb.pending[cell.SequenceID] = cell.Payload
+		if fb.pendingN > ss.MaxCellLength {
+			delete(ss.fragments, cell.StreamID)
+			return nil, fmt.Errorf("marionette: too many pending fragment bytes: %d", fb.pendingN)
+		}
+	}
+	for {
+		payload, ok := fb.pending[len(fb.buf)]
+		if !ok {
+			break
+		}
+		delete(fb.pending, len(fb.buf))
+		fb.pendingN -= len(payload)
+		fb.buf = append(fb.buf, payload...)
+	}
+
+	// Wait until the cell's size is known & all of its bytes are received.
+	if len(fb.buf) < 4 {
+		return nil, nil
+	}
+	sz := int(binary.BigEndian.Uint32(fb.buf))
+	if sz < CellHeaderSize || sz > ss.MaxCellLength {
+		delete(ss.fragments, cell.StreamID)
+		return nil, fmt.Errorf("marionette: invalid fragmented cell size: %d", sz)
+	} else if len(fb.buf) < sz {
+		return nil, nil
+	}
+	delete(ss.fragments, cell.StreamID)
+
+	var other Cell
+	if err := other.UnmarshalBinary(fb.buf[:sz]); err != nil {
+		return nil, err
+	}
+	return &other, nil
+}
+
+// discardOldestFragment removes the least recently updated reassembly buffer.
+func (ss *StreamSet) discardOldestFragment() {
+	var oldestID int
+	var oldest *fragmentBuffer
+	for id, fb := range ss.fragments {
+		if oldest == nil || fb.modTime.Before(oldest.modTime) {
+			oldestID, oldest = id, fb
+		}
+	}
+	delete(ss.fragments, oldestID)
+}
+
+// dequeueKeepalive returns a pong if a ping has been received or a ping if no
+// cells have been received within KeepaliveInterval. Must be called under lock.
+func (ss *StreamSet) dequeueKeepalive(n int) *Cell {
+	if n != 0 && n <= CellHeaderSize {
+		return nil
+	} else if n == 0 || n > ss.MaxCellLength {
+		n = CellHeaderSize + PingPayloadSize
+	}
+
+	if ss.pong != nil {
+		cell := NewCell(0, 0, n, CellTypePong)
+		cell.Payload, ss.pong = ss.pong, nil
+		return cell
+	}
+
+	now := time.Now()
+	if ss.KeepaliveInterval <= 0 || now.Sub(ss.lastRecv) < ss.KeepaliveInterval || now.Sub(ss.lastPing) < ss.KeepaliveInterval {
 		return nil
 	}
+	ss.lastPing = now
+
+	cell := NewCell(0, 0, n, CellTypePing)
+	cell.Payload = make([]byte, PingPayloadSize)
+	binary.BigEndian.PutUint64(cell.Payload, uint64(now.UnixNano()))
+	return cell
+}
+
+// LastReceived returns the last time a cell was received by the stream set.
+func (ss *StreamSet) LastReceived() time.Time {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.lastRecv
+}
+
+// RTT returns the round trip time measured by the last keepalive ping.
+// Returns zero if no pong has been received.
+func (ss *StreamSet) RTT() time.Duration {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.rtt
+}
+
+// Retransmit marks all unacknowledged cells in all streams to be resent.
+func (ss *StreamSet) Retransmit() {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, stream := range ss.streams {
+		stream.Retransmit()
+	}
+}
+
+// WriteBufferLen returns the total number of bytes in all stream write buffers.
+func (ss *StreamSet) WriteBufferLen() int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
 
-	// Generate cell from stream.
-	return stream.Dequeue(n)
+	var n int
+	for _, stream := range ss.streams {
+		n += stream.WriteBufferLen()
+	}
+	return n
 }
 
 // WriteNotify returns a channel that receives a notification when a new write is available.
@@ -283,3 +694,11 @@ type timestampWriter struct {
 func (w *timestampWriter) Write(p []byte) (n int, err error) {
 	return fmt.Fprintf(w.Writer, "%s %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), p)
 }
+
+// fragmentBuffer holds the fragments of a partially received cell.
+type fragmentBuffer struct {
+	buf      []byte         // contiguous bytes from the start of the cell
+	pending  map[int][]byte // out-of-order fragment payloads by offset
+	pendingN int            // total size of pending payloads
+	modTime  time.Time      // last time a fragment was received
+}
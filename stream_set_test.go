@@ -1,9 +1,12 @@
 package marionette_test
 
 import (
+	"bytes"
 	"io/ioutil"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/redjack/marionette"
@@ -75,6 +78,63 @@ func TestStreamSet_Enqueue(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+
+	// Ensure control cells do not create new streams.
+	t.Run("ControlCell", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		ss.OnNewStream = func(s *marionette.Stream) {
+			t.Fatal("unexpected callback invocation")
+		}
+
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.CellTypeRST, StreamID: 100, Payload: []byte{0, 0, 0, 1}}); err != nil {
+			t.Fatal(err)
+		} else if stream := ss.Stream(100); stream != nil {
+			t.Fatal("unexpected stream")
+		}
+	})
+}
+
+func TestStreamSet_Keepalive(t *testing.T) {
+	client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+	defer client.Close()
+	defer server.Close()
+	client.KeepaliveInterval = 10 * time.Millisecond
+
+	// No ping should be sent until the interval has passed without data.
+	if cell := client.Dequeue(0); cell != nil {
+		t.Fatalf("unexpected cell: %#v", cell)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ping := client.Dequeue(0)
+	if ping == nil || ping.Type != marionette.CellTypePing || len(ping.Payload) != marionette.PingPayloadSize {
+		t.Fatalf("unexpected ping: %#v", ping)
+	} else if cell := client.Dequeue(0); cell != nil {
+		t.Fatalf("unexpected cell: %#v", cell)
+	}
+
+	// Server should echo the ping's payload back in a pong.
+	if err := server.Enqueue(ping); err != nil {
+		t.Fatal(err)
+	}
+	pong := server.Dequeue(0)
+	if diff := cmp.Diff(pong, &marionette.Cell{
+		Type:    marionette.CellTypePong,
+		Length:  marionette.CellHeaderSize + marionette.PingPayloadSize,
+		Payload: ping.Payload,
+	}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Client should record the round trip time.
+	if err := client.Enqueue(pong); err != nil {
+		t.Fatal(err)
+	} else if client.RTT() <= 0 {
+		t.Fatalf("unexpected rtt: %s", client.RTT())
+	} else if time.Since(client.LastReceived()) > time.Second {
+		t.Fatalf("unexpected last received: %s", client.LastReceived())
+	}
 }
 
 func TestStreamSet_Dequeue(t *testing.T) {
@@ -126,4 +186,422 @@ func TestStreamSet_Dequeue(t *testing.T) {
 			t.Fatal("expected no cell")
 		}
 	})
+
+	// Ensure a stream with no send window does not block other streams.
+	t.Run("WindowExhausted", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		stream0, stream1 := ss.Create(), ss.Create()
+		for stream0.SendWindow() > 0 {
+			if _, err := stream0.Write(make([]byte, marionette.MaxCellLength/2)); err != nil {
+				t.Fatal(err)
+			} else if cell := stream0.Dequeue(0); cell == nil {
+				t.Fatal("expected cell")
+			}
+		}
+
+		if _, err := stream0.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream1.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if cell := ss.Dequeue(0); cell == nil || cell.StreamID != stream1.ID() {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if cell := ss.Dequeue(0); cell != nil {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+}
+
+func TestStreamSet_Retransmit(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		client.RetransmitTimeout, server.RetransmitTimeout = 50*time.Millisecond, 50*time.Millisecond
+		defer client.Close()
+		defer server.Close()
+
+		var serverStream *marionette.Stream
+		server.OnNewStream = func(s *marionette.Stream) { serverStream = s }
+
+		// Write to the client stream & drop the first cell.
+		stream := client.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if cell := client.Dequeue(0); cell == nil || string(cell.Payload) != "foo" {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		// Write more data which is received out of order.
+		if _, err := stream.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if cell := client.Dequeue(0); cell == nil || cell.SequenceID != 1 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if err := server.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first cell should be resent after the timeout.
+		time.Sleep(100 * time.Millisecond)
+		if cell := client.Dequeue(0); cell == nil {
+			t.Fatal("expected retransmitted cell")
+		} else if diff := cmp.Diff(cell, &marionette.Cell{Type: marionette.CellTypeNormal, StreamID: stream.ID(), SequenceID: 0, Payload: []byte("foo")}); diff != "" {
+			t.Fatal(diff)
+		} else if err := server.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		}
+
+		// Data should be read in order.
+		buf := make([]byte, 6)
+		if serverStream == nil {
+			t.Fatal("expected stream")
+		} else if n, err := serverStream.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "foobar" {
+			t.Fatalf("unexpected data: %q", buf[:n])
+		}
+
+		// Server acknowledges all received cells.
+		ack := server.Dequeue(0)
+		if diff := cmp.Diff(ack, &marionette.Cell{Type: marionette.CellTypeAck, StreamID: stream.ID(), SequenceID: 2, Length: marionette.CellHeaderSize + marionette.AckPayloadSize, Payload: MustEncodeWindow(marionette.StreamWindowSize + 6)}); diff != "" {
+			t.Fatal(diff)
+		} else if err := client.Enqueue(ack); err != nil {
+			t.Fatal(err)
+		} else if server.Dequeue(0) != nil {
+			t.Fatal("expected no cell")
+		}
+
+		// Acknowledged cells should not be resent.
+		time.Sleep(100 * time.Millisecond)
+		if cell := client.Dequeue(0); cell != nil {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+
+	t.Run("IgnoreAckForUnknownStream", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		ss.RetransmitTimeout = time.Millisecond
+		defer ss.Close()
+		ss.OnNewStream = func(s *marionette.Stream) {
+			t.Fatal("unexpected callback invocation")
+		}
+
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.CellTypeAck, StreamID: 100, SequenceID: 1}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStreamSet_Fragment(t *testing.T) {
+	// Ensure control cells larger than a message are sent in fragments.
+	t.Run("ControlCell", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		defer client.Close()
+		defer server.Close()
+
+		stream := client.Create()
+		if err := server.Enqueue(&marionette.Cell{StreamID: stream.ID(), Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Reset(marionette.ResetCodeCancel); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each fragment carries two bytes of the serialized RST cell.
+		cells := MustDequeueAll(t, client, marionette.CellHeaderSize+2)
+		if len(cells) != 15 {
+			t.Fatalf("unexpected fragment count: %d", len(cells))
+		}
+		for _, cell := range cells {
+			if cell.Type != marionette.CellTypeFragment || cell.Size() != marionette.CellHeaderSize+2 {
+				t.Fatalf("unexpected fragment: %#v", cell)
+			} else if err := server.Enqueue(cell); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := server.Stream(stream.ID()).Read(make([]byte, 10)); !isResetError(err, marionette.ResetCodeCancel, true) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure fragments received out of order are reassembled.
+	t.Run("OutOfOrder", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		client.KeepaliveInterval = time.Millisecond
+		defer client.Close()
+		defer server.Close()
+
+		time.Sleep(10 * time.Millisecond)
+		cells := MustDequeueAll(t, client, marionette.CellHeaderSize+4)
+		if len(cells) < 2 {
+			t.Fatalf("unexpected fragment count: %d", len(cells))
+		}
+		for i := len(cells) - 1; i >= 0; i-- {
+			if err := server.Enqueue(cells[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Server should respond to the reassembled ping.
+		if cell := server.Dequeue(0); cell == nil || cell.Type != marionette.CellTypePong {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+
+	// Ensure a resent cell which no longer fits in a message is fragmented.
+	t.Run("Retransmit", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		client.RetransmitTimeout = 10 * time.Millisecond
+		defer client.Close()
+		defer server.Close()
+
+		stream := client.Create()
+		if _, err := stream.Write([]byte("hello, world")); err != nil {
+			t.Fatal(err)
+		} else if cell := client.Dequeue(0); cell == nil {
+			t.Fatal("expected cell")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		for _, cell := range MustDequeueAll(t, client, marionette.CellHeaderSize+8) {
+			if err := server.Enqueue(cell); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		buf := make([]byte, 20)
+		if n, err := server.Stream(stream.ID()).Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "hello, world" {
+			t.Fatalf("unexpected data: %q", buf[:n])
+		}
+	})
+
+	// Ensure reassembled cells larger than the max cell size are rejected.
+	t.Run("ErrTooLarge", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		payload := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.CellTypeFragment, StreamID: 1, Payload: payload}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure fragments outside of the max cell size are rejected.
+	t.Run("ErrOutOfRange", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		for _, offset := range []int{-1, marionette.MaxCellLength, marionette.MaxCellLength - 1, 1 << 30} {
+			cell := &marionette.Cell{Type: marionette.CellTypeFragment, StreamID: 1, SequenceID: offset, Payload: []byte{0x00, 0x00}}
+			if err := ss.Enqueue(cell); err == nil || !strings.Contains(err.Error(), "fragment out of range") {
+				t.Fatalf("offset=%d: unexpected error: %v", offset, err)
+			}
+		}
+	})
+
+	// Ensure overlapping fragments cannot buffer more than a cell's size.
+	t.Run("ErrTooManyPendingBytes", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		payload := make([]byte, marionette.MaxCellLength/4)
+		for i := 1; ; i++ {
+			err := ss.Enqueue(&marionette.Cell{Type: marionette.CellTypeFragment, StreamID: 1, SequenceID: i, Payload: payload})
+			if err != nil && strings.Contains(err.Error(), "too many pending fragment bytes") {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			} else if i > 4 {
+				t.Fatal("expected error")
+			}
+		}
+	})
+}
+
+func TestStreamSet_MaxCellLength(t *testing.T) {
+	ss := marionette.NewStreamSet()
+	ss.MaxCellLength = 4 * marionette.MaxCellLength
+	defer ss.Close()
+
+	// Writes & cells can be larger than the default max cell size.
+	stream := ss.Create()
+	data := make([]byte, 3*marionette.MaxCellLength)
+	if _, err := stream.Write(data); err != nil {
+		t.Fatal(err)
+	} else if cell := ss.Dequeue(0); cell == nil || len(cell.Payload) != len(data) {
+		t.Fatalf("unexpected cell: %#v", cell)
+	} else if n := stream.SendWindow(); n != 16*marionette.MaxCellLength-len(data) {
+		t.Fatalf("unexpected send window: %d", n)
+	}
+}
+
+// MustDequeueAll dequeues cells of n bytes from ss until no cells remain.
+func MustDequeueAll(tb testing.TB, ss *marionette.StreamSet, n int) []*marionette.Cell {
+	tb.Helper()
+
+	var cells []*marionette.Cell
+	for cell := ss.Dequeue(n); cell != nil; cell = ss.Dequeue(n) {
+		if len(cells) > 1000 {
+			tb.Fatal("too many cells")
+		}
+		cells = append(cells, cell)
+	}
+	return cells
+}
+
+func TestStreamSet_Compress(t *testing.T) {
+	client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+	client.Compress = true
+	defer client.Close()
+	defer server.Close()
+
+	// Write compressible data larger than a single message.
+	data := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 20)
+	stream := client.Create()
+	if _, err := stream.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	cell := client.Dequeue(128)
+	if cell == nil || len(cell.Payload) <= 128-marionette.CellHeaderSize {
+		t.Fatalf("expected compressed payload larger than message: %#v", cell)
+	}
+
+	// Marshaled cell should still fit in the message.
+	var other marionette.Cell
+	if buf, err := cell.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	} else if len(buf) != 128 {
+		t.Fatalf("unexpected size: %d", len(buf))
+	} else if err := other.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	} else if err := server.Enqueue(&other); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+	if n, err := server.Stream(stream.ID()).Read(buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf[:n], data[:len(cell.Payload)]) {
+		t.Fatalf("unexpected data: %q", buf[:n])
+	}
+}
+
+func TestStreamSet_CreateWithDestination(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		defer client.Close()
+		defer server.Close()
+
+		stream := client.CreateWithDestination("example.com:80")
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The open cell should be sent before any data.
+		cells := MustDequeueAll(t, client, 0)
+		if len(cells) != 2 {
+			t.Fatalf("unexpected cell count: %d", len(cells))
+		} else if cell := cells[0]; cell.Type != marionette.CellTypeOpen || cell.SequenceID != 0 || string(cell.Payload) != "example.com:80" {
+			t.Fatalf("unexpected open cell: %#v", cell)
+		} else if cell := cells[1]; cell.Type != marionette.CellTypeNormal || cell.SequenceID != 1 || string(cell.Payload) != "foo" {
+			t.Fatalf("unexpected data cell: %#v", cell)
+		}
+
+		// Deliver cells out of order. Destination is not available until the
+		// open cell is received.
+		if err := server.Enqueue(cells[1]); err != nil {
+			t.Fatal(err)
+		}
+		other := server.Stream(stream.ID())
+		select {
+		case <-other.OpenNotify():
+			t.Fatal("unexpected open notification")
+		default:
+		}
+
+		if err := server.Enqueue(cells[0]); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-other.OpenNotify():
+		default:
+			t.Fatal("expected open notification")
+		}
+
+		// Open cell should not be readable or consume the receive window.
+		buf := make([]byte, 10)
+		if dest := other.Destination(); dest != "example.com:80" {
+			t.Fatalf("unexpected destination: %q", dest)
+		} else if n, err := other.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "foo" {
+			t.Fatalf("unexpected data: %q", buf[:n])
+		} else if w := stream.SendWindow(); w != marionette.StreamWindowSize-3 {
+			t.Fatalf("unexpected send window: %d", w)
+		}
+	})
+
+	// Ensure streams created without a destination open on their first cell.
+	t.Run("NoDestination", func(t *testing.T) {
+		client, server := marionette.NewStreamSet(), marionette.NewStreamSet()
+		defer client.Close()
+		defer server.Close()
+
+		stream := client.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := server.Enqueue(client.Dequeue(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		other := server.Stream(stream.ID())
+		select {
+		case <-other.OpenNotify():
+		default:
+			t.Fatal("expected open notification")
+		}
+		if dest := other.Destination(); dest != "" {
+			t.Fatalf("unexpected destination: %q", dest)
+		}
+	})
+}
+
+// Reports the payload bytes carried per 128 byte message with & without
+// compression of HTTP-like traffic.
+func BenchmarkStreamSet_Dequeue(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		name := "Uncompressed"
+		if compress {
+			name = "Compressed"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			ss := marionette.NewStreamSet()
+			ss.Compress = compress
+			defer ss.Close()
+
+			stream := ss.Create()
+			data := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n<html><body><p>Hello, world!</p></body></html>\r\n")
+			var payloadN int
+			for i := 0; i < b.N; i++ {
+				for stream.WriteBufferLen() < 4096 {
+					if _, err := stream.Write(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				cell := ss.Dequeue(128)
+				if _, err := cell.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+				payloadN += len(cell.Payload)
+
+				// Reset the window so the benchmark is not limited by flow control.
+				stream.Enqueue(&marionette.Cell{Type: marionette.CellTypeWindowUpdate, StreamID: stream.ID(), Payload: MustEncodeWindow(uint32(payloadN + marionette.StreamWindowSize))})
+			}
+			b.ReportMetric(float64(payloadN)/float64(b.N), "payload/msg")
+		})
+	}
 }
@@ -2,7 +2,10 @@ package marionette_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
 	"io/ioutil"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -310,6 +313,168 @@ func TestStream_Write(t *testing.T) {
 	})
 }
 
+func TestStream_FlowControl(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		sender, receiver := marionette.NewStream(100), marionette.NewStream(100)
+		defer sender.Close()
+		defer receiver.Close()
+
+		// Send until the receiver's window is exhausted. Nothing is read.
+		data := bytes.Repeat([]byte("x"), marionette.MaxCellLength/2)
+		var sent int
+		for sender.SendPending() || sender.WriteBufferLen() == 0 {
+			if sender.WriteBufferLen() == 0 {
+				if _, err := sender.Write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cell := sender.Dequeue(marionette.MaxCellLength)
+			if err := receiver.Enqueue(cell); err != nil {
+				t.Fatal(err)
+			}
+			sent += len(cell.Payload)
+		}
+
+		if sent != marionette.StreamWindowSize {
+			t.Fatalf("unexpected bytes sent: %d", sent)
+		} else if n := sender.SendWindow(); n != 0 {
+			t.Fatalf("unexpected send window: %d", n)
+		} else if cell := sender.Dequeue(marionette.MaxCellLength); len(cell.Payload) != 0 {
+			t.Fatalf("unexpected payload size: %d", len(cell.Payload))
+		} else if receiver.ControlPending() {
+			t.Fatal("expected no window update")
+		}
+
+		// Reading half the window should advertise a larger window to the sender.
+		if _, err := io.ReadFull(receiver, make([]byte, marionette.StreamWindowSize/2)); err != nil {
+			t.Fatal(err)
+		} else if !receiver.ControlPending() {
+			t.Fatal("expected window update")
+		}
+
+		ack := receiver.DequeueControl(0)
+		if diff := cmp.Diff(ack, &marionette.Cell{
+			Type:       marionette.CellTypeWindowUpdate,
+			Length:     marionette.CellHeaderSize + marionette.WindowUpdatePayloadSize,
+			StreamID:   100,
+			SequenceID: 4,
+			Payload:    MustEncodeWindow(marionette.StreamWindowSize * 3 / 2),
+		}); diff != "" {
+			t.Fatal(diff)
+		} else if err := sender.Enqueue(ack); err != nil {
+			t.Fatal(err)
+		} else if n := sender.SendWindow(); n != marionette.StreamWindowSize/2 {
+			t.Fatalf("unexpected send window: %d", n)
+		} else if !sender.SendPending() {
+			t.Fatal("expected pending send")
+		}
+	})
+
+	// Ensure windows from reordered acks do not shrink the send window.
+	t.Run("StaleWindow", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if err := stream.Enqueue(&marionette.Cell{Type: marionette.CellTypeAck, StreamID: 100, Payload: MustEncodeWindow(marionette.StreamWindowSize + 10)}); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Enqueue(&marionette.Cell{Type: marionette.CellTypeAck, StreamID: 100, Payload: MustEncodeWindow(marionette.StreamWindowSize)}); err != nil {
+			t.Fatal(err)
+		} else if n := stream.SendWindow(); n != marionette.StreamWindowSize+10 {
+			t.Fatalf("unexpected send window: %d", n)
+		}
+	})
+}
+
+func TestStream_Reset(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		local, remote := marionette.NewStream(100), marionette.NewStream(100)
+		defer local.Close()
+		defer remote.Close()
+
+		if _, err := local.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := local.Reset(marionette.ResetCodeCancel); err != nil {
+			t.Fatal(err)
+		}
+
+		// Buffered data is discarded & reads and writes return the reset error.
+		if n := local.WriteBufferLen(); n != 0 {
+			t.Fatalf("unexpected write buffer length: %d", n)
+		} else if _, err := local.Read(make([]byte, 10)); !isResetError(err, marionette.ResetCodeCancel, false) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := local.Write([]byte("bar")); !isResetError(err, marionette.ResetCodeCancel, false) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !local.ControlPending() {
+			t.Fatal("expected pending reset")
+		}
+
+		cell := local.DequeueControl(0)
+		if diff := cmp.Diff(cell, &marionette.Cell{
+			Type:     marionette.CellTypeRST,
+			Length:   marionette.CellHeaderSize + marionette.RSTPayloadSize,
+			StreamID: 100,
+			Payload:  []byte{0, 0, 0, marionette.ResetCodeCancel},
+		}); diff != "" {
+			t.Fatal(diff)
+		} else if local.ControlPending() {
+			t.Fatal("expected no pending control cell")
+		}
+
+		// Peer should see the reset on its next read.
+		if err := remote.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		} else if _, err := remote.Read(make([]byte, 10)); !isResetError(err, marionette.ResetCodeCancel, true) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if remote.ControlPending() {
+			t.Fatal("expected no reset reply")
+		}
+	})
+
+	// Ensure a blocked read is woken by a reset.
+	t.Run("Blocked", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			stream.Reset(marionette.ResetCodeRefused)
+		}()
+
+		if _, err := stream.Read(make([]byte, 10)); !isResetError(err, marionette.ResetCodeRefused, false) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure data cells are ignored after a reset.
+	t.Run("LateData", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if err := stream.Reset(marionette.ResetCodeCancel); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Enqueue(&marionette.Cell{StreamID: 100, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if n := stream.ReadBufferLen(); n != 0 {
+			t.Fatalf("unexpected read buffer length: %d", n)
+		}
+	})
+}
+
+// Ensure control cells with an unknown type are ignored.
+func TestStream_Enqueue_UnknownControl(t *testing.T) {
+	stream := marionette.NewStream(100)
+	defer stream.Close()
+
+	if err := stream.Enqueue(&marionette.Cell{Type: 0x7F, StreamID: 100, Payload: []byte("foo")}); err != nil {
+		t.Fatal(err)
+	} else if n := stream.ReadBufferLen(); n != 0 {
+		t.Fatalf("unexpected read buffer length: %d", n)
+	} else if stream.ControlPending() {
+		t.Fatal("expected no pending control cell")
+	}
+}
+
 func TestStream_ReadNotify(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		stream := marionette.NewStream(100)
@@ -442,23 +607,107 @@ func TestStream_RemoteAddr(t *testing.T) {
 func TestStream_SetDeadline(t *testing.T) {
 	stream := marionette.NewStream(100)
 	defer stream.Close()
+
+	if err := stream.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	} else if _, err := stream.Read(make([]byte, 1)); err != marionette.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := stream.Write([]byte("foo")); err != marionette.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Clearing the deadline allows writes again.
 	if err := stream.SetDeadline(time.Time{}); err != nil {
 		t.Fatal(err)
+	} else if _, err := stream.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
 	}
 }
 
 func TestStream_SetReadDeadline(t *testing.T) {
-	stream := marionette.NewStream(100)
-	defer stream.Close()
-	if err := stream.SetReadDeadline(time.Time{}); err != nil {
-		t.Fatal(err)
-	}
+	t.Run("Blocked", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if err := stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := stream.Read(make([]byte, 1))
+		if err != marionette.ErrTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatalf("expected timeout net.Error: %#v", err)
+		}
+	})
+
+	// Ensure changing the deadline wakes a blocked read.
+	t.Run("Changed", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := stream.Read(make([]byte, 1))
+			errs <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := stream.SetReadDeadline(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errs:
+			if err != marionette.ErrTimeout {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for read")
+		}
+	})
+
+	t.Run("NotExceeded", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if err := stream.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: 0, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+		MustReadString(t, stream, "foo")
+	})
 }
 
 func TestStream_SetWriteDeadline(t *testing.T) {
 	stream := marionette.NewStream(100)
 	defer stream.Close()
-	if err := stream.SetWriteDeadline(time.Time{}); err != nil {
+
+	// Fill the write buffer so the next write blocks.
+	if _, err := stream.Write(make([]byte, marionette.MaxCellLength)); err != nil {
 		t.Fatal(err)
+	} else if err := stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := stream.Write([]byte("foo"))
+	if err != marionette.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("expected timeout net.Error: %#v", err)
 	}
 }
+
+// MustEncodeWindow returns an ack payload for a receive window.
+func MustEncodeWindow(window uint32) []byte {
+	buf := make([]byte, marionette.AckPayloadSize)
+	binary.BigEndian.PutUint32(buf, window)
+	return buf
+}
+
+// isResetError returns true if err is a *StreamResetError with code & remote.
+func isResetError(err error, code int, remote bool) bool {
+	e, ok := err.(*marionette.StreamResetError)
+	return ok && e.Code == code && e.Remote == remote
+}
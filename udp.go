@@ -0,0 +1,330 @@
+package marionette
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// PacketReadTimeout is the amount of time a blocking read waits for the
+	// next message on a packet-based connection before returning ErrReadTimeout.
+	// Lost messages would otherwise stall both parties indefinitely.
+	PacketReadTimeout = 5 * time.Second
+
+	// PacketIdleTimeout is the amount of time before an idle peer is removed
+	// from a packet listener and its connection returns io.EOF.
+	PacketIdleTimeout = 60 * time.Second
+
+	// PacketRetransmitTimeout is the amount of time before an unacknowledged
+	// cell is resent on a packet-based connection.
+	PacketRetransmitTimeout = 1 * time.Second
+
+	// MaxPacketSize is the largest datagram that can be received.
+	MaxPacketSize = 65535
+
+	// MaxPacketPeers is the maximum number of peers tracked by a packet
+	// listener. Datagrams from new peers are dropped once it is reached.
+	MaxPacketPeers = 4096
+
+	// packetQueueSize is the number of datagrams buffered per peer before
+	// additional datagrams are dropped.
+	packetQueueSize = 64
+
+	// packetAcceptBacklog is the number of new peers waiting to be accepted
+	// before datagrams from additional new peers are dropped.
+	packetAcceptBacklog = 128
+)
+
+// isPacketTransport returns true if transport delivers discrete, unreliable
+// messages instead of a reliable byte stream.
+func isPacketTransport(transport string) bool {
+	switch transport {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// listen opens a listener for the transport. Packet-based transports return a
+// listener which accepts a connection for each remote peer.
+func listen(transport, addr string) (net.Listener, error) {
+	if isPacketTransport(transport) {
+		return listenPacket(transport, addr)
+	}
+	return net.Listen(transport, addr)
+}
+
+// packetListener implements net.Listener over a net.PacketConn. Datagrams are
+// demultiplexed by remote address into a separate connection per peer.
+type packetListener struct {
+	mu    sync.Mutex
+	conn  net.PacketConn
+	conns map[string]*packetConn // peer connections by remote address
+
+	accepts chan *packetConn // newly seen peers, up to packetAcceptBacklog
+
+	// Close management
+	once    sync.Once
+	wg      sync.WaitGroup
+	closing chan struct{}
+}
+
+// listenPacket returns a new packet listener bound to addr.
+func listenPacket(network, addr string) (*packetListener, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &packetListener{
+		conn:    conn,
+		conns:   make(map[string]*packetConn),
+		accepts: make(chan *packetConn, packetAcceptBacklog),
+		closing: make(chan struct{}),
+	}
+
+	ln.wg.Add(2)
+	go func() { defer ln.wg.Done(); ln.serve() }()
+	go func() { defer ln.wg.Done(); ln.expire() }()
+
+	return ln, nil
+}
+
+// Accept waits for a datagram from a new peer and returns its connection.
+// Peers which expire before they are accepted are skipped.
+func (ln *packetListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-ln.closing:
+			return nil, ErrListenerClosed
+		case conn := <-ln.accepts:
+			select {
+			case <-conn.closing:
+				continue
+			default:
+				return conn, nil
+			}
+		}
+	}
+}
+
+// Close closes the underlying packet connection and all peer connections.
+func (ln *packetListener) Close() error {
+	ln.once.Do(func() { close(ln.closing) })
+	err := ln.conn.Close()
+	ln.wg.Wait()
+
+	ln.mu.Lock()
+	conns := make([]*packetConn, 0, len(ln.conns))
+	for _, conn := range ln.conns {
+		conns = append(conns, conn)
+	}
+	ln.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Addr returns the local address of the listener.
+func (ln *packetListener) Addr() net.Addr { return ln.conn.LocalAddr() }
+
+// serve continually reads datagrams and dispatches them to peer connections.
+// Datagrams from new peers are dropped if too many peers are tracked or if
+// too many new peers are waiting to be accepted so that reads never block.
+func (ln *packetListener) serve() {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, addr, err := ln.conn.ReadFrom(buf)
+		if err != nil {
+			if isTemporaryError(err) {
+				continue
+			}
+			return
+		}
+
+		// Find connection for the peer or hand off a new one to the caller.
+		ln.mu.Lock()
+		conn := ln.conns[addr.String()]
+		if conn == nil {
+			if len(ln.conns) >= MaxPacketPeers {
+				ln.mu.Unlock()
+				continue
+			}
+
+			conn = newPacketConn(ln, addr)
+			select {
+			case ln.accepts <- conn:
+				ln.conns[addr.String()] = conn
+			default:
+				ln.mu.Unlock()
+				continue
+			}
+		}
+		conn.lastRecv = time.Now()
+		ln.mu.Unlock()
+
+		// Queue a copy of the datagram. Drop it if the peer is not keeping up.
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		select {
+		case conn.incoming <- msg:
+		default:
+		}
+	}
+}
+
+// expire periodically closes peers which have not sent a datagram within
+// PacketIdleTimeout, including peers which have not been accepted.
+func (ln *packetListener) expire() {
+	ticker := time.NewTicker(PacketIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ln.closing:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*packetConn
+		ln.mu.Lock()
+		for _, conn := range ln.conns {
+			if time.Since(conn.lastRecv) >= PacketIdleTimeout {
+				expired = append(expired, conn)
+			}
+		}
+		ln.mu.Unlock()
+
+		for _, conn := range expired {
+			conn.Close()
+		}
+	}
+}
+
+// remove removes conn from the set of peers.
+func (ln *packetListener) remove(conn *packetConn) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.conns[conn.addr.String()] == conn {
+		delete(ln.conns, conn.addr.String())
+	}
+}
+
+// packetConn is a connection to a single peer of a packet listener.
+// Each read returns a single datagram.
+type packetConn struct {
+	ln       *packetListener
+	addr     net.Addr
+	incoming chan []byte
+	lastRecv time.Time // time of last datagram, protected by ln.mu
+
+	// Read & write deadlines. Zero if reads & writes do not time out.
+	mu                   sync.Mutex
+	rdeadline, wdeadline time.Time
+	rnotify              chan struct{} // closed when the read deadline changes
+
+	once    sync.Once
+	closing chan struct{}
+}
+
+func newPacketConn(ln *packetListener, addr net.Addr) *packetConn {
+	return &packetConn{
+		ln:       ln,
+		addr:     addr,
+		incoming: make(chan []byte, packetQueueSize),
+		rnotify:  make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+}
+
+// Read reads the next datagram into b. Returns io.EOF if the connection is
+// closed or the peer has been idle longer than PacketIdleTimeout. Returns
+// ErrTimeout if the read deadline passes first.
+func (c *packetConn) Read(b []byte) (n int, err error) {
+	for {
+		c.mu.Lock()
+		notify, deadline := c.rnotify, c.rdeadline
+		c.mu.Unlock()
+
+		if deadlineExceeded(deadline) {
+			return 0, ErrTimeout
+		}
+
+		// Wait for a datagram, the deadline, or a change to the deadline.
+		timer := newDeadlineTimer(deadline)
+		select {
+		case <-c.closing:
+			timer.Stop()
+			return 0, io.EOF
+		case msg := <-c.incoming:
+			timer.Stop()
+			return copy(b, msg), nil
+		case <-notify:
+		case <-timer.C():
+		}
+		timer.Stop()
+	}
+}
+
+// Write sends b as a single datagram to the peer. Returns ErrTimeout if the
+// write deadline has passed. Datagrams are sent on the listener's shared
+// connection so a write in progress is not interrupted by the deadline.
+func (c *packetConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	deadline := c.wdeadline
+	c.mu.Unlock()
+
+	if deadlineExceeded(deadline) {
+		return 0, ErrTimeout
+	}
+	return c.ln.conn.WriteTo(b, c.addr)
+}
+
+// Close removes the peer from the listener. The listener remains open.
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.closing)
+		c.ln.remove(c)
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of the listener.
+func (c *packetConn) LocalAddr() net.Addr { return c.ln.Addr() }
+
+// RemoteAddr returns the address of the peer.
+func (c *packetConn) RemoteAddr() net.Addr { return c.addr }
+
+// SetDeadline sets the read & write deadlines. Implements net.Conn.
+func (c *packetConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the time after which blocked & future reads return
+// ErrTimeout. A zero value disables the deadline. Implements net.Conn.
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline = t
+
+	// Wake blocked reads so they wait on the new deadline.
+	close(c.rnotify)
+	c.rnotify = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline sets the time after which future writes return
+// ErrTimeout. A zero value disables the deadline. Implements net.Conn.
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdeadline = t
+	return nil
+}
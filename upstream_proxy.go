@@ -0,0 +1,360 @@
+package marionette
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrUpstreamProxyNetwork is returned when a connection over a network
+	// other than "tcp", "tcp4" or "tcp6" is dialed through an upstream proxy.
+	ErrUpstreamProxyNetwork = errors.New("marionette: upstream proxy only supports tcp")
+)
+
+// NewUpstreamProxyDialer returns a dialer which connects through the proxy
+// specified by rawurl. Supported schemes are "socks5" and "http", which uses
+// the CONNECT method. Credentials may be specified in the URL's user info.
+// Connections to the proxy are made using forward or net.Dialer if nil.
+func NewUpstreamProxyDialer(rawurl string, forward NetDialer) (NetDialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	} else if u.Hostname() == "" {
+		return nil, fmt.Errorf("marionette: upstream proxy host required: %s", rawurl)
+	}
+
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		return &SOCKS5Dialer{
+			Addr:     hostPortOrDefault(u, "1080"),
+			Username: username,
+			Password: password,
+			Forward:  forward,
+		}, nil
+	case "http":
+		return &HTTPConnectDialer{
+			Addr:     hostPortOrDefault(u, "80"),
+			Username: username,
+			Password: password,
+			Forward:  forward,
+		}, nil
+	default:
+		return nil, fmt.Errorf("marionette: unsupported upstream proxy scheme: %q", u.Scheme)
+	}
+}
+
+// hostPortOrDefault returns the URL's host & port. Uses port if unspecified.
+func hostPortOrDefault(u *url.URL, port string) string {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// SOCKS5Dialer dials TCP connections through a SOCKS5 proxy.
+type SOCKS5Dialer struct {
+	// Proxy host & port.
+	Addr string
+
+	// Credentials for username/password authentication, if required.
+	Username string
+	Password string
+
+	// Dialer used to connect to the proxy.
+	Forward NetDialer
+}
+
+// Dial connects to address through the proxy.
+func (d *SOCKS5Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy. The dial & handshake are
+// aborted if ctx is canceled.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !isTCPNetwork(network) {
+		return nil, ErrUpstreamProxyNetwork
+	}
+
+	conn, err := d.Forward.DialContext(ctx, network, d.Addr)
+	if err != nil {
+		return nil, err
+	} else if err := handshakeContext(ctx, conn, func() error { return d.handshake(conn, address) }); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshake authenticates with the proxy and requests a connection to address.
+func (d *SOCKS5Dialer) handshake(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("marionette: invalid port: %s", address)
+	}
+
+	// Negotiate authentication method.
+	methods := []byte{socks5AuthNone}
+	if d.Username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	} else if buf[0] != socks5Version {
+		return fmt.Errorf("marionette: unexpected socks version: %d", buf[0])
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.Username == "" {
+			return errors.New("marionette: socks5 proxy requires authentication")
+		}
+		req := []byte{0x01, byte(len(d.Username))}
+		req = append(req, d.Username...)
+		req = append(req, byte(len(d.Password)))
+		req = append(req, d.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		} else if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		} else if buf[1] != 0x00 {
+			return errors.New("marionette: socks5 proxy authentication failed")
+		}
+	default:
+		return errors.New("marionette: no acceptable socks5 authentication method")
+	}
+
+	// Request connection to destination.
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("marionette: host name too long: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Read reply header & discard the bound address.
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	} else if reply[1] != 0x00 {
+		return fmt.Errorf("marionette: socks5 connect failed: %s", socks5ReplyText(reply[1]))
+	}
+
+	var addrN int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		addrN = net.IPv4len
+	case socks5AddrIPv6:
+		addrN = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		addrN = int(buf[0])
+	default:
+		return fmt.Errorf("marionette: unexpected socks5 address type: %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrN+2)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SOCKS5 protocol constants.
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// socks5ReplyText returns a description of a SOCKS5 reply code.
+func socks5ReplyText(code byte) string {
+	switch code {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "ttl expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return "unknown error " + strconv.Itoa(int(code))
+	}
+}
+
+// HTTPConnectDialer dials TCP connections through an HTTP proxy using the
+// CONNECT method.
+type HTTPConnectDialer struct {
+	// Proxy host & port.
+	Addr string
+
+	// Credentials for basic proxy authentication, if required.
+	Username string
+	Password string
+
+	// Dialer used to connect to the proxy.
+	Forward NetDialer
+}
+
+// Dial connects to address through the proxy.
+func (d *HTTPConnectDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy. The dial & handshake are
+// aborted if ctx is canceled.
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !isTCPNetwork(network) {
+		return nil, ErrUpstreamProxyNetwork
+	}
+
+	conn, err := d.Forward.DialContext(ctx, network, d.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var other net.Conn
+	if err := handshakeContext(ctx, conn, func() (err error) {
+		other, err = d.handshake(conn, address)
+		return err
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return other, nil
+}
+
+// handshake sends a CONNECT request for address and reads the response.
+func (d *HTTPConnectDialer) handshake(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marionette: http proxy connect failed: %s", resp.Status)
+	}
+
+	// Data sent by the destination may have been read with the response.
+	if br.Buffered() > 0 {
+		return &readerConn{Conn: conn, r: io.MultiReader(br, conn)}, nil
+	}
+	return conn, nil
+}
+
+// readerConn is a net.Conn which reads from a separate reader.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// handshakeContext executes fn while allowing ctx to interrupt blocking reads
+// & writes on conn. Returns the context's error if it is canceled.
+func handshakeContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0)) // unblock immediately
+		case <-stop:
+		}
+	}()
+
+	err := fn()
+	close(stop)
+	<-done
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// isTCPNetwork returns true if network can be dialed through an upstream
+// proxy. The network is also used to connect to the proxy itself.
+func isTCPNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	default:
+		return false
+	}
+}